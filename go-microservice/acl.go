@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrUnauthenticated is returned when a request carries no known token
+	ErrUnauthenticated = errors.New("missing or unknown registry token")
+	// ErrForbidden is returned when a token does not cover the service
+	ErrForbidden = errors.New("token is not authorized for this service")
+)
+
+// ACLToken grants a registration token write access to services. Services
+// are path.Match patterns such as "orders" or "orders-*"; Namespaces
+// defaults to the default namespace. Admin tokens may write any service and
+// manage gateway-wide settings such as webhooks. TokenSHA256 may stand in
+// for Token as its hex SHA-256 digest, so the policy needn't hold the
+// tokens themselves.
+type ACLToken struct {
+	Token       string   `json:"token,omitempty"`
+	TokenSHA256 string   `json:"token_sha256,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Namespaces  []string `json:"namespaces,omitempty"`
+	Services    []string `json:"services,omitempty"`
+	Admin       bool     `json:"admin,omitempty"`
+}
+
+// ACL checks registry writes against the tokens in REGISTRY_ACL_FILE:
+//
+//	{"tokens": [{"token": "s3cret", "namespaces": ["payments"], "services": ["billing-*"]}]}
+//
+// Tokens are indexed by their SHA-256 digest so lookups don't leak timing
+// information about the configured tokens.
+//
+// With VAULT_ACL_PATH set, the policy is the data of that KV secret
+// instead, and tokens added to or removed from it apply without a restart.
+type ACL struct {
+	tokens atomic.Pointer[map[[sha256.Size]byte]*ACLToken]
+}
+
+// aclPolicy is the document ACL tokens are loaded from
+type aclPolicy struct {
+	Tokens []*ACLToken `json:"tokens"`
+}
+
+// NewACL loads the ACL policy. It returns nil when neither
+// REGISTRY_ACL_FILE nor VAULT_ACL_PATH is set, in which case the registry
+// API stays open.
+func NewACL(vault *Vault, logger *zap.Logger) (*ACL, error) {
+	file := getEnv("REGISTRY_ACL_FILE", "")
+	vaultPath := getEnv("VAULT_ACL_PATH", "")
+	if vaultPath != "" {
+		if vault == nil {
+			return nil, errors.New("VAULT_ACL_PATH needs VAULT_ADDR")
+		}
+		acl := &ACL{}
+		err := vault.watchKV(vaultPath, func(data map[string]interface{}) error {
+			var policy aclPolicy
+			if err := decodeKVData(data, &policy); err != nil {
+				return fmt.Errorf("decode ACL policy: %w", err)
+			}
+			return acl.load(&policy, logger)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return acl, nil
+	}
+	if file == "" {
+		logger.Warn("REGISTRY_ACL_FILE not set, registry API accepts unauthenticated writes")
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read ACL file: %w", err)
+	}
+
+	var policy aclPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("decode ACL file: %w", err)
+	}
+	acl := &ACL{}
+	if err := acl.load(&policy, logger); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// load checks a policy and puts its tokens in place of the current ones
+func (a *ACL) load(policy *aclPolicy, logger *zap.Logger) error {
+	tokens := make(map[[sha256.Size]byte]*ACLToken, len(policy.Tokens))
+	for i, token := range policy.Tokens {
+		var digest [sha256.Size]byte
+		switch {
+		case token.Token != "":
+			digest = sha256.Sum256([]byte(token.Token))
+		case token.TokenSHA256 != "":
+			decoded, err := hex.DecodeString(token.TokenSHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("ACL token %d: token_sha256 is not a hex SHA-256 digest", i)
+			}
+			copy(digest[:], decoded)
+		default:
+			return fmt.Errorf("ACL token %d has no token value", i)
+		}
+		for _, pattern := range token.Services {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("ACL token %d: invalid service pattern %q", i, pattern)
+			}
+		}
+		if len(token.Namespaces) == 0 {
+			token.Namespaces = []string{defaultNamespace}
+		}
+		token.Token = "" // only the digest is kept
+		tokens[digest] = token
+	}
+
+	a.tokens.Store(&tokens)
+	logger.Info("Registry ACL loaded", zap.Int("tokens", len(tokens)))
+	return nil
+}
+
+// requestToken reads the token from "Authorization: Bearer" or
+// X-Registry-Token
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("X-Registry-Token"); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+func (a *ACL) lookup(r *http.Request) (*ACLToken, error) {
+	token := requestToken(r)
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+	grant, ok := (*a.tokens.Load())[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return grant, nil
+}
+
+// Authorize checks that the request may write the named service
+func (a *ACL) Authorize(r *http.Request, namespace, serviceName string) error {
+	grant, err := a.lookup(r)
+	if err != nil {
+		return err
+	}
+	if grant.Admin {
+		return nil
+	}
+
+	namespaceAllowed := false
+	for _, allowed := range grant.Namespaces {
+		if allowed == "*" || allowed == namespace {
+			namespaceAllowed = true
+			break
+		}
+	}
+	if !namespaceAllowed {
+		return ErrForbidden
+	}
+
+	for _, pattern := range grant.Services {
+		if matched, _ := path.Match(pattern, serviceName); matched {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
+
+// AuthorizeAdmin checks that the request carries an admin token
+func (a *ACL) AuthorizeAdmin(r *http.Request) error {
+	grant, err := a.lookup(r)
+	if err != nil {
+		return err
+	}
+	if !grant.Admin {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authorizeWrite checks a write to a service. Users signed in with an
+// admin group may write anything; otherwise the ACL decides. With sign-in
+// enabled and no ACL, writes are closed to everyone else, as requireAdmin
+// closes the admin API.
+func (gw *APIGateway) authorizeWrite(r *http.Request, namespace, serviceName string) error {
+	session := gw.oidc.session(r)
+	switch {
+	case session != nil && session.Admin:
+		return nil
+	case gw.acl != nil:
+		return gw.acl.Authorize(r, namespace, serviceName)
+	case gw.oidc == nil:
+		return nil
+	case session != nil:
+		return ErrForbidden
+	default:
+		return ErrUnauthenticated
+	}
+}
+
+// authorize writes a 401 or 403 response and reports false when a write to
+// the service is refused
+func (gw *APIGateway) authorize(w http.ResponseWriter, r *http.Request, namespace, serviceName string) bool {
+	return gw.aclResult(w, r, gw.authorizeWrite(r, namespace, serviceName))
+}
+
+// checkRegistration authorizes a registration. Re-registering an existing
+// ID also requires access to the instance it replaces, so a token can't
+// take over another service's instance by reusing its ID.
+func (gw *APIGateway) checkRegistration(r *http.Request, service *ServiceInstance) error {
+	if err := gw.authorizeWrite(r, service.Namespace, service.Name); err != nil {
+		return err
+	}
+	if existing, exists := gw.registry.GetService(service.ID); exists {
+		return gw.authorizeWrite(r, existing.Namespace, existing.Name)
+	}
+	return nil
+}
+
+// authorizeInstance applies the ACL to a write addressed by instance ID.
+// Unknown IDs pass so the handler can answer 404.
+func (gw *APIGateway) authorizeInstance(w http.ResponseWriter, r *http.Request, serviceID string) bool {
+	service, exists := gw.registry.GetService(serviceID)
+	if !exists {
+		return true
+	}
+	return gw.authorize(w, r, service.Namespace, service.Name)
+}
+
+// requireAdmin wraps handlers that only admin tokens, or users signed in
+// with an admin group, may call. With sign-in enabled they are closed to
+// anonymous callers even without an ACL.
+func (gw *APIGateway) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if session := gw.oidc.session(r); session != nil && requestToken(r) == "" {
+			if !session.Admin {
+				gw.aclResult(w, r, ErrForbidden)
+				return
+			}
+		} else if gw.acl != nil {
+			if !gw.aclResult(w, r, gw.acl.AuthorizeAdmin(r)) {
+				return
+			}
+		} else if gw.oidc != nil {
+			gw.aclResult(w, r, ErrUnauthenticated)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (gw *APIGateway) aclResult(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrUnauthenticated):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+
+	gw.logger.Warn("Registry write rejected",
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.Error(err))
+	return false
+}
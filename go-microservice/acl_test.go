@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestOIDC returns an OIDC that only seals and opens sessions
+func newTestOIDC(t *testing.T) *OIDC {
+	t.Helper()
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &OIDC{aead: aead, logger: zap.NewNop()}
+}
+
+// writeRequest returns a registry write signed in as a user with the given
+// admin flag, or anonymous when o is nil
+func writeRequest(t *testing.T, o *OIDC, admin bool, token string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/services", nil)
+	if token != "" {
+		r.Header.Set("X-Registry-Token", token)
+	}
+	if o != nil {
+		sealed, err := o.seal(&oidcSession{
+			Subject: "user",
+			Admin:   admin,
+			CSRF:    "csrf",
+			Expiry:  time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: sealed})
+		r.Header.Set(csrfHeader, "csrf")
+	}
+	return r
+}
+
+func TestAuthorizeWriteWithOIDCAndNoACL(t *testing.T) {
+	o := newTestOIDC(t)
+	gw := &APIGateway{
+		oidc:     o,
+		registry: NewServiceRegistry(zap.NewNop(), NewMemoryBackend()),
+		logger:   zap.NewNop(),
+	}
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    error
+	}{
+		{"anonymous", writeRequest(t, nil, false, ""), ErrUnauthenticated},
+		{"token without ACL", writeRequest(t, nil, false, "s3cret"), ErrUnauthenticated},
+		{"signed in", writeRequest(t, o, false, ""), ErrForbidden},
+		{"signed in admin", writeRequest(t, o, true, ""), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := gw.authorizeWrite(tt.request, defaultNamespace, "orders"); !errors.Is(err, tt.want) {
+				t.Errorf("authorizeWrite() = %v, want %v", err, tt.want)
+			}
+			service := &ServiceInstance{ID: "orders-1", Name: "orders", Namespace: defaultNamespace}
+			if err := gw.checkRegistration(tt.request, service); !errors.Is(err, tt.want) {
+				t.Errorf("checkRegistration() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWrite(t *testing.T) {
+	acl := &ACL{}
+	err := acl.load(&aclPolicy{Tokens: []*ACLToken{
+		{Token: "admin", Admin: true},
+		{Token: "orders", Services: []string{"orders", "orders-*"}},
+		{Token: "payments", Namespaces: []string{"payments"}, Services: []string{"billing-*"}},
+		{Token: "everywhere", Namespaces: []string{"*"}, Services: []string{"*"}},
+	}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newTestOIDC(t)
+
+	tests := []struct {
+		name      string
+		acl       *ACL
+		oidc      *OIDC
+		request   *http.Request
+		namespace string
+		service   string
+		want      error
+	}{
+		{"open without ACL or sign-in", nil, nil, writeRequest(t, nil, false, ""), defaultNamespace, "orders", nil},
+		{"admin token", acl, nil, writeRequest(t, nil, false, "admin"), "payments", "anything", nil},
+		{"scoped token", acl, nil, writeRequest(t, nil, false, "orders"), defaultNamespace, "orders-api", nil},
+		{"scoped token, other service", acl, nil, writeRequest(t, nil, false, "orders"), defaultNamespace, "billing", ErrForbidden},
+		{"scoped token, other namespace", acl, nil, writeRequest(t, nil, false, "orders"), "payments", "orders", ErrForbidden},
+		{"namespaced token", acl, nil, writeRequest(t, nil, false, "payments"), "payments", "billing-api", nil},
+		{"namespaced token, default namespace", acl, nil, writeRequest(t, nil, false, "payments"), defaultNamespace, "billing-api", ErrForbidden},
+		{"wildcard token", acl, nil, writeRequest(t, nil, false, "everywhere"), "payments", "orders", nil},
+		{"unknown token", acl, nil, writeRequest(t, nil, false, "guess"), defaultNamespace, "orders", ErrUnauthenticated},
+		{"no token", acl, nil, writeRequest(t, nil, false, ""), defaultNamespace, "orders", ErrUnauthenticated},
+		{"admin session with ACL", acl, o, writeRequest(t, o, true, ""), "payments", "orders", nil},
+		{"session with ACL defers to token", acl, o, writeRequest(t, o, false, "orders"), defaultNamespace, "orders", nil},
+		{"session with ACL and no token", acl, o, writeRequest(t, o, false, ""), defaultNamespace, "orders", ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := &APIGateway{acl: tt.acl, oidc: tt.oidc, logger: zap.NewNop()}
+			if err := gw.authorizeWrite(tt.request, tt.namespace, tt.service); !errors.Is(err, tt.want) {
+				t.Errorf("authorizeWrite() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	acl := &ACL{}
+	err := acl.load(&aclPolicy{Tokens: []*ACLToken{
+		{Token: "admin", Admin: true},
+		{Token: "orders", Services: []string{"orders"}},
+	}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newTestOIDC(t)
+
+	tests := []struct {
+		name    string
+		acl     *ACL
+		oidc    *OIDC
+		request *http.Request
+		want    int
+	}{
+		{"open without ACL or sign-in", nil, nil, writeRequest(t, nil, false, ""), http.StatusOK},
+		{"admin token", acl, nil, writeRequest(t, nil, false, "admin"), http.StatusOK},
+		{"scoped token", acl, nil, writeRequest(t, nil, false, "orders"), http.StatusForbidden},
+		{"unknown token", acl, nil, writeRequest(t, nil, false, "guess"), http.StatusUnauthorized},
+		{"anonymous with sign-in and no ACL", nil, o, writeRequest(t, nil, false, ""), http.StatusUnauthorized},
+		{"signed in", nil, o, writeRequest(t, o, false, ""), http.StatusForbidden},
+		{"signed in admin", nil, o, writeRequest(t, o, true, ""), http.StatusOK},
+		{"signed in with admin token", acl, o, writeRequest(t, o, false, "admin"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := &APIGateway{acl: tt.acl, oidc: tt.oidc, logger: zap.NewNop()}
+			w := httptest.NewRecorder()
+			gw.requireAdmin(func(w http.ResponseWriter, r *http.Request) {})(w, tt.request)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME obtains and renews the certificates of ACME_DOMAINS from an ACME
+// CA, Let's Encrypt unless ACME_DIRECTORY_URL names another, with
+// ACME_EMAIL as the account contact. Setting ACME_DOMAINS accepts the CA's
+// terms of service. Certificates are renewed ACME_RENEW_BEFORE ahead of
+// expiry, 30 days by default.
+//
+// Domains are validated with TLS-ALPN-01 on the TLS listener, which must
+// be reachable on port 443, and with HTTP-01 as well when
+// GATEWAY_HTTP_REDIRECT_ADDR listens on port 80. Accounts and certificates
+// are kept in ACME_CACHE: "dir:PATH", the default being "dir:acme-cache",
+// or a redis:// URL so that replicas share them rather than each ordering
+// its own.
+type ACME struct {
+	manager *autocert.Manager
+	domains []string
+	logger  *zap.Logger
+}
+
+// NewACME returns nil when ACME_DOMAINS is not set
+func NewACME(logger *zap.Logger) (*ACME, error) {
+	domains := getEnvList("ACME_DOMAINS", nil)
+	if len(domains) == 0 {
+		return nil, nil
+	}
+	for i, domain := range domains {
+		domains[i] = strings.ToLower(domain)
+	}
+	cache, err := newACMECache(getEnv("ACME_CACHE", "dir:acme-cache"))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ACME{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       cache,
+			HostPolicy:  autocert.HostWhitelist(domains...),
+			RenewBefore: getEnvDuration("ACME_RENEW_BEFORE", 30*24*time.Hour),
+			Email:       getEnv("ACME_EMAIL", ""),
+		},
+		domains: domains,
+		logger:  logger,
+	}
+	if directory := getEnv("ACME_DIRECTORY_URL", ""); directory != "" {
+		a.manager.Client = &acme.Client{DirectoryURL: directory}
+	}
+
+	logger.Info("ACME certificates enabled",
+		zap.Strings("domains", domains),
+		zap.String("directory", getEnv("ACME_DIRECTORY_URL", autocert.DefaultACMEDirectory)))
+	return a, nil
+}
+
+// handles reports whether a handshake is for one of the ACME domains, or
+// is the CA validating one
+func (a *ACME) handles(hello *tls.ClientHelloInfo) bool {
+	if a == nil {
+		return false
+	}
+	return slices.Contains(hello.SupportedProtos, acme.ALPNProto) ||
+		slices.Contains(a.domains, strings.ToLower(hello.ServerName))
+}
+
+// getCertificate returns the certificate of an ACME domain, obtaining it
+// on first use, or answers a TLS-ALPN-01 challenge
+func (a *ACME) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate, err := a.manager.GetCertificate(hello)
+	if err != nil {
+		a.logger.Error("Failed to get ACME certificate",
+			zap.String("server_name", hello.ServerName),
+			zap.Error(err))
+	}
+	return certificate, err
+}
+
+// challengeConfig returns the configuration for the CA's TLS-ALPN-01
+// handshakes, which present no client certificate, and nil for others
+func (a *ACME) challengeConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if a == nil || !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return nil, nil
+	}
+	return &tls.Config{
+		GetCertificate: a.getCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// httpHandler answers HTTP-01 challenges, passing other requests to
+// fallback
+func (a *ACME) httpHandler(fallback http.Handler) http.Handler {
+	if a == nil {
+		return fallback
+	}
+	return a.manager.HTTPHandler(fallback)
+}
+
+// newACMECache returns the cache ACME_CACHE names
+func newACMECache(source string) (autocert.Cache, error) {
+	if dir, ok := strings.CutPrefix(source, "dir:"); ok {
+		return autocert.DirCache(dir), nil
+	}
+	if strings.HasPrefix(source, "redis://") || strings.HasPrefix(source, "rediss://") {
+		options, err := redis.ParseURL(source)
+		if err != nil {
+			return nil, fmt.Errorf("parse ACME_CACHE: %w", err)
+		}
+		return &redisACMECache{client: redis.NewClient(options), prefix: getEnv("ACME_CACHE_PREFIX", "gateway:acme:")}, nil
+	}
+	return nil, fmt.Errorf("unknown ACME_CACHE %q, use dir:PATH or a redis:// URL", source)
+}
+
+// redisACMECache keeps ACME accounts and certificates in Redis
+type redisACMECache struct {
+	client *redis.Client
+	prefix string
+}
+
+func (c *redisACMECache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := c.client.Get(ctx, c.prefix+name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (c *redisACMECache) Put(ctx context.Context, name string, data []byte) error {
+	return c.client.Set(ctx, c.prefix+name, data, 0).Err()
+}
+
+func (c *redisACMECache) Delete(ctx context.Context, name string) error {
+	return c.client.Del(ctx, c.prefix+name).Err()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ServiceAlias maps an alternative service name to its canonical name,
+// e.g. "payments-v1" -> "payments" while callers migrate after a rename
+type ServiceAlias struct {
+	Namespace string `json:"namespace"`
+	Alias     string `json:"alias"`
+	Target    string `json:"target"`
+}
+
+// AliasTable resolves aliased service names to canonical pools. Aliases
+// and targets live in the same namespace, and aliases don't chain.
+type AliasTable struct {
+	aliases map[string]*ServiceAlias // qualified alias -> alias
+	mutex   sync.RWMutex
+	logger  *zap.Logger
+}
+
+func NewAliasTable(logger *zap.Logger) *AliasTable {
+	return &AliasTable{
+		aliases: make(map[string]*ServiceAlias),
+		logger:  logger,
+	}
+}
+
+// Resolve returns the canonical service name for a name in a namespace
+func (at *AliasTable) Resolve(namespace, name string) string {
+	at.mutex.RLock()
+	defer at.mutex.RUnlock()
+
+	if alias, exists := at.aliases[qualifiedName(namespace, name)]; exists {
+		return alias.Target
+	}
+	return name
+}
+
+func (at *AliasTable) listHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	at.mutex.RLock()
+	aliases := make([]ServiceAlias, 0)
+	for _, alias := range at.aliases {
+		if alias.Namespace == namespace {
+			aliases = append(aliases, *alias)
+		}
+	}
+	at.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
+
+// putAliasHandler creates or replaces an alias. Writing an alias needs
+// registry access to both names, since it redirects the alias's traffic.
+func (gw *APIGateway) putAliasHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Target == "" {
+		http.Error(w, "Invalid JSON, expected {\"target\": \"service\"}", http.StatusBadRequest)
+		return
+	}
+
+	alias := &ServiceAlias{
+		Namespace: namespace,
+		Alias:     mux.Vars(r)["alias"],
+		Target:    strings.TrimSpace(request.Target),
+	}
+	if alias.Alias == alias.Target {
+		http.Error(w, "An alias can't point to itself", http.StatusBadRequest)
+		return
+	}
+	if !gw.authorize(w, r, namespace, alias.Alias) || !gw.authorize(w, r, namespace, alias.Target) {
+		return
+	}
+
+	at := gw.aliases
+	at.mutex.Lock()
+	if _, chained := at.aliases[qualifiedName(namespace, alias.Target)]; chained {
+		at.mutex.Unlock()
+		http.Error(w, "Alias targets must be canonical service names, not aliases", http.StatusBadRequest)
+		return
+	}
+	for _, existing := range at.aliases {
+		if existing.Namespace == namespace && existing.Target == alias.Alias {
+			at.mutex.Unlock()
+			http.Error(w, "Name is already the target of another alias", http.StatusConflict)
+			return
+		}
+	}
+	at.aliases[qualifiedName(namespace, alias.Alias)] = alias
+	at.mutex.Unlock()
+
+	at.logger.Info("Service alias set",
+		zap.String("namespace", namespace),
+		zap.String("alias", alias.Alias),
+		zap.String("target", alias.Target))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alias)
+}
+
+func (gw *APIGateway) deleteAliasHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["alias"]
+	if !gw.authorize(w, r, namespace, name) {
+		return
+	}
+
+	at := gw.aliases
+	at.mutex.Lock()
+	_, exists := at.aliases[qualifiedName(namespace, name)]
+	delete(at.aliases, qualifiedName(namespace, name))
+	at.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Alias not found", http.StatusNotFound)
+		return
+	}
+
+	at.logger.Info("Service alias removed",
+		zap.String("namespace", namespace),
+		zap.String("alias", name))
+	w.WriteHeader(http.StatusNoContent)
+}
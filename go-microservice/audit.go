@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// auditQueueSize buffers entries between the registry and the log file.
+// Recording blocks when it is full so no entry is ever dropped.
+const auditQueueSize = 4096
+
+// ChangeActor identifies who made a registry change through the API
+type ChangeActor struct {
+	Name    string `json:"name"`    // SSO user, ACL token description, or "anonymous"
+	Address string `json:"address"` // remote address of the request
+}
+
+type actorContextKey struct{}
+
+func actorFrom(ctx context.Context) *ChangeActor {
+	actor, _ := ctx.Value(actorContextKey{}).(*ChangeActor)
+	return actor
+}
+
+// actorContext tags the request context with the caller so registry
+// changes made for it are attributed in the change and audit logs
+func (gw *APIGateway) actorContext(r *http.Request) context.Context {
+	actor := &ChangeActor{Name: "anonymous", Address: r.RemoteAddr}
+	if session := gw.oidc.session(r); session != nil && requestToken(r) == "" {
+		actor.Name = session.Email
+		if actor.Name == "" {
+			actor.Name = session.Subject
+		}
+	} else if gw.acl != nil {
+		if grant, err := gw.acl.lookup(r); err == nil {
+			actor.Name = grant.Description
+			if actor.Name == "" {
+				actor.Name = "token"
+			}
+		}
+	}
+	return context.WithValue(r.Context(), actorContextKey{}, actor)
+}
+
+// AuditEntry is one line of the audit log. Registry changes carry the
+// instance; admin changes carry the Target they acted on, a route's
+// service, an alias, a path route or a webhook, with its state Before and
+// After the change.
+type AuditEntry struct {
+	Time      time.Time       `json:"time"`
+	Action    string          `json:"action"` // registered, updated, deregistered, status_changed, or an admin action such as canary_set
+	ServiceID string          `json:"service_id,omitempty"`
+	Service   string          `json:"service,omitempty"`
+	Namespace string          `json:"namespace,omitempty"`
+	Status    string          `json:"status,omitempty"`
+	Target    string          `json:"target,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Actor     string          `json:"actor"` // "system" for health checks, expiry, discovery
+	Source    string          `json:"source,omitempty"`
+
+	// PrevHash is the Hash of the entry before, and Hash covers this
+	// entry's other fields, chaining every entry to all those before it
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// AuditLog appends every registry change and admin change to
+// AUDIT_LOG_PATH as JSON lines. Entries form a hash chain, so editing or
+// removing one breaks the chain from there on, as GET /api/audit/verify
+// reports. With AUDIT_HMAC_SECRET the hashes are keyed, so that rewriting
+// the chain from the edit onwards also takes the secret. Truncation only
+// shows against a hash kept elsewhere, such as the last_hash that verify
+// returns.
+type AuditLog struct {
+	path     string
+	file     *os.File
+	entries  chan AuditEntry
+	secret   []byte
+	lastHash string // of the last entry written, owned by Run
+	logger   *zap.Logger
+}
+
+func NewAuditLog(logger *zap.Logger) (*AuditLog, error) {
+	path := getEnv("AUDIT_LOG_PATH", "audit.log")
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	al := &AuditLog{
+		path:    path,
+		file:    file,
+		entries: make(chan AuditEntry, auditQueueSize),
+		secret:  []byte(getEnv("AUDIT_HMAC_SECRET", "")),
+		logger:  logger,
+	}
+
+	// Carry on the chain of the entries already written
+	err = al.scan(file, func(_ int, line []byte, entry *AuditEntry) bool {
+		if entry.Hash != "" {
+			al.lastHash = entry.Hash
+		}
+		return true
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read audit log: %w", err)
+	}
+	return al, nil
+}
+
+// record queues a change; it is called by recordChange
+func (al *AuditLog) record(change RegistryChange) {
+	entry := AuditEntry{
+		Time:      change.Time,
+		Action:    change.Type,
+		ServiceID: change.Service.ID,
+		Service:   change.Service.Name,
+		Namespace: change.Service.Namespace,
+		Status:    change.Service.Status,
+		Reason:    change.Reason,
+		Actor:     "system",
+	}
+	if change.PreviousStatus != "" {
+		entry.Before, _ = json.Marshal(map[string]string{"status": change.PreviousStatus})
+		entry.After, _ = json.Marshal(map[string]string{"status": change.Service.Status})
+	}
+	if change.Actor != nil {
+		entry.Actor = change.Actor.Name
+		entry.Source = change.Actor.Address
+	}
+	entry.Time = entry.Time.UTC()
+	al.entries <- entry
+}
+
+// Run chains queued entries and writes them to disk. It is the only writer,
+// so the chain needs no lock.
+func (al *AuditLog) Run() {
+	for entry := range al.entries {
+		entry.PrevHash = al.lastHash
+		digest, err := al.hash(entry)
+		if err == nil {
+			entry.Hash = digest
+			var line []byte
+			line, err = json.Marshal(entry)
+			if err == nil {
+				_, err = al.file.Write(append(line, '\n'))
+			}
+		}
+		if err != nil {
+			al.logger.Error("Failed to write audit log entry",
+				zap.String("service_id", entry.ServiceID),
+				zap.String("target", entry.Target),
+				zap.String("action", entry.Action),
+				zap.Error(err))
+			continue
+		}
+		al.lastHash = entry.Hash
+	}
+}
+
+// hash returns the chain hash of an entry, which covers every field but
+// Hash itself
+func (al *AuditLog) hash(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	var h hash.Hash
+	if len(al.secret) > 0 {
+		h = hmac.New(sha256.New, al.secret)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scan calls fn with each entry of the log and its line number until fn
+// returns false. Lines that aren't entries are passed with a nil entry.
+func (al *AuditLog) scan(file io.Reader, fn func(number int, line []byte, entry *AuditEntry) bool) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		var entry AuditEntry
+		parsed := &entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			parsed = nil
+		}
+		if !fn(number, scanner.Bytes(), parsed) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// auditTimeBounds parses the since and until parameters as RFC 3339
+func auditTimeBounds(query url.Values) (since, until time.Time, err error) {
+	for name, bound := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return since, until, fmt.Errorf("Invalid %s, expected RFC 3339", name)
+			}
+			*bound = parsed
+		}
+	}
+	return since, until, nil
+}
+
+// queryHandler serves GET /api/audit?since=&until=&namespace=&service=&action=&limit=
+// with RFC 3339 time bounds. It returns the most recent matching entries,
+// oldest first.
+func (al *AuditLog) queryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	since, until, err := auditTimeBounds(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := 1000
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 && value < limit {
+		limit = value
+	}
+
+	file, err := os.Open(al.path)
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	entries := make([]AuditEntry, 0)
+	al.scan(file, func(_ int, _ []byte, entry *AuditEntry) bool {
+		if entry == nil {
+			return true
+		}
+		if (!since.IsZero() && entry.Time.Before(since)) || (!until.IsZero() && entry.Time.After(until)) {
+			return true
+		}
+		if (query.Get("namespace") != "" && entry.Namespace != query.Get("namespace")) ||
+			(query.Get("service") != "" && entry.Service != query.Get("service") && entry.Target != query.Get("service")) ||
+			(query.Get("action") != "" && entry.Action != query.Get("action")) {
+			return true
+		}
+
+		entries = append(entries, *entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// exportHandler serves GET /api/audit/export?since=&until= with the log's
+// lines as written, hashes included, for archiving or a SIEM
+func (al *AuditLog) exportHandler(w http.ResponseWriter, r *http.Request) {
+	since, until, err := auditTimeBounds(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.Open(al.path)
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	err = al.scan(file, func(_ int, line []byte, entry *AuditEntry) bool {
+		if entry == nil ||
+			(!since.IsZero() && entry.Time.Before(since)) || (!until.IsZero() && entry.Time.After(until)) {
+			return true
+		}
+		_, err := w.Write(append(line, '\n'))
+		return err == nil
+	})
+	if err != nil {
+		al.logger.Error("Failed to export audit log", zap.Error(err))
+	}
+}
+
+// verifyHandler serves GET /api/audit/verify, checking the hash chain and
+// reporting the first line that breaks it. Entries written before the log
+// was chained are counted as unchained and skipped.
+func (al *AuditLog) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	file, err := os.Open(al.path)
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	result := struct {
+		Valid      bool   `json:"valid"`
+		Entries    int    `json:"entries"`
+		Unchained  int    `json:"unchained,omitempty"`
+		LastHash   string `json:"last_hash,omitempty"`
+		BrokenLine int    `json:"broken_line,omitempty"`
+		Error      string `json:"error,omitempty"`
+	}{Valid: true}
+
+	fail := func(number int, reason string) bool {
+		result.Valid = false
+		result.BrokenLine = number
+		result.Error = reason
+		return false
+	}
+	err = al.scan(file, func(number int, line []byte, entry *AuditEntry) bool {
+		switch {
+		case entry == nil:
+			return fail(number, "line is not an audit entry")
+		case entry.Hash == "" && result.LastHash == "":
+			result.Unchained++
+			return true
+		case entry.PrevHash != result.LastHash:
+			return fail(number, "entry doesn't follow the one before it")
+		}
+		digest, err := al.hash(*entry)
+		if err != nil {
+			return fail(number, err.Error())
+		}
+		if !hmac.Equal([]byte(digest), []byte(entry.Hash)) {
+			return fail(number, "entry doesn't match its hash")
+		}
+		result.Entries++
+		result.LastHash = entry.Hash
+		return true
+	})
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	if !result.Valid {
+		al.logger.Error("Audit log chain is broken",
+			zap.Int("line", result.BrokenLine),
+			zap.String("error", result.Error))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// auditRecorder passes a response through while noting its status, and
+// its body when the change has no state to snapshot
+type auditRecorder struct {
+	http.ResponseWriter
+	status   int
+	keepBody bool
+	body     bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.keepBody {
+		rec.body.Write(p)
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// auditAdmin records the admin changes next makes in the audit log, with
+// what state returns for the request before and after as the change. With
+// no state, as for creations whose target is only known once made, the
+// response body stands as the after value. Refused and failed requests
+// change nothing and aren't recorded.
+func (gw *APIGateway) auditAdmin(action string, state func(r *http.Request) interface{}, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		al := gw.registry.audit
+		if al == nil {
+			next(w, r)
+			return
+		}
+
+		var before json.RawMessage
+		if state != nil {
+			before = auditState(state(r))
+		}
+		rec := &auditRecorder{ResponseWriter: w, keepBody: state == nil}
+		next(rec, r)
+		if rec.status < 200 || rec.status > 299 {
+			return
+		}
+
+		vars := mux.Vars(r)
+		entry := AuditEntry{
+			Time:   time.Now().UTC(),
+			Action: action,
+			Before: before,
+			Actor:  "anonymous",
+		}
+		for _, name := range []string{"service", "alias", "name", "id"} {
+			if target := vars[name]; target != "" {
+				entry.Target = target
+				break
+			}
+		}
+		if vars["service"] != "" || vars["alias"] != "" {
+			entry.Namespace, _ = requestNamespace(r)
+			entry.Service = vars["service"]
+		}
+		if state != nil {
+			entry.After = auditState(state(r))
+		} else if json.Valid(rec.body.Bytes()) {
+			entry.After = json.RawMessage(bytes.TrimSpace(rec.body.Bytes()))
+		}
+		if actor := actorFrom(gw.actorContext(r)); actor != nil {
+			entry.Actor = actor.Name
+			entry.Source = actor.Address
+		}
+		al.entries <- entry
+	}
+}
+
+// auditState marshals a snapshot, leaving out absent state
+func auditState(state interface{}) json.RawMessage {
+	data, err := json.Marshal(state)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// routeState returns the snapshot function of one of the route settings
+// of the service a request names
+func (gw *APIGateway) routeState(setting func(rt *RouteTable, poolName string) interface{}) func(r *http.Request) interface{} {
+	return func(r *http.Request) interface{} {
+		namespace, err := requestNamespace(r)
+		if err != nil {
+			return nil
+		}
+		return setting(gw.routes, qualifiedName(namespace, mux.Vars(r)["service"]))
+	}
+}
+
+// auditHeaderRules snapshots header rules with the values they set left
+// out, since injected headers are often credentials
+func auditHeaderRules(rt *RouteTable, poolName string) interface{} {
+	rules := rt.headerRules(poolName)
+	if rules == nil {
+		return nil
+	}
+	redacted := HeaderRules{}
+	for _, actions := range []struct{ from, to **HeaderActions }{
+		{&rules.Request, &redacted.Request},
+		{&rules.Response, &redacted.Response},
+	} {
+		if *actions.from == nil {
+			continue
+		}
+		copied := **actions.from
+		copied.Set = redactHeaderValues(copied.Set)
+		copied.Add = redactHeaderValues(copied.Add)
+		*actions.to = &copied
+	}
+	return redacted
+}
+
+func auditCanary(rt *RouteTable, poolName string) interface{}   { return rt.canary(poolName) }
+func auditSplit(rt *RouteTable, poolName string) interface{}    { return rt.split(poolName) }
+func auditIPAccess(rt *RouteTable, poolName string) interface{} { return rt.ipAccess(poolName) }
+
+func redactHeaderValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(values))
+	for name := range values {
+		redacted[name] = "[redacted]"
+	}
+	return redacted
+}
+
+func (gw *APIGateway) aliasState(r *http.Request) interface{} {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		return nil
+	}
+	gw.aliases.mutex.RLock()
+	defer gw.aliases.mutex.RUnlock()
+
+	if alias, exists := gw.aliases.aliases[qualifiedName(namespace, mux.Vars(r)["alias"])]; exists {
+		copied := *alias
+		return copied
+	}
+	return nil
+}
+
+func (gw *APIGateway) pathRouteState(r *http.Request) interface{} {
+	for _, route := range gw.pathRoutes.list() {
+		if route.Name == mux.Vars(r)["name"] {
+			return route
+		}
+	}
+	return nil
+}
+
+func (gw *APIGateway) webhookState(r *http.Request) interface{} {
+	wm := gw.webhooks
+	wm.mutex.RLock()
+	defer wm.mutex.RUnlock()
+
+	if hook, exists := wm.hooks[mux.Vars(r)["id"]]; exists {
+		redacted := *hook
+		redacted.Secret = ""
+		return redacted
+	}
+	return nil
+}
+
+func (gw *APIGateway) adminIPAccessState(r *http.Request) interface{} {
+	if list := gw.ipAccess.admin.Load(); list != nil {
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var servicesBucket = []byte("services")
+
+// BoltBackend persists registrations to an embedded bbolt database so a
+// single gateway can restart without losing its catalog. Like the memory
+// backend it has no external writers, so Watch never reports anything.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open registry database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(servicesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltBackend{db: db}, nil
+}
+
+func (bb *BoltBackend) Register(ctx context.Context, service *ServiceInstance) error {
+	value, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).Put([]byte(service.ID), value)
+	})
+}
+
+func (bb *BoltBackend) Deregister(ctx context.Context, serviceID string) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).Delete([]byte(serviceID))
+	})
+}
+
+func (bb *BoltBackend) List(ctx context.Context) ([]*ServiceInstance, error) {
+	services := make([]*ServiceInstance, 0)
+
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(servicesBucket).ForEach(func(key, value []byte) error {
+			var service ServiceInstance
+			if err := json.Unmarshal(value, &service); err != nil {
+				return fmt.Errorf("decode service %s: %w", key, err)
+			}
+			services = append(services, &service)
+			return nil
+		})
+	})
+
+	return services, err
+}
+
+func (bb *BoltBackend) Snapshot(ctx context.Context) (*RegistrySnapshot, error) {
+	services, err := bb.List(ctx)
+	return &RegistrySnapshot{Services: services}, err
+}
+
+func (bb *BoltBackend) Watch(ctx context.Context, from *RegistrySnapshot) (<-chan RegistryEvent, error) {
+	events := make(chan RegistryEvent)
+	go func() {
+		<-ctx.Done()
+		close(events)
+	}()
+	return events, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Canary variants, also the values of the variant metric label
+const (
+	variantCanary = "canary"
+	variantStable = "stable"
+)
+
+// CanaryConfig sends Percent of a service's proxied traffic to its canary
+// instances: those of Version when it is set, otherwise those tagged Tag
+// ("canary" by default). The rest goes to the stable instances. Requests
+// asking for a version themselves are routed as asked.
+type CanaryConfig struct {
+	Percent int    `json:"percent"`
+	Version string `json:"version,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+}
+
+func (cc *CanaryConfig) validate() error {
+	if cc.Percent < 0 || cc.Percent > 100 {
+		return errors.New("canary percent must be between 0 and 100")
+	}
+	if cc.Version != "" && cc.Tag != "" {
+		return errors.New("canary takes a version or a tag, not both")
+	}
+	return nil
+}
+
+// isCanary reports whether an instance is one of the canaries
+func (cc *CanaryConfig) isCanary(instance *ServiceInstance) bool {
+	if cc.Version != "" {
+		return instance.Version == cc.Version
+	}
+	tag := cc.Tag
+	if tag == "" {
+		tag = variantCanary
+	}
+	return hasTags(instance, []string{tag})
+}
+
+// variantOf names the variant an instance belongs to
+func (cc *CanaryConfig) variantOf(instance *ServiceInstance) string {
+	if cc.isCanary(instance) {
+		return variantCanary
+	}
+	return variantStable
+}
+
+// pickVariant draws the variant of a request
+func (cc *CanaryConfig) pickVariant() string {
+	if rand.Intn(100) < cc.Percent {
+		return variantCanary
+	}
+	return variantStable
+}
+
+// subset narrows picks to the instances of a variant. A variant without
+// instances gets the whole pool rather than failing, e.g. after the
+// canaries are removed.
+func (cc *CanaryConfig) subset(variant string) *instanceSubset {
+	return &instanceSubset{
+		scope: "#" + variant,
+		match: func(instance *ServiceInstance) bool { return cc.variantOf(instance) == variant },
+	}
+}
+
+// canary returns the canary of a pool, nil when it has none
+func (rt *RouteTable) canary(poolName string) *CanaryConfig {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Canary
+	}
+	return nil
+}
+
+// setCanary replaces the canary of a pool; nil removes it
+func (rt *RouteTable) setCanary(poolName string, canary *CanaryConfig) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	route := &RouteConfig{}
+	if existing := rt.routes[poolName]; existing != nil {
+		copied := *existing
+		route = &copied
+	}
+	route.Canary = canary
+	rt.routes[poolName] = route
+}
+
+func (gw *APIGateway) getCanaryHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	canary := gw.routes.canary(qualifiedName(namespace, mux.Vars(r)["service"]))
+	if canary == nil {
+		http.Error(w, "Service has no canary", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(canary)
+}
+
+// putCanaryHandler starts a canary or changes its share of traffic
+func (gw *APIGateway) putCanaryHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	var canary CanaryConfig
+	if err := json.NewDecoder(r.Body).Decode(&canary); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := canary.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gw.routes.setCanary(qualifiedName(namespace, service), &canary)
+	gw.logger.Info("Canary updated",
+		zap.String("namespace", namespace),
+		zap.String("service", service),
+		zap.Int("percent", canary.Percent),
+		zap.String("version", canary.Version),
+		zap.String("tag", canary.Tag))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(canary)
+}
+
+func (gw *APIGateway) deleteCanaryHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	gw.routes.setCanary(qualifiedName(namespace, service), nil)
+	gw.logger.Info("Canary removed",
+		zap.String("namespace", namespace),
+		zap.String("service", service))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Circuit breaker states, also the values of the circuit_breaker_state
+// gauge
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = map[int]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+// breakerResult is the outcome of a request let through a breaker
+type breakerResult int
+
+const (
+	breakerSuccess breakerResult = iota
+	breakerFailure
+	// breakerIgnored is for requests that say nothing about the service,
+	// e.g. ones the client cancelled
+	breakerIgnored
+)
+
+// CircuitBreakers guard each service pool. A closed breaker trips open
+// when at least CIRCUIT_BREAKER_FAILURE_RATE percent of the requests in a
+// CIRCUIT_BREAKER_WINDOW fail, once there were CIRCUIT_BREAKER_MIN_REQUESTS.
+// An open breaker rejects requests with a 503 right away instead of letting
+// them pile up on a failing backend. After CIRCUIT_BREAKER_OPEN_TIMEOUT it
+// turns half-open and lets CIRCUIT_BREAKER_HALF_OPEN_REQUESTS through:
+// all of them succeeding closes it, any failure opens it again.
+type CircuitBreakers struct {
+	failureRate      float64
+	minRequests      int
+	window           time.Duration
+	openTimeout      time.Duration
+	halfOpenRequests int
+
+	breakers map[string]*circuitBreaker // by pool name
+	mutex    sync.Mutex
+	logger   *zap.Logger
+
+	state    *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+}
+
+type circuitBreaker struct {
+	namespace string
+	service   string
+	state     int
+	changed   time.Time
+
+	// closed: the current window's counts
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	// half-open: trial requests let through and how many succeeded
+	trials    int
+	successes int
+}
+
+// CircuitBreakerStatus is a breaker's entry in the API
+type CircuitBreakerStatus struct {
+	Service     string    `json:"service"`
+	State       string    `json:"state"`
+	Since       time.Time `json:"since"`
+	Requests    int       `json:"requests"`
+	Failures    int       `json:"failures"`
+	FailureRate float64   `json:"failure_rate"`
+}
+
+// NewCircuitBreakers returns nil when CIRCUIT_BREAKER_FAILURE_RATE is 0
+func NewCircuitBreakers(logger *zap.Logger) *CircuitBreakers {
+	failureRate := getEnvInt("CIRCUIT_BREAKER_FAILURE_RATE", 50)
+	if failureRate <= 0 {
+		return nil
+	}
+
+	cb := &CircuitBreakers{
+		failureRate:      float64(failureRate) / 100,
+		minRequests:      max(getEnvInt("CIRCUIT_BREAKER_MIN_REQUESTS", 20), 1),
+		window:           getEnvDuration("CIRCUIT_BREAKER_WINDOW", 10*time.Second),
+		openTimeout:      getEnvDuration("CIRCUIT_BREAKER_OPEN_TIMEOUT", 30*time.Second),
+		halfOpenRequests: max(getEnvInt("CIRCUIT_BREAKER_HALF_OPEN_REQUESTS", 5), 1),
+		breakers:         make(map[string]*circuitBreaker),
+		logger:           logger,
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "Circuit breaker state by service: 0 closed, 1 open, 2 half-open",
+		}, []string{"service"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "circuit_breaker_rejected_total",
+			Help: "Requests rejected by an open circuit breaker",
+		}, []string{"service"}),
+	}
+	prometheus.MustRegister(cb.state, cb.rejected)
+	return cb
+}
+
+// Allow reports whether a request to a pool may go through. When it may,
+// done must be called with the request's result; later calls are ignored.
+// When it may not, retryAfter is how long until the breaker tries again.
+func (cb *CircuitBreakers) Allow(namespace, poolName string) (done func(breakerResult), retryAfter time.Duration, ok bool) {
+	if cb == nil {
+		return func(breakerResult) {}, 0, true
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := time.Now()
+	breaker := cb.breakers[poolName]
+	if breaker == nil {
+		breaker = &circuitBreaker{namespace: namespace, service: poolName, changed: now, windowStart: now}
+		cb.breakers[poolName] = breaker
+		cb.state.WithLabelValues(poolName).Set(breakerClosed)
+	}
+
+	if breaker.state == breakerOpen {
+		if wait := breaker.changed.Add(cb.openTimeout).Sub(now); wait > 0 {
+			cb.rejected.WithLabelValues(poolName).Inc()
+			return nil, wait, false
+		}
+		cb.transition(breaker, breakerHalfOpen, now)
+	}
+	if breaker.state == breakerHalfOpen {
+		if breaker.trials >= cb.halfOpenRequests {
+			cb.rejected.WithLabelValues(poolName).Inc()
+			return nil, time.Second, false
+		}
+		breaker.trials++
+	}
+
+	state := breaker.state
+	var once sync.Once
+	return func(result breakerResult) {
+		once.Do(func() { cb.record(breaker, state, result) })
+	}, 0, true
+}
+
+// record applies the result of a request let through in state
+func (cb *CircuitBreakers) record(breaker *circuitBreaker, state int, result breakerResult) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	// Results of requests let through before the last transition belong
+	// to a previous state
+	if breaker.state != state {
+		return
+	}
+
+	now := time.Now()
+	switch breaker.state {
+	case breakerClosed:
+		if result == breakerIgnored {
+			return
+		}
+		if now.Sub(breaker.windowStart) >= cb.window {
+			breaker.windowStart, breaker.requests, breaker.failures = now, 0, 0
+		}
+		breaker.requests++
+		if result == breakerFailure {
+			breaker.failures++
+		}
+		if breaker.requests >= cb.minRequests && float64(breaker.failures) >= cb.failureRate*float64(breaker.requests) {
+			cb.transition(breaker, breakerOpen, now)
+		}
+	case breakerHalfOpen:
+		switch result {
+		case breakerIgnored:
+			breaker.trials--
+		case breakerFailure:
+			cb.transition(breaker, breakerOpen, now)
+		case breakerSuccess:
+			if breaker.successes++; breaker.successes >= cb.halfOpenRequests {
+				cb.transition(breaker, breakerClosed, now)
+			}
+		}
+	}
+}
+
+// transition moves a breaker to a new state. The caller must hold
+// cb.mutex.
+func (cb *CircuitBreakers) transition(breaker *circuitBreaker, state int, now time.Time) {
+	cb.logger.Warn("Circuit breaker state changed",
+		zap.String("service", breaker.service),
+		zap.String("from", breakerStateNames[breaker.state]),
+		zap.String("to", breakerStateNames[state]),
+		zap.Int("requests", breaker.requests),
+		zap.Int("failures", breaker.failures))
+
+	breaker.state = state
+	breaker.changed = now
+	breaker.windowStart, breaker.requests, breaker.failures = now, 0, 0
+	breaker.trials, breaker.successes = 0, 0
+	cb.state.WithLabelValues(breaker.service).Set(float64(state))
+}
+
+// Status returns the breakers of a namespace's services
+func (cb *CircuitBreakers) Status(namespace string) []CircuitBreakerStatus {
+	statuses := make([]CircuitBreakerStatus, 0)
+	if cb == nil {
+		return statuses
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	for _, breaker := range cb.breakers {
+		if breaker.namespace != namespace {
+			continue
+		}
+		status := CircuitBreakerStatus{
+			Service:  breaker.service,
+			State:    breakerStateNames[breaker.state],
+			Since:    breaker.changed,
+			Requests: breaker.requests,
+			Failures: breaker.failures,
+		}
+		if breaker.requests > 0 {
+			status.FailureRate = float64(breaker.failures) / float64(breaker.requests)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Service < statuses[j].Service })
+	return statuses
+}
+
+func (gw *APIGateway) circuitBreakersHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  gw.breakers != nil,
+		"breakers": gw.breakers.Status(namespace),
+	})
+}
+
+// rejectOpenCircuit answers a request refused by an open breaker
+func rejectOpenCircuit(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, "Service unavailable: circuit breaker open", http.StatusServiceUnavailable)
+}
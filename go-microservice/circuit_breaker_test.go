@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// newTestCircuitBreakers returns breakers that open at half the requests
+// failing once there were 4, and close after 2 trials, with metrics that
+// aren't registered
+func newTestCircuitBreakers() *CircuitBreakers {
+	return &CircuitBreakers{
+		failureRate:      0.5,
+		minRequests:      4,
+		window:           time.Minute,
+		openTimeout:      time.Minute,
+		halfOpenRequests: 2,
+		breakers:         make(map[string]*circuitBreaker),
+		logger:           zap.NewNop(),
+		state:            prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_state"}, []string{"service"}),
+		rejected:         prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_rejected"}, []string{"service"}),
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	// Each step lets a request through and reports its result: s success,
+	// f failure, i ignored. h holds a request without a result and F fails
+	// the oldest held one. w waits out the open timeout.
+	tests := []struct {
+		name     string
+		steps    string
+		want     int
+		rejected int
+	}{
+		{"stays closed below min requests", "fff", breakerClosed, 0},
+		{"stays closed under failure rate", "sssf", breakerClosed, 0},
+		{"opens at failure rate", "ssff", breakerOpen, 0},
+		{"ignored results don't count", "iiiisff", breakerClosed, 0},
+		{"open rejects", "ssffss", breakerOpen, 2},
+		{"half-open after timeout", "ssffws", breakerHalfOpen, 0},
+		{"half-open successes close", "ssffwss", breakerClosed, 0},
+		{"half-open failure reopens", "ssffwsf", breakerOpen, 0},
+		{"half-open limits trials", "ssffwhhs", breakerHalfOpen, 1},
+		{"ignored trials free their slot", "ssffwiss", breakerClosed, 0},
+		{"results from a previous state are dropped", "hssffwsF", breakerHalfOpen, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newTestCircuitBreakers()
+			var held []func(breakerResult)
+			rejected := 0
+			for _, step := range tt.steps {
+				switch step {
+				case 'w':
+					cb.breakers["orders"].changed = time.Now().Add(-cb.openTimeout)
+					continue
+				case 'F':
+					held[0](breakerFailure)
+					held = held[1:]
+					continue
+				}
+
+				done, _, ok := cb.Allow(defaultNamespace, "orders")
+				if !ok {
+					rejected++
+					continue
+				}
+				switch step {
+				case 's':
+					done(breakerSuccess)
+				case 'f':
+					done(breakerFailure)
+				case 'i':
+					done(breakerIgnored)
+				case 'h':
+					held = append(held, done)
+				}
+			}
+
+			if got := cb.breakers["orders"].state; got != tt.want {
+				t.Errorf("state = %s, want %s", breakerStateNames[got], breakerStateNames[tt.want])
+			}
+			if rejected != tt.rejected {
+				t.Errorf("rejected %d requests, want %d", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerRetryAfter(t *testing.T) {
+	cb := newTestCircuitBreakers()
+	for range cb.minRequests {
+		done, _, _ := cb.Allow(defaultNamespace, "orders")
+		done(breakerFailure)
+	}
+
+	_, retryAfter, ok := cb.Allow(defaultNamespace, "orders")
+	if ok {
+		t.Fatal("open breaker let a request through")
+	}
+	if retryAfter <= 0 || retryAfter > cb.openTimeout {
+		t.Errorf("retryAfter = %v, want up to %v", retryAfter, cb.openTimeout)
+	}
+}
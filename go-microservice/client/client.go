@@ -0,0 +1,245 @@
+// Package client lets services register themselves with the gateway
+// registry, keep their registration alive with heartbeats and deregister on
+// shutdown.
+//
+//	c, err := client.New(client.Config{GatewayURL: "http://gateway:8080"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	instance := &client.ServiceInstance{Name: "orders", Address: "10.0.0.7", Port: 8080, TTL: 30}
+//	go c.Run(ctx, instance) // registers, heartbeats, deregisters when ctx ends
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ServiceInstance is the registration payload accepted by the gateway
+type ServiceInstance struct {
+	ID        string                 `json:"id,omitempty"`
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace,omitempty"`
+	Address   string                 `json:"address"`
+	Port      int                    `json:"port"`
+	Status    string                 `json:"status,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Tags      []string               `json:"tags,omitempty"`
+	Version   string                 `json:"version,omitempty"`
+	Zone      string                 `json:"zone,omitempty"`
+	Region    string                 `json:"region,omitempty"`
+	Weight    int                    `json:"weight,omitempty"`
+	Priority  string                 `json:"priority,omitempty"`
+	DependsOn []string               `json:"depends_on,omitempty"`
+
+	// TTL in seconds; the gateway expires the instance when heartbeats stop
+	TTL int `json:"ttl,omitempty"`
+}
+
+// Config configures a Client. Only GatewayURL is required.
+type Config struct {
+	// GatewayURL is the base URL of the gateway, e.g. "http://gateway:8080"
+	GatewayURL string
+	// Token is sent as a bearer token when the registry requires one
+	Token string
+	// Namespace is sent as X-Namespace when set
+	Namespace string
+	// HeartbeatInterval defaults to a third of the instance TTL, or 10s
+	HeartbeatInterval time.Duration
+	// MaxRetries bounds the attempts for each call; defaults to 5
+	MaxRetries int
+	// HTTPClient defaults to a client with a 10s timeout
+	HTTPClient *http.Client
+	// OnError is called with heartbeat failures in Run
+	OnError func(error)
+}
+
+// APIError is returned when the gateway answers with a non-2xx status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gateway returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the gateway
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Client talks to the gateway registry API
+type Client struct {
+	baseURL  string
+	config   Config
+	http     *http.Client
+	retries  int
+	maxDelay time.Duration
+}
+
+func New(config Config) (*Client, error) {
+	if _, err := url.ParseRequestURI(config.GatewayURL); err != nil {
+		return nil, fmt.Errorf("invalid gateway URL: %w", err)
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	retries := config.MaxRetries
+	if retries <= 0 {
+		retries = 5
+	}
+
+	return &Client{
+		baseURL:  strings.TrimSuffix(config.GatewayURL, "/"),
+		config:   config,
+		http:     httpClient,
+		retries:  retries,
+		maxDelay: 30 * time.Second,
+	}, nil
+}
+
+// Register registers the instance and stores the ID assigned by the
+// gateway in instance.ID
+func (c *Client) Register(ctx context.Context, instance *ServiceInstance) error {
+	var response struct {
+		ServiceID string `json:"service_id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/services", instance, &response); err != nil {
+		return err
+	}
+	instance.ID = response.ServiceID
+	return nil
+}
+
+// Heartbeat refreshes the TTL of a registered instance
+func (c *Client) Heartbeat(ctx context.Context, serviceID string) error {
+	return c.do(ctx, http.MethodPut, "/api/services/"+url.PathEscape(serviceID)+"/heartbeat", nil, nil)
+}
+
+// Deregister removes an instance from the registry
+func (c *Client) Deregister(ctx context.Context, serviceID string) error {
+	return c.do(ctx, http.MethodDelete, "/api/services/"+url.PathEscape(serviceID), nil, nil)
+}
+
+// Run registers the instance, heartbeats until ctx is cancelled and then
+// deregisters it. If the gateway forgets the instance (e.g. it restarted
+// with an in-memory registry) it is registered again.
+func (c *Client) Run(ctx context.Context, instance *ServiceInstance) error {
+	if err := c.Register(ctx, instance); err != nil {
+		return err
+	}
+
+	interval := c.config.HeartbeatInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+		if instance.TTL > 0 {
+			interval = time.Duration(instance.TTL) * time.Second / 3
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := c.Heartbeat(ctx, instance.ID)
+			if IsNotFound(err) {
+				err = c.Register(ctx, instance)
+			}
+			// Keep going on errors; the next tick retries
+			if err != nil && ctx.Err() == nil && c.config.OnError != nil {
+				c.config.OnError(err)
+			}
+		case <-ctx.Done():
+			shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return c.Deregister(shutdown, instance.ID)
+		}
+	}
+}
+
+// do sends a request, retrying network errors and 5xx responses with
+// exponential backoff
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	delay := 500 * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt < c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if delay *= 2; delay > c.maxDelay {
+				delay = c.maxDelay
+			}
+		}
+
+		lastErr = c.send(ctx, method, path, payload, out)
+		var apiErr *APIError
+		if lastErr == nil || (errors.As(lastErr, &apiErr) && apiErr.StatusCode < 500) {
+			return lastErr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return lastErr
+}
+
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+	if c.config.Namespace != "" {
+		req.Header.Set("X-Namespace", c.config.Namespace)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
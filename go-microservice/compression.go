@@ -0,0 +1,260 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Compression encodes responses, proxied and the gateway's own, with the
+// best of COMPRESSION_ENCODINGS (in order of preference, "br" and "gzip")
+// the client accepts. Only bodies of at least COMPRESSION_MIN_SIZE bytes
+// with one of the COMPRESSION_TYPES are compressed, and never ones an
+// upstream already encoded.
+type Compression struct {
+	encodings []string
+	minSize   int
+	types     []string // media types, "text/*" matching any text type
+
+	encoders map[string]*sync.Pool
+}
+
+// encoder is what gzip and brotli writers have in common
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var defaultCompressionTypes = []string{
+	"text/html", "text/plain", "text/css", "text/xml", "text/javascript",
+	"application/javascript", "application/json", "application/xml", "image/svg+xml",
+}
+
+// NewCompression returns nil when COMPRESSION_ENCODINGS is "none"
+func NewCompression() (*Compression, error) {
+	encodings := getEnvList("COMPRESSION_ENCODINGS", []string{"br", "gzip"})
+	if len(encodings) == 1 && encodings[0] == "none" {
+		return nil, nil
+	}
+
+	c := &Compression{
+		encodings: encodings,
+		minSize:   getEnvInt("COMPRESSION_MIN_SIZE", 1024),
+		types:     getEnvList("COMPRESSION_TYPES", defaultCompressionTypes),
+		encoders:  make(map[string]*sync.Pool),
+	}
+	for _, encoding := range encodings {
+		switch encoding {
+		case "br":
+			c.encoders[encoding] = &sync.Pool{New: func() interface{} { return brotli.NewWriter(nil) }}
+		case "gzip":
+			c.encoders[encoding] = &sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+		default:
+			return nil, fmt.Errorf("unsupported compression encoding %q", encoding)
+		}
+	}
+	return c, nil
+}
+
+// negotiate returns the encoding to use for a request's Accept-Encoding,
+// empty when it accepts none
+func (c *Compression) negotiate(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(entry, ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		qualities[strings.ToLower(strings.TrimSpace(coding))] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range c.encodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressible reports whether a response may be compressed going by its
+// status and headers; an unset Content-Type is decided once it is sniffed
+func (c *Compression) compressible(status int, header http.Header) bool {
+	switch {
+	case status < http.StatusOK, status == http.StatusNoContent, status == http.StatusNotModified,
+		status == http.StatusPartialContent:
+		return false
+	case header.Get("Content-Encoding") != "", header.Get("Content-Range") != "",
+		strings.Contains(header.Get("Cache-Control"), "no-transform"):
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, allowed := range c.types {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); (ok && strings.HasPrefix(mediaType, prefix)) || mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (gw *APIGateway) compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// gRPC has its own compression and upgraded connections aren't
+		// HTTP responses
+		if gw.compression == nil || r.Method == http.MethodHead || isGRPC(r) || isUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		encoding := gw.compression.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Not deferred: a handler aborting the response by panicking must
+		// not have it finished
+		cw := &compressWriter{ResponseWriter: w, compression: gw.compression, encoding: encoding}
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// compressWriter holds a response back until it has seen enough of it to
+// tell whether to compress it: its headers rule it out, or its body reaches
+// the minimum size
+type compressWriter struct {
+	http.ResponseWriter
+	compression *Compression
+	encoding    string
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	encoder     encoder // set once compressing
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	// Informational responses go out as they are, ahead of the final one
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.status, w.wroteHeader = status, true
+
+	if !w.compression.compressible(status, w.Header()) {
+		w.decide(false)
+	} else if length, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+		w.decide(length >= w.compression.minSize)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	if w.decided {
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.compression.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what has been written so far. There is no telling how large
+// a streamed response gets, so it is compressed whatever its size if its
+// type allows.
+func (w *compressWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide(len(w.buf) > 0 || w.Header().Get("Content-Type") != "")
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// decide writes the response's headers, compressing its body if asked to
+// and of a compressible type, and what has been held back of it
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	header := w.Header()
+	if compress && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if compress && w.compression.compressible(w.status, header) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		header.Add("Vary", "Accept-Encoding")
+		// The compressed body is a different representation
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.encoder = w.compression.encoders[w.encoding].Get().(encoder)
+		w.encoder.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// close finishes the response once the handler returns
+func (w *compressWriter) close() {
+	if w.wroteHeader && !w.decided {
+		w.decide(false)
+	}
+	if w.encoder != nil {
+		w.encoder.Close()
+		w.compression.encoders[w.encoding].Put(w.encoder)
+		w.encoder = nil
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConcurrencyLimit bounds the requests proxied to a service at once, so a
+// slow backend can't pile up unlimited requests in the gateway. Requests
+// over MaxInFlight wait in a queue of up to MaxQueue, first come first
+// served, for at most QueueTimeout; the ones that don't fit or wait too
+// long are shed with Status, 503 by default or 429, and a Retry-After of
+// RetryAfter. Zero fields take the PROXY_* defaults. Upgraded connections
+// such as WebSockets aren't counted, as they would hold their slot for as
+// long as they stay open; event streams are, until they end.
+type ConcurrencyLimit struct {
+	MaxInFlight  int      `json:"max_in_flight,omitempty"`
+	MaxQueue     int      `json:"max_queue,omitempty"`
+	QueueTimeout Duration `json:"queue_timeout,omitempty"`
+	Status       int      `json:"status,omitempty"`
+	RetryAfter   Duration `json:"retry_after,omitempty"`
+}
+
+func (cl *ConcurrencyLimit) validate() error {
+	if cl.MaxInFlight < 0 || cl.MaxQueue < 0 || cl.QueueTimeout < 0 || cl.RetryAfter < 0 {
+		return errors.New("concurrency limits must not be negative")
+	}
+	if cl.Status != 0 && cl.Status != http.StatusTooManyRequests && cl.Status != http.StatusServiceUnavailable {
+		return errors.New("concurrency limit status must be 429 or 503")
+	}
+	return nil
+}
+
+// overlay returns the limit with the fields set in override replacing its
+// own
+func (cl ConcurrencyLimit) overlay(override *ConcurrencyLimit) ConcurrencyLimit {
+	if override == nil {
+		return cl
+	}
+	if override.MaxInFlight > 0 {
+		cl.MaxInFlight = override.MaxInFlight
+	}
+	if override.MaxQueue > 0 {
+		cl.MaxQueue = override.MaxQueue
+	}
+	if override.QueueTimeout > 0 {
+		cl.QueueTimeout = override.QueueTimeout
+	}
+	if override.Status != 0 {
+		cl.Status = override.Status
+	}
+	if override.RetryAfter > 0 {
+		cl.RetryAfter = override.RetryAfter
+	}
+	return cl
+}
+
+// ConcurrencyLimits admits proxied requests under their service's limit.
+// PROXY_MAX_IN_FLIGHT, PROXY_MAX_QUEUE, PROXY_QUEUE_TIMEOUT and
+// PROXY_SHED_RETRY_AFTER apply to services whose route doesn't set its
+// own; with PROXY_MAX_IN_FLIGHT at 0, the default, only those routes are
+// limited.
+type ConcurrencyLimits struct {
+	defaults ConcurrencyLimit
+	pools    map[string]*poolLimiter
+	mutex    sync.Mutex
+
+	inFlight *prometheus.GaugeVec
+	queued   *prometheus.GaugeVec
+	shed     *prometheus.CounterVec
+}
+
+// poolLimiter holds a pool's slots and the requests waiting for one
+type poolLimiter struct {
+	inFlight int
+	waiting  *list.List // of chan struct{}, closed when handed a slot
+	mutex    sync.Mutex
+}
+
+func NewConcurrencyLimits() *ConcurrencyLimits {
+	cl := &ConcurrencyLimits{
+		defaults: ConcurrencyLimit{
+			MaxInFlight:  getEnvInt("PROXY_MAX_IN_FLIGHT", 0),
+			MaxQueue:     getEnvInt("PROXY_MAX_QUEUE", 100),
+			QueueTimeout: Duration(getEnvDuration("PROXY_QUEUE_TIMEOUT", time.Second)),
+			Status:       http.StatusServiceUnavailable,
+			RetryAfter:   Duration(getEnvDuration("PROXY_SHED_RETRY_AFTER", time.Second)),
+		},
+		pools: make(map[string]*poolLimiter),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_in_flight_requests",
+			Help: "Proxied requests holding a slot of their service's concurrency limit",
+		}, []string{"namespace", "service"}),
+		queued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_queued_requests",
+			Help: "Proxied requests waiting for a slot of their service's concurrency limit",
+		}, []string{"namespace", "service"}),
+		shed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_shed_requests_total",
+			Help: "Proxied requests shed by their service's concurrency limit, by reason: queue_full or queue_timeout",
+		}, []string{"namespace", "service", "reason"}),
+	}
+	prometheus.MustRegister(cl.inFlight, cl.queued, cl.shed)
+	return cl
+}
+
+// acquire takes a slot of a pool for a request, waiting in the queue if
+// need be. It returns the function releasing the slot, or false after
+// answering a request that was shed.
+func (cl *ConcurrencyLimits) acquire(w http.ResponseWriter, r *http.Request, target *proxyTarget, override *ConcurrencyLimit) (func(), bool) {
+	if cl == nil || isUpgrade(r) {
+		return func() {}, true
+	}
+	limit := cl.defaults.overlay(override)
+	if limit.MaxInFlight <= 0 {
+		return func() {}, true
+	}
+
+	cl.mutex.Lock()
+	pool, exists := cl.pools[target.poolName]
+	if !exists {
+		pool = &poolLimiter{waiting: list.New()}
+		cl.pools[target.poolName] = pool
+	}
+	cl.mutex.Unlock()
+
+	inFlight := cl.inFlight.WithLabelValues(target.namespace, target.serviceName)
+	release := func() {
+		inFlight.Dec()
+		pool.release()
+	}
+
+	pool.mutex.Lock()
+	if pool.inFlight < limit.MaxInFlight {
+		pool.inFlight++
+		pool.mutex.Unlock()
+		inFlight.Inc()
+		return release, true
+	}
+	if pool.waiting.Len() >= limit.MaxQueue {
+		pool.mutex.Unlock()
+		cl.reject(w, target, limit, "queue_full")
+		return nil, false
+	}
+	ready := make(chan struct{})
+	element := pool.waiting.PushBack(ready)
+	pool.mutex.Unlock()
+
+	queued := cl.queued.WithLabelValues(target.namespace, target.serviceName)
+	queued.Inc()
+	defer queued.Dec()
+
+	timer := time.NewTimer(time.Duration(limit.QueueTimeout))
+	defer timer.Stop()
+	var reason string
+	select {
+	case <-ready:
+		inFlight.Inc()
+		return release, true
+	case <-timer.C:
+		reason = "queue_timeout"
+	case <-r.Context().Done():
+	}
+
+	// A slot handed over while giving up is ours all the same
+	pool.mutex.Lock()
+	select {
+	case <-ready:
+		pool.mutex.Unlock()
+		inFlight.Inc()
+		return release, true
+	default:
+		pool.waiting.Remove(element)
+		pool.mutex.Unlock()
+	}
+
+	// A client that went away has no one to answer
+	if reason != "" {
+		cl.reject(w, target, limit, reason)
+	}
+	return nil, false
+}
+
+// release hands a slot to the longest waiting request, or frees it
+func (pl *poolLimiter) release() {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	if front := pl.waiting.Front(); front != nil {
+		close(pl.waiting.Remove(front).(chan struct{}))
+		return
+	}
+	pl.inFlight--
+}
+
+// reject answers a shed request
+func (cl *ConcurrencyLimits) reject(w http.ResponseWriter, target *proxyTarget, limit ConcurrencyLimit, reason string) {
+	cl.shed.WithLabelValues(target.namespace, target.serviceName, reason).Inc()
+	seconds := int((time.Duration(limit.RetryAfter) + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, "Service is overloaded, retry later", limit.Status)
+}
+
+// concurrencyLimit returns a pool's concurrency limit, nil when it has none
+// of its own
+func (rt *RouteTable) concurrencyLimit(poolName string) *ConcurrencyLimit {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Concurrency
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hashRingReplicas is the number of ring points per unit of instance weight
+const hashRingReplicas = 100
+
+// hashRing maps hash keys to instances for the consistent-hash strategy.
+// Adding or removing an instance only moves the keys of its own points.
+type hashRing struct {
+	points  []uint64
+	owners  []*ServiceInstance // owner of each point
+	members uint64             // membersHash of the instances on the ring
+}
+
+// membersHash identifies a set of instances, so rings built for a
+// candidate set that changed without a pool change (zone-aware routing)
+// get rebuilt
+func membersHash(instances []*ServiceInstance) uint64 {
+	var hash uint64
+	for _, instance := range instances {
+		hash ^= hashString(instance.ID)
+	}
+	return hash
+}
+
+func hashString(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+// ringHash places a value on a hash ring. FNV alone leaves keys that only
+// differ in their last characters, such as client IPs, next to each other
+// on the ring, so its hash is run through MurmurHash3's finalizer to
+// spread them out.
+func ringHash(value string) uint64 {
+	hash := hashString(value)
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+func newHashRing(instances []*ServiceInstance) *hashRing {
+	type point struct {
+		hash  uint64
+		owner *ServiceInstance
+	}
+
+	points := make([]point, 0, len(instances)*hashRingReplicas)
+	for _, instance := range instances {
+		for i := 0; i < hashRingReplicas*max(instance.Weight, 1); i++ {
+			points = append(points, point{ringHash(instance.ID + "#" + strconv.Itoa(i)), instance})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	ring := &hashRing{
+		points:  make([]uint64, len(points)),
+		owners:  make([]*ServiceInstance, len(points)),
+		members: membersHash(instances),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+	return ring
+}
+
+// consistentHash picks the instance owning key on the pool's ring, walking
+// clockwise past unhealthy and ejected instances. Slow start doesn't
+// apply, as skipping turns would break the affinity. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) consistentHash(key string, instances []*ServiceInstance, hashKey string, now time.Time) *ServiceInstance {
+	ring := lb.rings[key]
+	if ring == nil || ring.members != membersHash(instances) {
+		ring = newHashRing(instances)
+		lb.rings[key] = ring
+	}
+
+	hash := ringHash(hashKey)
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	for i := range ring.points {
+		owner := ring.owners[(start+i)%len(ring.points)]
+		if routable(owner) && !lb.isEjected(owner.ID, now) {
+			return owner
+		}
+	}
+	return lb.fallback(instances, 0)
+}
+
+// requestHashKey extracts the consistent-hash key from a request as
+// configured by LB_HASH_KEY
+func (lb *LoadBalancer) requestHashKey(r *http.Request) string {
+	return requestKey(r, lb.hashKey)
+}
+
+// validRequestKey reports whether a request key is "ip", "header:<name>"
+// or "cookie:<name>"
+func validRequestKey(key string) bool {
+	source, name, _ := strings.Cut(key, ":")
+	return source == "ip" || ((source == "header" || source == "cookie") && name != "")
+}
+
+// requestKey extracts a key identifying a client from a request: its IP
+// for "ip", or the value of a header or cookie for "header:<name>" and
+// "cookie:<name>". Requests without the header or cookie fall back to the
+// client IP.
+func requestKey(r *http.Request, key string) string {
+	source, name, _ := strings.Cut(key, ":")
+	switch source {
+	case "header":
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	case "cookie":
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
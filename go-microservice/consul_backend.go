@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// ConsulBackend stores registrations in the Consul catalog. Instances are
+// registered as external services on a node named after their address, so
+// services registered by regular Consul agents show up side by side with
+// the ones registered through the gateway.
+//
+// Consul caps service meta values at 512 bytes and shows them to anyone who
+// can read the catalog, so the gateway's instance documents, health checks
+// and their headers included, are kept in KV under CONSUL_KV_PREFIX. The
+// catalog entry only carries the document's digest, which also makes every
+// document change wake the catalog watchers.
+type ConsulBackend struct {
+	client   *consul.Client
+	kvPrefix string
+	logger   *zap.Logger
+	leader   atomic.Bool
+}
+
+// NewConsulBackend connects to the Consul cluster described by the standard
+// CONSUL_HTTP_ADDR / CONSUL_HTTP_TOKEN environment variables
+func NewConsulBackend(logger *zap.Logger) (*ConsulBackend, error) {
+	client, err := consul.NewClient(consul.DefaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("consul client: %w", err)
+	}
+
+	logger.Info("Using Consul registry backend",
+		zap.String("address", os.Getenv("CONSUL_HTTP_ADDR")))
+
+	cb := &ConsulBackend{
+		client:   client,
+		kvPrefix: getEnv("CONSUL_KV_PREFIX", "devtoolkit/services/"),
+		logger:   logger,
+	}
+	go cb.campaign(getEnv("CONSUL_LEADER_KEY", "devtoolkit/leader"))
+
+	return cb, nil
+}
+
+// campaign holds a Consul session lock while this gateway is leader
+func (cb *ConsulBackend) campaign(key string) {
+	for {
+		lock, err := cb.client.LockOpts(&consul.LockOptions{
+			Key:        key,
+			SessionTTL: "15s",
+		})
+		if err != nil {
+			cb.logger.Error("Failed to create Consul leader lock", zap.Error(err))
+			return
+		}
+
+		lost, err := lock.Lock(nil)
+		if err != nil {
+			cb.logger.Warn("Consul leader lock failed", zap.Error(err))
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		cb.leader.Store(true)
+		cb.logger.Info("Elected leader through Consul", zap.String("key", key))
+
+		<-lost
+		cb.leader.Store(false)
+		cb.logger.Warn("Lost Consul leadership")
+		lock.Unlock()
+	}
+}
+
+func (cb *ConsulBackend) IsLeader() bool {
+	return cb.leader.Load()
+}
+
+// PublishStatus re-registers the instance so its status meta is updated
+func (cb *ConsulBackend) PublishStatus(ctx context.Context, service *ServiceInstance) error {
+	return cb.Register(ctx, service)
+}
+
+func (cb *ConsulBackend) Register(ctx context.Context, service *ServiceInstance) error {
+	document, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+	_, err = cb.client.KV().Put(&consul.KVPair{Key: cb.kvPrefix + service.ID, Value: document},
+		(&consul.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("store instance document: %w", err)
+	}
+	digest := sha256.Sum256(document)
+
+	registration := &consul.CatalogRegistration{
+		Node:           service.Address,
+		Address:        service.Address,
+		SkipNodeUpdate: true,
+		Service: &consul.AgentService{
+			ID:      service.ID,
+			Service: service.Name,
+			Address: service.Address,
+			Port:    service.Port,
+			Meta:    map[string]string{consulDocumentKey: hex.EncodeToString(digest[:8])},
+			Tags:    service.Tags,
+			Weights: consul.AgentWeights{Passing: service.Weight, Warning: 1},
+		},
+	}
+
+	// An address change moves the instance to another node; drop the old entry
+	entries, _, err := cb.client.Catalog().Service(service.Name, "", (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.ServiceID == service.ID && entry.Node != service.Address {
+			_, err := cb.client.Catalog().Deregister(&consul.CatalogDeregistration{
+				Node:      entry.Node,
+				ServiceID: service.ID,
+			}, (&consul.WriteOptions{}).WithContext(ctx))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = cb.client.Catalog().Register(registration, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (cb *ConsulBackend) Deregister(ctx context.Context, serviceID string) error {
+	services, err := cb.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range services {
+		if service.ID != serviceID {
+			continue
+		}
+		_, err := cb.client.Catalog().Deregister(&consul.CatalogDeregistration{
+			Node:      service.Address,
+			ServiceID: serviceID,
+		}, (&consul.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	_, err = cb.client.KV().Delete(cb.kvPrefix+serviceID, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (cb *ConsulBackend) List(ctx context.Context) ([]*ServiceInstance, error) {
+	services, _, err := cb.listAt(ctx, 0)
+	return services, err
+}
+
+func (cb *ConsulBackend) Snapshot(ctx context.Context) (*RegistrySnapshot, error) {
+	services, index, err := cb.listAt(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &RegistrySnapshot{Services: services, Revision: index}, nil
+}
+
+// listAt lists the catalog, blocking until it changes past waitIndex
+func (cb *ConsulBackend) listAt(ctx context.Context, waitIndex uint64) ([]*ServiceInstance, uint64, error) {
+	catalog := cb.client.Catalog()
+
+	names, meta, err := catalog.Services((&consul.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  5 * time.Minute,
+	}).WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// One listing of the documents rather than a read per instance
+	pairs, _, err := cb.client.KV().List(cb.kvPrefix, (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	documents := make(map[string][]byte, len(pairs))
+	for _, pair := range pairs {
+		documents[strings.TrimPrefix(pair.Key, cb.kvPrefix)] = pair.Value
+	}
+
+	services := make([]*ServiceInstance, 0)
+	for name := range names {
+		if name == "consul" {
+			continue
+		}
+
+		entries, _, err := catalog.Service(name, "", (&consul.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, entry := range entries {
+			if _, ours := entry.ServiceMeta[consulDocumentKey]; ours {
+				// Skips instances whose document was just deleted
+				var service ServiceInstance
+				if err := json.Unmarshal(documents[entry.ServiceID], &service); err == nil {
+					services = append(services, &service)
+				}
+				continue
+			}
+
+			address := entry.ServiceAddress
+			if address == "" {
+				address = entry.Address
+			}
+			service := &ServiceInstance{
+				ID:      entry.ServiceID,
+				Name:    entry.ServiceName,
+				Address: address,
+				Port:    entry.ServicePort,
+				Tags:    entry.ServiceTags,
+				Weight:  entry.ServiceWeights.Passing,
+			}
+			decodeConsulMeta(entry.ServiceMeta, service)
+			services = append(services, service)
+		}
+	}
+
+	return services, meta.LastIndex, nil
+}
+
+// Watch uses Consul blocking queries from the snapshot's index and diffs
+// consecutive catalog listings
+func (cb *ConsulBackend) Watch(ctx context.Context, from *RegistrySnapshot) (<-chan RegistryEvent, error) {
+	index := from.Revision
+
+	events := make(chan RegistryEvent)
+	go func() {
+		defer close(events)
+
+		known := indexServices(from.Services)
+
+		for ctx.Err() == nil {
+			services, next, err := cb.listAt(ctx, index)
+			if err != nil {
+				if ctx.Err() == nil {
+					cb.logger.Warn("Consul watch failed", zap.Error(err))
+					select {
+					case <-time.After(5 * time.Second):
+					case <-ctx.Done():
+					}
+				}
+				continue
+			}
+			if next < index {
+				// Consul index went backwards (e.g. snapshot restore)
+				next = 0
+			}
+			index = next
+
+			var changes []RegistryEvent
+			known, changes = diffRegistry(known, services)
+			for _, event := range changes {
+				if !sendRegistryEvent(ctx, events, event) {
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// consulFields maps the reserved service meta keys to the ServiceInstance
+// fields that Consul has no native place for
+func consulFields(service *ServiceInstance) map[string]*string {
+	return map[string]*string{
+		"namespace":      &service.Namespace,
+		"version":        &service.Version,
+		"zone":           &service.Zone,
+		"region":         &service.Region,
+		"priority":       &service.Priority,
+		"gateway_status": &service.Status,
+	}
+}
+
+const (
+	consulDependsOnKey   = "depends_on"
+	consulHealthCheckKey = "gateway_health_check"
+
+	// consulDocumentKey marks the instances registered by a gateway, whose
+	// document is in KV, with the document's digest
+	consulDocumentKey = "gateway_document"
+)
+
+// decodeConsulMeta fills the reserved fields and Metadata of a service
+// registered by a Consul agent, or by a gateway before instance documents
+// moved to KV
+func decodeConsulMeta(meta map[string]string, service *ServiceInstance) {
+	fields := consulFields(service)
+	service.Metadata = make(map[string]interface{}, len(meta))
+	for key, value := range meta {
+		if field, reserved := fields[key]; reserved {
+			*field = value
+			continue
+		}
+		if key == consulDependsOnKey {
+			service.DependsOn = strings.Split(value, ",")
+			continue
+		}
+		if key == consulHealthCheckKey {
+			var check HealthCheckConfig
+			if json.Unmarshal([]byte(value), &check) == nil {
+				service.HealthCheck = &check
+			}
+			continue
+		}
+		service.Metadata[key] = value
+	}
+}
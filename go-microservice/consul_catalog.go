@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ConsulCatalog serves a read-only subset of the Consul HTTP API on /v1 so
+// tools that speak Consul (Prometheus consul_sd_configs, Fabio and the like)
+// can read the registry directly. Blocking queries are supported through
+// ?index= and ?wait= backed by the registry change log.
+type ConsulCatalog struct {
+	gateway    *APIGateway
+	datacenter string
+}
+
+func NewConsulCatalog(gateway *APIGateway) *ConsulCatalog {
+	return &ConsulCatalog{
+		gateway:    gateway,
+		datacenter: getEnv("FEDERATION_DATACENTER", "dc1"),
+	}
+}
+
+type consulNode struct {
+	ID              string            `json:"ID"`
+	Node            string            `json:"Node"`
+	Address         string            `json:"Address"`
+	Datacenter      string            `json:"Datacenter"`
+	TaggedAddresses map[string]string `json:"TaggedAddresses"`
+	Meta            map[string]string `json:"Meta"`
+}
+
+type consulService struct {
+	ID      string            `json:"ID"`
+	Service string            `json:"Service"`
+	Tags    []string          `json:"Tags"`
+	Address string            `json:"Address"`
+	Meta    map[string]string `json:"Meta"`
+	Port    int               `json:"Port"`
+	Weights consulWeights     `json:"Weights"`
+}
+
+type consulWeights struct {
+	Passing int `json:"Passing"`
+	Warning int `json:"Warning"`
+}
+
+type consulCheck struct {
+	Node        string `json:"Node"`
+	CheckID     string `json:"CheckID"`
+	Name        string `json:"Name"`
+	Status      string `json:"Status"`
+	Output      string `json:"Output"`
+	ServiceID   string `json:"ServiceID"`
+	ServiceName string `json:"ServiceName"`
+}
+
+type consulServiceEntry struct {
+	Node    consulNode    `json:"Node"`
+	Service consulService `json:"Service"`
+	Checks  []consulCheck `json:"Checks"`
+}
+
+// consulHealthStatus maps registry statuses to Consul check states
+func consulHealthStatus(status string) string {
+	switch status {
+	case "healthy":
+		return "passing"
+	case "unknown":
+		return "warning"
+	default:
+		return "critical"
+	}
+}
+
+// block waits for a blocking query and sets the headers Consul clients
+// expect. It returns the instances of the requested datacenter and namespace.
+func (cc *ConsulCatalog) block(w http.ResponseWriter, r *http.Request) ([]*ServiceInstance, bool) {
+	query := r.URL.Query()
+
+	namespace := query.Get("ns")
+	if namespace == "" {
+		var err error
+		if namespace, err = requestNamespace(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	datacenter := query.Get("dc")
+	if datacenter == "" {
+		datacenter = cc.datacenter
+	}
+
+	if index, err := strconv.ParseUint(query.Get("index"), 10, 64); err == nil && index > 0 {
+		wait := 5 * time.Minute
+		if value, err := time.ParseDuration(query.Get("wait")); err == nil && value > 0 && value < wait {
+			wait = value
+		}
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+		cc.gateway.registry.WaitForChange(r.Context(), index, wait)
+	}
+
+	// Consul indexes start at 1
+	_, current, _ := cc.gateway.registry.ChangesSince(0)
+	if current == 0 {
+		current = 1
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(current, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+
+	services := make([]*ServiceInstance, 0)
+	for _, service := range cc.gateway.registry.FindServices(nil, nil, map[string]string{"namespace": namespace}) {
+		origin := service.Origin
+		if origin == "" {
+			origin = cc.datacenter
+		}
+		if origin == datacenter {
+			services = append(services, service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, true
+}
+
+// servicesHandler serves /v1/catalog/services: service name -> tags
+func (cc *ConsulCatalog) servicesHandler(w http.ResponseWriter, r *http.Request) {
+	services, ok := cc.block(w, r)
+	if !ok {
+		return
+	}
+
+	catalog := make(map[string][]string)
+	seen := make(map[string]map[string]bool)
+	for _, service := range services {
+		if catalog[service.Name] == nil {
+			catalog[service.Name] = []string{}
+			seen[service.Name] = make(map[string]bool)
+		}
+		for _, tag := range service.Tags {
+			if !seen[service.Name][tag] {
+				seen[service.Name][tag] = true
+				catalog[service.Name] = append(catalog[service.Name], tag)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalog)
+}
+
+// healthServiceHandler serves /v1/health/service/{name}, honouring the
+// ?passing and ?tag filters
+func (cc *ConsulCatalog) healthServiceHandler(w http.ResponseWriter, r *http.Request) {
+	services, ok := cc.block(w, r)
+	if !ok {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+	_, passingOnly := query["passing"]
+	tags := query["tag"]
+
+	entries := make([]consulServiceEntry, 0)
+	for _, service := range services {
+		if service.Name != name || !hasTags(service, tags) {
+			continue
+		}
+
+		status := consulHealthStatus(service.Status)
+		if passingOnly && status != "passing" {
+			continue
+		}
+
+		serviceTags := service.Tags
+		if serviceTags == nil {
+			serviceTags = []string{}
+		}
+
+		entries = append(entries, consulServiceEntry{
+			Node: consulNode{
+				ID:              service.Address,
+				Node:            service.Address,
+				Address:         service.Address,
+				Datacenter:      cc.datacenter,
+				TaggedAddresses: map[string]string{"lan": service.Address},
+				Meta:            map[string]string{},
+			},
+			Service: consulService{
+				ID:      service.ID,
+				Service: service.Name,
+				Tags:    serviceTags,
+				Address: service.Address,
+				Meta:    encodeConsulMeta(service),
+				Port:    service.Port,
+				Weights: consulWeights{Passing: service.Weight, Warning: 1},
+			},
+			Checks: []consulCheck{{
+				Node:        service.Address,
+				CheckID:     "service:" + service.ID,
+				Name:        "Gateway health check",
+				Status:      status,
+				Output:      service.Status,
+				ServiceID:   service.ID,
+				ServiceName: service.Name,
+			}},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// agentSelfHandler serves the parts of /v1/agent/self clients read to find
+// out the local datacenter
+func (cc *ConsulCatalog) agentSelfHandler(w http.ResponseWriter, r *http.Request) {
+	self := map[string]interface{}{
+		"Config": map[string]interface{}{
+			"Datacenter": cc.datacenter,
+			"NodeName":   "devtoolkit-gateway",
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(self)
+}
+
+// encodeConsulMeta renders an instance's metadata and the fields Consul has
+// no native place for as string-only Consul meta, non-string values as
+// JSON. Health checks are left out, as their headers may be credentials.
+func encodeConsulMeta(service *ServiceInstance) map[string]string {
+	meta := make(map[string]string, len(service.Metadata)+4)
+	for key, value := range service.Metadata {
+		if s, ok := value.(string); ok {
+			meta[key] = s
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(encoded)
+	}
+	for key, field := range consulFields(service) {
+		if *field != "" {
+			meta[key] = *field
+		}
+	}
+	if len(service.DependsOn) > 0 {
+		meta[consulDependsOnKey] = strings.Join(service.DependsOn, ",")
+	}
+	return meta
+}
+
+func hasTags(service *ServiceInstance, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range service.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
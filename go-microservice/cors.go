@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// CORSPolicy says which browser origins may call the gateway and how.
+// Origins are exact, such as "https://app.example.com", "*" for any, or
+// wildcard subdomains such as "https://*.example.com". With
+// AllowCredentials, cookies and Authorization may be sent, and the
+// request's origin is echoed back rather than "*"; policies allowing any
+// origin never allow credentials. Headers may be "*" to
+// allow whatever a preflight asks for. Unset fields of a route's policy
+// take the gateway's.
+type CORSPolicy struct {
+	AllowedOrigins   []string `json:"allowed_origins,omitempty"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials *bool    `json:"allow_credentials,omitempty"`
+	MaxAge           Duration `json:"max_age,omitempty"`
+}
+
+func (cp *CORSPolicy) validate() error {
+	if cp.MaxAge < 0 {
+		return errors.New("CORS max age must not be negative")
+	}
+	for _, origin := range cp.AllowedOrigins {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return fmt.Errorf("CORS origin %q needs a scheme", origin)
+		}
+	}
+	return nil
+}
+
+// overlay returns the policy with the fields set in override replacing its
+// own
+func (cp CORSPolicy) overlay(override *CORSPolicy) CORSPolicy {
+	if override == nil {
+		return cp
+	}
+	if override.AllowedOrigins != nil {
+		cp.AllowedOrigins = override.AllowedOrigins
+	}
+	if override.AllowedMethods != nil {
+		cp.AllowedMethods = override.AllowedMethods
+	}
+	if override.AllowedHeaders != nil {
+		cp.AllowedHeaders = override.AllowedHeaders
+	}
+	if override.ExposedHeaders != nil {
+		cp.ExposedHeaders = override.ExposedHeaders
+	}
+	if override.AllowCredentials != nil {
+		cp.AllowCredentials = override.AllowCredentials
+	}
+	if override.MaxAge > 0 {
+		cp.MaxAge = override.MaxAge
+	}
+	return cp
+}
+
+func (cp *CORSPolicy) credentials() bool {
+	return cp.AllowCredentials != nil && *cp.AllowCredentials
+}
+
+// allowsOrigin reports whether a request's Origin may call
+func (cp *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range cp.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if prefix, suffix, wildcard := strings.Cut(allowed, "*."); wildcard {
+			host, found := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(prefix))
+			if found && strings.HasSuffix(host, "."+strings.ToLower(suffix)) && !strings.ContainsAny(host, "/@") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether every header a preflight asks for is allowed
+func (cp *CORSPolicy) allowsHeaders(requested []string) bool {
+	if slices.Contains(cp.AllowedHeaders, "*") {
+		return true
+	}
+	for _, name := range requested {
+		if !slices.ContainsFunc(cp.AllowedHeaders, func(allowed string) bool { return strings.EqualFold(allowed, name) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// CORS applies the gateway's cross-origin policy, set by
+// CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS,
+// CORS_EXPOSED_HEADERS, CORS_ALLOW_CREDENTIALS and CORS_MAX_AGE, to its own
+// endpoints, and with the routes' policies laid over it to proxied
+// requests. Preflights are answered by the gateway, with 403 when the
+// policy doesn't allow them; other OPTIONS requests are proxied.
+type CORS struct {
+	policy CORSPolicy
+	logger *zap.Logger
+}
+
+func NewCORS(logger *zap.Logger) (*CORS, error) {
+	credentials := getEnv("CORS_ALLOW_CREDENTIALS", "false") == "true"
+	c := &CORS{
+		policy: CORSPolicy{
+			AllowedOrigins:   getEnvList("CORS_ALLOWED_ORIGINS", []string{"*"}),
+			AllowedMethods:   getEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
+			AllowedHeaders:   getEnvList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Authorization", "X-Namespace", "X-Registry-Token"}),
+			ExposedHeaders:   getEnvList("CORS_EXPOSED_HEADERS", nil),
+			AllowCredentials: &credentials,
+			MaxAge:           Duration(getEnvDuration("CORS_MAX_AGE", 10*time.Minute)),
+		},
+		logger: logger,
+	}
+	if err := c.policy.validate(); err != nil {
+		return nil, err
+	}
+	if credentials && slices.Contains(c.policy.AllowedOrigins, "*") {
+		return nil, errors.New("CORS_ALLOW_CREDENTIALS needs CORS_ALLOWED_ORIGINS to list origins")
+	}
+	if slices.Contains(c.policy.AllowedOrigins, "*") {
+		logger.Warn("CORS allows any origin, set CORS_ALLOWED_ORIGINS in production")
+	}
+	return c, nil
+}
+
+// isPreflight reports whether a request is a browser's CORS preflight
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// apply sets the CORS headers of a request under a route's policy. It
+// returns true after answering a preflight, which goes no further.
+func (c *CORS) apply(w http.ResponseWriter, r *http.Request, override *CORSPolicy) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	policy := c.policy.overlay(override)
+	header := w.Header()
+	header.Add("Vary", "Origin")
+
+	if !policy.allowsOrigin(origin) {
+		if isPreflight(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	// Any origin never gets credentials, which would hand every site the
+	// user's session
+	if slices.Contains(policy.AllowedOrigins, "*") {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		if policy.credentials() {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if !isPreflight(r) {
+		if len(policy.ExposedHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	method := r.Header.Get("Access-Control-Request-Method")
+	var requested []string
+	for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			requested = append(requested, name)
+		}
+	}
+	if !slices.Contains(policy.AllowedMethods, method) || !policy.allowsHeaders(requested) {
+		http.Error(w, "CORS request not allowed", http.StatusForbidden)
+		return true
+	}
+
+	header.Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+	if len(requested) > 0 {
+		// Echoing the request also covers "*", which isn't honoured with
+		// credentials
+		header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if policy.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(policy.MaxAge).Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// middleware applies the gateway's policy to its own endpoints; proxied
+// requests get their route's in proxyHandler and pathRouteHandler.
+// Preflights to endpoints that don't take OPTIONS fall through to the
+// dashboard's catch-all route and are answered here all the same.
+func (c *CORS) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == proxyRouteName {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c.apply(w, r, nil) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyCORS applies a pool's policy to a request proxied to it, returning
+// true after answering a preflight
+func (gw *APIGateway) applyCORS(w http.ResponseWriter, r *http.Request, poolName string) bool {
+	return gw.cors.apply(w, r, gw.routes.cors(poolName))
+}
+
+// cors returns a pool's CORS policy, nil when it has none of its own
+func (rt *RouteTable) cors(poolName string) *CORSPolicy {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.CORS
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// deepHealthTimeout bounds each dependency check of /api/health?deep=true
+const deepHealthTimeout = 5 * time.Second
+
+// DependencyStatus is the result of checking one of the gateway's own
+// dependencies
+type DependencyStatus struct {
+	Status    string  `json:"status"` // ok or failed
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// dependencyCheck verifies that a dependency is usable
+type dependencyCheck func(ctx context.Context) error
+
+// addDependency registers a check run by the deep health check. Subsystems
+// with external state (stores, certificates) add theirs at startup, before
+// the server starts.
+func (gw *APIGateway) addDependency(name string, check dependencyCheck) {
+	gw.dependencies[name] = check
+}
+
+// checkDependencies runs every dependency check concurrently
+func (gw *APIGateway) checkDependencies(ctx context.Context) map[string]*DependencyStatus {
+	results := make(map[string]*DependencyStatus, len(gw.dependencies))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range gw.dependencies {
+		wg.Add(1)
+		go func(name string, check dependencyCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, deepHealthTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			result := &DependencyStatus{
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+
+			mutex.Lock()
+			results[name] = result
+			mutex.Unlock()
+		}(name, check)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// registryBackendCheck lists the backend catalog
+func (sr *ServiceRegistry) registryBackendCheck(ctx context.Context) error {
+	_, err := sr.backend.List(ctx)
+	return err
+}
+
+// check fails while the audit queue is full, since registry changes block
+// until entries are written
+func (al *AuditLog) check(ctx context.Context) error {
+	if len(al.entries) == cap(al.entries) {
+		return errors.New("audit log queue is full, registry changes are blocked")
+	}
+	_, err := al.file.Stat()
+	return err
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	dnsMinRefresh   = 5 * time.Second
+	dnsRetryRefresh = 10 * time.Second
+)
+
+// dnsTarget maps a service name to the DNS name it is resolved from. Names
+// starting with "_" are looked up as SRV records; anything else must be
+// host:port and is looked up as A/AAAA records.
+type dnsTarget struct {
+	service string
+	name    string
+	port    int
+}
+
+// DNSDiscovery keeps registry entries in sync with DNS records
+type DNSDiscovery struct {
+	gateway *APIGateway
+	targets []dnsTarget
+	client  *dns.Client
+	server  string
+	logger  *zap.Logger
+}
+
+// NewDNSDiscovery parses DNS_SERVICES, e.g.
+// "orders=_orders._tcp.svc.local,users=users.internal:8080". It returns nil
+// when no DNS services are configured.
+func NewDNSDiscovery(gateway *APIGateway, logger *zap.Logger) (*DNSDiscovery, error) {
+	entries := getEnvList("DNS_SERVICES", nil)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	targets := make([]dnsTarget, 0, len(entries))
+	for _, entry := range entries {
+		service, name, ok := strings.Cut(entry, "=")
+		if !ok || service == "" || name == "" {
+			return nil, fmt.Errorf("invalid DNS_SERVICES entry %q", entry)
+		}
+
+		target := dnsTarget{service: service, name: name}
+		if !strings.HasPrefix(name, "_") {
+			host, port, err := net.SplitHostPort(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DNS_SERVICES entry %q: %w", entry, err)
+			}
+			if target.port, err = strconv.Atoi(port); err != nil {
+				return nil, fmt.Errorf("invalid DNS_SERVICES port in %q", entry)
+			}
+			target.name = host
+		}
+		targets = append(targets, target)
+	}
+
+	server := getEnv("DNS_RESOLVER", "")
+	if server == "" {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil || len(config.Servers) == 0 {
+			return nil, fmt.Errorf("no DNS resolver configured: %v", err)
+		}
+		server = net.JoinHostPort(config.Servers[0], config.Port)
+	}
+
+	return &DNSDiscovery{
+		gateway: gateway,
+		targets: targets,
+		client:  &dns.Client{Timeout: 5 * time.Second},
+		server:  server,
+		logger:  logger,
+	}, nil
+}
+
+// Run resolves every target and re-resolves each one when its TTL expires
+func (dd *DNSDiscovery) Run(ctx context.Context) {
+	for _, target := range dd.targets {
+		go dd.watch(ctx, target)
+	}
+}
+
+func (dd *DNSDiscovery) watch(ctx context.Context, target dnsTarget) {
+	known := make(map[string]*ServiceInstance)
+
+	for {
+		instances, ttl, err := dd.resolve(ctx, target)
+		if err != nil {
+			dd.logger.Warn("DNS resolution failed",
+				zap.String("service", target.service),
+				zap.String("name", target.name),
+				zap.Error(err))
+			ttl = dnsRetryRefresh
+		} else {
+			known = dd.apply(target, known, instances)
+		}
+
+		if ttl < dnsMinRefresh {
+			ttl = dnsMinRefresh
+		}
+
+		select {
+		case <-time.After(ttl):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// apply registers new records and removes records that disappeared
+func (dd *DNSDiscovery) apply(target dnsTarget, known map[string]*ServiceInstance, instances []*ServiceInstance) map[string]*ServiceInstance {
+	current := make(map[string]*ServiceInstance, len(instances))
+	for _, instance := range instances {
+		if existing, exists := known[instance.ID]; exists {
+			current[instance.ID] = existing
+			continue
+		}
+		if dd.gateway.registry.AddLocal(instance) {
+			dd.gateway.registry.addToRotation(instance.ID)
+		}
+		current[instance.ID] = instance
+	}
+
+	for id := range known {
+		if _, exists := current[id]; !exists {
+			dd.gateway.registry.RemoveLocal(id)
+			dd.gateway.loadBalancer.RemoveService(target.service, id)
+		}
+	}
+
+	return current
+}
+
+// resolve returns the instances behind a target and the smallest record TTL
+func (dd *DNSDiscovery) resolve(ctx context.Context, target dnsTarget) ([]*ServiceInstance, time.Duration, error) {
+	if !strings.HasPrefix(target.name, "_") {
+		addresses, ttl, err := dd.lookupAddresses(ctx, target.name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		instances := make([]*ServiceInstance, 0, len(addresses))
+		for _, address := range addresses {
+			instances = append(instances, dd.instance(target, address, target.port, nil))
+		}
+		return instances, ttl, nil
+	}
+
+	answer, err := dd.query(ctx, target.name, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	instances := make([]*ServiceInstance, 0)
+	ttl := time.Duration(0)
+	for _, rr := range answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		ttl = minTTL(ttl, time.Duration(srv.Hdr.Ttl)*time.Second)
+
+		addresses, addrTTL, err := dd.lookupAddresses(ctx, srv.Target)
+		if err != nil {
+			dd.logger.Warn("DNS SRV target did not resolve",
+				zap.String("target", srv.Target),
+				zap.Error(err))
+			continue
+		}
+		ttl = minTTL(ttl, addrTTL)
+
+		for _, address := range addresses {
+			instances = append(instances, dd.instance(target, address, int(srv.Port), map[string]interface{}{
+				"srv_priority": srv.Priority,
+				"srv_weight":   srv.Weight,
+			}))
+		}
+	}
+
+	return instances, ttl, nil
+}
+
+func (dd *DNSDiscovery) lookupAddresses(ctx context.Context, name string) ([]string, time.Duration, error) {
+	addresses := make([]string, 0)
+	ttl := time.Duration(0)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answer, err := dd.query(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				addresses = append(addresses, record.A.String())
+			case *dns.AAAA:
+				addresses = append(addresses, record.AAAA.String())
+			default:
+				continue
+			}
+			ttl = minTTL(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, 0, fmt.Errorf("no A/AAAA records for %s", name)
+	}
+	return addresses, ttl, nil
+}
+
+func (dd *DNSDiscovery) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	resp, _, err := dd.client.ExchangeContext(ctx, msg, dd.server)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s lookup for %s: %s", dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp.Answer, nil
+}
+
+func (dd *DNSDiscovery) instance(target dnsTarget, address string, port int, extra map[string]interface{}) *ServiceInstance {
+	metadata := map[string]interface{}{
+		"source":   "dns",
+		"dns_name": target.name,
+	}
+	for key, value := range extra {
+		metadata[key] = value
+	}
+
+	return &ServiceInstance{
+		ID:       fmt.Sprintf("dns-%s-%s-%d", target.service, address, port),
+		Name:     target.service,
+		Address:  address,
+		Port:     port,
+		Metadata: metadata,
+	}
+}
+
+func minTTL(current, ttl time.Duration) time.Duration {
+	if current == 0 || ttl < current {
+		return ttl
+	}
+	return current
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DrainStatus describes an instance taken out of rotation while requests
+// to it were still in flight. It gets no new requests; the ones in flight
+// may complete until Deadline, after which they are cancelled.
+type DrainStatus struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Address   string    `json:"address"`
+	Port      int       `json:"port"`
+	InFlight  int       `json:"in_flight"`
+	Since     time.Time `json:"since"`
+	Deadline  time.Time `json:"deadline"`
+
+	timer *time.Timer
+}
+
+// instanceRequests is cancelled to abort every request in flight to an
+// instance whose drain timed out. removed is set while the instance is out
+// of rotation, so the state its last requests leave behind gets dropped.
+type instanceRequests struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	removed bool
+}
+
+// startDrain keeps track of an instance just removed from its pools until
+// its requests in flight complete or DRAIN_TIMEOUT passes. The caller must
+// hold lb.mutex.
+func (lb *LoadBalancer) startDrain(instance *ServiceInstance) {
+	if requests := lb.requests[instance.ID]; requests != nil {
+		requests.removed = true
+	}
+	if lb.drainTimeout <= 0 || lb.inflight[instance.ID] == 0 || lb.draining[instance.ID] != nil {
+		return
+	}
+
+	now := time.Now()
+	status := &DrainStatus{
+		ID:        instance.ID,
+		Name:      instance.Name,
+		Namespace: instance.Namespace,
+		Address:   instance.Address,
+		Port:      instance.Port,
+		Since:     now,
+		Deadline:  now.Add(lb.drainTimeout),
+	}
+	status.timer = time.AfterFunc(lb.drainTimeout, func() {
+		lb.mutex.Lock()
+		defer lb.mutex.Unlock()
+
+		if lb.draining[instance.ID] != status {
+			return
+		}
+		delete(lb.draining, instance.ID)
+		if requests := lb.requests[instance.ID]; requests != nil {
+			requests.cancel()
+			delete(lb.requests, instance.ID)
+		}
+	})
+	lb.draining[instance.ID] = status
+}
+
+// stopDrain forgets an instance's drain, either because its last request
+// completed or because it was put back into rotation. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) stopDrain(instanceID string) {
+	if requests := lb.requests[instanceID]; requests != nil {
+		requests.removed = false
+	}
+	if status := lb.draining[instanceID]; status != nil {
+		status.timer.Stop()
+		delete(lb.draining, instanceID)
+	}
+}
+
+// Draining returns the instances currently draining in a namespace
+func (lb *LoadBalancer) Draining(namespace string) []DrainStatus {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	draining := make([]DrainStatus, 0, len(lb.draining))
+	for id, status := range lb.draining {
+		if status.Namespace != namespace {
+			continue
+		}
+		copied := *status
+		copied.InFlight = lb.inflight[id]
+		copied.timer = nil
+		draining = append(draining, copied)
+	}
+	sort.Slice(draining, func(i, j int) bool { return draining[i].Since.Before(draining[j].Since) })
+	return draining
+}
+
+func (gw *APIGateway) drainingHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drain_timeout": gw.loadBalancer.drainTimeout.String(),
+		"draining":      gw.loadBalancer.Draining(namespace),
+	})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+)
+
+// EtcdBackend stores registrations under a shared etcd v3 prefix so every
+// gateway replica sees the same catalog. Keys written by a replica are bound
+// to that replica's lease, so registrations owned by a gateway that died
+// expire instead of lingering forever.
+type EtcdBackend struct {
+	client   *clientv3.Client
+	prefix   string
+	leaseTTL time.Duration
+	logger   *zap.Logger
+
+	lease clientv3.LeaseID
+	owned map[string]*ServiceInstance
+	mutex sync.Mutex
+
+	leader atomic.Bool
+}
+
+// NewEtcdBackend connects to ETCD_ENDPOINTS and starts keeping the lease alive
+func NewEtcdBackend(logger *zap.Logger) (*EtcdBackend, error) {
+	endpoints := getEnvList("ETCD_ENDPOINTS", []string{"localhost:2379"})
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("etcd client: %w", err)
+	}
+
+	eb := &EtcdBackend{
+		client:   client,
+		prefix:   getEnv("ETCD_PREFIX", "/devtoolkit/services/"),
+		leaseTTL: getEnvDuration("ETCD_LEASE_TTL", 60*time.Second),
+		logger:   logger,
+		owned:    make(map[string]*ServiceInstance),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	if err := eb.grantLease(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	go eb.keepAlive()
+	go eb.campaign(getEnv("ETCD_ELECTION_PREFIX", "/devtoolkit/leader"))
+
+	logger.Info("Using etcd registry backend",
+		zap.Strings("endpoints", endpoints),
+		zap.String("prefix", eb.prefix))
+
+	return eb, nil
+}
+
+func (eb *EtcdBackend) grantLease(ctx context.Context) error {
+	lease, err := eb.client.Grant(ctx, int64(eb.leaseTTL.Seconds()))
+	if err != nil {
+		return fmt.Errorf("etcd lease: %w", err)
+	}
+
+	eb.mutex.Lock()
+	eb.lease = lease.ID
+	eb.mutex.Unlock()
+	return nil
+}
+
+// keepAlive refreshes the lease and, if it is ever lost, grants a new one and
+// rewrites every registration this replica owns
+func (eb *EtcdBackend) keepAlive() {
+	for {
+		eb.mutex.Lock()
+		lease := eb.lease
+		eb.mutex.Unlock()
+
+		responses, err := eb.client.KeepAlive(context.Background(), lease)
+		if err == nil {
+			for range responses {
+			}
+		}
+
+		eb.logger.Warn("etcd lease lost, re-registering owned services", zap.Error(err))
+		time.Sleep(time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+		if err := eb.grantLease(ctx); err != nil {
+			eb.logger.Error("Failed to renew etcd lease", zap.Error(err))
+			cancel()
+			continue
+		}
+
+		eb.mutex.Lock()
+		owned := make([]*ServiceInstance, 0, len(eb.owned))
+		for _, service := range eb.owned {
+			owned = append(owned, service)
+		}
+		eb.mutex.Unlock()
+
+		for _, service := range owned {
+			if err := eb.put(ctx, service); err != nil {
+				eb.logger.Error("Failed to re-register service in etcd",
+					zap.String("id", service.ID),
+					zap.Error(err))
+			}
+		}
+		cancel()
+	}
+}
+
+// campaign keeps running for leadership; the session lapses (and another
+// replica wins) if this gateway stops renewing it
+func (eb *EtcdBackend) campaign(prefix string) {
+	hostname, _ := os.Hostname()
+
+	for {
+		session, err := concurrency.NewSession(eb.client, concurrency.WithTTL(15))
+		if err != nil {
+			eb.logger.Warn("Failed to create etcd election session", zap.Error(err))
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		election := concurrency.NewElection(session, prefix)
+		if err := election.Campaign(context.Background(), hostname); err != nil {
+			eb.logger.Warn("etcd leader campaign failed", zap.Error(err))
+			session.Close()
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		eb.leader.Store(true)
+		eb.logger.Info("Elected leader through etcd", zap.String("prefix", prefix))
+
+		<-session.Done()
+		eb.leader.Store(false)
+		eb.logger.Warn("Lost etcd leadership")
+	}
+}
+
+func (eb *EtcdBackend) IsLeader() bool {
+	return eb.leader.Load()
+}
+
+// PublishStatus rewrites an instance with its new status, keeping the lease
+// of the replica that owns the registration
+func (eb *EtcdBackend) PublishStatus(ctx context.Context, service *ServiceInstance) error {
+	value, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	_, err = eb.client.Put(ctx, eb.key(service.ID), string(value), clientv3.WithIgnoreLease())
+	return err
+}
+
+func (eb *EtcdBackend) key(serviceID string) string {
+	return eb.prefix + serviceID
+}
+
+func (eb *EtcdBackend) put(ctx context.Context, service *ServiceInstance) error {
+	value, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	eb.mutex.Lock()
+	lease := eb.lease
+	eb.mutex.Unlock()
+
+	_, err = eb.client.Put(ctx, eb.key(service.ID), string(value), clientv3.WithLease(lease))
+	return err
+}
+
+func (eb *EtcdBackend) Register(ctx context.Context, service *ServiceInstance) error {
+	if err := eb.put(ctx, service); err != nil {
+		return err
+	}
+
+	instance := *service
+	eb.mutex.Lock()
+	eb.owned[service.ID] = &instance
+	eb.mutex.Unlock()
+	return nil
+}
+
+func (eb *EtcdBackend) Deregister(ctx context.Context, serviceID string) error {
+	if _, err := eb.client.Delete(ctx, eb.key(serviceID)); err != nil {
+		return err
+	}
+
+	eb.mutex.Lock()
+	delete(eb.owned, serviceID)
+	eb.mutex.Unlock()
+	return nil
+}
+
+func (eb *EtcdBackend) List(ctx context.Context) ([]*ServiceInstance, error) {
+	services, _, err := eb.list(ctx)
+	return services, err
+}
+
+func (eb *EtcdBackend) Snapshot(ctx context.Context) (*RegistrySnapshot, error) {
+	services, revision, err := eb.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &RegistrySnapshot{Services: services, Revision: uint64(revision)}, nil
+}
+
+func (eb *EtcdBackend) list(ctx context.Context) ([]*ServiceInstance, int64, error) {
+	resp, err := eb.client.Get(ctx, eb.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	services := make([]*ServiceInstance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var service ServiceInstance
+		if err := json.Unmarshal(kv.Value, &service); err != nil {
+			eb.logger.Warn("Skipping malformed etcd registration",
+				zap.String("key", string(kv.Key)),
+				zap.Error(err))
+			continue
+		}
+		services = append(services, &service)
+	}
+
+	return services, resp.Header.Revision, nil
+}
+
+// Watch streams etcd watch events starting right after the snapshot's
+// revision. When the revision it needs was compacted away, it lists the
+// prefix again and reports the difference from the instances it knows
+// before watching on from the listing. The channel is closed if the watch
+// fails otherwise, so the caller can reload and watch again.
+func (eb *EtcdBackend) Watch(ctx context.Context, from *RegistrySnapshot) (<-chan RegistryEvent, error) {
+	events := make(chan RegistryEvent)
+	go func() {
+		defer close(events)
+
+		known := indexServices(from.Services)
+		revision := int64(from.Revision)
+		for {
+			var compacted bool
+			revision, compacted = eb.watchFrom(ctx, revision, known, events)
+			if !compacted {
+				return
+			}
+			eb.logger.Warn("etcd watch revision was compacted, listing again",
+				zap.Int64("revision", revision))
+
+			services, listed, err := eb.list(ctx)
+			if err != nil {
+				eb.logger.Warn("etcd watch failed", zap.Error(err))
+				return
+			}
+			var changes []RegistryEvent
+			known, changes = diffRegistry(known, services)
+			for _, event := range changes {
+				if !sendRegistryEvent(ctx, events, event) {
+					return
+				}
+			}
+			revision = listed
+		}
+	}()
+
+	return events, nil
+}
+
+// watchFrom sends the changes made after revision, keeping known up to
+// date, until the watch ends. It returns the last revision seen and
+// whether the watch ended because that revision was compacted.
+func (eb *EtcdBackend) watchFrom(ctx context.Context, revision int64, known map[string]*ServiceInstance, events chan<- RegistryEvent) (int64, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watch := eb.client.Watch(ctx, eb.prefix,
+		clientv3.WithPrefix(),
+		clientv3.WithRev(revision+1),
+		clientv3.WithPrevKV())
+
+	for resp := range watch {
+		if resp.CompactRevision != 0 {
+			return revision, true
+		}
+		if err := resp.Err(); err != nil {
+			eb.logger.Warn("etcd watch failed", zap.Error(err))
+			return revision, false
+		}
+
+		for _, ev := range resp.Events {
+			event := RegistryEvent{Type: RegistryEventPut}
+			kv := ev.Kv
+			if ev.Type == clientv3.EventTypeDelete {
+				event.Type = RegistryEventDelete
+				kv = ev.PrevKv
+			}
+
+			var service ServiceInstance
+			if kv == nil || json.Unmarshal(kv.Value, &service) != nil {
+				service = ServiceInstance{ID: strings.TrimPrefix(string(ev.Kv.Key), eb.prefix)}
+			}
+			event.Instance = &service
+
+			if event.Type == RegistryEventDelete {
+				delete(known, service.ID)
+			} else {
+				known[service.ID] = &service
+			}
+			if !sendRegistryEvent(ctx, events, event) {
+				return revision, false
+			}
+		}
+		revision = resp.Header.Revision
+	}
+	return revision, false
+}
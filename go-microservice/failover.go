@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Failover moves a proxied request on to another instance of its pool when
+// connecting to the one picked fails, e.g. because it refused the
+// connection, up to PROXY_MAX_FAILOVERS times. As such a request never
+// reached the instance it fails over whatever its method, without a retry
+// policy and outside the retry budget. Streamed bodies fail over as long
+// as none of them was sent.
+type Failover struct {
+	maxFailovers int
+
+	failovers *prometheus.CounterVec
+}
+
+// NewFailover returns nil when PROXY_MAX_FAILOVERS is 0
+func NewFailover() *Failover {
+	maxFailovers := getEnvInt("PROXY_MAX_FAILOVERS", 2)
+	if maxFailovers <= 0 {
+		return nil
+	}
+
+	f := &Failover{
+		maxFailovers: maxFailovers,
+		failovers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_failovers_total",
+			Help: "Proxied requests moved on to another instance after failing to connect",
+		}, []string{"namespace"}),
+	}
+	prometheus.MustRegister(f.failovers)
+	return f
+}
+
+// isConnectError reports whether a proxy error happened connecting to the
+// instance, before anything of the request was sent
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// allows reports whether a request that failed with err, after failing
+// over failovers times, fails over again
+func (f *Failover) allows(err error, failovers int, body *unsentBody) bool {
+	return f != nil && failovers < f.maxFailovers && isConnectError(err) && (body == nil || !body.sent.Load())
+}
+
+// unsentBody keeps a streamed request body open for another instance as
+// long as nothing of it has been read; the transport closes bodies when
+// connecting fails
+type unsentBody struct {
+	io.ReadCloser
+	sent atomic.Bool
+}
+
+func (b *unsentBody) Read(p []byte) (int, error) {
+	b.sent.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *unsentBody) Close() error {
+	if !b.sent.Load() {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
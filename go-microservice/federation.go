@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Federation shares local registrations with gateways in other datacenters.
+// Every gateway serves its own instances on /api/federation/catalog and
+// periodically pulls the catalogs of its peers. Remote instances are merged
+// into the registry with their Origin set, but they live in a separate load
+// balancer that is only consulted when the local pool is empty.
+type Federation struct {
+	gateway    *APIGateway
+	datacenter string
+	peers      []string
+	interval   time.Duration
+	client     *http.Client
+	remote     *LoadBalancer
+	logger     *zap.Logger
+
+	known map[string]map[string]*ServiceInstance // peer -> remote ID -> instance
+	mutex sync.Mutex
+}
+
+// FederationCatalog is the payload exchanged between federated gateways
+type FederationCatalog struct {
+	Datacenter string             `json:"datacenter"`
+	Services   []*ServiceInstance `json:"services"`
+}
+
+// NewFederation reads FEDERATION_DATACENTER and FEDERATION_PEERS. It returns
+// nil when federation is not configured.
+func NewFederation(gateway *APIGateway, logger *zap.Logger) *Federation {
+	datacenter := getEnv("FEDERATION_DATACENTER", "")
+	if datacenter == "" {
+		return nil
+	}
+
+	return &Federation{
+		gateway:    gateway,
+		datacenter: datacenter,
+		peers:      getEnvList("FEDERATION_PEERS", nil),
+		interval:   getEnvDuration("FEDERATION_INTERVAL", 10*time.Second),
+		client:     &http.Client{Timeout: 5 * time.Second},
+		remote:     NewLoadBalancer(),
+		logger:     logger,
+		known:      make(map[string]map[string]*ServiceInstance),
+	}
+}
+
+// Run pulls every peer's catalog on each interval
+func (f *Federation) Run(ctx context.Context) {
+	f.logger.Info("Registry federation enabled",
+		zap.String("datacenter", f.datacenter),
+		zap.Strings("peers", f.peers))
+
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		for _, peer := range f.peers {
+			if err := f.pull(ctx, peer); err != nil {
+				f.logger.Warn("Federation pull failed",
+					zap.String("peer", peer),
+					zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *Federation) pull(ctx context.Context, peer string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(peer, "/")+"/api/federation/catalog", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+
+	var catalog FederationCatalog
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return fmt.Errorf("decode catalog: %w", err)
+	}
+	if catalog.Datacenter == f.datacenter {
+		return fmt.Errorf("peer reports our own datacenter %q", f.datacenter)
+	}
+
+	f.merge(peer, &catalog)
+	return nil
+}
+
+// merge adds new remote instances and drops the ones the peer no longer has
+func (f *Federation) merge(peer string, catalog *FederationCatalog) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	known := f.known[peer]
+	current := make(map[string]*ServiceInstance, len(catalog.Services))
+
+	for _, service := range catalog.Services {
+		service.ID = catalog.Datacenter + ":" + service.ID
+		service.Origin = catalog.Datacenter
+
+		if existing, exists := known[service.ID]; exists {
+			current[service.ID] = existing
+			continue
+		}
+		if f.gateway.registry.AddLocal(service) {
+			f.remote.AddService(service.poolName(), service)
+		}
+		current[service.ID] = service
+	}
+
+	for id, service := range known {
+		if _, exists := current[id]; !exists {
+			f.gateway.registry.RemoveLocal(id)
+			f.remote.RemoveService(service.poolName(), id)
+		}
+	}
+
+	f.known[peer] = current
+}
+
+// GetNextService picks a remote instance for a service with no local pool
+func (f *Federation) GetNextService(serviceName, version string) *ServiceInstance {
+	return f.remote.GetNextServiceVersion(serviceName, version)
+}
+
+// catalogHandler serves this gateway's own instances to its peers
+func (f *Federation) catalogHandler(w http.ResponseWriter, r *http.Request) {
+	catalog := FederationCatalog{
+		Datacenter: f.datacenter,
+		Services:   make([]*ServiceInstance, 0),
+	}
+
+	for _, service := range f.gateway.registry.GetServices() {
+		// Only gossip local instances so catalogs don't bounce between peers
+		if service.Origin != "" {
+			continue
+		}
+		instance := *service
+		catalog.Services = append(catalog.Services, &instance)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(catalog)
+}
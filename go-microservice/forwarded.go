@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// ForwardedHeaders tells upstreams who the client is. X-Forwarded-For,
+// X-Forwarded-Proto, X-Forwarded-Host and X-Real-IP sent by the peer are
+// only kept when it is one of the TRUSTED_PROXIES (IPs or CIDRs, e.g. the
+// load balancer in front of the gateway); from anyone else they are
+// replaced, so clients can't spoof their address. Requests and responses
+// also get a Via entry naming the gateway (GATEWAY_VIA_NAME), and the
+// X-Client-Cert-* headers describe the certificate a client authenticated
+// with on a TLS listener, which are likewise only passed on from trusted
+// proxies.
+type ForwardedHeaders struct {
+	trusted []*net.IPNet
+	via     string
+}
+
+func NewForwardedHeaders() (*ForwardedHeaders, error) {
+	fh := &ForwardedHeaders{via: getEnv("GATEWAY_VIA_NAME", "api-gateway")}
+	for _, entry := range getEnvList("TRUSTED_PROXIES", nil) {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+		}
+		fh.trusted = append(fh.trusted, network)
+	}
+	return fh, nil
+}
+
+func (fh *ForwardedHeaders) isTrusted(address string) bool {
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return false
+	}
+	for _, network := range fh.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of the connection a request came in on
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientIP returns the address of the client behind any trusted proxies:
+// the right-most X-Forwarded-For entry that isn't a trusted proxy
+func (fh *ForwardedHeaders) ClientIP(r *http.Request) string {
+	client := peerIP(r)
+	if !fh.isTrusted(client) {
+		return client
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		client = hop
+		if !fh.isTrusted(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// apply sets the forwarding headers of an outbound proxy request.
+// ReverseProxy has already dropped the inbound X-Forwarded-* headers from
+// pr.Out; they are read from pr.In.
+func (fh *ForwardedHeaders) apply(pr *httputil.ProxyRequest) {
+	in, out := pr.In, pr.Out
+	peer := peerIP(in)
+	trusted := fh.isTrusted(peer)
+
+	forwardedFor := peer
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	host := in.Host
+	if trusted {
+		if prior := strings.Join(in.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+			forwardedFor = prior + ", " + peer
+		}
+		if value := in.Header.Get("X-Forwarded-Proto"); value != "" {
+			proto = value
+		}
+		if value := in.Header.Get("X-Forwarded-Host"); value != "" {
+			host = value
+		}
+	}
+
+	out.Header.Set("X-Forwarded-For", forwardedFor)
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", host)
+	out.Header.Set("X-Real-IP", fh.ClientIP(in))
+	out.Header.Add("Via", fh.viaEntry(in.ProtoMajor, in.ProtoMinor))
+
+	identity := clientCertIdentity(in)
+	for i, name := range clientCertHeaders {
+		switch {
+		case identity != nil:
+			out.Header.Set(name, identity[i])
+		case !trusted:
+			out.Header.Del(name)
+		}
+	}
+}
+
+// applyResponse adds the gateway to the Via header of an upstream response
+func (fh *ForwardedHeaders) applyResponse(resp *http.Response) {
+	resp.Header.Add("Via", fh.viaEntry(resp.ProtoMajor, resp.ProtoMinor))
+}
+
+// viaEntry is the gateway's Via entry for a message of an HTTP version,
+// e.g. "1.1 api-gateway"
+func (fh *ForwardedHeaders) viaEntry(major, minor int) string {
+	version := strconv.Itoa(major)
+	if major < 2 {
+		version += "." + strconv.Itoa(minor)
+	}
+	return version + " " + fh.via
+}
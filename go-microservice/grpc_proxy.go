@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// GRPCRoutes map gRPC methods to the services implementing them, from
+// GRPC_ROUTES_FILE. Keys are prefixes of the :path of a call, so a route
+// can cover a whole gRPC service or a single method, and the longest match
+// wins. Targets are service names, qualified by namespace outside the
+// default one:
+//
+//	{"/shop.Orders/": "orders", "/shop.Orders/Export": "orders-batch", "/shop.Search/": "team-a/search"}
+//
+// gRPC clients use the gateway as their target directly; calls reach the
+// backend over cleartext HTTP/2 with their path, headers and trailers
+// intact.
+type GRPCRoutes struct {
+	prefixes []string // longest first
+	targets  map[string]string
+}
+
+// NewGRPCRoutes returns nil when GRPC_ROUTES_FILE is unset
+func NewGRPCRoutes(logger *zap.Logger) (*GRPCRoutes, error) {
+	file := getEnv("GRPC_ROUTES_FILE", "")
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read gRPC routes: %w", err)
+	}
+
+	gr := &GRPCRoutes{}
+	if err := json.Unmarshal(data, &gr.targets); err != nil {
+		return nil, fmt.Errorf("decode gRPC routes: %w", err)
+	}
+	for prefix, target := range gr.targets {
+		if !strings.HasPrefix(prefix, "/") || target == "" {
+			return nil, fmt.Errorf("invalid gRPC route %q -> %q", prefix, target)
+		}
+		if namespace, _, qualified := strings.Cut(target, "/"); qualified && !namespacePattern.MatchString(namespace) {
+			return nil, fmt.Errorf("gRPC route %q: invalid namespace %q", prefix, namespace)
+		}
+		gr.prefixes = append(gr.prefixes, prefix)
+	}
+	sort.Slice(gr.prefixes, func(i, j int) bool { return len(gr.prefixes[i]) > len(gr.prefixes[j]) })
+
+	logger.Info("gRPC routes loaded",
+		zap.String("file", file),
+		zap.Int("routes", len(gr.prefixes)))
+	return gr, nil
+}
+
+// isGRPC reports whether a request is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// resolve returns the namespace and service a call's path is routed to
+func (gr *GRPCRoutes) resolve(path string) (namespace, service string, ok bool) {
+	for _, prefix := range gr.prefixes {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		target := gr.targets[prefix]
+		if namespace, service, qualified := strings.Cut(target, "/"); qualified {
+			return namespace, service, true
+		}
+		return defaultNamespace, target, true
+	}
+	return "", "", false
+}
+
+// grpcHandler proxies gRPC calls to the service their method is routed to.
+// Calls without a route fail with gRPC status UNIMPLEMENTED.
+func (gw *APIGateway) grpcHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	namespace, requested, ok := gw.grpcRoutes.resolve(r.URL.Path)
+	if !ok {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "12") // UNIMPLEMENTED
+		w.Header().Set("Grpc-Message", "no route for "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	gw.metrics.requestsTotal.WithLabelValues(namespace).Inc()
+
+	serviceName := gw.aliases.Resolve(namespace, requested)
+	gw.route(w, r, &proxyTarget{
+		namespace:   namespace,
+		serviceName: serviceName,
+		poolName:    qualifiedName(namespace, serviceName),
+		path:        r.URL.Path,
+		h2c:         true,
+	})
+
+	gw.metrics.requestDuration.WithLabelValues(namespace).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// GRPCTranscoder lets HTTP/JSON clients such as browsers call unary gRPC
+// methods. The methods come from GRPC_TRANSCODING_DESCRIPTORS, a descriptor
+// set built with
+//
+//	protoc --include_imports --descriptor_set_out=api.pb ...
+//
+// and are bound to HTTP by their google.api.http annotations, as with
+// grpc-gateway, e.g. GET /v1/orders/{id}. Methods without one are bound to
+// POST /{package.Service}/{Method} with the request message as the body.
+// Calls are routed to the service GRPC_ROUTES_FILE names for the method,
+// and gRPC errors come back as {"code": ..., "message": ...} with the
+// matching HTTP status.
+type GRPCTranscoder struct {
+	bindings []*httpBinding
+}
+
+// httpBinding binds a gRPC method to an HTTP method and path template
+type httpBinding struct {
+	httpMethod   string
+	segments     []templateSegment
+	verb         string // custom verb after ":", e.g. "cancel"
+	body         string // request field the body fills, "*" for all of it
+	responseBody string // response field returned instead of the whole message
+	method       protoreflect.MethodDescriptor
+	grpcPath     string
+}
+
+// templateSegment is one path segment of a binding. Variables spanning
+// several segments have each of them carry the variable's field.
+type templateSegment struct {
+	literal string // empty for wildcards
+	rest    bool   // "**", matching all remaining segments
+	field   string // field path the segment is bound to, if any
+}
+
+// NewGRPCTranscoder returns nil when GRPC_TRANSCODING_DESCRIPTORS is unset
+func NewGRPCTranscoder(logger *zap.Logger) (*GRPCTranscoder, error) {
+	file := getEnv("GRPC_TRANSCODING_DESCRIPTORS", "")
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read gRPC descriptors: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("decode gRPC descriptors: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("load gRPC descriptors: %w", err)
+	}
+
+	gt := &GRPCTranscoder{}
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		services := fd.Services()
+		for i := 0; i < services.Len() && err == nil; i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len() && err == nil; j++ {
+				err = gt.bind(methods.Get(j))
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("gRPC transcoding loaded",
+		zap.String("file", file),
+		zap.Int("bindings", len(gt.bindings)))
+	return gt, nil
+}
+
+// bind adds the bindings of a unary method
+func (gt *GRPCTranscoder) bind(method protoreflect.MethodDescriptor) error {
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil
+	}
+	grpcPath := fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name())
+
+	rule, _ := proto.GetExtension(method.Options(), annotations.E_Http).(*annotations.HttpRule)
+	if rule == nil {
+		rule = &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: grpcPath}, Body: "*"}
+	}
+	for _, rule := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+		binding := &httpBinding{body: rule.GetBody(), responseBody: rule.GetResponseBody(), method: method, grpcPath: grpcPath}
+		var template string
+		switch pattern := rule.GetPattern().(type) {
+		case *annotations.HttpRule_Get:
+			binding.httpMethod, template = http.MethodGet, pattern.Get
+		case *annotations.HttpRule_Put:
+			binding.httpMethod, template = http.MethodPut, pattern.Put
+		case *annotations.HttpRule_Post:
+			binding.httpMethod, template = http.MethodPost, pattern.Post
+		case *annotations.HttpRule_Delete:
+			binding.httpMethod, template = http.MethodDelete, pattern.Delete
+		case *annotations.HttpRule_Patch:
+			binding.httpMethod, template = http.MethodPatch, pattern.Patch
+		case *annotations.HttpRule_Custom:
+			binding.httpMethod, template = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+		default:
+			continue
+		}
+		if err := binding.parseTemplate(template); err != nil {
+			return fmt.Errorf("%s: %w", grpcPath, err)
+		}
+		gt.bindings = append(gt.bindings, binding)
+	}
+	return nil
+}
+
+// parseTemplate parses a google.api.http path template such as
+// /v1/{name=shelves/*/books/*}:publish
+func (b *httpBinding) parseTemplate(template string) error {
+	if !strings.HasPrefix(template, "/") {
+		return fmt.Errorf("path template %q must start with /", template)
+	}
+	path := template[1:]
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") && i > strings.LastIndex(path, "}") {
+		path, b.verb = path[:i], path[i+1:]
+	}
+
+	for path != "" {
+		var segment string
+		if strings.HasPrefix(path, "{") {
+			end := strings.Index(path, "}")
+			if end < 0 {
+				return fmt.Errorf("path template %q has an unclosed variable", template)
+			}
+			field, pattern, found := strings.Cut(path[1:end], "=")
+			if !found {
+				pattern = "*"
+			}
+			for _, part := range strings.Split(pattern, "/") {
+				b.segments = append(b.segments, newTemplateSegment(part, field))
+			}
+			segment, path = path[:end+1], path[end+1:]
+		} else {
+			segment, path, _ = strings.Cut(path, "/")
+			b.segments = append(b.segments, newTemplateSegment(segment, ""))
+			continue
+		}
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path template %q: %s must end a segment", template, segment)
+		}
+		path = strings.TrimPrefix(path, "/")
+	}
+
+	for i, segment := range b.segments {
+		if segment.rest && i != len(b.segments)-1 {
+			return fmt.Errorf("path template %q: ** must come last", template)
+		}
+	}
+	return nil
+}
+
+func newTemplateSegment(part, field string) templateSegment {
+	switch part {
+	case "*":
+		return templateSegment{field: field}
+	case "**":
+		return templateSegment{rest: true, field: field}
+	default:
+		return templateSegment{literal: part, field: field}
+	}
+}
+
+// match returns the variables of a path if it matches the binding
+func (b *httpBinding) match(method, path string) (map[string]string, bool) {
+	if method != b.httpMethod {
+		return nil, false
+	}
+	path = strings.TrimPrefix(path, "/")
+	if b.verb != "" {
+		var found bool
+		if path, found = strings.CutSuffix(path, ":"+b.verb); !found {
+			return nil, false
+		}
+	}
+	parts := strings.Split(path, "/")
+
+	variables := make(map[string]string)
+	for i, segment := range b.segments {
+		if segment.rest {
+			if segment.field != "" {
+				variables[segment.field] = joinVariable(variables[segment.field], strings.Join(parts[i:], "/"))
+			}
+			return variables, true
+		}
+		if i >= len(parts) || parts[i] == "" || (segment.literal != "" && parts[i] != segment.literal) {
+			return nil, false
+		}
+		if segment.field != "" {
+			variables[segment.field] = joinVariable(variables[segment.field], parts[i])
+		}
+	}
+	return variables, len(parts) == len(b.segments)
+}
+
+func joinVariable(value, part string) string {
+	if value == "" {
+		return part
+	}
+	return value + "/" + part
+}
+
+// match returns the binding of a request, nil when none matches
+func (gt *GRPCTranscoder) match(r *http.Request) (*httpBinding, map[string]string) {
+	for _, binding := range gt.bindings {
+		if variables, ok := binding.match(r.Method, r.URL.Path); ok {
+			return binding, variables
+		}
+	}
+	return nil, nil
+}
+
+// request builds the request message of a call from the HTTP request
+func (b *httpBinding) request(r *http.Request, variables map[string]string) (proto.Message, error) {
+	message := dynamicpb.NewMessage(b.method.Input())
+
+	switch b.body {
+	case "":
+	case "*":
+		if err := unmarshalBody(r.Body, message); err != nil {
+			return nil, err
+		}
+	default:
+		field := message.Descriptor().Fields().ByName(protoreflect.Name(b.body))
+		if field == nil || field.Kind() != protoreflect.MessageKind || field.IsList() || field.IsMap() {
+			return nil, fmt.Errorf("unsupported body field %q", b.body)
+		}
+		if err := unmarshalBody(r.Body, message.Mutable(field).Message().Interface()); err != nil {
+			return nil, err
+		}
+	}
+
+	for path, value := range variables {
+		if err := setField(message, path, []string{value}); err != nil {
+			return nil, err
+		}
+	}
+	// Query parameters fill the fields neither the body nor the path do
+	if b.body != "*" {
+		for path, values := range r.URL.Query() {
+			if _, bound := variables[path]; bound {
+				continue
+			}
+			if err := setField(message, path, values); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return message, nil
+}
+
+func unmarshalBody(body io.Reader, message proto.Message) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if err := protojson.Unmarshal(data, message); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// setField sets the scalar field at a dotted path of a message from its
+// text form; repeated fields take all values
+func setField(message protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		field := message.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if field == nil || field.Kind() != protoreflect.MessageKind || field.IsList() || field.IsMap() {
+			return fmt.Errorf("unknown field %q", path)
+		}
+		message = message.Mutable(field).Message()
+	}
+	field := message.Descriptor().Fields().ByName(protoreflect.Name(names[len(names)-1]))
+	if field == nil || field.IsMap() || field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind {
+		return fmt.Errorf("unknown field %q", path)
+	}
+
+	if !field.IsList() {
+		values = values[len(values)-1:]
+	}
+	for _, text := range values {
+		value, err := parseScalar(field, text)
+		if err != nil {
+			return fmt.Errorf("field %q: %w", path, err)
+		}
+		if field.IsList() {
+			message.Mutable(field).List().Append(value)
+		} else {
+			message.Set(field, value)
+		}
+	}
+	return nil
+}
+
+func parseScalar(field protoreflect.FieldDescriptor, text string) (protoreflect.Value, error) {
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(text), nil
+	case protoreflect.BoolKind:
+		value, err := strconv.ParseBool(text)
+		return protoreflect.ValueOfBool(value), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		value, err := strconv.ParseInt(text, 10, 32)
+		return protoreflect.ValueOfInt32(int32(value)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		value, err := strconv.ParseInt(text, 10, 64)
+		return protoreflect.ValueOfInt64(value), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		value, err := strconv.ParseUint(text, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(value)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		value, err := strconv.ParseUint(text, 10, 64)
+		return protoreflect.ValueOfUint64(value), err
+	case protoreflect.FloatKind:
+		value, err := strconv.ParseFloat(text, 32)
+		return protoreflect.ValueOfFloat32(float32(value)), err
+	case protoreflect.DoubleKind:
+		value, err := strconv.ParseFloat(text, 64)
+		return protoreflect.ValueOfFloat64(value), err
+	case protoreflect.BytesKind:
+		value, err := base64.URLEncoding.DecodeString(text)
+		if err != nil {
+			value, err = base64.StdEncoding.DecodeString(text)
+		}
+		return protoreflect.ValueOfBytes(value), err
+	case protoreflect.EnumKind:
+		if enum := field.Enum().Values().ByName(protoreflect.Name(text)); enum != nil {
+			return protoreflect.ValueOfEnum(enum.Number()), nil
+		}
+		value, err := strconv.ParseInt(text, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(value)), err
+	}
+	return protoreflect.Value{}, errors.New("unsupported field type")
+}
+
+// grpcHTTPStatus maps gRPC status codes to HTTP statuses as grpc-gateway
+// does
+var grpcHTTPStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// writeGRPCError answers a transcoded call with a gRPC status
+func writeGRPCError(w http.ResponseWriter, code codes.Code, message string) {
+	status, known := grpcHTTPStatus[code]
+	if !known {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message})
+}
+
+// grpcRecorder holds the gRPC response of a transcoded call
+type grpcRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *grpcRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *grpcRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *grpcRecorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
+
+func (rec *grpcRecorder) Flush() {}
+
+// metadata returns a header or trailer of the response
+func (rec *grpcRecorder) metadata(key string) string {
+	if value := rec.header.Get(key); value != "" {
+		return value
+	}
+	return rec.header.Get(http.TrailerPrefix + key)
+}
+
+// transcodeHandler calls a gRPC method for an HTTP/JSON request
+func (gw *APIGateway) transcodeHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	binding, variables := gw.transcoder.match(r)
+	if binding == nil {
+		http.NotFound(w, r)
+		return
+	}
+	namespace, requested, ok := gw.grpcRoutes.resolve(binding.grpcPath)
+	if !ok {
+		writeGRPCError(w, codes.Unimplemented, "no route for "+binding.grpcPath)
+		return
+	}
+	gw.metrics.requestsTotal.WithLabelValues(namespace).Inc()
+	defer func() {
+		gw.metrics.requestDuration.WithLabelValues(namespace).Observe(time.Since(start).Seconds())
+	}()
+
+	message, err := binding.request(r, variables)
+	if err != nil {
+		writeGRPCError(w, codes.InvalidArgument, err.Error())
+		return
+	}
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		writeGRPCError(w, codes.InvalidArgument, err.Error())
+		return
+	}
+	// A length-prefixed message, uncompressed
+	frame := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	call := r.Clone(r.Context())
+	call.Method = http.MethodPost
+	call.URL.Path, call.URL.RawPath, call.URL.RawQuery = binding.grpcPath, "", ""
+	call.Body = io.NopCloser(bytes.NewReader(frame))
+	call.ContentLength = int64(len(frame))
+	call.Header.Del("Content-Length")
+	call.Header.Del("Accept-Encoding")
+	call.Header.Set("Content-Type", "application/grpc")
+	call.Header.Set("Te", "trailers")
+
+	serviceName := gw.aliases.Resolve(namespace, requested)
+	rec := &grpcRecorder{header: make(http.Header)}
+	gw.route(rec, call, &proxyTarget{
+		namespace:   namespace,
+		serviceName: serviceName,
+		poolName:    qualifiedName(namespace, serviceName),
+		path:        binding.grpcPath,
+		h2c:         true,
+	})
+
+	// Failures before the call reached the service come back as they are
+	grpcStatus := rec.metadata("Grpc-Status")
+	if grpcStatus == "" && rec.status != 0 {
+		w.Header().Set("Content-Type", rec.header.Get("Content-Type"))
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+		return
+	}
+	if code, err := strconv.Atoi(grpcStatus); err != nil {
+		writeGRPCError(w, codes.Unknown, "invalid gRPC status")
+		return
+	} else if code != int(codes.OK) {
+		writeGRPCError(w, codes.Code(code), rec.metadata("Grpc-Message"))
+		return
+	}
+
+	data := rec.body.Bytes()
+	if len(data) < 5 || data[0] != 0 || int(binary.BigEndian.Uint32(data[1:5])) > len(data)-5 {
+		writeGRPCError(w, codes.Internal, "malformed gRPC response")
+		return
+	}
+	response := dynamicpb.NewMessage(binding.method.Output())
+	if err := proto.Unmarshal(data[5:5+binary.BigEndian.Uint32(data[1:5])], response); err != nil {
+		writeGRPCError(w, codes.Internal, "malformed gRPC response")
+		return
+	}
+	var out proto.Message = response
+	if binding.responseBody != "" {
+		if field := response.Descriptor().Fields().ByName(protoreflect.Name(binding.responseBody)); field != nil && field.Kind() == protoreflect.MessageKind && !field.IsList() && !field.IsMap() {
+			out = response.Get(field).Message().Interface()
+		}
+	}
+	encoded, err := protojson.Marshal(out)
+	if err != nil {
+		writeGRPCError(w, codes.Internal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
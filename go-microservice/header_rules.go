@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// HeaderRules change the headers of a service's proxied requests on the
+// way upstream and of its responses on the way back, e.g. to inject an
+// internal auth header or strip Server
+type HeaderRules struct {
+	Request  *HeaderActions `json:"request,omitempty"`
+	Response *HeaderActions `json:"response,omitempty"`
+}
+
+// HeaderActions are applied in field order: Remove, Rewrite, Set, Add
+type HeaderActions struct {
+	Remove  []string          `json:"remove,omitempty"`
+	Rewrite []*HeaderRewrite  `json:"rewrite,omitempty"`
+	Set     map[string]string `json:"set,omitempty"`
+	Add     map[string]string `json:"add,omitempty"`
+}
+
+// HeaderRewrite replaces the matches of a regular expression in every
+// value of a header, with $1 style references to capture groups
+type HeaderRewrite struct {
+	Name    string `json:"name"`
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+
+	pattern *regexp.Regexp
+}
+
+func (hr *HeaderRules) validate() error {
+	for _, actions := range []*HeaderActions{hr.Request, hr.Response} {
+		if actions == nil {
+			continue
+		}
+		names := append([]string{}, actions.Remove...)
+		for name := range actions.Set {
+			names = append(names, name)
+		}
+		for name := range actions.Add {
+			names = append(names, name)
+		}
+		for _, rewrite := range actions.Rewrite {
+			pattern, err := regexp.Compile(rewrite.Match)
+			if err != nil {
+				return fmt.Errorf("header rewrite %q: %w", rewrite.Match, err)
+			}
+			rewrite.pattern = pattern
+			names = append(names, rewrite.Name)
+		}
+		for _, name := range names {
+			// Go keeps Host outside the header map, so rules can't reach it
+			if name == "" || http.CanonicalHeaderKey(name) == "Host" {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (ha *HeaderActions) apply(header http.Header) {
+	if ha == nil {
+		return
+	}
+	for _, name := range ha.Remove {
+		header.Del(name)
+	}
+	for _, rewrite := range ha.Rewrite {
+		values := header.Values(rewrite.Name)
+		for i, value := range values {
+			values[i] = rewrite.pattern.ReplaceAllString(value, rewrite.Replace)
+		}
+	}
+	for name, value := range ha.Set {
+		header.Set(name, value)
+	}
+	for name, value := range ha.Add {
+		header.Add(name, value)
+	}
+}
+
+// headerRules returns the header rules of a pool, nil when it has none
+func (rt *RouteTable) headerRules(poolName string) *HeaderRules {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Headers
+	}
+	return nil
+}
+
+// setHeaderRules replaces the header rules of a pool; nil removes them.
+// Routes are copied rather than changed, as requests in flight may hold
+// the current one.
+func (rt *RouteTable) setHeaderRules(poolName string, rules *HeaderRules) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	route := &RouteConfig{}
+	if existing := rt.routes[poolName]; existing != nil {
+		copied := *existing
+		route = &copied
+	}
+	route.Headers = rules
+	rt.routes[poolName] = route
+}
+
+// getHeaderRulesHandler needs the same rights as changing the rules, as
+// they may hold credentials injected upstream
+func (gw *APIGateway) getHeaderRulesHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	rules := gw.routes.headerRules(qualifiedName(namespace, service))
+	if rules == nil {
+		rules = &HeaderRules{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (gw *APIGateway) putHeaderRulesHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	var rules HeaderRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := rules.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gw.routes.setHeaderRules(qualifiedName(namespace, service), &rules)
+	gw.logger.Info("Header rules updated",
+		zap.String("namespace", namespace),
+		zap.String("service", service))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (gw *APIGateway) deleteHeaderRulesHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	gw.routes.setHeaderRules(qualifiedName(namespace, service), nil)
+	gw.logger.Info("Header rules removed",
+		zap.String("namespace", namespace),
+		zap.String("service", service))
+	w.WriteHeader(http.StatusNoContent)
+}
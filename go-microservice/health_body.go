@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxHealthCheckBody bounds how much of a check response is validated
+const maxHealthCheckBody = 64 * 1024
+
+// HealthCheckBody validates the body of http check responses, so backends
+// answering 200 with {"status": "degraded"} count as unhealthy. Both
+// expectations must hold when both are set.
+type HealthCheckBody struct {
+	JSONPath string `json:"json_path,omitempty"` // e.g. $.status or $.checks[0].state
+	Equals   string `json:"equals,omitempty"`    // expected value at JSONPath
+	Regex    string `json:"regex,omitempty"`     // must match somewhere in the body
+}
+
+func (b *HealthCheckBody) validate() error {
+	if b.JSONPath == "" && b.Regex == "" {
+		return errors.New("health check body needs json_path or regex")
+	}
+	if b.JSONPath != "" {
+		if _, err := parseJSONPath(b.JSONPath); err != nil {
+			return err
+		}
+	}
+	if b.Regex != "" {
+		if _, err := regexp.Compile(b.Regex); err != nil {
+			return fmt.Errorf("invalid health check regex: %w", err)
+		}
+	}
+	return nil
+}
+
+// check reports why body doesn't meet the expectations, if it doesn't
+func (b *HealthCheckBody) check(body []byte) error {
+	if b.Regex != "" {
+		pattern, err := regexp.Compile(b.Regex)
+		if err != nil {
+			return err
+		}
+		if !pattern.Match(body) {
+			return fmt.Errorf("health check body does not match %q", b.Regex)
+		}
+	}
+
+	if b.JSONPath != "" {
+		path, err := parseJSONPath(b.JSONPath)
+		if err != nil {
+			return err
+		}
+		var document interface{}
+		if err := json.Unmarshal(body, &document); err != nil {
+			return fmt.Errorf("health check body is not JSON: %w", err)
+		}
+		value, found := lookupJSONPath(document, path)
+		if !found {
+			return fmt.Errorf("health check body has no %s", b.JSONPath)
+		}
+		if actual := jsonValueString(value); actual != b.Equals {
+			return fmt.Errorf("health check body %s is %q, expected %q", b.JSONPath, actual, b.Equals)
+		}
+	}
+	return nil
+}
+
+// parseJSONPath parses the dotted subset of JSONPath used by health
+// checks: $.field.nested[2].field. Segments are object keys (string) or
+// array indexes (int).
+func parseJSONPath(path string) ([]interface{}, error) {
+	if path != "$" && !strings.HasPrefix(path, "$.") && !strings.HasPrefix(path, "$[") {
+		return nil, fmt.Errorf("json_path %q must start with $", path)
+	}
+
+	segments := make([]interface{}, 0)
+	for _, part := range strings.Split(strings.TrimPrefix(path, "$"), ".") {
+		if part == "" {
+			continue
+		}
+		key := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key = part[:i]
+		}
+		if key != "" {
+			segments = append(segments, key)
+		}
+
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid json_path %q", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index in json_path %q", path)
+			}
+			segments = append(segments, index)
+			rest = rest[end+1:]
+		}
+	}
+	return segments, nil
+}
+
+func lookupJSONPath(document interface{}, path []interface{}) (interface{}, bool) {
+	value := document
+	for _, segment := range path {
+		switch segment := segment.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = object[segment]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || segment >= len(array) {
+				return nil, false
+			}
+			value = array[segment]
+		}
+	}
+	return value, true
+}
+
+// jsonValueString formats a decoded JSON value for comparison with Equals
+func jsonValueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "null"
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthCheckTimeout bounds a single probe
+const healthCheckTimeout = 5 * time.Second
+
+// HealthChecker probes one instance. Services pick a checker with the
+// health_check type or the "health_check" metadata key: http (default),
+// tcp, grpc or exec.
+type HealthChecker interface {
+	Check(ctx context.Context, service *ServiceInstance) error
+}
+
+var healthCheckers = map[string]HealthChecker{
+	"http": &httpHealthChecker{transports: make(map[string]*http.Transport)},
+	"tcp":  tcpHealthChecker{},
+	"grpc": grpcHealthChecker{},
+	"exec": execHealthChecker{},
+}
+
+// metadataString returns a string metadata value, or "" when it is unset or
+// not a string
+func metadataString(service *ServiceInstance, key string) string {
+	value, _ := service.Metadata[key].(string)
+	return value
+}
+
+func serviceHostPort(service *ServiceInstance) string {
+	return net.JoinHostPort(service.Address, strconv.Itoa(service.Port))
+}
+
+// probeService performs a single health check against an instance with the
+// checker and timeout from its health check configuration
+func probeService(service *ServiceInstance) error {
+	kind := healthCheckType(service)
+	checker, ok := healthCheckers[kind]
+	if !ok {
+		return fmt.Errorf("unknown health check type %q", kind)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeoutFor(service))
+	defer cancel()
+	return checker.Check(ctx, service)
+}
+
+// httpHealthChecker expects 200 from GET /health unless the instance
+// configures another path or status codes. Checks carry the instance's
+// headers and credentials and optionally validate the response body.
+// Instances with the same TLS settings share a transport so connections
+// are reused between checks.
+type httpHealthChecker struct {
+	transports map[string]*http.Transport // keyed by TLS settings
+	mutex      sync.Mutex
+}
+
+func (c *httpHealthChecker) Check(ctx context.Context, service *ServiceInstance) error {
+	check := service.HealthCheck
+	scheme := "http"
+	if check != nil && check.Scheme != "" {
+		scheme = check.Scheme
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+serviceHostPort(service)+healthCheckPath(service), nil)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		for name, value := range check.Headers {
+			req.Header.Set(name, value)
+		}
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+		}
+		if check.Host != "" {
+			req.Host = check.Host
+		}
+		if check.Auth != nil {
+			if err := check.Auth.apply(req, service); err != nil {
+				return err
+			}
+		}
+	}
+
+	transport, err := c.transport(check)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !expectedHealthStatus(service, resp.StatusCode) {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+
+	if check != nil && check.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+		if err != nil {
+			return err
+		}
+		return check.Body.check(body)
+	}
+	return nil
+}
+
+// transport returns the transport for an instance's TLS settings
+func (c *httpHealthChecker) transport(check *HealthCheckConfig) (*http.Transport, error) {
+	var settings HealthCheckTLS
+	if check != nil && check.TLS != nil {
+		settings = *check.TLS
+	}
+	key := fmt.Sprintf("%x|%s|%t", sha256.Sum256([]byte(settings.CACert)), settings.ServerName, settings.SkipVerify)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if transport, exists := c.transports[key]; exists {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.SkipVerify,
+	}
+	if settings.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(settings.CACert)) {
+			return nil, errors.New("health check ca_cert contains no PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.transports[key] = transport
+	return transport, nil
+}
+
+// tcpHealthChecker only checks that the port accepts connections, for
+// services that don't speak HTTP
+type tcpHealthChecker struct{}
+
+func (tcpHealthChecker) Check(ctx context.Context, service *ServiceInstance) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", serviceHostPort(service))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcHealthChecker uses the standard grpc.health.v1 protocol. The
+// "health_check_grpc_service" metadata key selects the service to ask
+// about; empty asks about the server as a whole.
+type grpcHealthChecker struct{}
+
+func (grpcHealthChecker) Check(ctx context.Context, service *ServiceInstance) error {
+	conn, err := grpc.NewClient(serviceHostPort(service), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: metadataString(service, "health_check_grpc_service"),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("grpc health status %s", resp.Status)
+	}
+	return nil
+}
+
+// execHealthChecker runs the script named by "health_check_script" with the
+// instance address and port as arguments; exit status 0 means healthy.
+// Scripts are only looked up in HEALTH_CHECK_SCRIPT_DIR so registrations
+// can't run arbitrary commands on the gateway.
+type execHealthChecker struct{}
+
+func (execHealthChecker) Check(ctx context.Context, service *ServiceInstance) error {
+	dir := getEnv("HEALTH_CHECK_SCRIPT_DIR", "")
+	if dir == "" {
+		return errors.New("exec health checks are disabled, HEALTH_CHECK_SCRIPT_DIR is not set")
+	}
+	script := metadataString(service, "health_check_script")
+	if script == "" {
+		return errors.New("exec health check without health_check_script")
+	}
+
+	cmd := exec.CommandContext(ctx, filepath.Join(dir, filepath.Base(script)), service.Address, strconv.Itoa(service.Port))
+	cmd.Env = []string{
+		"SERVICE_ID=" + service.ID,
+		"SERVICE_NAME=" + service.Name,
+		"SERVICE_ADDRESS=" + service.Address,
+		"SERVICE_PORT=" + strconv.Itoa(service.Port),
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if len(output) > 256 {
+			output = output[:256]
+		}
+		return fmt.Errorf("health check script %s failed: %w: %s", script, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckPath     = "/health"
+	minHealthCheckInterval     = time.Second
+
+	// healthCheckSecretPrefix limits which gateway environment variables
+	// registrations can send as credentials
+	healthCheckSecretPrefix = "HEALTH_CHECK_SECRET_"
+)
+
+// secretScopeName matches the namespaces and service names that map
+// one-to-one onto a secret scope
+var secretScopeName = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Duration is a time.Duration that reads and writes JSON as a Go duration
+// string such as "10s"; plain numbers are taken as seconds
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// HealthCheckConfig overrides how the gateway checks one instance. Zero
+// values fall back to the defaults: the checker named by the
+// "health_check" metadata key (or http), GET /health expecting 200, every
+// 30s with a 5s timeout.
+type HealthCheckConfig struct {
+	Type           string   `json:"type,omitempty"`   // http, tcp, grpc, exec
+	Scheme         string   `json:"scheme,omitempty"` // http (default) or https
+	Host           string   `json:"host,omitempty"`   // Host header override
+	Path           string   `json:"path,omitempty"`
+	Interval       Duration `json:"interval,omitempty"`
+	Timeout        Duration `json:"timeout,omitempty"`
+	ExpectedStatus []int    `json:"expected_status,omitempty"`
+
+	// Consecutive passes to become healthy and failures to become
+	// unhealthy; 0 uses HEALTH_CHECK_HEALTHY_THRESHOLD and
+	// HEALTH_CHECK_UNHEALTHY_THRESHOLD
+	HealthyThreshold   int `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"`
+
+	TLS *HealthCheckTLS `json:"tls,omitempty"`
+
+	// Headers are added to http checks; credentials go in Auth
+	Headers map[string]string `json:"headers,omitempty"`
+	Auth    *HealthCheckAuth  `json:"auth,omitempty"`
+
+	Body *HealthCheckBody `json:"body,omitempty"`
+}
+
+// HealthCheckTLS configures https health checks
+type HealthCheckTLS struct {
+	CACert     string `json:"ca_cert,omitempty"`     // PEM bundle to trust instead of the system roots
+	ServerName string `json:"server_name,omitempty"` // SNI and verified name, default the instance address
+	SkipVerify bool   `json:"skip_verify,omitempty"` // for development only
+}
+
+// HealthCheckAuth adds credentials to http checks. The secret itself never
+// enters the registry: SecretEnv names an environment variable on the
+// gateways holding the password or token, within the service's own scope
+// HEALTH_CHECK_SECRET_<NAMESPACE>__<SERVICE>__, e.g.
+// HEALTH_CHECK_SECRET_PAYMENTS__LEDGER_API__TOKEN for service ledger-api
+// of namespace payments.
+type HealthCheckAuth struct {
+	Type      string `json:"type"` // basic or bearer
+	Username  string `json:"username,omitempty"`
+	SecretEnv string `json:"secret_env"`
+}
+
+// healthCheckSecretScope returns the prefix of the secrets a service's
+// checks may send, so that a registration can't have another service's
+// secret sent to an address it controls. Names are upper-cased with
+// dashes as underscores; names that wouldn't map one-to-one, such as
+// upper-case ones, have no scope.
+func healthCheckSecretScope(namespace, name string) (string, error) {
+	if !secretScopeName.MatchString(namespace) || !secretScopeName.MatchString(name) {
+		return "", fmt.Errorf("health check secrets need a service name of lower-case letters, digits and single dashes, not %q", name)
+	}
+	scope := func(value string) string {
+		return strings.ToUpper(strings.ReplaceAll(value, "-", "_"))
+	}
+	return healthCheckSecretPrefix + scope(namespace) + "__" + scope(name) + "__", nil
+}
+
+// checkOwner checks that the secret is in the scope of the service
+func (a *HealthCheckAuth) checkOwner(namespace, name string) error {
+	scope, err := healthCheckSecretScope(namespace, name)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(a.SecretEnv, scope) || len(a.SecretEnv) == len(scope) {
+		return fmt.Errorf("health check secret_env must start with %s", scope)
+	}
+	return nil
+}
+
+// apply sets the Authorization header of a check request to the service.
+// The scope is checked again as instances also arrive from the backend.
+func (a *HealthCheckAuth) apply(req *http.Request, service *ServiceInstance) error {
+	if err := a.checkOwner(service.Namespace, service.Name); err != nil {
+		return err
+	}
+	secret := os.Getenv(a.SecretEnv)
+	if secret == "" {
+		return fmt.Errorf("health check secret %s is not set", a.SecretEnv)
+	}
+
+	switch a.Type {
+	case "basic":
+		req.SetBasicAuth(a.Username, secret)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	return nil
+}
+
+// validate rejects configurations the checker can't honor
+func (c *HealthCheckConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Type != "" {
+		if _, ok := healthCheckers[c.Type]; !ok {
+			return fmt.Errorf("unknown health check type %q", c.Type)
+		}
+	}
+	if c.Scheme != "" && c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("unsupported health check scheme %q", c.Scheme)
+	}
+	if c.TLS != nil && c.TLS.CACert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(c.TLS.CACert)) {
+		return errors.New("health check ca_cert contains no PEM certificates")
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return errors.New("health check path must start with /")
+	}
+	if c.Interval != 0 && time.Duration(c.Interval) < minHealthCheckInterval {
+		return fmt.Errorf("health check interval must be at least %s", minHealthCheckInterval)
+	}
+	if c.Timeout < 0 || (c.Interval != 0 && c.Timeout > c.Interval) {
+		return errors.New("health check timeout must be positive and no longer than the interval")
+	}
+	for name := range c.Headers {
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			return errors.New("use health check auth instead of an Authorization header")
+		}
+	}
+	if c.Auth != nil {
+		if c.Auth.Type != "basic" && c.Auth.Type != "bearer" {
+			return fmt.Errorf("unsupported health check auth type %q", c.Auth.Type)
+		}
+		if !strings.HasPrefix(c.Auth.SecretEnv, healthCheckSecretPrefix) {
+			return fmt.Errorf("health check secret_env must start with %s", healthCheckSecretPrefix)
+		}
+	}
+	if c.Body != nil {
+		if err := c.Body.validate(); err != nil {
+			return err
+		}
+	}
+	if c.HealthyThreshold < 0 || c.UnhealthyThreshold < 0 {
+		return errors.New("health check thresholds must not be negative")
+	}
+	for _, status := range c.ExpectedStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid expected status %d", status)
+		}
+	}
+	return nil
+}
+
+// validateOwner checks that the credentials of a service's checks are its
+// own; see healthCheckSecretScope
+func (c *HealthCheckConfig) validateOwner(namespace, name string) error {
+	if c == nil || c.Auth == nil {
+		return nil
+	}
+	return c.Auth.checkOwner(namespace, name)
+}
+
+func healthCheckType(service *ServiceInstance) string {
+	if service.HealthCheck != nil && service.HealthCheck.Type != "" {
+		return service.HealthCheck.Type
+	}
+	if kind := metadataString(service, "health_check"); kind != "" {
+		return kind
+	}
+	return "http"
+}
+
+func healthCheckPath(service *ServiceInstance) string {
+	if service.HealthCheck != nil && service.HealthCheck.Path != "" {
+		return service.HealthCheck.Path
+	}
+	return defaultHealthCheckPath
+}
+
+func healthCheckInterval(service *ServiceInstance) time.Duration {
+	if service.HealthCheck != nil && service.HealthCheck.Interval > 0 {
+		return time.Duration(service.HealthCheck.Interval)
+	}
+	return defaultHealthCheckInterval
+}
+
+func healthCheckTimeoutFor(service *ServiceInstance) time.Duration {
+	if service.HealthCheck != nil && service.HealthCheck.Timeout > 0 {
+		return time.Duration(service.HealthCheck.Timeout)
+	}
+	return healthCheckTimeout
+}
+
+// healthThresholds returns the consecutive passes and failures needed to
+// flip an instance's status
+func (sr *ServiceRegistry) healthThresholds(service *ServiceInstance) (healthy, unhealthy int) {
+	healthy, unhealthy = sr.healthyThreshold, sr.unhealthyThreshold
+	if service.HealthCheck != nil && service.HealthCheck.HealthyThreshold > 0 {
+		healthy = service.HealthCheck.HealthyThreshold
+	}
+	if service.HealthCheck != nil && service.HealthCheck.UnhealthyThreshold > 0 {
+		unhealthy = service.HealthCheck.UnhealthyThreshold
+	}
+	return healthy, unhealthy
+}
+
+// probeInterval returns the time until an instance's next check. Once an
+// instance is unhealthy, every further failure doubles the interval up to
+// maxProbeBackoff, so long-dead instances aren't probed at full rate.
+func (sr *ServiceRegistry) probeInterval(service *ServiceInstance) time.Duration {
+	interval := healthCheckInterval(service)
+	if service.Status != "unhealthy" {
+		return interval
+	}
+
+	_, unhealthy := sr.healthThresholds(service)
+	for i := unhealthy; i < service.checkFailures && interval < sr.maxProbeBackoff; i++ {
+		interval *= 2
+	}
+	if interval > sr.maxProbeBackoff {
+		interval = max(sr.maxProbeBackoff, healthCheckInterval(service))
+	}
+	return interval
+}
+
+// expectedHealthStatus reports whether an HTTP check status counts as healthy
+func expectedHealthStatus(service *ServiceInstance, status int) bool {
+	if service.HealthCheck == nil || len(service.HealthCheck.ExpectedStatus) == 0 {
+		return status == 200
+	}
+	for _, expected := range service.HealthCheck.ExpectedStatus {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// pushHealthChanges follows the registry change log and sends a
+// "health_changed" message to every WebSocket client as soon as an
+// instance changes status, instead of waiting for the periodic full list.
+// Webhooks subscribed to health_changed get the same details.
+func (gw *APIGateway) pushHealthChanges(ctx context.Context) {
+	_, index, _ := gw.registry.ChangesSince(0)
+	for ctx.Err() == nil {
+		gw.registry.WaitForChange(ctx, index, time.Minute)
+
+		changes, current, _ := gw.registry.ChangesSince(index)
+		index = current
+
+		for _, change := range changes {
+			if change.Type != "status_changed" {
+				continue
+			}
+			gw.broadcast(map[string]interface{}{
+				"type":            "health_changed",
+				"service":         change.Service,
+				"status":          change.Service.Status,
+				"previous_status": change.PreviousStatus,
+				"reason":          change.Reason,
+				"timestamp":       change.Time,
+			})
+		}
+	}
+}
+
+// broadcast queues a message for every WebSocket client
+func (gw *APIGateway) broadcast(message interface{}) {
+	gw.connMutex.RLock()
+	defer gw.connMutex.RUnlock()
+
+	for _, client := range gw.connections {
+		client.queue(message)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	healthHistoryProbes      = 100
+	healthHistoryTransitions = 50
+)
+
+// HealthProbe is the outcome of one active health check
+type HealthProbe struct {
+	Time      time.Time `json:"time"`
+	LatencyMs float64   `json:"latency_ms"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// HealthTransition is one status change of an instance, from any source:
+// health checks, heartbeats, expiry, maintenance or other gateways
+type HealthTransition struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// healthHistory keeps the most recent probes and transitions of one
+// instance in fixed-size rings. It is guarded by the registry mutex.
+type healthHistory struct {
+	status string
+
+	probes     [healthHistoryProbes]HealthProbe
+	probeCount int
+
+	transitions     [healthHistoryTransitions]HealthTransition
+	transitionCount int
+}
+
+func (h *healthHistory) addProbe(probe HealthProbe) {
+	h.probes[h.probeCount%healthHistoryProbes] = probe
+	h.probeCount++
+}
+
+// observeStatus records a transition when status differs from the last one
+// seen
+func (h *healthHistory) observeStatus(status string, now time.Time) {
+	if status == h.status {
+		return
+	}
+	if h.status != "" {
+		h.transitions[h.transitionCount%healthHistoryTransitions] = HealthTransition{Time: now, From: h.status, To: status}
+		h.transitionCount++
+	}
+	h.status = status
+}
+
+// recentProbes returns the retained probes, oldest first
+func (h *healthHistory) recentProbes() []HealthProbe {
+	probes := make([]HealthProbe, 0, healthHistoryProbes)
+	for i := max(0, h.probeCount-healthHistoryProbes); i < h.probeCount; i++ {
+		probes = append(probes, h.probes[i%healthHistoryProbes])
+	}
+	return probes
+}
+
+// recentTransitions returns the retained transitions, oldest first
+func (h *healthHistory) recentTransitions() []HealthTransition {
+	transitions := make([]HealthTransition, 0, healthHistoryTransitions)
+	for i := max(0, h.transitionCount-healthHistoryTransitions); i < h.transitionCount; i++ {
+		transitions = append(transitions, h.transitions[i%healthHistoryTransitions])
+	}
+	return transitions
+}
+
+// observeHistory updates an instance's history for a recorded change. The
+// caller must hold sr.mutex.
+func (sr *ServiceRegistry) observeHistory(changeType string, service *ServiceInstance) {
+	if changeType == "deregistered" {
+		delete(sr.history, service.ID)
+		return
+	}
+
+	history := sr.history[service.ID]
+	if history == nil {
+		history = &healthHistory{}
+		sr.history[service.ID] = history
+	}
+	history.observeStatus(service.Status, time.Now())
+}
+
+// recordProbe adds a health check result to an instance's history. The
+// caller must hold sr.mutex.
+func (sr *ServiceRegistry) recordProbe(service *ServiceInstance, latency time.Duration, err error) {
+	history := sr.history[service.ID]
+	if history == nil {
+		history = &healthHistory{status: service.Status}
+		sr.history[service.ID] = history
+	}
+
+	probe := HealthProbe{
+		Time:      time.Now(),
+		LatencyMs: float64(latency) / float64(time.Millisecond),
+		Healthy:   err == nil,
+	}
+	if err != nil {
+		probe.Error = err.Error()
+	}
+	history.addProbe(probe)
+}
+
+// healthHistoryHandler serves GET /api/services/{id}/health-history
+func (gw *APIGateway) healthHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID := mux.Vars(r)["id"]
+
+	sr := gw.registry
+	sr.mutex.RLock()
+	service, exists := sr.services[serviceID]
+	if !exists {
+		sr.mutex.RUnlock()
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		ID          string             `json:"id"`
+		Name        string             `json:"name"`
+		Status      string             `json:"status"`
+		Transitions []HealthTransition `json:"transitions"`
+		Probes      []HealthProbe      `json:"probes"`
+	}{
+		ID:          service.ID,
+		Name:        service.Name,
+		Status:      service.Status,
+		Transitions: make([]HealthTransition, 0),
+		Probes:      make([]HealthProbe, 0),
+	}
+	if history := sr.history[serviceID]; history != nil {
+		response.Transitions = history.recentTransitions()
+		response.Probes = history.recentProbes()
+	}
+	sr.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// hedgeWindowSize is how many recent response times of a service its
+	// hedge delay percentile is taken over
+	hedgeWindowSize = 256
+
+	// hedgeMinSamples is how many response times a service needs before
+	// its percentile is trusted over the fixed delay
+	hedgeMinSamples = 20
+
+	// hedgeRecompute is how many new response times it takes to work the
+	// percentile out again
+	hedgeRecompute = 16
+)
+
+// HedgeConfig cuts a service's tail latency: when an idempotent GET or
+// HEAD hasn't been answered after a delay, a second copy goes to another
+// instance and whichever responds first is used, the other cancelled. The
+// delay is Percentile of the service's recent response times, e.g. 95, or
+// Delay until there are enough of them or when no percentile is set.
+type HedgeConfig struct {
+	Delay      Duration `json:"delay,omitempty"`
+	Percentile float64  `json:"percentile,omitempty"`
+}
+
+func (hc *HedgeConfig) validate() error {
+	if hc.Delay < 0 || hc.Percentile < 0 || hc.Percentile >= 100 {
+		return errors.New("hedge needs a positive delay and a percentile below 100")
+	}
+	if hc.Delay == 0 && hc.Percentile == 0 {
+		return errors.New("hedge needs a delay or a percentile")
+	}
+	return nil
+}
+
+// Hedging tracks the response times hedge delays are taken from
+type Hedging struct {
+	windows map[string]*latencyWindow // by pool name
+	mutex   sync.Mutex
+
+	requests *prometheus.CounterVec
+}
+
+// latencyWindow holds a pool's latest response times
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+
+	// percentile was last worked out for percentileOf, before added more
+	// samples came in
+	percentile   time.Duration
+	percentileOf float64
+	added        int
+}
+
+func NewHedging() *Hedging {
+	h := &Hedging{
+		windows: make(map[string]*latencyWindow),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_hedged_requests_total",
+			Help: "Hedge requests by outcome: sent, or won when answered first",
+		}, []string{"namespace", "outcome"}),
+	}
+	prometheus.MustRegister(h.requests)
+	return h
+}
+
+// observe records a response time of a pool with hedging
+func (h *Hedging) observe(poolName string, latency time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	window := h.windows[poolName]
+	if window == nil {
+		window = &latencyWindow{samples: make([]time.Duration, 0, hedgeWindowSize)}
+		h.windows[poolName] = window
+	}
+	if len(window.samples) < hedgeWindowSize {
+		window.samples = append(window.samples, latency)
+	} else {
+		window.samples[window.next] = latency
+		window.next = (window.next + 1) % hedgeWindowSize
+	}
+	window.added++
+}
+
+// delay returns how long to wait before hedging a request to a pool, and
+// false when it shouldn't be hedged yet
+func (h *Hedging) delay(poolName string, config *HedgeConfig) (time.Duration, bool) {
+	if config.Percentile == 0 {
+		return time.Duration(config.Delay), true
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	window := h.windows[poolName]
+	if window == nil || len(window.samples) < hedgeMinSamples {
+		return time.Duration(config.Delay), config.Delay > 0
+	}
+	if window.percentileOf != config.Percentile || window.added >= hedgeRecompute {
+		sorted := append([]time.Duration(nil), window.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		window.percentile = sorted[int(float64(len(sorted)-1)*config.Percentile/100)]
+		window.percentileOf = config.Percentile
+		window.added = 0
+	}
+	return window.percentile, true
+}
+
+// hedge returns the hedging of a pool, nil when it has none
+func (rt *RouteTable) hedge(poolName string) *HedgeConfig {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Hedge
+	}
+	return nil
+}
+
+// hedgeable reports whether a request may be sent twice
+func hedgeable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.Body == http.NoBody && !isUpgrade(r)
+}
+
+// sendHedged sends an attempt to instance and, if it hasn't been answered
+// within the hedge delay, another to a different instance. The first
+// response wins and the other attempt is cancelled; when one attempt
+// fails the other is waited for.
+func (gw *APIGateway) sendHedged(req *http.Request, target *proxyTarget, instance *ServiceInstance, tried map[string]bool) *proxyAttempt {
+	delay, ok := gw.hedging.delay(target.poolName, target.hedge)
+	if !ok {
+		return gw.send(req, target, instance, nil)
+	}
+
+	results := make(chan *proxyAttempt, 2)
+	launch := func(instance *ServiceInstance) context.CancelFunc {
+		ctx, cancel := context.WithCancel(req.Context())
+		go func() {
+			attempt := gw.send(req.WithContext(ctx), target, instance, nil)
+			release := attempt.release
+			attempt.release = func() { release(); cancel() }
+			results <- attempt
+		}()
+		return cancel
+	}
+	cancelPrimary := launch(instance)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case attempt := <-results:
+		return attempt
+	case <-timer.C:
+	}
+
+	hedge := gw.retryInstance(req, target, tried)
+	if hedge == nil || tried[hedge.ID] {
+		return <-results
+	}
+	tried[hedge.ID] = true
+	gw.hedging.requests.WithLabelValues(target.namespace, "sent").Inc()
+	cancelHedge := launch(hedge)
+
+	first := <-results
+	if first.err != nil {
+		first.release()
+		return <-results
+	}
+
+	if first.instance == hedge {
+		gw.hedging.requests.WithLabelValues(target.namespace, "won").Inc()
+		cancelPrimary()
+	} else {
+		cancelHedge()
+	}
+	go func() {
+		loser := <-results
+		if loser.err == nil {
+			loser.resp.Body.Close()
+		}
+		loser.release()
+	}()
+	return first
+}
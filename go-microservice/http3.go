@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+// HTTP3 serves the gateway over HTTP/3 on HTTP3_ADDR (UDP), alongside the
+// TCP listener, with the certificate in HTTP3_CERT_FILE and its key in
+// HTTP3_KEY_FILE. Responses on TCP advertise it in an Alt-Svc header so
+// clients can switch; behind a proxy or NAT that changes the port, set
+// HTTP3_ADVERTISE_PORT to the one clients reach.
+type HTTP3 struct {
+	server   *http3.Server
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+}
+
+// NewHTTP3 returns nil when HTTP3_ADDR is unset
+func NewHTTP3(handler http.Handler, logger *zap.Logger) (*HTTP3, error) {
+	addr := getEnv("HTTP3_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+
+	h := &HTTP3{
+		server:   &http3.Server{Addr: addr, Handler: handler},
+		certFile: getEnv("HTTP3_CERT_FILE", ""),
+		keyFile:  getEnv("HTTP3_KEY_FILE", ""),
+		logger:   logger,
+	}
+	if h.certFile == "" || h.keyFile == "" {
+		return nil, errors.New("HTTP/3 needs HTTP3_CERT_FILE and HTTP3_KEY_FILE")
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	advertised, err := strconv.Atoi(getEnv("HTTP3_ADVERTISE_PORT", port))
+	if err != nil {
+		return nil, errors.New("invalid HTTP3_ADVERTISE_PORT")
+	}
+	h.server.Port = advertised
+	return h, nil
+}
+
+// serve listens until Shutdown
+func (h *HTTP3) serve() {
+	if h == nil {
+		return
+	}
+	h.logger.Info("Starting HTTP/3 listener", zap.String("addr", h.server.Addr))
+	if err := h.server.ListenAndServeTLS(h.certFile, h.keyFile); err != nil && err != http.ErrServerClosed {
+		h.logger.Error("HTTP/3 listener failed", zap.Error(err))
+	}
+}
+
+// Shutdown stops accepting connections and waits for requests in flight
+func (h *HTTP3) Shutdown(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+	return h.server.Shutdown(ctx)
+}
+
+// altSvcMiddleware advertises the HTTP/3 listener on responses served over
+// TCP
+func (h *HTTP3) altSvcMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h != nil && r.ProtoMajor < 3 {
+			h.server.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxIdempotencyKey bounds the length of Idempotency-Key values
+const maxIdempotencyKey = 255
+
+// IdempotencyStore deduplicates POST requests carrying an Idempotency-Key
+// header, so a client retrying a write through the gateway doesn't apply
+// it twice. The response of the first request with a key is stored for
+// IDEMPOTENCY_TTL and replayed, marked Idempotent-Replayed, to the
+// requests repeating it. Keys are scoped to the service and the client's
+// credentials. A repeat arriving while the first request is still in
+// flight gets 409, and one reusing the key for a different request 422.
+// Responses of 500 and above aren't stored, as the request may not have
+// been applied and can be tried again. Entries are evicted oldest first
+// once they take up more than IDEMPOTENCY_MAX_BYTES; requests and
+// responses over IDEMPOTENCY_MAX_ENTRY_BYTES can't carry a key.
+type IdempotencyStore struct {
+	ttl           time.Duration
+	maxBytes      int64
+	maxEntryBytes int64
+
+	entries map[string]*list.Element // of *idempotencyEntry
+	order   *list.List               // oldest first
+	size    int64
+	mutex   sync.Mutex
+
+	requests *prometheus.CounterVec
+}
+
+type idempotencyEntry struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	inFlight    bool
+	expiry      time.Time
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (e *idempotencyEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// idempotentRequest is a request whose key the store holds in flight
+// until its response is stored or it fails
+type idempotentRequest struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	stored      bool
+}
+
+// NewIdempotencyStore returns nil when IDEMPOTENCY_MAX_BYTES is 0
+func NewIdempotencyStore() *IdempotencyStore {
+	maxBytes := int64(getEnvInt("IDEMPOTENCY_MAX_BYTES", 16<<20))
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	is := &IdempotencyStore{
+		ttl:           getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		maxBytes:      maxBytes,
+		maxEntryBytes: min(int64(getEnvInt("IDEMPOTENCY_MAX_ENTRY_BYTES", 1<<20)), maxBytes),
+		entries:       make(map[string]*list.Element),
+		order:         list.New(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_idempotent_requests_total",
+			Help: "Proxied requests with an Idempotency-Key by result: first, replayed, in_flight or mismatch",
+		}, []string{"namespace", "result"}),
+	}
+	prometheus.MustRegister(is.requests)
+	return is
+}
+
+// begin looks up a POST request's Idempotency-Key and reports whether the
+// request goes on to be proxied; repeats and invalid keys are answered
+// here. The request returned, nil when there is no key, must be finished
+// once proxied. The body is read to fingerprint the request and replaced.
+func (is *IdempotencyStore) begin(w http.ResponseWriter, r *http.Request, namespace, poolName string) (*idempotentRequest, bool) {
+	value := r.Header.Get("Idempotency-Key")
+	if is == nil || r.Method != http.MethodPost || value == "" || isGRPC(r) {
+		return nil, true
+	}
+	if len(value) > maxIdempotencyKey {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if r.ContentLength > is.maxEntryBytes {
+		rejectTooLarge(w, is.maxEntryBytes)
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, is.maxEntryBytes+1))
+	r.Body.Close()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectTooLarge(w, tooLarge.Limit)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return nil, false
+	}
+	if int64(len(body)) > is.maxEntryBytes {
+		rejectTooLarge(w, is.maxEntryBytes)
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Clients only share keys with requests made with their own credentials
+	credentials := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	pending := &idempotentRequest{
+		key:         poolName + "\x00" + string(credentials[:]) + "\x00" + value,
+		fingerprint: sha256.Sum256([]byte(r.URL.RequestURI() + "\x00" + string(body))),
+	}
+
+	entry, exists := is.claim(pending)
+	switch {
+	case !exists:
+		is.requests.WithLabelValues(namespace, "first").Inc()
+		return pending, true
+	case entry.fingerprint != pending.fingerprint:
+		is.requests.WithLabelValues(namespace, "mismatch").Inc()
+		http.Error(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+	case entry.inFlight:
+		is.requests.WithLabelValues(namespace, "in_flight").Inc()
+		http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+	default:
+		is.requests.WithLabelValues(namespace, "replayed").Inc()
+		header := w.Header()
+		for name, values := range entry.header {
+			header[name] = append([]string(nil), values...)
+		}
+		header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+		header.Set("Idempotent-Replayed", "true")
+		w.WriteHeader(entry.status)
+		w.Write(entry.body)
+	}
+	return nil, false
+}
+
+// claim returns the live entry of a request's key, or marks the key in
+// flight for it when there is none. The entry returned is a copy.
+func (is *IdempotencyStore) claim(pending *idempotentRequest) (idempotencyEntry, bool) {
+	is.mutex.Lock()
+	defer is.mutex.Unlock()
+
+	is.expire()
+	if element, exists := is.entries[pending.key]; exists {
+		return *element.Value.(*idempotencyEntry), true
+	}
+	is.add(&idempotencyEntry{
+		key:         pending.key,
+		fingerprint: pending.fingerprint,
+		inFlight:    true,
+		expiry:      time.Now().Add(is.ttl),
+	})
+	return idempotencyEntry{}, false
+}
+
+// capture stores a response to a request with a key once its body has been
+// read in full
+func (is *IdempotencyStore) capture(resp *http.Response, pending *idempotentRequest) {
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusSwitchingProtocols || resp.ContentLength > is.maxEntryBytes {
+		return
+	}
+
+	entry := &idempotencyEntry{
+		key:         pending.key,
+		fingerprint: pending.fingerprint,
+		status:      resp.StatusCode,
+		header:      resp.Header.Clone(),
+	}
+	resp.Body = &cachingBody{ReadCloser: resp.Body, limit: is.maxEntryBytes, done: func(body []byte) {
+		entry.body = body
+		entry.expiry = time.Now().Add(is.ttl)
+
+		is.mutex.Lock()
+		defer is.mutex.Unlock()
+		if element, exists := is.entries[entry.key]; exists {
+			is.remove(element)
+		}
+		is.add(entry)
+		pending.stored = true
+	}}
+}
+
+// finish releases the key of a request whose response wasn't stored, so
+// the client can retry it
+func (is *IdempotencyStore) finish(pending *idempotentRequest) {
+	if pending == nil {
+		return
+	}
+
+	is.mutex.Lock()
+	defer is.mutex.Unlock()
+
+	if pending.stored {
+		return
+	}
+	if element, exists := is.entries[pending.key]; exists && element.Value.(*idempotencyEntry).inFlight {
+		is.remove(element)
+	}
+}
+
+// add appends an entry, evicting the oldest ones beyond the store's size.
+// The caller must hold is.mutex.
+func (is *IdempotencyStore) add(entry *idempotencyEntry) {
+	is.entries[entry.key] = is.order.PushBack(entry)
+	is.size += entry.size()
+	for is.size > is.maxBytes {
+		is.remove(is.order.Front())
+	}
+}
+
+// expire drops the entries past their expiry, which all share one TTL and
+// so come first. The caller must hold is.mutex.
+func (is *IdempotencyStore) expire() {
+	now := time.Now()
+	for element := is.order.Front(); element != nil && now.After(element.Value.(*idempotencyEntry).expiry); element = is.order.Front() {
+		is.remove(element)
+	}
+}
+
+// remove drops an entry. The caller must hold is.mutex.
+func (is *IdempotencyStore) remove(element *list.Element) {
+	entry := is.order.Remove(element).(*idempotencyEntry)
+	is.size -= entry.size()
+	delete(is.entries, entry.key)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestIdempotencyStore returns a store with metrics that aren't
+// registered
+func newTestIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:           time.Hour,
+		maxBytes:      1 << 20,
+		maxEntryBytes: 1 << 10,
+		entries:       make(map[string]*list.Element),
+		order:         list.New(),
+		requests:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests"}, []string{"namespace", "result"}),
+	}
+}
+
+// idempotentPost returns a POST of body with an Idempotency-Key
+func idempotentPost(key, authorization, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return r
+}
+
+// respond stores a response to a request begun with the store, as the
+// proxy does once the upstream answers
+func respond(is *IdempotencyStore, pending *idempotentRequest, status int, body string) {
+	resp := &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	is.capture(resp, pending)
+	io.Copy(io.Discard, resp.Body)
+	is.finish(pending)
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	const createdBody = `{"created": true}`
+
+	// Each case stores the first request's response unless it is in
+	// flight, then sends the repeat
+	tests := []struct {
+		name     string
+		first    *http.Request
+		status   int // of the first response, 0 while in flight
+		repeat   *http.Request
+		want     int
+		replayed bool
+		proxied  bool
+	}{
+		{"replayed", idempotentPost("k1", "", `{"id": 1}`), http.StatusCreated, idempotentPost("k1", "", `{"id": 1}`), http.StatusCreated, true, false},
+		{"client errors are replayed", idempotentPost("k1", "", `{}`), http.StatusBadRequest, idempotentPost("k1", "", `{}`), http.StatusBadRequest, true, false},
+		{"server errors are not stored", idempotentPost("k1", "", `{}`), http.StatusBadGateway, idempotentPost("k1", "", `{}`), 0, false, true},
+		{"in flight", idempotentPost("k1", "", `{}`), 0, idempotentPost("k1", "", `{}`), http.StatusConflict, false, false},
+		{"different body", idempotentPost("k1", "", `{"id": 1}`), http.StatusCreated, idempotentPost("k1", "", `{"id": 2}`), http.StatusUnprocessableEntity, false, false},
+		{"different key", idempotentPost("k1", "", `{}`), http.StatusCreated, idempotentPost("k2", "", `{}`), 0, false, true},
+		{"different credentials", idempotentPost("k1", "Bearer a", `{}`), http.StatusCreated, idempotentPost("k1", "Bearer b", `{}`), 0, false, true},
+		{"key too long", idempotentPost("k1", "", `{}`), http.StatusCreated, idempotentPost(strings.Repeat("k", maxIdempotencyKey+1), "", `{}`), http.StatusBadRequest, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := newTestIdempotencyStore()
+			pending, proxied := is.begin(httptest.NewRecorder(), tt.first, defaultNamespace, "orders")
+			if !proxied || pending == nil {
+				t.Fatal("first request wasn't proxied")
+			}
+			if tt.status != 0 {
+				respond(is, pending, tt.status, createdBody)
+			}
+
+			w := httptest.NewRecorder()
+			repeat, proxied := is.begin(w, tt.repeat, defaultNamespace, "orders")
+			if proxied != tt.proxied || (repeat != nil) != tt.proxied {
+				t.Fatalf("repeat proxied = %v, want %v", proxied, tt.proxied)
+			}
+			if tt.proxied {
+				return
+			}
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+				t.Errorf("Idempotent-Replayed = %v, want %v", got, tt.replayed)
+			}
+			if tt.replayed && w.Body.String() != createdBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), createdBody)
+			}
+		})
+	}
+}
+
+func TestIdempotencyReleasesUnstoredKeys(t *testing.T) {
+	is := newTestIdempotencyStore()
+	pending, _ := is.begin(httptest.NewRecorder(), idempotentPost("k1", "", `{}`), defaultNamespace, "orders")
+	is.finish(pending)
+
+	if retry, proxied := is.begin(httptest.NewRecorder(), idempotentPost("k1", "", `{}`), defaultNamespace, "orders"); !proxied || retry == nil {
+		t.Error("retry after a failed request wasn't proxied")
+	}
+}
+
+func TestIdempotencyForwardsBody(t *testing.T) {
+	is := newTestIdempotencyStore()
+	r := idempotentPost("k1", "", `{"id": 1}`)
+	if _, proxied := is.begin(httptest.NewRecorder(), r, defaultNamespace, "orders"); !proxied {
+		t.Fatal("first request wasn't proxied")
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"id": 1}` {
+		t.Errorf("body = %q after begin", body)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// proxyRouteName names the routes proxying to services, whose access lists
+// and CORS policies are their services' own rather than the admin API's
+const proxyRouteName = "proxy"
+
+// IPAccessList admits clients by address. Entries are CIDRs such as
+// "10.0.0.0/8" or single addresses. Deny wins over Allow, and with Allow
+// set, clients outside it are refused too. Clients are told apart by
+// their address behind TRUSTED_PROXIES, as in X-Forwarded-For.
+type IPAccessList struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func (al *IPAccessList) validate() error {
+	var err error
+	if al.allow, err = parseNetworks(al.Allow); err != nil {
+		return err
+	}
+	al.deny, err = parseNetworks(al.Deny)
+	return err
+}
+
+// parseNetworks parses CIDRs, taking single addresses as networks of their
+// own
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// admits reports whether the list lets a client address through; a nil
+// list admits everyone and unparsable addresses no one
+func (al *IPAccessList) admits(address string) bool {
+	if al == nil {
+		return true
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range al.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(al.allow) == 0 {
+		return true
+	}
+	for _, network := range al.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPAccess checks clients against the access lists of the services they
+// call and, for the rest of the /api admin API, the list set by
+// ADMIN_IP_ALLOW and ADMIN_IP_DENY. Both can be changed at runtime; the
+// liveness and readiness probes are outside /api and never refused.
+type IPAccess struct {
+	admin     atomic.Pointer[IPAccessList]
+	forwarded *ForwardedHeaders
+	logger    *zap.Logger
+
+	denied *prometheus.CounterVec
+}
+
+func NewIPAccess(forwarded *ForwardedHeaders, logger *zap.Logger) (*IPAccess, error) {
+	ia := &IPAccess{
+		forwarded: forwarded,
+		logger:    logger,
+		denied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ip_access_denied_total",
+			Help: "Requests refused by an IP access list, by scope: admin_api or route",
+		}, []string{"scope", "namespace", "service"}),
+	}
+
+	admin := &IPAccessList{
+		Allow: getEnvList("ADMIN_IP_ALLOW", nil),
+		Deny:  getEnvList("ADMIN_IP_DENY", nil),
+	}
+	if err := admin.validate(); err != nil {
+		return nil, fmt.Errorf("admin IP access list: %w", err)
+	}
+	if len(admin.Allow) > 0 || len(admin.Deny) > 0 {
+		ia.admin.Store(admin)
+		logger.Info("Admin API IP access list loaded",
+			zap.Strings("allow", admin.Allow),
+			zap.Strings("deny", admin.Deny))
+	}
+
+	prometheus.MustRegister(ia.denied)
+	return ia, nil
+}
+
+// allowRoute refuses clients outside a service's access list with 403
+func (ia *IPAccess) allowRoute(w http.ResponseWriter, r *http.Request, target *proxyTarget, list *IPAccessList) bool {
+	if list == nil {
+		return true
+	}
+	client := ia.forwarded.ClientIP(r)
+	if list.admits(client) {
+		return true
+	}
+	ia.deny(w, r, client, "route", target.namespace, target.serviceName)
+	return false
+}
+
+// adminMiddleware refuses clients outside the admin API's access list,
+// passing proxied requests through
+func (ia *IPAccess) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := ia.admin.Load()
+		if list == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == proxyRouteName {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := ia.forwarded.ClientIP(r)
+		if !list.admits(client) {
+			ia.deny(w, r, client, "admin_api", "", "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ia *IPAccess) deny(w http.ResponseWriter, r *http.Request, client, scope, namespace, service string) {
+	ia.denied.WithLabelValues(scope, namespace, service).Inc()
+	ia.logger.Warn("Request refused by IP access list",
+		zap.String("scope", scope),
+		zap.String("client_ip", client),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path))
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+func (ia *IPAccess) getAdminHandler(w http.ResponseWriter, r *http.Request) {
+	list := ia.admin.Load()
+	if list == nil {
+		list = &IPAccessList{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// putAdminHandler replaces the admin API's access list, refusing lists
+// that would lock out the client setting them
+func (ia *IPAccess) putAdminHandler(w http.ResponseWriter, r *http.Request) {
+	var list IPAccessList
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := list.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client := ia.forwarded.ClientIP(r)
+	if !list.admits(client) {
+		http.Error(w, fmt.Sprintf("Access list would refuse your own address %s", client), http.StatusConflict)
+		return
+	}
+
+	ia.admin.Store(&list)
+	ia.logger.Info("Admin API IP access list updated",
+		zap.Strings("allow", list.Allow),
+		zap.Strings("deny", list.Deny))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (ia *IPAccess) deleteAdminHandler(w http.ResponseWriter, r *http.Request) {
+	ia.admin.Store(nil)
+	ia.logger.Info("Admin API IP access list removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ipAccess returns the access list of a pool, nil when it has none
+func (rt *RouteTable) ipAccess(poolName string) *IPAccessList {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.IPAccess
+	}
+	return nil
+}
+
+// setIPAccess replaces the access list of a pool; nil removes it. Routes
+// are copied rather than changed, as requests in flight may hold the
+// current one.
+func (rt *RouteTable) setIPAccess(poolName string, list *IPAccessList) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	route := &RouteConfig{}
+	if existing := rt.routes[poolName]; existing != nil {
+		copied := *existing
+		route = &copied
+	}
+	route.IPAccess = list
+	rt.routes[poolName] = route
+}
+
+func (gw *APIGateway) getIPAccessHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+
+	list := gw.routes.ipAccess(qualifiedName(namespace, service))
+	if list == nil {
+		list = &IPAccessList{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (gw *APIGateway) putIPAccessHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	var list IPAccessList
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := list.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gw.routes.setIPAccess(qualifiedName(namespace, service), &list)
+	gw.logger.Info("IP access list updated",
+		zap.String("namespace", namespace),
+		zap.String("service", service),
+		zap.Strings("allow", list.Allow),
+		zap.Strings("deny", list.Deny))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (gw *APIGateway) deleteIPAccessHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	gw.routes.setIPAccess(qualifiedName(namespace, service), nil)
+	gw.logger.Info("IP access list removed",
+		zap.String("namespace", namespace),
+		zap.String("service", service))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// latencyDecay is the time constant of the latency and error EWMAs:
+	// a sample's influence falls to 1/e after this long
+	latencyDecay = 10 * time.Second
+
+	// latencyErrorPenalty scales an instance's cost by its error rate, so
+	// an instance failing fast doesn't look like the fastest one
+	latencyErrorPenalty = 10
+)
+
+// instanceLatency holds the EWMAs of one instance's proxied requests
+type instanceLatency struct {
+	latency   float64 // milliseconds to response headers
+	errorRate float64 // 0..1
+	updated   time.Time
+}
+
+// ObserveLatency feeds a proxied request's time to response headers and
+// outcome into the instance's EWMAs for the least-latency strategy and its
+// traffic statistics
+func (lb *LoadBalancer) ObserveLatency(instanceID string, latency time.Duration, failed bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.recordStats(instanceID, latency, failed)
+
+	now := time.Now()
+	sample := float64(latency) / float64(time.Millisecond)
+	errorSample := 0.0
+	if failed {
+		errorSample = 1
+	}
+
+	stats, exists := lb.latencies[instanceID]
+	if !exists {
+		lb.latencies[instanceID] = &instanceLatency{latency: sample, errorRate: errorSample, updated: now}
+		return
+	}
+
+	// Weight samples by the time since the last one, so the averages track
+	// the same window whether traffic is light or heavy
+	alpha := 1 - math.Exp(-float64(now.Sub(stats.updated))/float64(latencyDecay))
+	stats.latency += alpha * (sample - stats.latency)
+	stats.errorRate += alpha * (errorSample - stats.errorRate)
+	stats.updated = now
+}
+
+// latencyCost estimates how long a new request to an instance would take,
+// counting the requests already in flight to it. Instances without recent
+// samples cost nothing so they get tried, which also lets an instance that
+// was avoided for being slow prove it has recovered. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) latencyCost(instance *ServiceInstance, now time.Time) float64 {
+	stats, exists := lb.latencies[instance.ID]
+	if !exists || now.Sub(stats.updated) > 3*latencyDecay {
+		return 0
+	}
+	return stats.latency * (1 + latencyErrorPenalty*stats.errorRate) * float64(lb.inflight[instance.ID]+1)
+}
+
+// leastLatency picks the selectable instance with the lowest latency cost,
+// scanning from a rotating offset to spread ties. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) leastLatency(key string, instances []*ServiceInstance, now time.Time) *ServiceInstance {
+	start := lb.current[key]
+	lb.current[key] = (start + 1) % len(instances)
+
+	var best *ServiceInstance
+	bestCost := 0.0
+	for i := range instances {
+		instance := instances[(start+i)%len(instances)]
+		if !lb.selectable(instance, now) {
+			continue
+		}
+		if cost := lb.latencyCost(instance, now); best == nil || cost < bestCost {
+			best, bestCost = instance, cost
+		}
+	}
+	if best == nil {
+		return lb.fallback(instances, start)
+	}
+	return best
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// instanceStats accumulates the proxied requests of one instance while it
+// is in rotation
+type instanceStats struct {
+	requests     uint64
+	errors       uint64
+	totalLatency time.Duration
+}
+
+// InstanceStats is one instance's entry in the load balancer stats API
+type InstanceStats struct {
+	ID           string  `json:"id"`
+	Address      string  `json:"address"`
+	Port         int     `json:"port"`
+	Status       string  `json:"status"`
+	Weight       int     `json:"weight"`
+	Requests     uint64  `json:"requests"`
+	Errors       uint64  `json:"errors"`
+	InFlight     int     `json:"in_flight"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	Share        float64 `json:"share"` // of the pool's requests
+}
+
+// recordStats counts a completed request. The caller must hold lb.mutex.
+func (lb *LoadBalancer) recordStats(instanceID string, latency time.Duration, failed bool) {
+	stats := lb.stats[instanceID]
+	if stats == nil {
+		stats = &instanceStats{}
+		lb.stats[instanceID] = stats
+	}
+	stats.requests++
+	stats.totalLatency += latency
+	if failed {
+		stats.errors++
+	}
+}
+
+// Stats returns the traffic statistics of every instance in a pool, or nil
+// when the pool doesn't exist
+func (lb *LoadBalancer) Stats(serviceName, version string) []InstanceStats {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	instances, exists := lb.services[poolKey(serviceName, version)]
+	if !exists {
+		return nil
+	}
+
+	result := make([]InstanceStats, len(instances))
+	var total uint64
+	for i, instance := range instances {
+		result[i] = InstanceStats{
+			ID:       instance.ID,
+			Address:  instance.Address,
+			Port:     instance.Port,
+			Status:   instance.Status,
+			Weight:   instance.Weight,
+			InFlight: lb.inflight[instance.ID],
+		}
+		if stats := lb.stats[instance.ID]; stats != nil {
+			result[i].Requests = stats.requests
+			result[i].Errors = stats.errors
+			if stats.requests > 0 {
+				result[i].AvgLatencyMs = float64(stats.totalLatency) / float64(time.Millisecond) / float64(stats.requests)
+			}
+			total += stats.requests
+		}
+	}
+	if total > 0 {
+		for i := range result {
+			result[i].Share = float64(result[i].Requests) / float64(total)
+		}
+	}
+	return result
+}
+
+// lbStatsHandler serves GET /api/lb/{service}/stats, with ?version= to
+// look at a single version pool
+func (gw *APIGateway) lbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	serviceName := gw.aliases.Resolve(namespace, mux.Vars(r)["service"])
+	version := r.URL.Query().Get("version")
+	stats := gw.loadBalancer.Stats(qualifiedName(namespace, serviceName), version)
+	if stats == nil {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"service":   serviceName,
+		"namespace": namespace,
+		"version":   version,
+		"strategy":  gw.loadBalancer.strategy,
+		"instances": stats,
+	})
+}
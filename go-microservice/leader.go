@@ -0,0 +1,25 @@
+package main
+
+import "context"
+
+// LeaderElector is implemented by shared registry backends. When several
+// gateway replicas run, only the elected leader runs the periodic jobs that
+// reach out to backends; the others take over when the leader goes away.
+// Backends that don't implement it are single-node, so the gateway always
+// acts as leader.
+type LeaderElector interface {
+	IsLeader() bool
+}
+
+// StatusPublisher is implemented by shared registry backends so the leader
+// can hand its health check results to the followers, which don't probe.
+type StatusPublisher interface {
+	PublishStatus(ctx context.Context, service *ServiceInstance) error
+}
+
+func (sr *ServiceRegistry) isLeader() bool {
+	if elector, ok := sr.backend.(LeaderElector); ok {
+		return elector.IsLeader()
+	}
+	return true
+}
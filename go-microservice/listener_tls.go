@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// crlCheckInterval is how often the CRL file is checked for changes
+	crlCheckInterval = 10 * time.Second
+
+	// certCheckInterval is how often certificate files are checked for
+	// changes
+	certCheckInterval = 10 * time.Second
+
+	// ocspTimeout bounds a query to an OCSP responder
+	ocspTimeout = 5 * time.Second
+
+	// ocspMaxAge is how long OCSP answers without a next update are cached
+	ocspMaxAge = time.Hour
+)
+
+// Client certificate headers, set on proxied requests from the verified
+// certificate the client connected with
+var clientCertHeaders = []string{"X-Client-Cert-Subject", "X-Client-Cert-SAN", "X-Client-Cert-Fingerprint"}
+
+// tlsVersions are the values of GATEWAY_TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ListenerTLS serves the gateway over TLS with the certificate in
+// GATEWAY_TLS_CERT_FILE and its key in GATEWAY_TLS_KEY_FILE, and
+// authenticates clients by certificate against the CAs in
+// GATEWAY_CLIENT_CA_FILE. GATEWAY_CLIENT_AUTH is "require" (the default)
+// or "optional", which verifies certificates only when clients present
+// one. With GATEWAY_MTLS_ADDR set, client certificates are required on a
+// listener of their own there instead, and the main listener is left as
+// it is.
+//
+// GATEWAY_TLS_SNI_CERTS adds certificates for other host names, as
+// "cert.pem:key.pem" pairs separated by commas. Clients get the first one
+// valid for the name they ask for by SNI, and the main certificate when
+// none is. Certificate files are read again when they change, so renewed
+// certificates are served to new connections without a restart.
+// GATEWAY_TLS_MIN_VERSION, "1.2" by default, and GATEWAY_TLS_CIPHER_SUITES,
+// Go's secure defaults unless set, apply to all listeners; TLS 1.3 suites
+// are not configurable. GATEWAY_HTTP_REDIRECT_ADDR listens for plain HTTP
+// there and redirects it to HTTPS. Certificates of the domains in
+// ACME_DOMAINS are obtained automatically instead, see ACME; the main
+// certificate is then optional.
+//
+// Certificates listed in the CRLs of GATEWAY_CLIENT_CRL_FILE, read again
+// when it changes, are refused. GATEWAY_CLIENT_OCSP asks the responders
+// the certificates name: "soft" admits clients when the responder can't be
+// reached, "hard" refuses them. Revocation is checked for the client's own
+// certificate.
+//
+// The gateway's certificate may come from Vault instead of files: issued
+// by the PKI engine for VAULT_TLS_PKI_ROLE, with VAULT_TLS_COMMON_NAME,
+// VAULT_TLS_ALT_NAMES and VAULT_TLS_TTL, or kept as the certificate and
+// private_key fields of the KV secret at VAULT_TLS_PATH. Either way,
+// renewed or rotated certificates are served to new connections without a
+// restart.
+type ListenerTLS struct {
+	certificate     atomic.Pointer[tls.Certificate]
+	sniCertificates atomic.Pointer[[]*tls.Certificate]
+	certFile        *certificateFile // nil when the certificate is from Vault
+	sniFiles        []*certificateFile
+	certChecked     time.Time
+	minVersion      uint16
+	cipherSuites    []uint16
+	clientCAs       *x509.CertPool
+	caCerts         []*x509.Certificate // to check CRL signatures with
+	clientAuth      tls.ClientAuthType
+	mtlsAddr        string
+	redirectAddr    string
+	acme            *ACME
+
+	crlFile    string
+	crlChecked time.Time
+	crlChanged time.Time
+	revoked    map[string]map[string]bool // serials by issuer's raw subject
+
+	ocspMode   string
+	ocspClient *http.Client
+	ocspCache  map[string]ocspAnswer
+
+	mutex    sync.Mutex
+	logger   *zap.Logger
+	rejected *prometheus.CounterVec
+}
+
+type ocspAnswer struct {
+	status int
+	expiry time.Time
+}
+
+// certificateFile is a certificate and its key on disk
+type certificateFile struct {
+	certFile string
+	keyFile  string
+	modified time.Time // the later of the two files'
+}
+
+// load reads the certificate, noting when its files were last modified
+func (cf *certificateFile) load() (*tls.Certificate, error) {
+	modified, err := cf.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := tls.LoadX509KeyPair(cf.certFile, cf.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate %s: %w", cf.certFile, err)
+	}
+	cf.modified = modified
+	return &certificate, nil
+}
+
+func (cf *certificateFile) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, file := range []string{cf.certFile, cf.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+// changed reports whether the files have been modified since they were
+// loaded
+func (cf *certificateFile) changed() bool {
+	modified, err := cf.lastModified()
+	return err == nil && !modified.Equal(cf.modified)
+}
+
+// NewListenerTLS returns nil when no certificate source nor
+// GATEWAY_MTLS_ADDR is set, serving cleartext as before
+func NewListenerTLS(vault *Vault, logger *zap.Logger) (*ListenerTLS, error) {
+	certFile := getEnv("GATEWAY_TLS_CERT_FILE", "")
+	keyFile := getEnv("GATEWAY_TLS_KEY_FILE", "")
+	pkiRole := getEnv("VAULT_TLS_PKI_ROLE", "")
+	vaultPath := getEnv("VAULT_TLS_PATH", "")
+	sniCerts := getEnvList("GATEWAY_TLS_SNI_CERTS", nil)
+	mtlsAddr := getEnv("GATEWAY_MTLS_ADDR", "")
+	acmeCerts, err := NewACME(logger)
+	if err != nil {
+		return nil, err
+	}
+	if certFile == "" && pkiRole == "" && vaultPath == "" && len(sniCerts) == 0 && mtlsAddr == "" && acmeCerts == nil {
+		return nil, nil
+	}
+
+	lt := &ListenerTLS{
+		mtlsAddr:     mtlsAddr,
+		redirectAddr: getEnv("GATEWAY_HTTP_REDIRECT_ADDR", ""),
+		acme:         acmeCerts,
+		crlFile:      getEnv("GATEWAY_CLIENT_CRL_FILE", ""),
+		ocspMode:     getEnv("GATEWAY_CLIENT_OCSP", "off"),
+		ocspClient:   &http.Client{Timeout: ocspTimeout},
+		ocspCache:    make(map[string]ocspAnswer),
+		logger:       logger,
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_client_cert_rejections_total",
+			Help: "Client certificates refused after chain verification, by reason: crl, ocsp or ocsp_unavailable",
+		}, []string{"reason"}),
+	}
+
+	if err := lt.loadCertificate(vault, certFile, keyFile, pkiRole, vaultPath); err != nil {
+		return nil, err
+	}
+	for _, pair := range sniCerts {
+		cert, key, found := strings.Cut(pair, ":")
+		if !found || cert == "" || key == "" {
+			return nil, fmt.Errorf("GATEWAY_TLS_SNI_CERTS entry %q is not cert.pem:key.pem", pair)
+		}
+		lt.sniFiles = append(lt.sniFiles, &certificateFile{certFile: cert, keyFile: key})
+	}
+	if err := lt.loadSNICertificates(); err != nil {
+		return nil, err
+	}
+	if err := lt.configureProtocol(); err != nil {
+		return nil, err
+	}
+
+	if caFile := getEnv("GATEWAY_CLIENT_CA_FILE", ""); caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		lt.clientCAs = x509.NewCertPool()
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse client CA: %w", err)
+			}
+			lt.clientCAs.AddCert(cert)
+			lt.caCerts = append(lt.caCerts, cert)
+		}
+		if len(lt.caCerts) == 0 {
+			return nil, errors.New("client CA contains no PEM certificates")
+		}
+	} else if mtlsAddr != "" {
+		return nil, errors.New("GATEWAY_MTLS_ADDR needs GATEWAY_CLIENT_CA_FILE")
+	}
+
+	switch mode := getEnv("GATEWAY_CLIENT_AUTH", "require"); mode {
+	case "require":
+		lt.clientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		lt.clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown GATEWAY_CLIENT_AUTH %q", mode)
+	}
+	if lt.ocspMode != "off" && lt.ocspMode != "soft" && lt.ocspMode != "hard" {
+		return nil, fmt.Errorf("unknown GATEWAY_CLIENT_OCSP %q", lt.ocspMode)
+	}
+
+	if lt.crlFile != "" {
+		if lt.clientCAs == nil {
+			return nil, errors.New("GATEWAY_CLIENT_CRL_FILE needs GATEWAY_CLIENT_CA_FILE")
+		}
+		if err := lt.loadCRLs(); err != nil {
+			return nil, err
+		}
+	}
+	prometheus.MustRegister(lt.rejected)
+
+	logger.Info("Gateway TLS enabled",
+		zap.Int("sni_certificates", len(lt.sniFiles)),
+		zap.String("min_version", tls.VersionName(lt.minVersion)),
+		zap.String("redirect_addr", lt.redirectAddr),
+		zap.Bool("client_certificates", lt.clientCAs != nil),
+		zap.String("mtls_addr", mtlsAddr),
+		zap.Bool("crl", lt.crlFile != ""),
+		zap.String("ocsp", lt.ocspMode))
+	return lt, nil
+}
+
+// loadCertificate loads the gateway's certificate from Vault's PKI engine,
+// a Vault KV secret or files, keeping it up to date in the first two cases
+func (lt *ListenerTLS) loadCertificate(vault *Vault, certFile, keyFile, pkiRole, vaultPath string) error {
+	if (pkiRole != "" || vaultPath != "") && vault == nil {
+		return errors.New("VAULT_TLS_PKI_ROLE and VAULT_TLS_PATH need VAULT_ADDR")
+	}
+	switch {
+	case pkiRole != "":
+		commonName := getEnv("VAULT_TLS_COMMON_NAME", "")
+		if commonName == "" {
+			return errors.New("VAULT_TLS_PKI_ROLE needs VAULT_TLS_COMMON_NAME")
+		}
+		return vault.rotateCertificate(pkiRole, commonName, getEnvList("VAULT_TLS_ALT_NAMES", nil),
+			getEnvDuration("VAULT_TLS_TTL", 0), lt.certificate.Store)
+	case vaultPath != "":
+		return vault.watchKV(vaultPath, func(data map[string]interface{}) error {
+			certificate, err := kvCertificate(data)
+			if err != nil {
+				return fmt.Errorf("gateway certificate: %w", err)
+			}
+			lt.certificate.Store(certificate)
+			return nil
+		})
+	}
+
+	if certFile == "" && keyFile == "" && lt.acme != nil {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("TLS needs GATEWAY_TLS_CERT_FILE and GATEWAY_TLS_KEY_FILE")
+	}
+	lt.certFile = &certificateFile{certFile: certFile, keyFile: keyFile}
+	certificate, err := lt.certFile.load()
+	if err != nil {
+		return fmt.Errorf("load gateway certificate: %w", err)
+	}
+	lt.certificate.Store(certificate)
+	return nil
+}
+
+// loadSNICertificates reads the certificates of GATEWAY_TLS_SNI_CERTS,
+// replacing the ones in use only when all of them load
+func (lt *ListenerTLS) loadSNICertificates() error {
+	certificates := make([]*tls.Certificate, 0, len(lt.sniFiles))
+	for _, file := range lt.sniFiles {
+		certificate, err := file.load()
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, certificate)
+	}
+	lt.sniCertificates.Store(&certificates)
+	return nil
+}
+
+// configureProtocol reads the minimum TLS version and the cipher suites,
+// refusing suites Go considers insecure
+func (lt *ListenerTLS) configureProtocol() error {
+	version := getEnv("GATEWAY_TLS_MIN_VERSION", "1.2")
+	minVersion, known := tlsVersions[version]
+	if !known {
+		return fmt.Errorf("unknown GATEWAY_TLS_MIN_VERSION %q, use 1.0 to 1.3", version)
+	}
+	if minVersion < tls.VersionTLS12 {
+		lt.logger.Warn("GATEWAY_TLS_MIN_VERSION allows deprecated TLS versions", zap.String("min_version", version))
+	}
+	lt.minVersion = minVersion
+
+	for _, name := range getEnvList("GATEWAY_TLS_CIPHER_SUITES", nil) {
+		index := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if index < 0 {
+			if slices.ContainsFunc(tls.InsecureCipherSuites(), func(suite *tls.CipherSuite) bool { return suite.Name == name }) {
+				return fmt.Errorf("cipher suite %s is insecure", name)
+			}
+			return fmt.Errorf("unknown cipher suite %s", name)
+		}
+		lt.cipherSuites = append(lt.cipherSuites, tls.CipherSuites()[index].ID)
+	}
+	if len(lt.cipherSuites) > 0 && minVersion == tls.VersionTLS13 {
+		lt.logger.Warn("GATEWAY_TLS_CIPHER_SUITES has no effect with TLS 1.3 only")
+	}
+	return nil
+}
+
+// getCertificate picks the certificate for a handshake by SNI, reloading
+// certificate files first if they have changed
+func (lt *ListenerTLS) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if lt.acme.handles(hello) {
+		return lt.acme.getCertificate(hello)
+	}
+	lt.reloadCertificates()
+	if hello.ServerName != "" {
+		for _, certificate := range *lt.sniCertificates.Load() {
+			if hello.SupportsCertificate(certificate) == nil {
+				return certificate, nil
+			}
+		}
+	}
+	if certificate := lt.certificate.Load(); certificate != nil {
+		return certificate, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// reloadCertificates loads certificate files again when they have
+// changed, at most every certCheckInterval. Files that fail to load, such
+// as ones caught half-written, leave the certificates in use.
+func (lt *ListenerTLS) reloadCertificates() {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	if time.Since(lt.certChecked) < certCheckInterval {
+		return
+	}
+	lt.certChecked = time.Now()
+
+	if lt.certFile != nil && lt.certFile.changed() {
+		if certificate, err := lt.certFile.load(); err != nil {
+			lt.logger.Error("Failed to reload gateway certificate, keeping the previous one", zap.Error(err))
+		} else {
+			lt.certificate.Store(certificate)
+			lt.logger.Info("Gateway certificate reloaded", zap.String("file", lt.certFile.certFile))
+		}
+	}
+	if slices.ContainsFunc(lt.sniFiles, (*certificateFile).changed) {
+		if err := lt.loadSNICertificates(); err != nil {
+			lt.logger.Error("Failed to reload SNI certificates, keeping the previous ones", zap.Error(err))
+		} else {
+			lt.logger.Info("SNI certificates reloaded", zap.Int("certificates", len(lt.sniFiles)))
+		}
+	}
+}
+
+// tlsConfig returns the configuration of a listener, verifying client
+// certificates as clientAuth says
+func (lt *ListenerTLS) tlsConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: lt.getCertificate,
+		MinVersion:     lt.minVersion,
+		CipherSuites:   lt.cipherSuites,
+	}
+	if lt.acme != nil {
+		config.GetConfigForClient = lt.acme.challengeConfig
+	}
+	if lt.clientCAs != nil && clientAuth != tls.NoClientCert {
+		config.ClientCAs = lt.clientCAs
+		config.ClientAuth = clientAuth
+		config.VerifyConnection = lt.checkRevocation
+	}
+	return config
+}
+
+// configure puts the main server on TLS and returns the dedicated mTLS
+// server, nil when there is none
+func (lt *ListenerTLS) configure(server *http.Server) *http.Server {
+	if lt == nil {
+		return nil
+	}
+	if lt.mtlsAddr == "" {
+		server.TLSConfig = lt.tlsConfig(lt.clientAuth)
+		server.Protocols.SetHTTP2(true)
+		return nil
+	}
+	server.TLSConfig = lt.tlsConfig(tls.NoClientCert)
+	server.Protocols.SetHTTP2(true)
+
+	mtls := &http.Server{
+		Addr:         lt.mtlsAddr,
+		Handler:      server.Handler,
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: server.WriteTimeout,
+		IdleTimeout:  server.IdleTimeout,
+		TLSConfig:    lt.tlsConfig(tls.RequireAndVerifyClientCert),
+	}
+	return mtls
+}
+
+// redirectServer returns a server redirecting plain HTTP on
+// GATEWAY_HTTP_REDIRECT_ADDR to the main server's HTTPS, nil when there is
+// none
+func (lt *ListenerTLS) redirectServer(server *http.Server) *http.Server {
+	if lt == nil || lt.redirectAddr == "" {
+		return nil
+	}
+	_, port, _ := net.SplitHostPort(server.Addr)
+	return &http.Server{
+		Addr:         lt.redirectAddr,
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: server.WriteTimeout,
+		IdleTimeout:  server.IdleTimeout,
+		Handler: lt.acme.httpHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if hostname, _, err := net.SplitHostPort(host); err == nil {
+				host = hostname
+			}
+			host = strings.Trim(host, "[]")
+			if host == "" {
+				http.Error(w, "Missing Host header", http.StatusBadRequest)
+				return
+			}
+			if port != "" && port != "443" {
+				host = net.JoinHostPort(host, port)
+			} else if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+			// 308 keeps the method and body of writes
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+		})),
+	}
+}
+
+// listenAndServe serves a server over TLS when it has a TLS configuration
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// checkRevocation refuses verified client certificates that have been
+// revoked
+func (lt *ListenerTLS) checkRevocation(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil // no certificate, as optional client auth allows
+	}
+	chain := state.VerifiedChains[0]
+	leaf, issuer := chain[0], chain[0]
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+
+	if lt.crlFile != "" && lt.isRevoked(leaf) {
+		lt.rejected.WithLabelValues("crl").Inc()
+		return fmt.Errorf("client certificate %s is revoked", leaf.SerialNumber)
+	}
+	if lt.ocspMode != "off" && len(leaf.OCSPServer) > 0 {
+		status, err := lt.ocspStatus(leaf, issuer)
+		switch {
+		case err != nil && lt.ocspMode == "hard":
+			lt.rejected.WithLabelValues("ocsp_unavailable").Inc()
+			return fmt.Errorf("check client certificate status: %w", err)
+		case err != nil:
+			lt.logger.Warn("OCSP responder unavailable, admitting client certificate",
+				zap.String("subject", leaf.Subject.String()),
+				zap.Error(err))
+		case status == ocsp.Revoked:
+			lt.rejected.WithLabelValues("ocsp").Inc()
+			return fmt.Errorf("client certificate %s is revoked", leaf.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// isRevoked reports whether a certificate is in the CRLs, loading them
+// again first if the file has changed
+func (lt *ListenerTLS) isRevoked(cert *x509.Certificate) bool {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	if time.Since(lt.crlChecked) >= crlCheckInterval {
+		lt.crlChecked = time.Now()
+		if info, err := os.Stat(lt.crlFile); err == nil && !info.ModTime().Equal(lt.crlChanged) {
+			if err := lt.loadCRLsLocked(); err != nil {
+				lt.logger.Error("Failed to reload client CRLs, keeping the previous ones", zap.Error(err))
+			}
+		}
+	}
+	return lt.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()]
+}
+
+func (lt *ListenerTLS) loadCRLs() error {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	return lt.loadCRLsLocked()
+}
+
+// loadCRLsLocked reads the CRL file, PEM or DER, and checks each CRL was
+// signed by one of the client CAs. The caller must hold lt.mutex.
+func (lt *ListenerTLS) loadCRLsLocked() error {
+	info, err := os.Stat(lt.crlFile)
+	if err != nil {
+		return fmt.Errorf("read client CRLs: %w", err)
+	}
+	data, err := os.ReadFile(lt.crlFile)
+	if err != nil {
+		return fmt.Errorf("read client CRLs: %w", err)
+	}
+
+	var ders [][]byte
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			ders = append(ders, block.Bytes)
+		}
+	} else {
+		ders = append(ders, data)
+	}
+
+	revoked := make(map[string]map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("parse client CRL: %w", err)
+		}
+		signed := false
+		for _, ca := range lt.caCerts {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return fmt.Errorf("client CRL of %s is not signed by a client CA", crl.Issuer)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			lt.logger.Warn("Client CRL is past its next update", zap.String("issuer", crl.Issuer.String()))
+		}
+		serials := revoked[string(crl.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+
+	lt.revoked, lt.crlChanged = revoked, info.ModTime()
+	return nil
+}
+
+// ocspStatus asks a certificate's OCSP responder for its status, answering
+// from the cache while the last answer is current
+func (lt *ListenerTLS) ocspStatus(cert, issuer *x509.Certificate) (int, error) {
+	key := string(issuer.RawSubject) + "|" + cert.SerialNumber.String()
+	lt.mutex.Lock()
+	answer, cached := lt.ocspCache[key]
+	lt.mutex.Unlock()
+	if cached && time.Now().Before(answer.expiry) {
+		return answer.status, nil
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ocspTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := lt.ocspClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return 0, err
+	}
+
+	answer = ocspAnswer{status: parsed.Status, expiry: parsed.NextUpdate}
+	if answer.expiry.IsZero() {
+		answer.expiry = time.Now().Add(ocspMaxAge)
+	}
+	lt.mutex.Lock()
+	lt.ocspCache[key] = answer
+	lt.mutex.Unlock()
+	return answer.status, nil
+}
+
+// clientCertIdentity describes the verified certificate a request's client
+// connected with as the values of clientCertHeaders, nil without one
+func clientCertIdentity(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var sans []string
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI="+uri.String())
+	}
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS="+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email="+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP="+ip.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return []string{cert.Subject.String(), strings.Join(sans, ","), hex.EncodeToString(fingerprint[:])}
+}
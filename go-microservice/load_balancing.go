@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// loadBalancingStrategies lists the values accepted by LB_STRATEGY
+var loadBalancingStrategies = map[string]bool{
+	"round-robin":          true,
+	"weighted-round-robin": true,
+	"least-connections":    true,
+	"random":               true,
+	"weighted-random":      true,
+	"consistent-hash":      true,
+	"least-latency":        true,
+	"p2c":                  true,
+}
+
+// validate checks the LB_STRATEGY and LB_HASH_KEY settings
+func (lb *LoadBalancer) validate() error {
+	if !loadBalancingStrategies[lb.strategy] {
+		return fmt.Errorf("unknown load balancing strategy %q", lb.strategy)
+	}
+	if !validRequestKey(lb.hashKey) {
+		return fmt.Errorf("invalid LB_HASH_KEY %q, expected ip, header:<name> or cookie:<name>", lb.hashKey)
+	}
+	return nil
+}
+
+// routable reports whether an instance may get traffic at all. The registry
+// refreshes pooled copies as statuses change, so this sees the health
+// checker's verdict.
+func routable(instance *ServiceInstance) bool {
+	return instance.Status == "healthy"
+}
+
+// instanceSubset narrows picks to the instances of a pool that match, e.g.
+// a canary's or those a routing rule selects
+type instanceSubset struct {
+	scope string // suffixes the pool key for the subset's strategy state
+	match func(*ServiceInstance) bool
+}
+
+// GetNextServiceSubset is GetNextServiceForRequest narrowed to a subset
+// of the pool
+func (lb *LoadBalancer) GetNextServiceSubset(serviceName string, subset *instanceSubset, r *http.Request) *ServiceInstance {
+	hashKey := ""
+	if lb.strategy == "consistent-hash" {
+		hashKey = lb.requestHashKey(r)
+	}
+	return lb.pick(serviceName, "", hashKey, subset)
+}
+
+// narrowSubset narrows a pool to a subset, or leaves it whole when no
+// instance matches. Like preferLocalZone it also returns the key to keep
+// strategy state under.
+func narrowSubset(key string, instances []*ServiceInstance, subset *instanceSubset) ([]*ServiceInstance, string) {
+	if subset == nil {
+		return instances, key
+	}
+
+	matching := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if subset.match(instance) {
+			matching = append(matching, instance)
+		}
+	}
+	if len(matching) == 0 {
+		return instances, key
+	}
+	return matching, key + subset.scope
+}
+
+// fallback is used when no instance is selectable: it returns the first
+// routable instance from offset start, ignoring ejection and slow start,
+// or nil when the pool has no healthy instance. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) fallback(instances []*ServiceInstance, start int) *ServiceInstance {
+	for i := range instances {
+		if instance := instances[(start+i)%len(instances)]; routable(instance) {
+			return instance
+		}
+	}
+	return nil
+}
+
+// Begin counts a request in flight to an instance for least-connections
+// balancing and connection draining. The returned context is cancelled if
+// the instance is removed and its drain times out; the returned function
+// must be called when the request completes.
+func (lb *LoadBalancer) Begin(ctx context.Context, instanceID string) (context.Context, func()) {
+	lb.mutex.Lock()
+	lb.inflight[instanceID]++
+	requests := lb.requests[instanceID]
+	if requests == nil {
+		requests = &instanceRequests{}
+		requests.ctx, requests.cancel = context.WithCancel(context.Background())
+		lb.requests[instanceID] = requests
+	}
+	lb.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(requests.ctx, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+
+		lb.mutex.Lock()
+		defer lb.mutex.Unlock()
+
+		if lb.inflight[instanceID]--; lb.inflight[instanceID] <= 0 {
+			delete(lb.inflight, instanceID)
+			if lb.requests[instanceID] == requests {
+				requests.cancel()
+				delete(lb.requests, instanceID)
+			}
+			if requests.removed {
+				delete(lb.latencies, instanceID)
+				delete(lb.stats, instanceID)
+			}
+			lb.stopDrain(instanceID)
+		}
+	}
+}
+
+// fewerConnections reports whether a is less loaded than b relative to
+// their weights, so an instance of weight 2 takes twice the requests
+func (lb *LoadBalancer) fewerConnections(a, b *ServiceInstance) bool {
+	return lb.inflight[a.ID]*max(b.Weight, 1) < lb.inflight[b.ID]*max(a.Weight, 1)
+}
+
+// leastConnections picks the selectable instance with the fewest requests
+// in flight. Scanning starts at a rotating offset so idle pools still
+// spread requests instead of always picking the first instance. The
+// caller must hold lb.mutex.
+func (lb *LoadBalancer) leastConnections(key string, instances []*ServiceInstance, now time.Time) *ServiceInstance {
+	start := lb.current[key]
+	lb.current[key] = (start + 1) % len(instances)
+
+	var best *ServiceInstance
+	for i := range instances {
+		instance := instances[(start+i)%len(instances)]
+		if !lb.selectable(instance, now) {
+			continue
+		}
+		if best == nil || lb.fewerConnections(instance, best) {
+			best = instance
+		}
+	}
+	if best == nil {
+		return lb.fallback(instances, start)
+	}
+	return best
+}
+
+// random picks a selectable instance at random, in proportion to instance
+// weights when weighted is set. Unlike round-robin it gives clients no
+// shared order to synchronize on. The caller must hold lb.mutex.
+func (lb *LoadBalancer) random(instances []*ServiceInstance, now time.Time, weighted bool) *ServiceInstance {
+	candidates := make([]*ServiceInstance, 0, len(instances))
+	total := 0
+	for _, instance := range instances {
+		if lb.selectable(instance, now) {
+			candidates = append(candidates, instance)
+			total += instanceWeight(instance, weighted)
+		}
+	}
+	if len(candidates) == 0 {
+		return lb.fallback(instances, rand.Intn(len(instances)))
+	}
+
+	pick := rand.Intn(total)
+	for _, instance := range candidates {
+		if pick -= instanceWeight(instance, weighted); pick < 0 {
+			return instance
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// instanceWeight is an instance's share for weighted strategies, or 1
+func instanceWeight(instance *ServiceInstance, weighted bool) int {
+	if !weighted {
+		return 1
+	}
+	return max(instance.Weight, 1)
+}
+
+// p2cAttempts bounds the random draws power-of-two-choices makes to find
+// two selectable instances
+const p2cAttempts = 8
+
+// powerOfTwoChoices draws two random selectable instances and picks the
+// one with fewer requests in flight. It balances nearly as well as
+// least-connections without scanning the whole pool. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) powerOfTwoChoices(instances []*ServiceInstance, now time.Time) *ServiceInstance {
+	if len(instances) == 1 {
+		return lb.fallback(instances, 0)
+	}
+
+	var first, second *ServiceInstance
+	for attempt := 0; attempt < p2cAttempts && second == nil; attempt++ {
+		candidate := instances[rand.Intn(len(instances))]
+		if candidate == first || !lb.selectable(candidate, now) {
+			continue
+		}
+		if first == nil {
+			first = candidate
+		} else {
+			second = candidate
+		}
+	}
+
+	switch {
+	case first == nil:
+		return lb.fallback(instances, rand.Intn(len(instances)))
+	case second == nil:
+		return first
+	case lb.fewerConnections(second, first):
+		return second
+	default:
+		return first
+	}
+}
+
+// weightedRoundRobin is nginx's smooth weighted round-robin: every pick
+// raises each selectable instance's current weight by its weight, takes
+// the highest and lowers it by the total. Weights 5, 1, 1 give
+// a a b a c a a rather than a burst of five to the heaviest instance. The
+// caller must hold lb.mutex.
+func (lb *LoadBalancer) weightedRoundRobin(key string, instances []*ServiceInstance, now time.Time) *ServiceInstance {
+	current := lb.currentWeights[key]
+	if current == nil {
+		current = make(map[string]int, len(instances))
+		lb.currentWeights[key] = current
+	}
+
+	var best *ServiceInstance
+	total := 0
+	for _, instance := range instances {
+		if !lb.selectable(instance, now) {
+			continue
+		}
+		weight := max(instance.Weight, 1)
+		current[instance.ID] += weight
+		total += weight
+		if best == nil || current[instance.ID] > current[best.ID] {
+			best = instance
+		}
+	}
+	if best == nil {
+		return lb.fallback(instances, 0)
+	}
+
+	current[best.ID] -= total
+	return best
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestLoadBalancer returns a load balancer with the given strategy and
+// a healthy instance of "orders" per weight, named a, b, c...
+func newTestLoadBalancer(strategy string, weights ...int) *LoadBalancer {
+	lb := NewLoadBalancer()
+	lb.strategy = strategy
+	for i, weight := range weights {
+		lb.AddService("orders", &ServiceInstance{
+			ID:     string(rune('a' + i)),
+			Name:   "orders",
+			Status: "healthy",
+			Weight: weight,
+		})
+	}
+	return lb
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    string
+	}{
+		{"smooth", []int{5, 1, 1}, "aabacaa"},
+		{"equal weights", []int{1, 1, 1}, "abcabc"},
+		{"unset weights count as one", []int{0, 0}, "abab"},
+		{"two to one", []int{2, 1}, "abaaba"},
+		{"single instance", []int{3}, "aaa"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer("weighted-round-robin", tt.weights...)
+			var got strings.Builder
+			for range tt.want {
+				got.WriteString(lb.GetNextService("orders").ID)
+			}
+			if got.String() != tt.want {
+				t.Errorf("picks = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinSkipsUnhealthy(t *testing.T) {
+	lb := newTestLoadBalancer("weighted-round-robin", 5, 1, 1)
+	lb.services["orders"][0].Status = "unhealthy"
+
+	counts := make(map[string]int)
+	for range 10 {
+		counts[lb.GetNextService("orders").ID]++
+	}
+	if counts["a"] != 0 || counts["b"] != 5 || counts["c"] != 5 {
+		t.Errorf("picks = %v, want b and c 5 times each", counts)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	const keys = 30000
+
+	tests := []struct {
+		name    string
+		weights []int
+		want    []float64 // share of the keys each instance owns
+	}{
+		{"equal weights", []int{1, 1, 1}, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+		{"weighted", []int{2, 1, 1}, []float64{0.5, 0.25, 0.25}},
+		{"single instance", []int{1}, []float64{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer("consistent-hash", tt.weights...)
+			counts := make(map[string]int)
+			for i := range keys {
+				counts[lb.pick("orders", "", "client-"+strconv.Itoa(i), nil).ID]++
+			}
+			for i, share := range tt.want {
+				id := string(rune('a' + i))
+				got := float64(counts[id]) / keys
+				if got < share*0.8 || got > share*1.2 {
+					t.Errorf("instance %s owns %.3f of the keys, want %.3f within 20%%", id, got, share)
+				}
+			}
+		})
+	}
+}
+
+func TestConsistentHashStability(t *testing.T) {
+	lb := newTestLoadBalancer("consistent-hash", 1, 1, 1, 1)
+	before := make(map[string]string)
+	for i := range 5000 {
+		key := "client-" + strconv.Itoa(i)
+		if first, again := lb.pick("orders", "", key, nil).ID, lb.pick("orders", "", key, nil).ID; first != again {
+			t.Fatalf("key %s went to %s, then %s", key, first, again)
+		} else {
+			before[key] = first
+		}
+	}
+
+	lb.RemoveService("orders", "d")
+	for key, owner := range before {
+		got := lb.pick("orders", "", key, nil).ID
+		if owner != "d" && got != owner {
+			t.Errorf("key %s moved from %s to %s when d left", key, owner, got)
+		}
+		if got == "d" {
+			t.Errorf("key %s still goes to d after it left", key)
+		}
+	}
+}
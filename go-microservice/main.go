@@ -3,14 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -24,26 +26,164 @@ import (
 
 // ServiceRegistry manages microservice instances
 type ServiceRegistry struct {
-	services map[string]*ServiceInstance
-	mutex    sync.RWMutex
-	logger   *zap.Logger
+	services     map[string]*ServiceInstance
+	mutex        sync.RWMutex
+	logger       *zap.Logger
+	backend      RegistryBackend
+	heartbeatTTL time.Duration // default TTL, 0 disables expiry
+	index        *registryIndex
+	metrics      *registryMetrics
+	audit        *AuditLog
+	history      map[string]*healthHistory // by instance ID
+
+	// routing gets a fresh copy of every instance that changes, so the
+	// load balancer never reads the instances the registry writes
+	routing *LoadBalancer
+
+	// Consecutive check results needed to flip an instance's status,
+	// unless the instance configures its own
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	// maxProbeBackoff caps how far checks of long-failing instances are
+	// spread out
+	maxProbeBackoff time.Duration
+
+	// Change log served by the watch API
+	version uint64
+	changes []RegistryChange
+	changed chan struct{}
 }
 
+// ErrServiceNotFound is returned when an instance ID is not registered
+var ErrServiceNotFound = errors.New("service not found")
+
+// ErrLocalInstance is returned for changes to instances owned by a
+// discovery source or STATIC_UPSTREAMS_FILE rather than the registry API
+var ErrLocalInstance = errors.New("instance is managed by a discovery source or static upstreams")
+
 type ServiceInstance struct {
-	ID       string    `json:"id"`
-	Name     string    `json:"name"`
-	Address  string    `json:"address"`
-	Port     int       `json:"port"`
-	Status   string    `json:"status"`
-	LastSeen time.Time `json:"last_seen"`
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	Address  string                 `json:"address"`
+	Port     int                    `json:"port"`
+	Status   string                 `json:"status"`
+	LastSeen time.Time              `json:"last_seen"`
 	Metadata map[string]interface{} `json:"metadata"`
+	Tags     []string               `json:"tags,omitempty"`
+	Version  string                 `json:"version,omitempty"`
+	Origin   string                 `json:"origin,omitempty"` // datacenter of federated instances
+	Zone     string                 `json:"zone,omitempty"`
+	Region   string                 `json:"region,omitempty"`
+
+	// Namespace partitions the registry between teams; names only need to
+	// be unique within a namespace
+	Namespace string `json:"namespace"`
+
+	// Weight is the instance's relative share of traffic for weighted load
+	// balancing strategies; it defaults to 1
+	Weight int `json:"weight"`
+
+	// Priority is "primary" (the default) or "backup"; backups only get
+	// traffic while no primary of their pool can take it
+	Priority string `json:"priority,omitempty"`
+
+	// DependsOn lists the names of the upstream services this one calls
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// TTL in seconds; instances that do not heartbeat within it expire
+	TTL           int       `json:"ttl,omitempty"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+
+	// Static instances come from STATIC_UPSTREAMS_FILE; they are never
+	// health checked, expired or deregistered
+	Static bool `json:"static,omitempty"`
+
+	// HealthCheck overrides the default health check for this instance
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+
+	// local marks instances found by a discovery source on this gateway;
+	// they are never written to the registry backend
+	local bool
+	// nextCheck is when the health checker next probes the instance;
+	// the counters hold its current run of passed or failed checks
+	nextCheck     time.Time
+	checkPasses   int
+	checkFailures int
+	// recoveredAt is when the instance last became healthy again, for
+	// slow start
+	recoveredAt time.Time
+	// heartbeatPublished is when a heartbeat was last written to the
+	// backend for the leader, which expires instances for every gateway
+	heartbeatPublished time.Time
 }
 
+// ServiceUpdate holds the mutable registration fields accepted by
+// PUT /api/services/{id}; omitted fields are left unchanged
+type ServiceUpdate struct {
+	Address  *string                `json:"address"`
+	Port     *int                   `json:"port"`
+	Metadata map[string]interface{} `json:"metadata"`
+	Tags     []string               `json:"tags"`
+	Version  *string                `json:"version"`
+	TTL      *int                   `json:"ttl"`
+	Zone     *string                `json:"zone"`
+	Region   *string                `json:"region"`
+	Weight   *int                   `json:"weight"`
+	Priority *string                `json:"priority"`
+
+	DependsOn   []string           `json:"depends_on"`
+	HealthCheck *HealthCheckConfig `json:"health_check"`
+}
+
+// LoadBalancer keeps one pool per service name plus one pool per
+// service version, keyed by poolKey (e.g. "orders" and "orders@v2").
+// Pools hold copies of the registry's instances, which the registry
+// refreshes whenever it records a change, so strategies read each
+// instance's current status and Weight without the registry lock.
 type LoadBalancer struct {
 	services map[string][]*ServiceInstance
 	current  map[string]int
 	mutex    sync.RWMutex
-	strategy string // round-robin, least-connections, random
+	strategy string         // LB_STRATEGY, see loadBalancingStrategies
+	inflight map[string]int // requests in flight by instance ID
+
+	// latencies feeds the least-latency strategy, by instance ID
+	latencies map[string]*instanceLatency
+	// stats backs the /api/lb/{service}/stats API, by instance ID
+	stats map[string]*instanceStats
+
+	// currentWeights holds the weighted-round-robin state of each pool,
+	// reset when the pool changes
+	currentWeights map[string]map[string]int
+
+	// Zone-aware routing prefers instances in the gateway's own zone
+	zone            string
+	zoneMaxInflight int
+
+	// Deterministic subsetting of large pools, 0 size disables it
+	subsetSize     int
+	subsetClientID int
+	subsets        map[string][]*ServiceInstance
+
+	// consistent-hash strategy: LB_HASH_KEY and the ring of each pool,
+	// rebuilt when the pool changes
+	hashKey string
+	rings   map[string]*hashRing
+
+	// ejected holds instances taken out of selection by outlier
+	// detection, until the time they may be picked again
+	ejected map[string]time.Time
+
+	// slowStart is how long a recovered instance takes to ramp up to a
+	// full share of traffic, 0 disables the ramp
+	slowStart time.Duration
+
+	// Connection draining: instances removed with requests in flight are
+	// tracked until those complete or drainTimeout passes
+	drainTimeout time.Duration
+	draining     map[string]*DrainStatus
+	requests     map[string]*instanceRequests
 }
 
 type APIGateway struct {
@@ -51,25 +191,78 @@ type APIGateway struct {
 	loadBalancer *LoadBalancer
 	logger       *zap.Logger
 	upgrader     websocket.Upgrader
-	connections  map[string]*websocket.Conn
+	connections  map[string]*websocketClient
 	connMutex    sync.RWMutex
 	metrics      *Metrics
+	federation   *Federation
+	webhooks     *WebhookManager
+	acl          *ACL
+	aliases      *AliasTable
+	outliers     *OutlierDetector
+	readiness    *Readiness
+	dependencies map[string]dependencyCheck // checked by /api/health?deep=true
+	synthetic    *SyntheticProber
+	sticky       *StickySessions
+	retries      *RetryPolicies
+	breakers     *CircuitBreakers
+	forwarded    *ForwardedHeaders
+	grpcRoutes   *GRPCRoutes
+	transcoder   *GRPCTranscoder
+	cache        *ResponseCache
+	idempotency  *IdempotencyStore
+	compression  *Compression
+	mirrors      *Mirrors
+	hedging      *Hedging
+	concurrency  *ConcurrencyLimits
+	uploads      *Uploads
+	failover     *Failover
+	oidc         *OIDC
+	rateLimits   *RateLimiter
+	ipAccess     *IPAccess
+	cors         *CORS
+	signatures   *Signatures
+	inspector    *Inspector
+
+	// routes, proxyTransports and flushInterval configure the reverse proxy
+	routes          *RouteTable
+	pathRoutes      *PathRoutes
+	proxyTransports *proxyTransports
+	flushInterval   time.Duration
 }
 
 type Metrics struct {
-	requestsTotal     prometheus.Counter
-	requestDuration   prometheus.Histogram
+	requestsTotal     *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
 	activeConnections prometheus.Gauge
 	serviceHealth     *prometheus.GaugeVec
+	zoneRequests      *prometheus.CounterVec
+	canaryRequests    *prometheus.CounterVec
+	canaryDuration    *prometheus.HistogramVec
+	splitRequests     *prometheus.CounterVec
 }
 
 type HealthCheck struct {
-	Status    string            `json:"status"`
-	Timestamp time.Time         `json:"timestamp"`
-	Services  map[string]string `json:"services"`
-	Uptime    string            `json:"uptime"`
-	Version   string            `json:"version"`
-	Memory    MemoryInfo        `json:"memory"`
+	Status    string                 `json:"status"`
+	Timestamp time.Time              `json:"timestamp"`
+	Services  map[string]string      `json:"services"`
+	Uptime    string                 `json:"uptime"`
+	Version   string                 `json:"version"`
+	Memory    MemoryInfo             `json:"memory"`
+	Zones     map[string]*ZoneHealth `json:"zones,omitempty"`
+
+	// Dependencies is only filled in by deep checks
+	Dependencies map[string]*DependencyStatus `json:"dependencies,omitempty"`
+
+	// Synthetic holds the latest result of each synthetic probe
+	Synthetic map[string]*SyntheticResult `json:"synthetic,omitempty"`
+}
+
+// ZoneHealth summarizes the instances of one availability zone
+type ZoneHealth struct {
+	Region     string `json:"region,omitempty"`
+	Total      int    `json:"total"`
+	Healthy    int    `json:"healthy"`
+	InRotation int    `json:"in_rotation"`
 }
 
 type MemoryInfo struct {
@@ -81,31 +274,80 @@ type MemoryInfo struct {
 
 var startTime = time.Now()
 
-func NewServiceRegistry(logger *zap.Logger) *ServiceRegistry {
-	return &ServiceRegistry{
-		services: make(map[string]*ServiceInstance),
-		logger:   logger,
+// backendTimeout bounds a single call to the registry backend
+const backendTimeout = 10 * time.Second
+
+// defaultWeight is used for instances registered without a weight
+const defaultWeight = 1
+
+// applyDefaults fills in the fields an instance may be registered without
+func applyDefaults(service *ServiceInstance) {
+	if service.Weight <= 0 {
+		service.Weight = defaultWeight
+	}
+	if service.Namespace == "" {
+		service.Namespace = defaultNamespace
+	}
+}
+
+func NewServiceRegistry(logger *zap.Logger, backend RegistryBackend) *ServiceRegistry {
+	registry := &ServiceRegistry{
+		services:     make(map[string]*ServiceInstance),
+		logger:       logger,
+		backend:      backend,
+		heartbeatTTL: getEnvDuration("HEARTBEAT_TTL", 0),
+		changed:      make(chan struct{}),
+		index:        newRegistryIndex(),
+		history:      make(map[string]*healthHistory),
+
+		healthyThreshold:   getEnvInt("HEALTH_CHECK_HEALTHY_THRESHOLD", 2),
+		unhealthyThreshold: getEnvInt("HEALTH_CHECK_UNHEALTHY_THRESHOLD", 3),
+		maxProbeBackoff:    getEnvDuration("HEALTH_CHECK_MAX_BACKOFF", 5*time.Minute),
 	}
+	registry.metrics = newRegistryMetrics(registry)
+	return registry
 }
 
 func NewLoadBalancer() *LoadBalancer {
 	return &LoadBalancer{
 		services: make(map[string][]*ServiceInstance),
 		current:  make(map[string]int),
-		strategy: "round-robin",
+		strategy: getEnv("LB_STRATEGY", "round-robin"),
+		inflight: make(map[string]int),
+
+		latencies: make(map[string]*instanceLatency),
+		stats:     make(map[string]*instanceStats),
+
+		currentWeights: make(map[string]map[string]int),
+
+		zone:            getEnv("GATEWAY_ZONE", ""),
+		zoneMaxInflight: getEnvInt("LB_ZONE_MAX_INFLIGHT", 0),
+
+		subsetSize:     getEnvInt("LB_SUBSET_SIZE", 0),
+		subsetClientID: max(getEnvInt("LB_SUBSET_CLIENT_ID", 0), 0),
+		subsets:        make(map[string][]*ServiceInstance),
+		hashKey:        getEnv("LB_HASH_KEY", "ip"),
+		rings:          make(map[string]*hashRing),
+		ejected:        make(map[string]time.Time),
+
+		slowStart: getEnvDuration("SLOW_START_WINDOW", 30*time.Second),
+
+		drainTimeout: getEnvDuration("DRAIN_TIMEOUT", 30*time.Second),
+		draining:     make(map[string]*DrainStatus),
+		requests:     make(map[string]*instanceRequests),
 	}
 }
 
 func NewMetrics() *Metrics {
 	return &Metrics{
-		requestsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests",
-		}),
-		requestDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+		}, []string{"namespace"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name: "http_request_duration_seconds",
 			Help: "HTTP request duration in seconds",
-		}),
+		}, []string{"namespace"}),
 		activeConnections: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "websocket_connections_active",
 			Help: "Number of active WebSocket connections",
@@ -113,7 +355,23 @@ func NewMetrics() *Metrics {
 		serviceHealth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "service_health_status",
 			Help: "Health status of registered services",
-		}, []string{"service_name"}),
+		}, []string{"namespace", "service_name"}),
+		zoneRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_zone_requests_total",
+			Help: "Proxied requests by whether they stayed in the gateway's zone",
+		}, []string{"locality"}),
+		canaryRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_canary_requests_total",
+			Help: "Proxied requests to services with a canary by variant and status code",
+		}, []string{"namespace", "service", "variant", "code"}),
+		canaryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "proxy_canary_request_duration_seconds",
+			Help: "Duration of proxied requests to services with a canary by variant",
+		}, []string{"namespace", "service", "variant"}),
+		splitRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_split_requests_total",
+			Help: "Proxied requests to services with a traffic split by version and status code",
+		}, []string{"namespace", "service", "version", "code"}),
 	}
 }
 
@@ -122,50 +380,121 @@ func (m *Metrics) Register() {
 	prometheus.MustRegister(m.requestDuration)
 	prometheus.MustRegister(m.activeConnections)
 	prometheus.MustRegister(m.serviceHealth)
+	prometheus.MustRegister(m.zoneRequests)
+	prometheus.MustRegister(m.canaryRequests)
+	prometheus.MustRegister(m.canaryDuration)
+	prometheus.MustRegister(m.splitRequests)
 }
 
-func NewAPIGateway(logger *zap.Logger) *APIGateway {
+func NewAPIGateway(logger *zap.Logger, backend RegistryBackend) *APIGateway {
 	metrics := NewMetrics()
 	metrics.Register()
 
+	registry := NewServiceRegistry(logger, backend)
+	prometheus.MustRegister(registry.metrics)
+	loadBalancer := NewLoadBalancer()
+	registry.routing = loadBalancer
+
 	return &APIGateway{
-		registry:     NewServiceRegistry(logger),
-		loadBalancer: NewLoadBalancer(),
+		registry:     registry,
+		loadBalancer: loadBalancer,
 		logger:       logger,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins in development
 			},
 		},
-		connections: make(map[string]*websocket.Conn),
+		connections: make(map[string]*websocketClient),
 		metrics:     metrics,
+		webhooks:    NewWebhookManager(registry, logger),
+		aliases:     NewAliasTable(logger),
+		outliers:    NewOutlierDetector(loadBalancer, logger),
+		breakers:    NewCircuitBreakers(logger),
+		cache:       NewResponseCache(),
+		idempotency: NewIdempotencyStore(),
+		mirrors:     NewMirrors(logger),
+		hedging:     NewHedging(),
+		concurrency: NewConcurrencyLimits(),
+		uploads:     NewUploads(),
+		failover:    NewFailover(),
+		readiness:   NewReadiness(),
+		dependencies: map[string]dependencyCheck{
+			"registry_backend": registry.registryBackendCheck,
+		},
+		proxyTransports: newProxyTransports(),
+		flushInterval:   getEnvDuration("PROXY_FLUSH_INTERVAL", 100*time.Millisecond),
 	}
 }
 
 // Service Discovery and Registration
-func (sr *ServiceRegistry) RegisterService(service *ServiceInstance) error {
+func (sr *ServiceRegistry) RegisterService(ctx context.Context, service *ServiceInstance) error {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	return sr.register(ctx, service)
+}
+
+// RegisterServices registers a batch of instances under a single lock
+// acquisition. The returned slice holds one error (or nil) per instance.
+func (sr *ServiceRegistry) RegisterServices(ctx context.Context, services []*ServiceInstance) []error {
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
+	errs := make([]error, len(services))
+	for i, service := range services {
+		errs[i] = sr.register(ctx, service)
+	}
+	return errs
+}
+
+// register stores an instance; the caller must hold sr.mutex
+func (sr *ServiceRegistry) register(ctx context.Context, service *ServiceInstance) error {
 	service.LastSeen = time.Now()
+	service.LastHeartbeat = service.LastSeen
 	service.Status = "healthy"
+	applyDefaults(service)
+
+	if existing, exists := sr.services[service.ID]; exists && existing.Namespace != service.Namespace {
+		return fmt.Errorf("%w: %s is in namespace %s", ErrNamespaceConflict, service.ID, existing.Namespace)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	if err := sr.backend.Register(ctx, service); err != nil {
+		return fmt.Errorf("failed to store service %s: %w", service.ID, err)
+	}
+
+	if existing, exists := sr.services[service.ID]; exists {
+		sr.index.remove(existing)
+	}
 	sr.services[service.ID] = service
+	sr.index.add(service)
+	sr.recordChangeFrom(ctx, "registered", service)
 
 	sr.logger.Info("Service registered",
 		zap.String("id", service.ID),
 		zap.String("name", service.Name),
+		zap.String("namespace", service.Namespace),
 		zap.String("address", service.Address),
 		zap.Int("port", service.Port))
 
 	return nil
 }
 
-func (sr *ServiceRegistry) DeregisterService(serviceID string) error {
+func (sr *ServiceRegistry) DeregisterService(ctx context.Context, serviceID string) error {
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	if err := sr.backend.Deregister(ctx, serviceID); err != nil {
+		return fmt.Errorf("failed to remove service %s: %w", serviceID, err)
+	}
+
 	if service, exists := sr.services[serviceID]; exists {
 		delete(sr.services, serviceID)
+		sr.index.remove(service)
+		sr.recordChangeFrom(ctx, "deregistered", service)
 		sr.logger.Info("Service deregistered",
 			zap.String("id", serviceID),
 			zap.String("name", service.Name))
@@ -174,6 +503,114 @@ func (sr *ServiceRegistry) DeregisterService(serviceID string) error {
 	return nil
 }
 
+func (sr *ServiceRegistry) GetService(serviceID string) (*ServiceInstance, bool) {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+
+	service, exists := sr.services[serviceID]
+	return service, exists
+}
+
+// addToRotation puts a registered instance into rotation. The balancer
+// copies it under the registry lock, so no change made meanwhile is lost.
+func (sr *ServiceRegistry) addToRotation(serviceID string) {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+
+	if service, exists := sr.services[serviceID]; exists {
+		sr.routing.AddService(service.poolName(), service)
+	}
+}
+
+// moveVersion moves a registered instance between version pools after an
+// update changed its version
+func (sr *ServiceRegistry) moveVersion(serviceID, previousVersion string) {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+
+	if service, exists := sr.services[serviceID]; exists {
+		sr.routing.MoveVersion(service.poolName(), service, previousVersion)
+	}
+}
+
+// UpdateService applies an update to a registered instance, stores it in
+// the backend and returns a copy of it
+func (sr *ServiceRegistry) UpdateService(ctx context.Context, serviceID string, update *ServiceUpdate) (*ServiceInstance, error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	service, exists := sr.services[serviceID]
+	if !exists {
+		return nil, ErrServiceNotFound
+	}
+	// They only exist on this gateway, so they must stay out of the backend
+	if service.local || service.Static {
+		return nil, ErrLocalInstance
+	}
+
+	updated := *service
+	if update.Address != nil {
+		updated.Address = *update.Address
+	}
+	if update.Port != nil {
+		updated.Port = *update.Port
+	}
+	if update.Metadata != nil {
+		updated.Metadata = update.Metadata
+	}
+	if update.Tags != nil {
+		updated.Tags = update.Tags
+	}
+	if update.Version != nil {
+		updated.Version = *update.Version
+	}
+	if update.TTL != nil {
+		updated.TTL = *update.TTL
+	}
+	if update.Zone != nil {
+		updated.Zone = *update.Zone
+	}
+	if update.Region != nil {
+		updated.Region = *update.Region
+	}
+	if update.Weight != nil {
+		updated.Weight = *update.Weight
+		if updated.Weight == 0 {
+			updated.Weight = defaultWeight
+		}
+	}
+	if update.Priority != nil {
+		updated.Priority = *update.Priority
+	}
+	if update.DependsOn != nil {
+		updated.DependsOn = update.DependsOn
+	}
+	if update.HealthCheck != nil {
+		updated.HealthCheck = update.HealthCheck
+		updated.nextCheck = time.Time{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	if err := sr.backend.Register(ctx, &updated); err != nil {
+		return nil, fmt.Errorf("failed to store service %s: %w", serviceID, err)
+	}
+
+	sr.index.remove(service)
+	*service = updated
+	sr.index.add(service)
+	sr.recordChangeFrom(ctx, "updated", service)
+
+	sr.logger.Info("Service updated",
+		zap.String("id", service.ID),
+		zap.String("name", service.Name),
+		zap.String("address", service.Address),
+		zap.Int("port", service.Port))
+
+	snapshot := *service
+	return &snapshot, nil
+}
+
 func (sr *ServiceRegistry) GetServices() map[string]*ServiceInstance {
 	sr.mutex.RLock()
 	defer sr.mutex.RUnlock()
@@ -185,79 +622,776 @@ func (sr *ServiceRegistry) GetServices() map[string]*ServiceInstance {
 	return services
 }
 
+// FindServices returns the instances carrying every given tag, metadata
+// value and attribute (zone, region), using the registry index
+func (sr *ServiceRegistry) FindServices(tags []string, metadata, attributes map[string]string) map[string]*ServiceInstance {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+
+	services := make(map[string]*ServiceInstance)
+	for id := range sr.index.lookup(tags, metadata, attributes) {
+		if service, exists := sr.services[id]; exists {
+			services[id] = service
+		}
+	}
+	return services
+}
+
+// Load fills the local cache from a backend snapshot, which it returns for
+// the watch to carry on from, along with the instances new to the cache for
+// the caller to put into rotation. Shared backends carry the leader's health
+// verdicts; otherwise the instances get no traffic until the health checker
+// probes them on its next round. As a reload follows a failed watch, it
+// also returns the changes missed meanwhile, updates of cached instances
+// and removals of those the backend no longer has, for the caller to apply.
+// The snapshot is taken under the lock, so registrations made here can't
+// fall between it and the cache.
+func (sr *ServiceRegistry) Load(ctx context.Context) (*RegistrySnapshot, []*ServiceInstance, []RegistryEvent, error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	listCtx, cancel := context.WithTimeout(ctx, backendTimeout)
+	snapshot, err := sr.backend.Snapshot(listCtx)
+	cancel()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	listed := indexServices(snapshot.Services)
+	missed := make([]RegistryEvent, 0)
+	for id, service := range sr.services {
+		if _, exists := listed[id]; !exists && !service.local {
+			missed = append(missed, RegistryEvent{Type: RegistryEventDelete, Instance: &ServiceInstance{ID: id}})
+		}
+	}
+
+	loaded := make([]*ServiceInstance, 0, len(snapshot.Services))
+	for _, instance := range snapshot.Services {
+		// The snapshot stays as the watch's starting point, so the cache
+		// gets copies
+		copied := *instance
+		service := &copied
+		if existing, exists := sr.services[service.ID]; exists {
+			if !existing.local {
+				missed = append(missed, RegistryEvent{Type: RegistryEventPut, Instance: service})
+			}
+			continue
+		}
+		applyDefaults(service)
+		sr.services[service.ID] = service
+		sr.index.add(service)
+		// Instances in maintenance stay out of rotation until an operator
+		// takes them out of it, expired ones until they heartbeat again
+		if outOfRotation(service) {
+			sr.recordChange("registered", service)
+			continue
+		}
+		if _, shared := sr.backend.(StatusPublisher); !shared || service.Status == "" {
+			service.Status = "unknown"
+		}
+		sr.recordChange("registered", service)
+		loaded = append(loaded, service)
+	}
+
+	sr.logger.Info("Registry loaded from backend",
+		zap.Int("services", len(loaded)),
+		zap.Int("missed_changes", len(missed)))
+	return snapshot, loaded, missed, nil
+}
+
+// applyEvent merges a backend change into the local cache. It returns the
+// instance that entered or left rotation (new, removed, or moved in or out
+// of maintenance) so the caller can update routing.
+func (sr *ServiceRegistry) applyEvent(event RegistryEvent) (added, removed *ServiceInstance) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	instance := event.Instance
+	existing, exists := sr.services[instance.ID]
+
+	switch event.Type {
+	case RegistryEventPut:
+		// Heartbeats taken by other gateways; only a newer one brings an
+		// expired instance back
+		resumed := false
+		if exists && instance.LastHeartbeat.After(existing.LastHeartbeat) {
+			existing.LastHeartbeat = instance.LastHeartbeat
+			resumed = existing.Status == "expired"
+		}
+		if exists && sameRegistration(existing, instance) {
+			return nil, nil
+		}
+		if exists {
+			sr.index.remove(existing)
+			existing.Name = instance.Name
+			existing.Namespace = instance.Namespace
+			existing.Address = instance.Address
+			existing.Port = instance.Port
+			existing.Metadata = instance.Metadata
+			existing.Tags = instance.Tags
+			existing.Version = instance.Version
+			existing.Zone = instance.Zone
+			existing.Region = instance.Region
+			existing.Weight = instance.Weight
+			existing.Priority = instance.Priority
+			existing.TTL = instance.TTL
+			existing.DependsOn = instance.DependsOn
+			existing.HealthCheck = instance.HealthCheck
+			wasOut := outOfRotation(existing)
+			// Health results, expiry and maintenance published by other gateways
+			if instance.Status != "" && instance.Status != existing.Status && (existing.Status != "expired" || resumed) {
+				existing.Status = instance.Status
+			}
+			sr.index.add(existing)
+			sr.recordChange("updated", existing)
+
+			switch isOut := outOfRotation(existing); {
+			case isOut && !wasOut:
+				return nil, existing
+			case wasOut && !isOut:
+				return existing, nil
+			}
+			return nil, nil
+		}
+		if instance.Status == "" {
+			instance.Status = "healthy"
+		}
+		applyDefaults(instance)
+		instance.LastSeen = time.Now()
+		sr.services[instance.ID] = instance
+		sr.index.add(instance)
+		sr.recordChange("registered", instance)
+		sr.logger.Info("Service discovered from backend",
+			zap.String("id", instance.ID),
+			zap.String("name", instance.Name))
+		if outOfRotation(instance) {
+			return nil, nil
+		}
+		return instance, nil
+	case RegistryEventDelete:
+		if exists {
+			delete(sr.services, instance.ID)
+			sr.index.remove(existing)
+			sr.recordChange("deregistered", existing)
+			sr.logger.Info("Service removed from backend",
+				zap.String("id", instance.ID),
+				zap.String("name", existing.Name))
+			return nil, existing
+		}
+	}
+
+	return nil, nil
+}
+
+// AddLocal caches an instance found by a discovery source (DNS, mDNS, static
+// config). Such instances are derived locally by every gateway, so they are
+// never written to the backend. It reports whether the instance is new.
+func (sr *ServiceRegistry) AddLocal(service *ServiceInstance) bool {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if _, exists := sr.services[service.ID]; exists {
+		return false
+	}
+
+	service.LastSeen = time.Now()
+	service.Status = "healthy"
+	applyDefaults(service)
+	service.local = true
+	sr.services[service.ID] = service
+	sr.index.add(service)
+	sr.recordChange("registered", service)
+
+	sr.logger.Info("Service discovered",
+		zap.String("id", service.ID),
+		zap.String("name", service.Name),
+		zap.String("address", service.Address),
+		zap.Int("port", service.Port))
+	return true
+}
+
+// RemoveLocal drops a discovered instance from the cache
+func (sr *ServiceRegistry) RemoveLocal(serviceID string) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	if service, exists := sr.services[serviceID]; exists {
+		delete(sr.services, serviceID)
+		sr.index.remove(service)
+		sr.recordChange("deregistered", service)
+		sr.logger.Info("Discovered service removed",
+			zap.String("id", serviceID),
+			zap.String("name", service.Name))
+	}
+}
+
+// outOfRotation reports whether an instance is kept out of the load
+// balancer regardless of its health
+func outOfRotation(service *ServiceInstance) bool {
+	return service.Status == "maintenance" || service.Status == "expired"
+}
+
+// Heartbeat refreshes an instance's TTL and returns a copy of it. It also
+// reports whether the instance had expired so the caller can put it back
+// into rotation. Only the leader expires instances, so the heartbeat is
+// published to the backend when it resumes an instance and otherwise at
+// most every third of the TTL.
+func (sr *ServiceRegistry) Heartbeat(ctx context.Context, serviceID string) (ServiceInstance, bool, error) {
+	sr.mutex.Lock()
+
+	service, exists := sr.services[serviceID]
+	if !exists {
+		sr.mutex.Unlock()
+		return ServiceInstance{}, false, ErrServiceNotFound
+	}
+
+	expired := service.Status == "expired"
+	service.LastHeartbeat = time.Now()
+	if expired {
+		service.Status = "healthy"
+		service.LastSeen = service.LastHeartbeat
+		sr.recordChangeFrom(ctx, "status_changed", service)
+		sr.logger.Info("Expired service resumed heartbeats",
+			zap.String("id", service.ID),
+			zap.String("name", service.Name))
+	}
+
+	ttl := sr.ttlFor(service)
+	publish := !service.local && ttl > 0 &&
+		(expired || service.LastHeartbeat.Sub(service.heartbeatPublished) >= ttl/3)
+	if publish {
+		service.heartbeatPublished = service.LastHeartbeat
+	}
+	snapshot := *service
+	sr.mutex.Unlock()
+
+	if publish {
+		sr.publishStatus([]ServiceInstance{snapshot})
+	}
+	return snapshot, expired, nil
+}
+
+func (sr *ServiceRegistry) ttlFor(service *ServiceInstance) time.Duration {
+	if service.TTL > 0 {
+		return time.Duration(service.TTL) * time.Second
+	}
+	return sr.heartbeatTTL
+}
+
+// ExpireStale marks instances whose heartbeat TTL elapsed as "expired" and
+// returns copies of them
+func (sr *ServiceRegistry) ExpireStale() []ServiceInstance {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	expired := make([]ServiceInstance, 0)
+	for _, service := range sr.services {
+		ttl := sr.ttlFor(service)
+		if ttl <= 0 || service.Status == "expired" || service.Status == "maintenance" || service.LastHeartbeat.IsZero() {
+			continue
+		}
+		if time.Since(service.LastHeartbeat) > ttl {
+			service.Status = "expired"
+			sr.recordChangeWithReason(context.Background(), "status_changed", service, "heartbeat TTL elapsed")
+			expired = append(expired, *service)
+			sr.logger.Warn("Service heartbeat expired",
+				zap.String("id", service.ID),
+				zap.String("name", service.Name),
+				zap.Duration("ttl", ttl))
+		}
+	}
+	return expired
+}
+
+// CollectGarbage removes instances that haven't been seen healthy for
+// longer than maxAge from the registry and the backend, and returns them.
+// Static instances, instances in maintenance and ones owned by a discovery
+// source are left alone.
+func (sr *ServiceRegistry) CollectGarbage(maxAge time.Duration) []*ServiceInstance {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	removed := make([]*ServiceInstance, 0)
+	for id, service := range sr.services {
+		if service.local || service.Static || service.Status == "maintenance" || service.LastSeen.IsZero() {
+			continue
+		}
+		age := time.Since(service.LastSeen)
+		if age <= maxAge {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+		err := sr.backend.Deregister(ctx, id)
+		cancel()
+		if err != nil {
+			sr.logger.Warn("Failed to remove stale service",
+				zap.String("id", id),
+				zap.Error(err))
+			continue
+		}
+
+		delete(sr.services, id)
+		sr.index.remove(service)
+		sr.recordChange("deregistered", service)
+		sr.metrics.evictions.WithLabelValues(service.Namespace, service.Name).Inc()
+		removed = append(removed, service)
+
+		sr.logger.Warn("Stale service removed",
+			zap.String("id", id),
+			zap.String("name", service.Name),
+			zap.String("status", service.Status),
+			zap.Duration("last_seen", age))
+	}
+	return removed
+}
+
+// healthCheckTick is how often the checker looks for instances whose own
+// check interval has elapsed
+const healthCheckTick = time.Second
+
 func (sr *ServiceRegistry) HealthCheck() {
-	ticker := time.NewTicker(30 * time.Second)
+	workers := getEnvInt("HEALTH_CHECK_CONCURRENCY", 16)
+	if workers < 1 {
+		workers = 1
+	}
+
+	ticker := time.NewTicker(healthCheckTick)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			sr.checkServiceHealth()
+			// Followers get health results from the leader via the backend
+			if sr.isLeader() {
+				sr.checkServiceHealth(workers)
+			}
+		}
+	}
+}
+
+// checkServiceHealth probes every instance that is due, at most workers at
+// a time. Probes run on copies without holding the registry lock, so slow
+// instances don't block registrations.
+func (sr *ServiceRegistry) checkServiceHealth(workers int) {
+	due := sr.dueHealthChecks()
+	if len(due) == 0 {
+		return
+	}
+
+	results := make([]error, len(due))
+	latencies := make([]time.Duration, len(due))
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := range due {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			start := time.Now()
+			results[i] = probeService(&due[i])
+			latencies[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	sr.publishStatus(sr.applyHealthResults(due, results, latencies))
+}
+
+// dueHealthChecks returns copies of the instances whose check interval has
+// elapsed and schedules their next check. Up to a tenth of the interval is
+// added as jitter so instances registered together don't stay in lockstep.
+func (sr *ServiceRegistry) dueHealthChecks() []ServiceInstance {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	// Shared backends have the leader check instances for every gateway,
+	// so it can't keep to its own subsets
+	_, shared := sr.backend.(StatusPublisher)
+
+	now := time.Now()
+	due := make([]ServiceInstance, 0)
+	for _, service := range sr.services {
+		// Expired instances only come back through a heartbeat, instances
+		// in maintenance are expected to fail checks, and static upstreams
+		// (databases, legacy services) may not speak HTTP at all
+		if service.Status == "expired" || service.Status == "maintenance" || service.Static {
+			continue
+		}
+		if now.Before(service.nextCheck) || (!shared && !sr.routing.balances(service)) {
+			continue
 		}
+
+		interval := sr.probeInterval(service)
+		service.nextCheck = now.Add(interval + time.Duration(rand.Int63n(int64(interval/10)+1)))
+		due = append(due, *service)
 	}
+	return due
 }
 
-func (sr *ServiceRegistry) checkServiceHealth() {
+// applyHealthResults updates the status of the checked instances and
+// returns the ones whose status changed. An instance only flips after a
+// run of results reaching its threshold, except that instances of unknown
+// status take the first result. Results are dropped for instances that
+// were deregistered, moved or taken out of checking meanwhile.
+func (sr *ServiceRegistry) applyHealthResults(checked []ServiceInstance, results []error, latencies []time.Duration) []ServiceInstance {
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
-	for id, service := range sr.services {
-		// Simple HTTP health check
-		client := &http.Client{Timeout: 5 * time.Second}
-		healthURL := fmt.Sprintf("http://%s:%d/health", service.Address, service.Port)
-		
-		resp, err := client.Get(healthURL)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			service.Status = "unhealthy"
+	changed := make([]ServiceInstance, 0)
+	for i := range checked {
+		service, exists := sr.services[checked[i].ID]
+		if !exists || service.Address != checked[i].Address || service.Port != checked[i].Port {
+			continue
+		}
+		if service.Status == "expired" || service.Status == "maintenance" {
+			continue
+		}
+
+		sr.recordProbe(service, latencies[i], results[i])
+
+		previous := service.Status
+		healthy, unhealthy := sr.healthThresholds(service)
+		if err := results[i]; err != nil {
+			service.checkPasses = 0
+			service.checkFailures++
+			if previous == "unknown" || service.checkFailures >= unhealthy {
+				service.Status = "unhealthy"
+			}
 			sr.logger.Warn("Service health check failed",
-				zap.String("id", id),
+				zap.String("id", service.ID),
 				zap.String("name", service.Name),
+				zap.Int("consecutive_failures", service.checkFailures),
 				zap.Error(err))
 		} else {
-			service.Status = "healthy"
+			// Leave probe backoff as soon as the instance answers again
+			if next := time.Now().Add(healthCheckInterval(service)); service.checkFailures > 0 && service.nextCheck.After(next) {
+				service.nextCheck = next
+			}
+			service.checkFailures = 0
+			service.checkPasses++
+			if previous == "unknown" || service.checkPasses >= healthy {
+				service.Status = "healthy"
+			}
 			service.LastSeen = time.Now()
 		}
-		
-		if resp != nil {
-			resp.Body.Close()
+
+		if service.Status != previous {
+			reason := ""
+			if results[i] != nil {
+				reason = results[i].Error()
+			}
+			sr.recordChangeWithReason(context.Background(), "status_changed", service, reason)
+			if !service.local {
+				changed = append(changed, *service)
+			}
 		}
 	}
+	return changed
 }
 
-// Load Balancing
-func (lb *LoadBalancer) AddService(serviceName string, instance *ServiceInstance) {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
-
-	if lb.services[serviceName] == nil {
-		lb.services[serviceName] = make([]*ServiceInstance, 0)
-		lb.current[serviceName] = 0
+// publishStatus shares status changes with the other gateways when the
+// backend supports it
+func (sr *ServiceRegistry) publishStatus(changed []ServiceInstance) {
+	publisher, ok := sr.backend.(StatusPublisher)
+	if !ok {
+		return
 	}
 
-	lb.services[serviceName] = append(lb.services[serviceName], instance)
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+
+	for i := range changed {
+		if err := publisher.PublishStatus(ctx, &changed[i]); err != nil {
+			sr.logger.Warn("Failed to publish service status",
+				zap.String("id", changed[i].ID),
+				zap.Error(err))
+		}
+	}
 }
 
-func (lb *LoadBalancer) GetNextService(serviceName string) *ServiceInstance {
-	lb.mutex.Lock()
-	defer lb.mutex.Unlock()
+// SetMaintenance puts an instance into maintenance or takes it out again.
+// Instances in maintenance stay registered but are skipped by the health
+// checker and heartbeat expiry; leaving maintenance marks them healthy. It
+// reports whether the state changed so the caller can update routing.
+func (sr *ServiceRegistry) SetMaintenance(ctx context.Context, serviceID string, enabled bool, reason string) (*ServiceInstance, bool, error) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
 
-	instances := lb.services[serviceName]
-	if len(instances) == 0 {
-		return nil
+	service, exists := sr.services[serviceID]
+	if !exists {
+		return nil, false, ErrServiceNotFound
+	}
+	if enabled == (service.Status == "maintenance") {
+		return service, false, nil
 	}
 
-	switch lb.strategy {
-	case "round-robin":
-		current := lb.current[serviceName]
-		service := instances[current]
-		lb.current[serviceName] = (current + 1) % len(instances)
-		return service
-	default:
-		return instances[0]
+	updated := *service
+	if enabled {
+		updated.Status = "maintenance"
+	} else {
+		updated.Status = "healthy"
+		updated.LastSeen = time.Now()
+		updated.LastHeartbeat = updated.LastSeen
 	}
-}
 
-// HTTP Handlers
+	if !service.local {
+		ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+		defer cancel()
+		if err := sr.backend.Register(ctx, &updated); err != nil {
+			return nil, false, fmt.Errorf("failed to store service %s: %w", serviceID, err)
+		}
+	}
+
+	*service = updated
+	sr.recordChangeWithReason(ctx, "status_changed", service, reason)
+
+	sr.logger.Info("Service maintenance mode changed",
+		zap.String("id", service.ID),
+		zap.String("name", service.Name),
+		zap.Bool("maintenance", enabled),
+		zap.String("reason", reason))
+
+	return service, true, nil
+}
+
+// Load Balancing
+func poolKey(serviceName, version string) string {
+	if version == "" {
+		return serviceName
+	}
+	return serviceName + "@" + version
+}
+
+// AddService puts a copy of an instance into rotation; see refresh. An
+// instance registered again under the same ID replaces the previous one
+// everywhere, so a stale copy pointing at an old address can't linger in a
+// pool after deregistration.
+func (lb *LoadBalancer) AddService(serviceName string, instance *ServiceInstance) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	copied := *instance
+	instance = &copied
+
+	for key := range lb.services {
+		if lb.removeFromPool(key, instance.ID) != nil {
+			delete(lb.ejected, instance.ID)
+			delete(lb.latencies, instance.ID)
+			delete(lb.stats, instance.ID)
+		}
+	}
+	lb.stopDrain(instance.ID)
+	lb.addToPool(serviceName, instance)
+	if instance.Version != "" {
+		lb.addToPool(poolKey(serviceName, instance.Version), instance)
+	}
+}
+
+func (lb *LoadBalancer) addToPool(key string, instance *ServiceInstance) {
+	if lb.services[key] == nil {
+		lb.services[key] = make([]*ServiceInstance, 0)
+		lb.current[key] = 0
+	}
+
+	lb.services[key] = append(lb.services[key], instance)
+	lb.poolChanged(key)
+}
+
+func (lb *LoadBalancer) RemoveService(serviceName, instanceID string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	removed := lb.removeFromPool(serviceName, instanceID)
+	if removed != nil && removed.Version != "" {
+		lb.removeFromPool(poolKey(serviceName, removed.Version), instanceID)
+	}
+	if removed != nil {
+		lb.startDrain(removed)
+	}
+	delete(lb.ejected, instanceID)
+	delete(lb.latencies, instanceID)
+	delete(lb.stats, instanceID)
+}
+
+func (lb *LoadBalancer) removeFromPool(key, instanceID string) *ServiceInstance {
+	instances := lb.services[key]
+	for i, instance := range instances {
+		if instance.ID != instanceID {
+			continue
+		}
+
+		lb.services[key] = append(instances[:i:i], instances[i+1:]...)
+		lb.poolChanged(key)
+		if remaining := len(lb.services[key]); remaining == 0 {
+			delete(lb.services, key)
+			delete(lb.current, key)
+		} else if lb.current[key] >= remaining {
+			lb.current[key] = 0
+		}
+		return instance
+	}
+	return nil
+}
+
+// MoveVersion moves an instance between version pools after its Version
+// changed. Instances that are out of rotation stay out.
+func (lb *LoadBalancer) MoveVersion(serviceName string, instance *ServiceInstance, previousVersion string) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if previousVersion != "" {
+		lb.removeFromPool(poolKey(serviceName, previousVersion), instance.ID)
+	}
+
+	if instance.Version == "" {
+		return
+	}
+	for _, pooled := range lb.services[serviceName] {
+		if pooled.ID == instance.ID {
+			lb.addToPool(poolKey(serviceName, instance.Version), pooled)
+			return
+		}
+	}
+}
+
+// refresh replaces the pooled copies of an instance after it changed. Pools
+// only ever hold the balancer's own copies, which are replaced rather than
+// written, so instances returned by a pick can be read without a lock. The
+// registry calls it with its lock held, which makes the copy consistent.
+func (lb *LoadBalancer) refresh(instance *ServiceInstance) {
+	if lb == nil {
+		return
+	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	var copied *ServiceInstance
+	for key, instances := range lb.services {
+		for i, pooled := range instances {
+			if pooled.ID != instance.ID {
+				continue
+			}
+			if copied == nil {
+				snapshot := *instance
+				copied = &snapshot
+			}
+			instances[i] = copied
+			lb.poolChanged(key)
+		}
+	}
+}
+
+// ZoneCounts returns how many instances in rotation each zone has
+func (lb *LoadBalancer) ZoneCounts() map[string]int {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	counts := make(map[string]int)
+	for _, instances := range lb.services {
+		for _, instance := range instances {
+			if seen[instance.ID] || instance.Zone == "" || !routable(instance) {
+				continue
+			}
+			seen[instance.ID] = true
+			counts[instance.Zone]++
+		}
+	}
+	return counts
+}
+
+func (lb *LoadBalancer) GetNextService(serviceName string) *ServiceInstance {
+	return lb.GetNextServiceVersion(serviceName, "")
+}
+
+// GetNextServiceVersion picks an instance from the pool of one version of a
+// service, or from all instances when version is empty
+func (lb *LoadBalancer) GetNextServiceVersion(serviceName, version string) *ServiceInstance {
+	return lb.pick(serviceName, version, "", nil)
+}
+
+// GetNextServiceForRequest is GetNextServiceVersion for proxied requests,
+// which the consistent-hash strategy keys on
+func (lb *LoadBalancer) GetNextServiceForRequest(serviceName, version string, r *http.Request) *ServiceInstance {
+	hashKey := ""
+	if lb.strategy == "consistent-hash" {
+		hashKey = lb.requestHashKey(r)
+	}
+	return lb.pick(serviceName, version, hashKey, nil)
+}
+
+// pick selects an instance with the configured strategy, from a subset of
+// the pool when one is given. Consistent hashing falls back to round-robin
+// for callers without a hash key.
+func (lb *LoadBalancer) pick(serviceName, version, hashKey string, subset *instanceSubset) *ServiceInstance {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	key := poolKey(serviceName, version)
+	instances := lb.balanced(key)
+	if len(instances) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	instances, key = narrowSubset(key, instances, subset)
+	instances, key = lb.preferPrimaries(key, instances, now)
+	instances, key = lb.preferLocalZone(key, instances, now)
+	if lb.current[key] >= len(instances) {
+		lb.current[key] = 0
+	}
+
+	// Unhealthy instances are never picked. Ejected instances and instances
+	// passing on a turn during slow start are skipped too, but when no
+	// instance is selectable traffic still goes to the healthy ones rather
+	// than failing outright
+	strategy := lb.strategy
+	if strategy == "consistent-hash" {
+		if hashKey != "" {
+			return lb.consistentHash(key, instances, hashKey, now)
+		}
+		strategy = "round-robin"
+	}
+
+	switch strategy {
+	case "round-robin":
+		start := lb.current[key]
+		for i := range instances {
+			current := (start + i) % len(instances)
+			if lb.selectable(instances[current], now) {
+				lb.current[key] = (current + 1) % len(instances)
+				return instances[current]
+			}
+		}
+		lb.current[key] = (start + 1) % len(instances)
+		return lb.fallback(instances, start)
+	case "least-connections":
+		return lb.leastConnections(key, instances, now)
+	case "random":
+		return lb.random(instances, now, false)
+	case "weighted-random":
+		return lb.random(instances, now, true)
+	case "least-latency":
+		return lb.leastLatency(key, instances, now)
+	case "p2c":
+		return lb.powerOfTwoChoices(instances, now)
+	case "weighted-round-robin":
+		return lb.weightedRoundRobin(key, instances, now)
+	default:
+		for _, instance := range instances {
+			if lb.selectable(instance, now) {
+				return instance
+			}
+		}
+		return lb.fallback(instances, 0)
+	}
+}
+
+// HTTP Handlers
 func (gw *APIGateway) healthHandler(w http.ResponseWriter, r *http.Request) {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -276,114 +1410,684 @@ func (gw *APIGateway) healthHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	// Add service health status
-	for id, service := range gw.registry.GetServices() {
-		health.Services[service.Name] = service.Status
-		
-		// Update Prometheus metrics
-		if service.Status == "healthy" {
-			gw.metrics.serviceHealth.WithLabelValues(service.Name).Set(1)
-		} else {
-			gw.metrics.serviceHealth.WithLabelValues(service.Name).Set(0)
+	// Add service health status
+	zones := make(map[string]*ZoneHealth)
+	for _, service := range gw.registry.GetServices() {
+		health.Services[service.poolName()] = service.Status
+
+		if service.Zone != "" {
+			zone := zones[service.Zone]
+			if zone == nil {
+				zone = &ZoneHealth{Region: service.Region}
+				zones[service.Zone] = zone
+			}
+			zone.Total++
+			if service.Status == "healthy" {
+				zone.Healthy++
+			}
+		}
+
+		// Update Prometheus metrics
+		if service.Status == "healthy" {
+			gw.metrics.serviceHealth.WithLabelValues(service.Namespace, service.Name).Set(1)
+		} else {
+			gw.metrics.serviceHealth.WithLabelValues(service.Namespace, service.Name).Set(0)
+		}
+	}
+
+	for name, count := range gw.loadBalancer.ZoneCounts() {
+		if zone := zones[name]; zone != nil {
+			zone.InRotation = count
+		}
+	}
+	if len(zones) > 0 {
+		health.Zones = zones
+	}
+
+	if gw.synthetic != nil {
+		health.Synthetic = gw.synthetic.Results()
+	}
+
+	// ?deep=true also verifies the gateway's own dependencies and fails
+	// the check when one of them is unusable
+	if r.URL.Query().Get("deep") == "true" {
+		health.Dependencies = gw.checkDependencies(r.Context())
+		for _, dependency := range health.Dependencies {
+			if dependency.Status != "ok" {
+				health.Status = "degraded"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != "healthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+func (gw *APIGateway) registerServiceHandler(w http.ResponseWriter, r *http.Request) {
+	var service ServiceInstance
+	if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if service.Weight < 0 {
+		http.Error(w, "Weight must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validatePriority(service.Priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := service.HealthCheck.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	namespace, err := requestNamespace(r)
+	if err == nil {
+		err = assignNamespace(&service, namespace)
+	}
+	if err == nil {
+		err = service.HealthCheck.validateOwner(service.Namespace, service.Name)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Generate ID if not provided
+	if service.ID == "" {
+		service.ID = fmt.Sprintf("%s-%d", service.poolName(), time.Now().Unix())
+	}
+
+	if !gw.aclResult(w, r, gw.checkRegistration(r, &service)) {
+		return
+	}
+
+	if err := gw.registry.RegisterService(gw.actorContext(r), &service); err != nil {
+		if errors.Is(err, ErrNamespaceConflict) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Add to load balancer
+	gw.registry.addToRotation(service.ID)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"service_id": service.ID,
+		"message":    "Service registered successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// BulkRegistrationResult reports the outcome for one item of a bulk request
+type BulkRegistrationResult struct {
+	Index     int    `json:"index"`
+	ServiceID string `json:"service_id,omitempty"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (gw *APIGateway) bulkRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var services []*ServiceInstance
+	if err := json.NewDecoder(r.Body).Decode(&services); err != nil {
+		http.Error(w, "Invalid JSON, expected an array of services", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BulkRegistrationResult, len(services))
+	valid := make([]*ServiceInstance, 0, len(services))
+	positions := make([]int, 0, len(services))
+
+	for i, service := range services {
+		results[i].Index = i
+		if service == nil || service.Name == "" {
+			results[i].Error = "service name is required"
+			continue
+		}
+		if service.Weight < 0 {
+			results[i].Error = "weight must not be negative"
+			continue
+		}
+		if err := validatePriority(service.Priority); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := service.HealthCheck.validate(); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := assignNamespace(service, namespace); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := service.HealthCheck.validateOwner(service.Namespace, service.Name); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		// Generate ID if not provided
+		if service.ID == "" {
+			service.ID = fmt.Sprintf("%s-%d", service.poolName(), time.Now().UnixNano())
+		}
+		results[i].ServiceID = service.ID
+		if err := gw.checkRegistration(r, service); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, service)
+		positions = append(positions, i)
+	}
+
+	registered := 0
+	for i, err := range gw.registry.RegisterServices(gw.actorContext(r), valid) {
+		result := &results[positions[i]]
+		if err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		result.Success = true
+		registered++
+		gw.registry.addToRotation(valid[i].ID)
+	}
+
+	response := map[string]interface{}{
+		"success":    registered == len(services),
+		"registered": registered,
+		"failed":     len(services) - registered,
+		"results":    results,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (gw *APIGateway) updateServiceHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID := mux.Vars(r)["id"]
+
+	var update ServiceUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if update.Weight != nil && *update.Weight < 0 {
+		http.Error(w, "Weight must not be negative", http.StatusBadRequest)
+		return
+	}
+	if update.Priority != nil {
+		if err := validatePriority(*update.Priority); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := update.HealthCheck.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	existing, exists := gw.registry.GetService(serviceID)
+	if !exists {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if !gw.authorize(w, r, existing.Namespace, existing.Name) {
+		return
+	}
+	if err := update.HealthCheck.validateOwner(existing.Namespace, existing.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	previousVersion := existing.Version
+
+	service, err := gw.registry.UpdateService(gw.actorContext(r), serviceID, &update)
+	if errors.Is(err, ErrServiceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrLocalInstance) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if service.Version != previousVersion {
+		gw.registry.moveVersion(service.ID, previousVersion)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(service)
+}
+
+func (gw *APIGateway) deregisterServiceHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID := mux.Vars(r)["id"]
+
+	service, exists := gw.registry.GetService(serviceID)
+	if !exists {
+		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if !gw.authorize(w, r, service.Namespace, service.Name) {
+		return
+	}
+	if service.Static {
+		http.Error(w, "Static upstreams are managed by STATIC_UPSTREAMS_FILE", http.StatusConflict)
+		return
+	}
+
+	if err := gw.registry.DeregisterService(gw.actorContext(r), serviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gw.loadBalancer.RemoveService(service.poolName(), serviceID)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"service_id": serviceID,
+		"message":    "Service deregistered successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (gw *APIGateway) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID := mux.Vars(r)["id"]
+	if !gw.authorizeInstance(w, r, serviceID) {
+		return
+	}
+
+	service, expired, err := gw.registry.Heartbeat(gw.actorContext(r), serviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Put the instance back into rotation once it heartbeats again
+	if expired {
+		gw.registry.addToRotation(service.ID)
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"service_id": service.ID,
+		"status":     service.Status,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// maintenanceHandler toggles maintenance mode for an instance, e.g. during
+// a rolling deploy, without deregistering it
+func (gw *APIGateway) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID := mux.Vars(r)["id"]
+	if !gw.authorizeInstance(w, r, serviceID) {
+		return
+	}
+
+	var request struct {
+		Enabled *bool  `json:"enabled"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Enabled == nil {
+		http.Error(w, "Invalid JSON, expected {\"enabled\": true|false}", http.StatusBadRequest)
+		return
+	}
+
+	service, changed, err := gw.registry.SetMaintenance(gw.actorContext(r), serviceID, *request.Enabled, request.Reason)
+	if errors.Is(err, ErrServiceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if changed {
+		if *request.Enabled {
+			gw.loadBalancer.RemoveService(service.poolName(), service.ID)
+		} else {
+			gw.registry.addToRotation(service.ID)
+		}
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"service_id": service.ID,
+		"status":     service.Status,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (gw *APIGateway) servicesHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Filters: ?tag=payments&tag=internal&meta.env=prod&zone=us-east-1a
+	query := r.URL.Query()
+	tags := query["tag"]
+	metadata := make(map[string]string)
+	for key, values := range query {
+		if strings.HasPrefix(key, "meta.") && len(values) > 0 {
+			metadata[strings.TrimPrefix(key, "meta.")] = values[0]
+		}
+	}
+
+	attributes := map[string]string{"namespace": namespace}
+	for _, key := range []string{"zone", "region"} {
+		if value := query.Get(key); value != "" {
+			attributes[key] = value
+		}
+	}
+
+	services := gw.registry.FindServices(tags, metadata, attributes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(services)
+}
+
+// watchServicesHandler long-polls for registry changes. Clients pass the
+// index from their previous response and get back the delta since then, or
+// a full snapshot with "reset": true when they are too far behind.
+func (gw *APIGateway) watchServicesHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	timeout := 30 * time.Second
+	if value, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && value > 0 {
+		timeout = value
+	}
+	if timeout > 5*time.Minute {
+		timeout = 5 * time.Minute
+	}
+
+	// Outlive the server-wide WriteTimeout while blocking
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	if index != 0 {
+		gw.registry.WaitForChange(r.Context(), index, timeout)
+	}
+
+	changes, current, reset := gw.registry.ChangesSince(index)
+	scoped := make([]RegistryChange, 0, len(changes))
+	for _, change := range changes {
+		if change.Service.Namespace == namespace {
+			scoped = append(scoped, change)
 		}
 	}
 
+	response := map[string]interface{}{
+		"index":   current,
+		"reset":   reset,
+		"changes": scoped,
+	}
+	if reset {
+		response["services"] = gw.registry.FindServices(nil, nil, map[string]string{"namespace": namespace})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(health)
+	json.NewEncoder(w).Encode(response)
 }
 
-func (gw *APIGateway) registerServiceHandler(w http.ResponseWriter, r *http.Request) {
-	var service ServiceInstance
-	if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+func (gw *APIGateway) proxyHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	gw.metrics.requestsTotal.WithLabelValues(namespace).Inc()
 
-	// Generate ID if not provided
-	if service.ID == "" {
-		service.ID = fmt.Sprintf("%s-%d", service.Name, time.Now().Unix())
+	// The first segment names the service, the rest is the path within it
+	requested, subPath, _ := strings.Cut(mux.Vars(r)["service"], "/")
+	serviceName := gw.aliases.Resolve(namespace, requested)
+	poolName := qualifiedName(namespace, serviceName)
+	if gw.applyCORS(w, r, poolName) {
+		return
 	}
 
-	if err := gw.registry.RegisterService(&service); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	gw.route(w, r, &proxyTarget{
+		namespace:   namespace,
+		serviceName: serviceName,
+		poolName:    poolName,
+		path:        gw.routes.upstreamPath(poolName, r.URL.Path, "/"+subPath),
+	})
+
+	// Record metrics
+	gw.metrics.requestDuration.WithLabelValues(namespace).Observe(time.Since(start).Seconds())
+}
+
+// route picks an instance of the target's pool for a request and forwards
+// it there, unless the pool's circuit breaker is open
+func (gw *APIGateway) route(w http.ResponseWriter, r *http.Request, target *proxyTarget) {
+	namespace, poolName := target.namespace, target.poolName
+
+	// Refuse clients outside the service's IP access list
+	if !gw.ipAccess.allowRoute(w, r, target, gw.routes.ipAccess(poolName)) {
 		return
 	}
 
-	// Add to load balancer
-	gw.loadBalancer.AddService(service.Name, &service)
+	// Throttle clients over the service's rate limit
+	if !gw.rateLimits.allow(w, r, target, gw.routes.rateLimit(poolName)) {
+		return
+	}
 
-	response := map[string]interface{}{
-		"success":    true,
-		"service_id": service.ID,
-		"message":    "Service registered successfully",
+	// Route to a specific version when the client asks for one
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = r.Header.Get("X-Service-Version")
+	}
+	// Otherwise the service's routing rules may pick a version or subset
+	if version == "" {
+		if rule := gw.routes.matchRule(poolName, r); rule != nil && rule.Version != "" {
+			version = rule.Version
+		} else if rule != nil {
+			target.subset = rule.subset()
+		}
+	}
+	// Or its traffic split share the request out by version
+	if version == "" && target.subset == nil {
+		if split := gw.routes.split(poolName); split != nil {
+			target.split = split
+			target.subset = split.subset(split.pickVersion(r, poolName))
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	// Answer from the response cache on routes that enable it
+	if ttl, cached := gw.routes.cacheTTL(poolName); cached && gw.cache != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		variant := version
+		if target.subset != nil {
+			variant = target.subset.scope
+		}
+		key := cacheKey(poolName, variant, target.path, r.URL.RawQuery)
+		if gw.cache.serve(w, r, namespace, key) {
+			return
+		}
+		target.cache = &cacheRequest{key: key, ttl: ttl, pool: poolName, path: target.path}
+	}
 
-func (gw *APIGateway) servicesHandler(w http.ResponseWriter, r *http.Request) {
-	services := gw.registry.GetServices()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(services)
-}
+	// Refuse bodies over the route's limit before they reach a backend;
+	// ones of unknown length fail once they have been read that far
+	maxRequestBody, maxResponseBody := gw.routes.bodyLimits(poolName)
+	if maxRequestBody > 0 && r.Body != http.NoBody {
+		if r.ContentLength > maxRequestBody {
+			rejectTooLarge(w, maxRequestBody)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+	}
 
-func (gw *APIGateway) proxyHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	gw.metrics.requestsTotal.Inc()
+	// Authenticate signed machine callers, buffering the body to check it
+	if !gw.signatures.verify(w, r, target, gw.routes.signature(poolName), maxRequestBody) {
+		return
+	}
+
+	// Refuse requests that look like attacks on services inspecting them
+	if !gw.inspector.inspect(w, r, target, gw.routes.inspection(poolName)) {
+		return
+	}
 
-	vars := mux.Vars(r)
-	serviceName := vars["service"]
+	// Stream large bodies under the route's upload timeouts
+	defer gw.uploads.track(w, r, target, gw.routes.upload(poolName))()
 
-	// Get service instance from load balancer
-	instance := gw.loadBalancer.GetNextService(serviceName)
-	if instance == nil {
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+	// Replay the response to a repeated Idempotency-Key instead of
+	// proxying the write again
+	pending, proceed := gw.idempotency.begin(w, r, namespace, poolName)
+	if !proceed {
+		return
+	}
+	defer gw.idempotency.finish(pending)
+	target.idempotency = pending
+
+	// Adapt JSON bodies for services with a request transform
+	if transform := gw.routes.requestTransform(poolName); transform != nil && isJSON(r.Header.Get("Content-Type")) {
+		if err := transform.apply(r, gw.routes.maxTransformBody); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				rejectTooLarge(w, tooLarge.Limit)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Fail fast while the service's circuit breaker is open
+	breakerDone, retryAfter, allowed := gw.breakers.Allow(namespace, poolName)
+	if !allowed {
+		rejectOpenCircuit(w, retryAfter)
 		return
 	}
+	defer breakerDone(breakerIgnored)
 
-	// Create proxy request
-	targetURL := fmt.Sprintf("http://%s:%d%s", instance.Address, instance.Port, r.URL.Path)
-	
-	client := &http.Client{Timeout: 30 * time.Second}
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
+	// Hold a slot of the service's concurrency limit while proxying, or
+	// queue for one; requests that can't get one are shed
+	releaseSlot, admitted := gw.concurrency.acquire(w, r, target, gw.routes.concurrencyLimit(poolName))
+	if !admitted {
 		return
 	}
+	defer releaseSlot()
+
+	// Upgraded connections are long-lived, so only their handshake is
+	// bounded by the connect and response header timeouts. So are event
+	// streams, which only show as such in the response: the total timeout
+	// is a timer that forward can stop, cancelling the request with
+	// context.DeadlineExceeded as its cause when it fires.
+	timeouts := gw.routes.timeouts(poolName, target.timeoutOverrides, r)
+	if timeouts.Total > 0 && !isUpgrade(r) {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		timer := time.AfterFunc(time.Duration(timeouts.Total), func() { cancel(context.DeadlineExceeded) })
+		defer cancel(nil)
+		defer timer.Stop()
+		r = r.WithContext(ctx)
+		target.liftTimeout = timer.Stop
+	}
 
-	// Copy headers
-	for key, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(key, value)
+	// Get service instance from load balancer, keeping clients with an
+	// affinity cookie on their instance while it can take traffic and is
+	// in the subset a routing rule or split picked. Pools with a canary
+	// send its share of the rest there.
+	var instance *ServiceInstance
+	if gw.sticky != nil {
+		if id := gw.sticky.instanceFor(r, poolName); id != "" {
+			instance = gw.loadBalancer.GetInstance(poolName, version, id)
+		}
+		if instance != nil && target.subset != nil && !target.subset.match(instance) {
+			instance = nil
+		}
+	}
+	if canary := gw.routes.canary(poolName); canary != nil && version == "" && target.subset == nil {
+		target.canary = canary
+		if instance == nil {
+			target.subset = canary.subset(canary.pickVariant())
+		}
+	}
+	if instance == nil {
+		if target.subset != nil {
+			instance = gw.loadBalancer.GetNextServiceSubset(poolName, target.subset, r)
+		} else {
+			instance = gw.loadBalancer.GetNextServiceForRequest(poolName, version, r)
+		}
+		if instance != nil && gw.sticky != nil {
+			gw.sticky.bind(w, poolName, instance.ID)
 		}
 	}
 
-	// Execute request
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		gw.logger.Error("Proxy request failed",
-			zap.String("service", serviceName),
-			zap.String("target", targetURL),
-			zap.Error(err))
-		http.Error(w, "Service request failed", http.StatusBadGateway)
+	// Only go cross-datacenter when there is no local instance
+	if instance == nil && gw.federation != nil {
+		instance = gw.federation.GetNextService(poolName, version)
+	}
+	if instance == nil {
+		if version != "" {
+			http.Error(w, "Service version not available", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "Service not available", http.StatusServiceUnavailable)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+	if zone := gw.loadBalancer.zone; zone != "" {
+		locality := "local"
+		if instance.Zone != zone {
+			locality = "cross_zone"
 		}
+		gw.metrics.zoneRequests.WithLabelValues(locality).Inc()
 	}
 
-	// Copy status code and body
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	target.version = version
+	target.instance = instance
+	target.timeouts = timeouts
+	if !isUpgrade(r) && gw.routes.h2c(poolName) {
+		target.h2c = true
+	}
+	target.tls = gw.routes.upstreamTLS(poolName)
+	target.headers = gw.routes.headerRules(poolName)
+	target.responseTransform = gw.routes.responseTransform(poolName)
+	target.maxResponseBody = maxResponseBody
+	target.breakerDone = breakerDone
+	gw.mirror(r, target)
+	if hedgeable(r) {
+		target.hedge = gw.routes.hedge(poolName)
+	}
 
-	// Record metrics
-	gw.metrics.requestDuration.Observe(time.Since(start).Seconds())
+	start := time.Now()
+	gw.forward(w, r, target)
+	if target.canary != nil {
+		variant := target.canary.variantOf(instance)
+		gw.metrics.canaryRequests.WithLabelValues(namespace, poolName, variant, strconv.Itoa(target.status)).Inc()
+		gw.metrics.canaryDuration.WithLabelValues(namespace, poolName, variant).Observe(time.Since(start).Seconds())
+	}
+	if target.split != nil {
+		gw.metrics.splitRequests.WithLabelValues(namespace, poolName, instance.Version, strconv.Itoa(target.status)).Inc()
+	}
 }
 
 func (gw *APIGateway) websocketHandler(w http.ResponseWriter, r *http.Request) {
@@ -395,9 +2099,10 @@ func (gw *APIGateway) websocketHandler(w http.ResponseWriter, r *http.Request) {
 	defer conn.Close()
 
 	clientID := fmt.Sprintf("client-%d", time.Now().UnixNano())
-	
+
+	client := newWebsocketClient(clientID, conn, gw.logger)
 	gw.connMutex.Lock()
-	gw.connections[clientID] = conn
+	gw.connections[clientID] = client
 	gw.metrics.activeConnections.Inc()
 	gw.connMutex.Unlock()
 
@@ -406,6 +2111,8 @@ func (gw *APIGateway) websocketHandler(w http.ResponseWriter, r *http.Request) {
 		delete(gw.connections, clientID)
 		gw.metrics.activeConnections.Dec()
 		gw.connMutex.Unlock()
+		// Nothing queues for the client once it is out of the map
+		close(client.send)
 	}()
 
 	gw.logger.Info("WebSocket client connected", zap.String("client_id", clientID))
@@ -416,7 +2123,7 @@ func (gw *APIGateway) websocketHandler(w http.ResponseWriter, r *http.Request) {
 		"type":     "service_list",
 		"services": services,
 	}
-	conn.WriteJSON(message)
+	client.queue(message)
 
 	// Handle incoming messages
 	for {
@@ -431,13 +2138,13 @@ func (gw *APIGateway) websocketHandler(w http.ResponseWriter, r *http.Request) {
 		// Handle different message types
 		switch msg["type"] {
 		case "ping":
-			conn.WriteJSON(map[string]interface{}{
+			client.queue(map[string]interface{}{
 				"type":      "pong",
 				"timestamp": time.Now(),
 			})
 		case "get_services":
 			services := gw.registry.GetServices()
-			conn.WriteJSON(map[string]interface{}{
+			client.queue(map[string]interface{}{
 				"type":     "service_list",
 				"services": services,
 			})
@@ -445,6 +2152,107 @@ func (gw *APIGateway) websocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// syncRegistry loads the backend catalog and keeps following its changes
+func (gw *APIGateway) syncRegistry(ctx context.Context) {
+	for ctx.Err() == nil {
+		snapshot, loaded, missed, err := gw.registry.Load(ctx)
+		if err == nil {
+			gw.readiness.registryLoaded.Store(true)
+			for _, event := range missed {
+				gw.applyRegistryEvent(event)
+			}
+			for _, service := range loaded {
+				gw.registry.addToRotation(service.ID)
+			}
+
+			var events <-chan RegistryEvent
+			if events, err = gw.registry.backend.Watch(ctx, snapshot); err == nil {
+				for event := range events {
+					gw.applyRegistryEvent(event)
+				}
+				continue
+			}
+		}
+
+		gw.logger.Error("Failed to sync registry from backend", zap.Error(err))
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// applyRegistryEvent merges a backend change into the registry and updates
+// routing for instances that entered or left rotation
+func (gw *APIGateway) applyRegistryEvent(event RegistryEvent) {
+	added, removed := gw.registry.applyEvent(event)
+	if added != nil {
+		gw.registry.addToRotation(added.ID)
+	}
+	if removed != nil {
+		gw.loadBalancer.RemoveService(removed.poolName(), removed.ID)
+	}
+}
+
+// expireStaleServices takes instances that stopped heartbeating out of
+// rotation. Heartbeats may reach any gateway, so only the leader, which
+// sees them all through the backend, decides and publishes the expiry.
+func (gw *APIGateway) expireStaleServices(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !gw.registry.isLeader() {
+				continue
+			}
+			expired := gw.registry.ExpireStale()
+			published := make([]ServiceInstance, 0, len(expired))
+			for _, service := range expired {
+				gw.loadBalancer.RemoveService(service.poolName(), service.ID)
+				if !service.local {
+					published = append(published, service)
+				}
+			}
+			gw.registry.publishStatus(published)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collectStaleServices periodically removes instances that have been dead
+// for longer than REGISTRY_GC_MAX_AGE. Like the health checker it only runs
+// on the leader; the other gateways see the removals through the backend.
+func (gw *APIGateway) collectStaleServices(ctx context.Context) {
+	maxAge := getEnvDuration("REGISTRY_GC_MAX_AGE", 0)
+	if maxAge <= 0 {
+		return
+	}
+
+	gw.logger.Info("Stale instance GC enabled", zap.Duration("max_age", maxAge))
+
+	ticker := time.NewTicker(getEnvDuration("REGISTRY_GC_INTERVAL", time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !gw.registry.isLeader() {
+				continue
+			}
+			for _, service := range gw.registry.CollectGarbage(maxAge) {
+				gw.loadBalancer.RemoveService(service.poolName(), service.ID)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// broadcastServiceUpdate only talks to this replica's own WebSocket clients,
+// so unlike the health checker it runs on every gateway, leader or not.
 func (gw *APIGateway) broadcastServiceUpdate() {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -453,21 +2261,11 @@ func (gw *APIGateway) broadcastServiceUpdate() {
 		select {
 		case <-ticker.C:
 			services := gw.registry.GetServices()
-			message := map[string]interface{}{
+			gw.broadcast(map[string]interface{}{
 				"type":      "service_update",
 				"services":  services,
 				"timestamp": time.Now(),
-			}
-
-			gw.connMutex.RLock()
-			for clientID, conn := range gw.connections {
-				if err := conn.WriteJSON(message); err != nil {
-					gw.logger.Warn("Failed to send message to client",
-						zap.String("client_id", clientID),
-						zap.Error(err))
-				}
-			}
-			gw.connMutex.RUnlock()
+			})
 		}
 	}
 }
@@ -476,10 +2274,14 @@ func (gw *APIGateway) broadcastServiceUpdate() {
 func (gw *APIGateway) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		
+
 		next.ServeHTTP(w, r)
-		
-		gw.logger.Info("HTTP Request",
+
+		logger := gw.logger
+		if identity := clientCertIdentity(r); identity != nil {
+			logger = logger.With(zap.String("client_cert", identity[0]), zap.String("client_cert_san", identity[1]))
+		}
+		logger.Info("HTTP Request",
 			zap.String("method", r.Method),
 			zap.String("path", r.URL.Path),
 			zap.String("remote_addr", r.RemoteAddr),
@@ -487,21 +2289,6 @@ func (gw *APIGateway) loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (gw *APIGateway) corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
 func main() {
 	// Initialize logger
 	logger, err := zap.NewProduction()
@@ -510,26 +2297,269 @@ func main() {
 	}
 	defer logger.Sync()
 
+	// Select registry backend
+	backend, err := newRegistryBackend(logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize registry backend", zap.Error(err))
+	}
+
 	// Create API Gateway
-	gateway := NewAPIGateway(logger)
+	gateway := NewAPIGateway(logger, backend)
+	if err := gateway.loadBalancer.validate(); err != nil {
+		logger.Fatal("Invalid load balancer configuration", zap.Error(err))
+	}
+
+	secrets, err := NewVault(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure Vault", zap.Error(err))
+	}
+	if secrets != nil {
+		gateway.addDependency("vault", secrets.check)
+	}
+	upstreamVault = secrets
+
+	gateway.sticky, err = NewStickySessions(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure sticky sessions", zap.Error(err))
+	}
+
+	gateway.forwarded, err = NewForwardedHeaders()
+	if err != nil {
+		logger.Fatal("Failed to configure forwarded headers", zap.Error(err))
+	}
+
+	gateway.cors, err = NewCORS(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure CORS", zap.Error(err))
+	}
+
+	gateway.ipAccess, err = NewIPAccess(gateway.forwarded, logger)
+	if err != nil {
+		logger.Fatal("Failed to configure IP access lists", zap.Error(err))
+	}
+
+	gateway.rateLimits, err = NewRateLimiter(gateway.forwarded, logger)
+	if err != nil {
+		logger.Fatal("Failed to configure rate limits", zap.Error(err))
+	}
+	if gateway.rateLimits.shared != nil {
+		gateway.addDependency("rate_limit_store", gateway.rateLimits.shared.check)
+	}
+
+	gateway.compression, err = NewCompression()
+	if err != nil {
+		logger.Fatal("Failed to configure compression", zap.Error(err))
+	}
+
+	gateway.grpcRoutes, err = NewGRPCRoutes(logger)
+	if err != nil {
+		logger.Fatal("Failed to load gRPC routes", zap.Error(err))
+	}
+
+	gateway.transcoder, err = NewGRPCTranscoder(logger)
+	if err != nil {
+		logger.Fatal("Failed to load gRPC transcoding", zap.Error(err))
+	}
+	if gateway.transcoder != nil && gateway.grpcRoutes == nil {
+		logger.Fatal("gRPC transcoding needs GRPC_ROUTES_FILE to route calls")
+	}
+
+	gateway.routes, err = NewRouteTable(logger)
+	if err != nil {
+		logger.Fatal("Failed to load proxy routes", zap.Error(err))
+	}
+
+	gateway.pathRoutes, err = NewPathRoutes(logger)
+	if err != nil {
+		logger.Fatal("Failed to load path routes", zap.Error(err))
+	}
+
+	gateway.retries, err = NewRetryPolicies(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure retries", zap.Error(err))
+	}
+
+	gateway.acl, err = NewACL(secrets, logger)
+	if err != nil {
+		logger.Fatal("Failed to load registry ACL", zap.Error(err))
+	}
+
+	gateway.oidc, err = NewOIDC(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure OIDC sign-in", zap.Error(err))
+	}
+
+	gateway.signatures, err = NewSignatures(secrets, logger)
+	if err != nil {
+		logger.Fatal("Failed to load HMAC signing keys", zap.Error(err))
+	}
+
+	gateway.inspector, err = NewInspector(gateway.forwarded, logger)
+	if err != nil {
+		logger.Fatal("Failed to load WAF rules", zap.Error(err))
+	}
+
+	audit, err := NewAuditLog(logger)
+	if err != nil {
+		logger.Fatal("Failed to open audit log", zap.Error(err))
+	}
+	gateway.registry.audit = audit
+	gateway.addDependency("audit_log", audit.check)
+	go audit.Run()
+
+	syncCtx, stopSync := context.WithCancel(context.Background())
+	defer stopSync()
 
 	// Start background services
+	go gateway.syncRegistry(syncCtx)
+
+	dnsDiscovery, err := NewDNSDiscovery(gateway, logger)
+	if err != nil {
+		logger.Fatal("Failed to configure DNS discovery", zap.Error(err))
+	}
+	if err := gateway.LoadStaticUpstreams(logger); err != nil {
+		logger.Fatal("Failed to load static upstreams", zap.Error(err))
+	}
+	gateway.synthetic, err = NewSyntheticProber(gateway, logger)
+	if err != nil {
+		logger.Fatal("Failed to load synthetic probes", zap.Error(err))
+	}
+	if gateway.synthetic != nil {
+		gateway.synthetic.Run(syncCtx)
+	}
+	if dnsDiscovery != nil {
+		dnsDiscovery.Run(syncCtx)
+	}
+	if mdnsDiscovery := NewMDNSDiscovery(gateway, logger); mdnsDiscovery != nil {
+		go mdnsDiscovery.Run(syncCtx)
+	}
+
+	gateway.federation = NewFederation(gateway, logger)
+	if gateway.federation != nil {
+		go gateway.federation.Run(syncCtx)
+	}
 	go gateway.registry.HealthCheck()
+	go gateway.expireStaleServices(syncCtx)
+	go gateway.collectStaleServices(syncCtx)
+	go gateway.webhooks.Run(syncCtx)
 	go gateway.broadcastServiceUpdate()
+	go gateway.pushHealthChanges(syncCtx)
 
 	// Setup routes
 	r := mux.NewRouter()
 
 	// Apply middleware
 	r.Use(gateway.loggingMiddleware)
-	r.Use(gateway.corsMiddleware)
+	r.Use(gateway.cors.middleware)
+	r.Use(gateway.compressionMiddleware)
+
+	h3, err := NewHTTP3(r, logger)
+	if err != nil {
+		logger.Fatal("Failed to configure HTTP/3", zap.Error(err))
+	}
+	r.Use(h3.altSvcMiddleware)
+
+	// gRPC calls are routed by method rather than by URL prefix
+	if gateway.grpcRoutes != nil {
+		r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return isGRPC(req)
+		}).HandlerFunc(gateway.grpcHandler)
+	}
 
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
+	api.Use(gateway.ipAccess.adminMiddleware)
 	api.HandleFunc("/health", gateway.healthHandler).Methods("GET")
 	api.HandleFunc("/services", gateway.servicesHandler).Methods("GET")
+	api.HandleFunc("/services/watch", gateway.watchServicesHandler).Methods("GET")
+	api.HandleFunc("/services/bulk", gateway.bulkRegisterHandler).Methods("POST")
 	api.HandleFunc("/services", gateway.registerServiceHandler).Methods("POST")
-	api.HandleFunc("/proxy/{service:.*}", gateway.proxyHandler)
+	api.HandleFunc("/services/{id}", gateway.updateServiceHandler).Methods("PUT")
+	api.HandleFunc("/services/{id}", gateway.deregisterServiceHandler).Methods("DELETE")
+	api.HandleFunc("/services/{id}/heartbeat", gateway.heartbeatHandler).Methods("PUT")
+	api.HandleFunc("/services/{id}/maintenance", gateway.maintenanceHandler).Methods("PUT")
+	api.HandleFunc("/services/{id}/health-history", gateway.healthHistoryHandler).Methods("GET")
+	api.HandleFunc("/topology", gateway.topologyHandler).Methods("GET")
+	api.HandleFunc("/lb/draining", gateway.drainingHandler).Methods("GET")
+	api.HandleFunc("/lb/{service}/stats", gateway.lbStatsHandler).Methods("GET")
+	api.HandleFunc("/circuit-breakers", gateway.circuitBreakersHandler).Methods("GET")
+	api.HandleFunc("/routes/{service}/headers", gateway.getHeaderRulesHandler).Methods("GET")
+	api.HandleFunc("/routes/{service}/headers", gateway.auditAdmin("header_rules_set", gateway.routeState(auditHeaderRules), gateway.putHeaderRulesHandler)).Methods("PUT")
+	api.HandleFunc("/routes/{service}/headers", gateway.auditAdmin("header_rules_removed", gateway.routeState(auditHeaderRules), gateway.deleteHeaderRulesHandler)).Methods("DELETE")
+	api.HandleFunc("/routes/{service}/canary", gateway.getCanaryHandler).Methods("GET")
+	api.HandleFunc("/routes/{service}/canary", gateway.auditAdmin("canary_set", gateway.routeState(auditCanary), gateway.putCanaryHandler)).Methods("PUT")
+	api.HandleFunc("/routes/{service}/canary", gateway.auditAdmin("canary_removed", gateway.routeState(auditCanary), gateway.deleteCanaryHandler)).Methods("DELETE")
+	api.HandleFunc("/routes/{service}/split", gateway.getSplitHandler).Methods("GET")
+	api.HandleFunc("/routes/{service}/split", gateway.auditAdmin("split_set", gateway.routeState(auditSplit), gateway.putSplitHandler)).Methods("PUT")
+	api.HandleFunc("/routes/{service}/split", gateway.auditAdmin("split_removed", gateway.routeState(auditSplit), gateway.deleteSplitHandler)).Methods("DELETE")
+	api.HandleFunc("/routes/{service}/ip-access", gateway.getIPAccessHandler).Methods("GET")
+	api.HandleFunc("/routes/{service}/ip-access", gateway.auditAdmin("ip_access_set", gateway.routeState(auditIPAccess), gateway.putIPAccessHandler)).Methods("PUT")
+	api.HandleFunc("/routes/{service}/ip-access", gateway.auditAdmin("ip_access_removed", gateway.routeState(auditIPAccess), gateway.deleteIPAccessHandler)).Methods("DELETE")
+	api.HandleFunc("/cache/{service}", gateway.auditAdmin("cache_purged", nil, gateway.purgeCacheHandler)).Methods("DELETE")
+	api.HandleFunc("/audit", gateway.requireAdmin(audit.queryHandler)).Methods("GET")
+	api.HandleFunc("/audit/export", gateway.requireAdmin(audit.exportHandler)).Methods("GET")
+	api.HandleFunc("/audit/verify", gateway.requireAdmin(audit.verifyHandler)).Methods("GET")
+	api.HandleFunc("/aliases", gateway.aliases.listHandler).Methods("GET")
+	api.HandleFunc("/aliases/{alias}", gateway.auditAdmin("alias_set", gateway.aliasState, gateway.putAliasHandler)).Methods("PUT")
+	api.HandleFunc("/aliases/{alias}", gateway.auditAdmin("alias_removed", gateway.aliasState, gateway.deleteAliasHandler)).Methods("DELETE")
+	api.HandleFunc("/webhooks", gateway.requireAdmin(gateway.webhooks.listHandler)).Methods("GET")
+	api.HandleFunc("/webhooks", gateway.requireAdmin(gateway.auditAdmin("webhook_created", nil, gateway.webhooks.createHandler))).Methods("POST")
+	api.HandleFunc("/webhooks/{id}", gateway.requireAdmin(gateway.auditAdmin("webhook_removed", gateway.webhookState, gateway.webhooks.deleteHandler))).Methods("DELETE")
+	api.HandleFunc("/path-routes", gateway.requireAdmin(gateway.listPathRoutesHandler)).Methods("GET")
+	api.HandleFunc("/path-routes/{name}", gateway.requireAdmin(gateway.auditAdmin("path_route_set", gateway.pathRouteState, gateway.putPathRouteHandler))).Methods("PUT")
+	api.HandleFunc("/path-routes/{name}", gateway.requireAdmin(gateway.auditAdmin("path_route_removed", gateway.pathRouteState, gateway.deletePathRouteHandler))).Methods("DELETE")
+	api.HandleFunc("/ip-access", gateway.requireAdmin(gateway.ipAccess.getAdminHandler)).Methods("GET")
+	api.HandleFunc("/ip-access", gateway.requireAdmin(gateway.auditAdmin("admin_ip_access_set", gateway.adminIPAccessState, gateway.ipAccess.putAdminHandler))).Methods("PUT")
+	api.HandleFunc("/ip-access", gateway.requireAdmin(gateway.auditAdmin("admin_ip_access_removed", gateway.adminIPAccessState, gateway.ipAccess.deleteAdminHandler))).Methods("DELETE")
+	api.HandleFunc("/proxy/{service:.*}", gateway.proxyHandler).Name(proxyRouteName)
+
+	// Namespace-scoped variants of the listing, registration and proxy
+	// routes; the unscoped ones use X-Namespace or the default namespace
+	ns := api.PathPrefix("/namespaces/{namespace}").Subrouter()
+	ns.HandleFunc("/services", gateway.servicesHandler).Methods("GET")
+	ns.HandleFunc("/services/watch", gateway.watchServicesHandler).Methods("GET")
+	ns.HandleFunc("/services/bulk", gateway.bulkRegisterHandler).Methods("POST")
+	ns.HandleFunc("/services", gateway.registerServiceHandler).Methods("POST")
+	ns.HandleFunc("/topology", gateway.topologyHandler).Methods("GET")
+	ns.HandleFunc("/lb/draining", gateway.drainingHandler).Methods("GET")
+	ns.HandleFunc("/lb/{service}/stats", gateway.lbStatsHandler).Methods("GET")
+	ns.HandleFunc("/circuit-breakers", gateway.circuitBreakersHandler).Methods("GET")
+	ns.HandleFunc("/routes/{service}/headers", gateway.getHeaderRulesHandler).Methods("GET")
+	ns.HandleFunc("/routes/{service}/headers", gateway.auditAdmin("header_rules_set", gateway.routeState(auditHeaderRules), gateway.putHeaderRulesHandler)).Methods("PUT")
+	ns.HandleFunc("/routes/{service}/headers", gateway.auditAdmin("header_rules_removed", gateway.routeState(auditHeaderRules), gateway.deleteHeaderRulesHandler)).Methods("DELETE")
+	ns.HandleFunc("/routes/{service}/canary", gateway.getCanaryHandler).Methods("GET")
+	ns.HandleFunc("/routes/{service}/canary", gateway.auditAdmin("canary_set", gateway.routeState(auditCanary), gateway.putCanaryHandler)).Methods("PUT")
+	ns.HandleFunc("/routes/{service}/canary", gateway.auditAdmin("canary_removed", gateway.routeState(auditCanary), gateway.deleteCanaryHandler)).Methods("DELETE")
+	ns.HandleFunc("/routes/{service}/split", gateway.getSplitHandler).Methods("GET")
+	ns.HandleFunc("/routes/{service}/split", gateway.auditAdmin("split_set", gateway.routeState(auditSplit), gateway.putSplitHandler)).Methods("PUT")
+	ns.HandleFunc("/routes/{service}/split", gateway.auditAdmin("split_removed", gateway.routeState(auditSplit), gateway.deleteSplitHandler)).Methods("DELETE")
+	ns.HandleFunc("/routes/{service}/ip-access", gateway.getIPAccessHandler).Methods("GET")
+	ns.HandleFunc("/routes/{service}/ip-access", gateway.auditAdmin("ip_access_set", gateway.routeState(auditIPAccess), gateway.putIPAccessHandler)).Methods("PUT")
+	ns.HandleFunc("/routes/{service}/ip-access", gateway.auditAdmin("ip_access_removed", gateway.routeState(auditIPAccess), gateway.deleteIPAccessHandler)).Methods("DELETE")
+	ns.HandleFunc("/cache/{service}", gateway.auditAdmin("cache_purged", nil, gateway.purgeCacheHandler)).Methods("DELETE")
+	ns.HandleFunc("/aliases", gateway.aliases.listHandler).Methods("GET")
+	ns.HandleFunc("/aliases/{alias}", gateway.auditAdmin("alias_set", gateway.aliasState, gateway.putAliasHandler)).Methods("PUT")
+	ns.HandleFunc("/aliases/{alias}", gateway.auditAdmin("alias_removed", gateway.aliasState, gateway.deleteAliasHandler)).Methods("DELETE")
+	ns.HandleFunc("/proxy/{service:.*}", gateway.proxyHandler).Name(proxyRouteName)
+
+	if gateway.federation != nil {
+		api.HandleFunc("/federation/catalog", gateway.federation.catalogHandler).Methods("GET")
+	}
+
+	if raftBackend, ok := backend.(*RaftBackend); ok {
+		api.HandleFunc("/cluster/status", raftBackend.statusHandler).Methods("GET")
+	}
+
+	// Read-only Consul-compatible catalog for tooling that speaks Consul
+	consulCatalog := NewConsulCatalog(gateway)
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/catalog/services", consulCatalog.servicesHandler).Methods("GET")
+	v1.HandleFunc("/health/service/{name}", consulCatalog.healthServiceHandler).Methods("GET")
+	v1.HandleFunc("/agent/self", consulCatalog.agentSelfHandler).Methods("GET")
+
+	// Liveness and readiness probes for orchestrators
+	r.HandleFunc("/healthz", gateway.livenessHandler).Methods("GET")
+	r.HandleFunc("/readyz", gateway.readinessHandler).Methods("GET")
 
 	// WebSocket endpoint
 	r.HandleFunc("/ws", gateway.websocketHandler)
@@ -537,8 +2567,29 @@ func main() {
 	// Metrics endpoint
 	r.Handle("/metrics", promhttp.Handler())
 
-	// Static file serving for dashboard
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+	// Dashboard sign-in
+	if gateway.oidc != nil {
+		r.HandleFunc("/auth/login", gateway.oidc.loginHandler).Methods("GET")
+		r.HandleFunc("/auth/callback", gateway.oidc.callbackHandler).Methods("GET")
+		r.HandleFunc("/auth/logout", gateway.oidc.logoutHandler).Methods("GET", "POST")
+		r.HandleFunc("/auth/me", gateway.oidc.meHandler).Methods("GET")
+	}
+
+	// HTTP bindings of gRPC methods and path routes come after the
+	// gateway's own endpoints
+	if gateway.transcoder != nil {
+		r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			binding, _ := gateway.transcoder.match(req)
+			return binding != nil
+		}).HandlerFunc(gateway.transcodeHandler)
+	}
+	r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		return gateway.pathRoutes.match(req) != nil
+	}).HandlerFunc(gateway.pathRouteHandler).Name(proxyRouteName)
+
+	// Static file serving for dashboard, for signed-in users when sign-in
+	// is enabled
+	r.PathPrefix("/").Handler(gateway.oidc.requireSession(http.FileServer(http.Dir("./static/"))))
 
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
@@ -553,14 +2604,43 @@ func main() {
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	// Accept cleartext HTTP/2 for gRPC clients
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	listenerTLS, err := NewListenerTLS(secrets, logger)
+	if err != nil {
+		logger.Fatal("Failed to configure gateway TLS", zap.Error(err))
+	}
+	mtlsServer := listenerTLS.configure(server)
+	redirectServer := listenerTLS.redirectServer(server)
+	gateway.readiness.routerReady.Store(true)
 
 	// Graceful shutdown
 	go func() {
 		logger.Info("Starting Go Microservice Gateway", zap.String("port", port))
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := listenAndServe(server); err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Server failed to start", zap.Error(err))
 		}
 	}()
+	if mtlsServer != nil {
+		go func() {
+			logger.Info("Starting mTLS listener", zap.String("addr", mtlsServer.Addr))
+			if err := listenAndServe(mtlsServer); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("mTLS listener failed to start", zap.Error(err))
+			}
+		}()
+	}
+	if redirectServer != nil {
+		go func() {
+			logger.Info("Starting HTTP to HTTPS redirect", zap.String("addr", redirectServer.Addr))
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("HTTP redirect listener failed to start", zap.Error(err))
+			}
+		}()
+	}
+	go h3.serve()
 
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
@@ -568,10 +2648,24 @@ func main() {
 	<-quit
 
 	logger.Info("Shutting down server...")
+	gateway.readiness.shuttingDown.Store(true)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	if err := h3.Shutdown(ctx); err != nil {
+		logger.Warn("HTTP/3 listener forced to shutdown", zap.Error(err))
+	}
+	if mtlsServer != nil {
+		if err := mtlsServer.Shutdown(ctx); err != nil {
+			logger.Warn("mTLS listener forced to shutdown", zap.Error(err))
+		}
+	}
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			logger.Warn("HTTP redirect listener forced to shutdown", zap.Error(err))
+		}
+	}
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Fatal("Server forced to shutdown", zap.Error(err))
 	}
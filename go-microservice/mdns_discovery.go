@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"go.uber.org/zap"
+)
+
+// mdnsMissedBrowses is how many consecutive browses an instance may be
+// missing from before it is removed; multicast answers get lost now and then
+const mdnsMissedBrowses = 3
+
+// MDNSDiscovery browses the LAN for services advertised over mDNS/zeroconf
+// and adds them to the registry, so local development setups don't need
+// registration scripts. The service name comes from the "service" TXT
+// record when present, otherwise from the advertised instance name; other
+// key=value TXT records become metadata.
+type MDNSDiscovery struct {
+	gateway  *APIGateway
+	service  string
+	domain   string
+	interval time.Duration
+	logger   *zap.Logger
+
+	known  map[string]*ServiceInstance
+	missed map[string]int
+}
+
+// NewMDNSDiscovery returns nil unless MDNS_ENABLED is "true"
+func NewMDNSDiscovery(gateway *APIGateway, logger *zap.Logger) *MDNSDiscovery {
+	if getEnv("MDNS_ENABLED", "false") != "true" {
+		return nil
+	}
+
+	return &MDNSDiscovery{
+		gateway:  gateway,
+		service:  getEnv("MDNS_SERVICE", "_http._tcp"),
+		domain:   getEnv("MDNS_DOMAIN", "local"),
+		interval: getEnvDuration("MDNS_INTERVAL", 30*time.Second),
+		logger:   logger,
+		known:    make(map[string]*ServiceInstance),
+		missed:   make(map[string]int),
+	}
+}
+
+// Run browses on every interval until ctx is cancelled
+func (md *MDNSDiscovery) Run(ctx context.Context) {
+	md.logger.Info("mDNS discovery enabled",
+		zap.String("service", md.service),
+		zap.String("domain", md.domain))
+
+	ticker := time.NewTicker(md.interval)
+	defer ticker.Stop()
+
+	for {
+		instances, err := md.browse(ctx)
+		if err != nil {
+			md.logger.Warn("mDNS browse failed", zap.Error(err))
+		} else {
+			md.apply(instances)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (md *MDNSDiscovery) browse(ctx context.Context) (map[string]*ServiceInstance, error) {
+	entries := make(chan *mdns.ServiceEntry, 64)
+	instances := make(map[string]*ServiceInstance)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for entry := range entries {
+			if instance := md.instance(entry); instance != nil {
+				instances[instance.ID] = instance
+			}
+		}
+	}()
+
+	err := mdns.QueryContext(ctx, &mdns.QueryParam{
+		Service:     md.service,
+		Domain:      md.domain,
+		Timeout:     3 * time.Second,
+		Entries:     entries,
+		DisableIPv6: true,
+		Logger:      zap.NewStdLog(md.logger),
+	})
+	close(entries)
+	<-done
+
+	return instances, err
+}
+
+// apply adds new instances and removes the ones that stopped answering
+func (md *MDNSDiscovery) apply(instances map[string]*ServiceInstance) {
+	for id, instance := range instances {
+		md.missed[id] = 0
+		if _, exists := md.known[id]; exists {
+			continue
+		}
+		if md.gateway.registry.AddLocal(instance) {
+			md.gateway.registry.addToRotation(instance.ID)
+		}
+		md.known[id] = instance
+	}
+
+	for id, instance := range md.known {
+		if _, seen := instances[id]; seen {
+			continue
+		}
+		if md.missed[id]++; md.missed[id] < mdnsMissedBrowses {
+			continue
+		}
+		md.gateway.registry.RemoveLocal(id)
+		md.gateway.loadBalancer.RemoveService(instance.poolName(), id)
+		delete(md.known, id)
+		delete(md.missed, id)
+	}
+}
+
+func (md *MDNSDiscovery) instance(entry *mdns.ServiceEntry) *ServiceInstance {
+	if entry.AddrV4 == nil || entry.Port == 0 {
+		return nil
+	}
+
+	// "my-app._http._tcp.local." -> "my-app"
+	name := strings.TrimSuffix(entry.Name, "."+md.service+"."+md.domain+".")
+	name = strings.ReplaceAll(name, `\ `, " ")
+
+	metadata := map[string]interface{}{
+		"source":        "mdns",
+		"mdns_instance": name,
+		"mdns_host":     entry.Host,
+	}
+	for _, field := range entry.InfoFields {
+		if key, value, ok := strings.Cut(field, "="); ok && key != "" {
+			metadata[key] = value
+		}
+	}
+
+	service := name
+	if value, ok := metadata["service"].(string); ok && value != "" {
+		service = value
+	}
+	version, _ := metadata["version"].(string)
+
+	address := entry.AddrV4.String()
+	return &ServiceInstance{
+		ID:       fmt.Sprintf("mdns-%s-%s-%d", service, address, entry.Port),
+		Name:     service,
+		Address:  address,
+		Port:     entry.Port,
+		Version:  version,
+		Metadata: metadata,
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// MirrorConfig sends copies of a route's requests to a shadow service,
+// e.g. a new version to be tried on production traffic. Clients only ever
+// see the primary service's responses; the shadow's are discarded.
+type MirrorConfig struct {
+	// Service is the shadow, qualified by namespace outside the default one
+	Service string `json:"service"`
+
+	// Percent of requests mirrored, all of them when zero
+	Percent int `json:"percent,omitempty"`
+}
+
+// Mirrors sends mirrored requests in the background, at most
+// MIRROR_MAX_CONCURRENCY at a time; requests beyond that aren't mirrored.
+// Each copy gets MIRROR_TIMEOUT to complete and carries an X-Mirrored-From
+// header naming the primary service. Bodies are buffered to be sent twice,
+// so requests with bodies over MIRROR_MAX_BODY_BYTES or of unknown length
+// aren't mirrored either.
+type Mirrors struct {
+	slots   chan struct{}
+	timeout time.Duration
+	maxBody int64
+	logger  *zap.Logger
+
+	requests *prometheus.CounterVec
+}
+
+// NewMirrors returns nil when MIRROR_MAX_CONCURRENCY is 0
+func NewMirrors(logger *zap.Logger) *Mirrors {
+	concurrency := getEnvInt("MIRROR_MAX_CONCURRENCY", 64)
+	if concurrency <= 0 {
+		return nil
+	}
+
+	m := &Mirrors{
+		slots:   make(chan struct{}, concurrency),
+		timeout: getEnvDuration("MIRROR_TIMEOUT", 5*time.Second),
+		maxBody: int64(getEnvInt("MIRROR_MAX_BODY_BYTES", 1<<20)),
+		logger:  logger,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_mirrored_requests_total",
+			Help: "Mirrored requests by outcome: sent, failed or skipped",
+		}, []string{"namespace", "outcome"}),
+	}
+	prometheus.MustRegister(m.requests)
+	return m
+}
+
+// mirror sends a copy of a proxied request to its route's shadow service,
+// if it has one. It must be called before the request is forwarded, as it
+// may replace the request's body with a buffered copy.
+func (gw *APIGateway) mirror(r *http.Request, target *proxyTarget) {
+	m := gw.mirrors
+	config := gw.routes.mirror(target.poolName)
+	if m == nil || config == nil || isGRPC(r) || isUpgrade(r) {
+		return
+	}
+	if config.Percent > 0 && rand.Intn(100) >= config.Percent {
+		return
+	}
+
+	var body []byte
+	if r.Body != http.NoBody {
+		if r.ContentLength < 0 || r.ContentLength > m.maxBody {
+			m.requests.WithLabelValues(target.namespace, "skipped").Inc()
+			return
+		}
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			// Leave what was read in place, the proxy gets the same error
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			m.requests.WithLabelValues(target.namespace, "skipped").Inc()
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.requests.WithLabelValues(target.namespace, "skipped").Inc()
+		return
+	}
+
+	shadowPool := config.Service
+	instance := gw.loadBalancer.GetNextServiceForRequest(shadowPool, "", r)
+	if instance == nil {
+		<-m.slots
+		m.requests.WithLabelValues(target.namespace, "failed").Inc()
+		return
+	}
+
+	// The copy outlives the client's request, so it gets a context of its own
+	out := r.Clone(context.Background())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	shadowTLS := gw.routes.upstreamTLS(shadowPool)
+	out.URL.Scheme = upstreamScheme(shadowTLS)
+	out.URL.Host = serviceHostPort(instance)
+	out.URL.Path = target.path
+	out.URL.RawPath = ""
+	out.Host = ""
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	gw.forwarded.apply(&httputil.ProxyRequest{In: r, Out: out})
+	if target.headers != nil {
+		target.headers.Request.apply(out.Header)
+	}
+	out.Header.Set("X-Mirrored-From", target.poolName)
+	transport := gw.proxyTransports.get(target.timeouts, gw.routes.h2c(shadowPool), shadowTLS)
+
+	go func() {
+		defer func() { <-m.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+		ctx, release := gw.loadBalancer.Begin(ctx, instance.ID)
+		defer release()
+
+		start := time.Now()
+		resp, err := transport.RoundTrip(out.WithContext(ctx))
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthCheckBody))
+			resp.Body.Close()
+		}
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		gw.loadBalancer.ObserveLatency(instance.ID, time.Since(start), failed)
+
+		if failed {
+			m.requests.WithLabelValues(target.namespace, "failed").Inc()
+			fields := []zap.Field{zap.String("service", shadowPool), zap.String("instance", instance.ID)}
+			if err != nil {
+				fields = append(fields, zap.Error(err))
+			} else {
+				fields = append(fields, zap.Int("status", resp.StatusCode))
+			}
+			m.logger.Debug("Mirrored request failed", fields...)
+			return
+		}
+		m.requests.WithLabelValues(target.namespace, "sent").Inc()
+	}()
+}
+
+// hopHeaders only apply to a single connection, so they are not passed on
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders drops the hop-by-hop headers, including those the
+// Connection header names, as httputil.ReverseProxy does for proxied
+// requests
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultNamespace holds instances registered without a namespace
+const defaultNamespace = "default"
+
+// Namespaces are DNS labels so they are safe in pool keys, metric labels
+// and URL paths
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ErrNamespaceConflict is returned when an instance ID is already
+// registered in another namespace
+var ErrNamespaceConflict = errors.New("service ID is registered in another namespace")
+
+// requestNamespace resolves the namespace of an API request from the
+// /api/namespaces/{namespace}/... path segment or the X-Namespace header,
+// falling back to the default namespace
+func requestNamespace(r *http.Request) (string, error) {
+	namespace := mux.Vars(r)["namespace"]
+	if namespace == "" {
+		namespace = r.Header.Get("X-Namespace")
+	}
+	if namespace == "" {
+		return defaultNamespace, nil
+	}
+	if !namespacePattern.MatchString(namespace) {
+		return "", fmt.Errorf("invalid namespace %q", namespace)
+	}
+	return namespace, nil
+}
+
+// qualifiedName scopes a service name to its namespace. Names in the
+// default namespace are left as they are.
+func qualifiedName(namespace, name string) string {
+	if namespace == "" || namespace == defaultNamespace {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// poolName is the load balancer pool an instance belongs to
+func (s *ServiceInstance) poolName() string {
+	return qualifiedName(s.Namespace, s.Name)
+}
+
+// assignNamespace places a registration in the request's namespace. A
+// namespace in the body must agree with the one in the request.
+func assignNamespace(service *ServiceInstance, namespace string) error {
+	if service.Namespace == "" {
+		service.Namespace = namespace
+	}
+	if service.Namespace != namespace {
+		return fmt.Errorf("service namespace %q does not match request namespace %q", service.Namespace, namespace)
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie = "gateway_session"
+	loginCookie   = "gateway_login"
+
+	// csrfCookie holds the session's CSRF token where the dashboard's
+	// scripts can read it, to send back as csrfHeader
+	csrfCookie = "gateway_csrf"
+	csrfHeader = "X-CSRF-Token"
+
+	// loginTimeout bounds the round trip through the identity provider
+	loginTimeout = 10 * time.Minute
+)
+
+// OIDC signs dashboard users in through an OpenID Connect provider such as
+// Keycloak, Auth0 or Azure AD, with the authorization code flow and PKCE.
+// OIDC_ISSUER_URL, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and
+// OIDC_REDIRECT_URL (ending in /auth/callback) configure the client, and
+// OIDC_SCOPES the scopes asked for besides openid.
+//
+// Sessions live in a cookie sealed with OIDC_SESSION_SECRET, so every
+// gateway sharing the secret accepts them, for OIDC_SESSION_TTL. Users
+// whose OIDC_GROUPS_CLAIM lists one of OIDC_ADMIN_GROUPS may call the admin
+// API with their session, as with an admin token. The claim is a top-level
+// name, e.g. "groups" or "roles" (Azure AD) or a namespaced Auth0 claim, or
+// a dotted path such as "realm_access.roles" (Keycloak).
+//
+// Requests changing state only count as signed in when they send the
+// session's CSRF token as X-CSRF-Token, copied from the gateway_csrf cookie
+// or /auth/me. Other sites can make a user's browser send the session
+// cookie but can't read the token; clients calling with an API token
+// rather than a session are not affected.
+type OIDC struct {
+	provider     *oidc.Provider
+	verifier     *oidc.IDTokenVerifier
+	oauth        oauth2.Config
+	aead         cipher.AEAD
+	sessionTTL   time.Duration
+	groupsClaim  string
+	adminGroups  []string
+	secure       bool
+	logoutTarget string
+	logger       *zap.Logger
+}
+
+// oidcSession is the user signed in with a session cookie
+type oidcSession struct {
+	Subject string    `json:"sub"`
+	Email   string    `json:"email,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Groups  []string  `json:"groups,omitempty"`
+	Admin   bool      `json:"admin"`
+	CSRF    string    `json:"csrf_token"`
+	Expiry  time.Time `json:"expiry"`
+}
+
+// oidcLogin is what a login needs to remember until the provider redirects
+// back
+type oidcLogin struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Redirect string    `json:"redirect"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// NewOIDC returns nil when OIDC_ISSUER_URL is unset. It discovers the
+// provider's endpoints, so the provider must be reachable at startup.
+func NewOIDC(logger *zap.Logger) (*OIDC, error) {
+	issuer := getEnv("OIDC_ISSUER_URL", "")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	clientID := getEnv("OIDC_CLIENT_ID", "")
+	redirectURL := getEnv("OIDC_REDIRECT_URL", "")
+	if clientID == "" || redirectURL == "" {
+		return nil, errors.New("OIDC needs OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+	}
+	secret := getEnv("OIDC_SESSION_SECRET", "")
+	if len(secret) < 32 {
+		return nil, errors.New("OIDC_SESSION_SECRET must be at least 32 characters")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover OIDC provider: %w", err)
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &OIDC{
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, getEnvList("OIDC_SCOPES", []string{"profile", "email"})...),
+		},
+		aead:         aead,
+		sessionTTL:   getEnvDuration("OIDC_SESSION_TTL", 8*time.Hour),
+		groupsClaim:  getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		adminGroups:  getEnvList("OIDC_ADMIN_GROUPS", nil),
+		secure:       getEnv("OIDC_COOKIE_SECURE", "true") == "true",
+		logoutTarget: getEnv("OIDC_POST_LOGOUT_REDIRECT_URL", ""),
+		logger:       logger,
+	}
+	if len(o.adminGroups) == 0 {
+		logger.Warn("OIDC_ADMIN_GROUPS not set, no signed-in user may call the admin API")
+	}
+
+	logger.Info("OIDC sign-in enabled",
+		zap.String("issuer", issuer),
+		zap.String("client_id", clientID))
+	return o, nil
+}
+
+// seal encrypts and authenticates a cookie value
+func (o *OIDC) seal(value interface{}) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, o.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(o.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// open decrypts a sealed cookie value, failing for ones that were tampered
+// with or sealed with another secret
+func (o *OIDC) open(sealed string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < o.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	nonce, ciphertext := data[:o.aead.NonceSize()], data[o.aead.NonceSize():]
+	plaintext, err := o.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, value)
+}
+
+func (o *OIDC) setCookie(w http.ResponseWriter, name, value string, expiry time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// setCSRFCookie sets the session's CSRF token, readable by the dashboard's
+// scripts unlike the session itself
+func (o *OIDC) setCSRFCookie(w http.ResponseWriter, token string, expiry time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiry,
+		Secure:   o.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (o *OIDC) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session returns the user signed in on a request, nil when there is none.
+// Requests changing state from another origin, or without the session's
+// CSRF token, don't count as signed in, so other sites can't make a user's
+// browser call the admin API.
+func (o *OIDC) session(r *http.Request) *oidcSession {
+	if o == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var session oidcSession
+	if err := o.open(cookie.Value, &session); err != nil || time.Now().After(session.Expiry) {
+		return nil
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if parsed, err := url.Parse(origin); err != nil || parsed.Host != r.Host {
+				return nil
+			}
+		}
+		token := r.Header.Get(csrfHeader)
+		if session.CSRF == "" || subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRF)) != 1 {
+			o.logger.Warn("Signed-in request without a valid CSRF token",
+				zap.String("subject", session.Subject),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path))
+			return nil
+		}
+	}
+	return &session
+}
+
+// randomString returns a random URL-safe string
+func randomString() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// localRedirect returns a path to send the user back to after signing in,
+// falling back to / for anything that would leave the gateway
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// loginHandler sends the user to the provider, to come back to ?redirect=
+func (o *OIDC) loginHandler(w http.ResponseWriter, r *http.Request) {
+	login := oidcLogin{
+		Verifier: oauth2.GenerateVerifier(),
+		Redirect: localRedirect(r.URL.Query().Get("redirect")),
+		Expiry:   time.Now().Add(loginTimeout),
+	}
+	var err error
+	if login.State, err = randomString(); err == nil {
+		login.Nonce, err = randomString()
+	}
+	if err != nil {
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	sealed, err := o.seal(login)
+	if err != nil {
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+	o.setCookie(w, loginCookie, sealed, login.Expiry)
+
+	http.Redirect(w, r, o.oauth.AuthCodeURL(login.State,
+		oidc.Nonce(login.Nonce),
+		oauth2.S256ChallengeOption(login.Verifier)), http.StatusFound)
+}
+
+// callbackHandler completes a sign-in when the provider redirects back
+func (o *OIDC) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil || o.open(cookie.Value, &login) != nil || time.Now().After(login.Expiry) {
+		http.Error(w, "Sign-in expired, start again", http.StatusBadRequest)
+		return
+	}
+	o.clearCookie(w, loginCookie)
+
+	query := r.URL.Query()
+	if query.Get("state") != login.State {
+		http.Error(w, "Sign-in state mismatch", http.StatusBadRequest)
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "Sign-in failed: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+
+	token, err := o.oauth.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		o.logger.Warn("OIDC code exchange failed", zap.Error(err))
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "Sign-in failed: no ID token", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := o.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		o.logger.Warn("OIDC ID token rejected", zap.Error(err))
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	session := oidcSession{
+		Subject: idToken.Subject,
+		Groups:  claimStrings(claims, o.groupsClaim),
+		Expiry:  time.Now().Add(o.sessionTTL),
+	}
+	session.Email, _ = claims["email"].(string)
+	session.Name, _ = claims["name"].(string)
+	for _, group := range session.Groups {
+		session.Admin = session.Admin || slices.Contains(o.adminGroups, group)
+	}
+	if session.CSRF, err = randomString(); err != nil {
+		http.Error(w, "Sign-in failed", http.StatusInternalServerError)
+		return
+	}
+
+	sealed, err := o.seal(session)
+	if err != nil {
+		http.Error(w, "Sign-in failed", http.StatusInternalServerError)
+		return
+	}
+	o.setCookie(w, sessionCookie, sealed, session.Expiry)
+	o.setCSRFCookie(w, session.CSRF, session.Expiry)
+	o.logger.Info("User signed in",
+		zap.String("subject", session.Subject),
+		zap.String("email", session.Email),
+		zap.Bool("admin", session.Admin))
+
+	http.Redirect(w, r, login.Redirect, http.StatusFound)
+}
+
+// claimStrings returns the strings of a claim, looked up by its full name
+// first and then as a dotted path
+func claimStrings(claims map[string]interface{}, name string) []string {
+	value, exists := claims[name]
+	if !exists {
+		value, _ = getPath(claims, name)
+	}
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// logoutHandler ends the session, and the provider's too when it
+// advertises an end_session_endpoint
+func (o *OIDC) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	o.clearCookie(w, sessionCookie)
+	o.clearCookie(w, csrfCookie)
+
+	var metadata struct {
+		EndSession string `json:"end_session_endpoint"`
+	}
+	if o.provider.Claims(&metadata) == nil && metadata.EndSession != "" {
+		target, err := url.Parse(metadata.EndSession)
+		if err == nil {
+			query := target.Query()
+			query.Set("client_id", o.oauth.ClientID)
+			if o.logoutTarget != "" {
+				query.Set("post_logout_redirect_uri", o.logoutTarget)
+			}
+			target.RawQuery = query.Encode()
+			http.Redirect(w, r, target.String(), http.StatusFound)
+			return
+		}
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// meHandler describes the signed-in user, for the dashboard
+func (o *OIDC) meHandler(w http.ResponseWriter, r *http.Request) {
+	session := o.session(r)
+	if session == nil {
+		http.Error(w, "Not signed in", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// requireSession sends users without a session to sign in first
+func (o *OIDC) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o != nil && o.session(r) == nil {
+			http.Redirect(w, r, "/auth/login?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
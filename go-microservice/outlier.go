@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OutlierDetector ejects instances from load balancing based on proxy
+// results, so a crashed or failing instance stops getting traffic without
+// waiting for the next active health check. A refused connection ejects
+// immediately; other failures eject after OUTLIER_CONSECUTIVE_FAILURES in a
+// row. Ejected instances return once OUTLIER_EJECTION_TIME has passed.
+type OutlierDetector struct {
+	threshold    int
+	ejectionTime time.Duration
+	failures     map[string]int // instance ID -> consecutive failures
+	mutex        sync.Mutex
+	loadBalancer *LoadBalancer
+	logger       *zap.Logger
+}
+
+// NewOutlierDetector returns nil when OUTLIER_CONSECUTIVE_FAILURES is 0
+func NewOutlierDetector(loadBalancer *LoadBalancer, logger *zap.Logger) *OutlierDetector {
+	threshold := getEnvInt("OUTLIER_CONSECUTIVE_FAILURES", 5)
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &OutlierDetector{
+		threshold:    threshold,
+		ejectionTime: getEnvDuration("OUTLIER_EJECTION_TIME", 30*time.Second),
+		failures:     make(map[string]int),
+		loadBalancer: loadBalancer,
+		logger:       logger,
+	}
+}
+
+// Observe records the outcome of one proxied request; resp is nil when the
+// request failed without a response
+func (od *OutlierDetector) Observe(instance *ServiceInstance, resp *http.Response, err error) {
+	if od == nil {
+		return
+	}
+
+	od.mutex.Lock()
+	defer od.mutex.Unlock()
+
+	if err == nil && resp.StatusCode < http.StatusInternalServerError {
+		delete(od.failures, instance.ID)
+		return
+	}
+
+	od.failures[instance.ID]++
+	if od.failures[instance.ID] < od.threshold && !errors.Is(err, syscall.ECONNREFUSED) {
+		return
+	}
+	failures := od.failures[instance.ID]
+	delete(od.failures, instance.ID)
+
+	od.loadBalancer.Eject(instance.ID, time.Now().Add(od.ejectionTime))
+	od.logger.Warn("Ejected service instance from load balancing",
+		zap.String("id", instance.ID),
+		zap.String("name", instance.Name),
+		zap.Int("consecutive_failures", failures),
+		zap.Duration("ejection_time", od.ejectionTime),
+		zap.Error(err))
+}
+
+// Eject keeps an instance out of selection until the given time
+func (lb *LoadBalancer) Eject(instanceID string, until time.Time) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.ejected[instanceID] = until
+}
+
+// isEjected reports whether an instance is ejected, forgetting ejections
+// that have run out. The caller must hold lb.mutex.
+func (lb *LoadBalancer) isEjected(instanceID string, now time.Time) bool {
+	until, exists := lb.ejected[instanceID]
+	if !exists {
+		return false
+	}
+	if now.After(until) {
+		delete(lb.ejected, instanceID)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"sigs.k8s.io/yaml"
+)
+
+// PathRoute sends requests matching a path prefix, and optionally a host
+// and methods, to a service, as an alternative to /api/proxy/{service}
+type PathRoute struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+
+	// Host matches the request's host exactly, or any subdomain for
+	// "*.example.com"; empty matches any host
+	Host string `json:"host,omitempty"`
+
+	// Methods restricts the route to these methods; empty allows any
+	Methods []string `json:"methods,omitempty"`
+
+	// Service is qualified by namespace outside the default one
+	Service string `json:"service"`
+
+	// Priority orders overlapping routes, highest first; among routes of
+	// equal priority the longest prefix, then one with a host, wins
+	Priority int `json:"priority,omitempty"`
+
+	// StripPrefix forwards only the path after Prefix
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+
+	// Timeouts override the service's route configuration for requests
+	// through this route
+	Timeouts *ProxyTimeouts `json:"timeouts,omitempty"`
+
+	// Middleware wraps the route's requests, outermost first: "admin"
+	// admits admin tokens only and "authorize" tokens with access to
+	// Service, as for registry writes
+	Middleware []string `json:"middleware,omitempty"`
+}
+
+var pathRouteNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func (pr *PathRoute) validate() error {
+	if !pathRouteNamePattern.MatchString(pr.Name) {
+		return fmt.Errorf("invalid route name %q", pr.Name)
+	}
+	if !strings.HasPrefix(pr.Prefix, "/") {
+		return errors.New("prefix must start with /")
+	}
+	if pr.Service == "" {
+		return errors.New("route needs a service")
+	}
+	if namespace, _, qualified := strings.Cut(pr.Service, "/"); qualified && !namespacePattern.MatchString(namespace) {
+		return fmt.Errorf("invalid namespace %q", namespace)
+	}
+	for i, method := range pr.Methods {
+		pr.Methods[i] = strings.ToUpper(method)
+	}
+	pr.Host = strings.ToLower(pr.Host)
+	for _, name := range pr.Middleware {
+		if name != "admin" && name != "authorize" {
+			return fmt.Errorf("unknown middleware %q", name)
+		}
+	}
+	if pr.Timeouts != nil {
+		return pr.Timeouts.validate()
+	}
+	return nil
+}
+
+// matches reports whether a request falls under the route
+func (pr *PathRoute) matches(r *http.Request) bool {
+	path := r.URL.Path
+	if prefix := strings.TrimSuffix(pr.Prefix, "/"); path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return false
+	}
+	if len(pr.Methods) > 0 && !slices.Contains(pr.Methods, r.Method) {
+		return false
+	}
+	if pr.Host == "" {
+		return true
+	}
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	if domain, ok := strings.CutPrefix(pr.Host, "*."); ok {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return host == pr.Host
+}
+
+// target returns the namespace and service a route sends requests to
+func (pr *PathRoute) target() (namespace, service string) {
+	if namespace, service, qualified := strings.Cut(pr.Service, "/"); qualified {
+		return namespace, service
+	}
+	return defaultNamespace, pr.Service
+}
+
+// upstreamPath returns the path a request is forwarded with
+func (pr *PathRoute) upstreamPath(path string) string {
+	if !pr.StripPrefix {
+		return path
+	}
+	path = strings.TrimPrefix(path, strings.TrimSuffix(pr.Prefix, "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// PathRoutes holds the path routes, loaded from PATH_ROUTES_FILE (YAML or
+// JSON, a list of routes) and changed at runtime through the admin API.
+// They are tried after the gateway's own endpoints:
+//
+//   - name: shop
+//     prefix: /shop
+//     host: "*.example.com"
+//     service: team-a/storefront
+//     strip_prefix: true
+type PathRoutes struct {
+	routes []*PathRoute // in match order
+	mutex  sync.RWMutex
+}
+
+func NewPathRoutes(logger *zap.Logger) (*PathRoutes, error) {
+	pr := &PathRoutes{}
+
+	file := getEnv("PATH_ROUTES_FILE", "")
+	if file == "" {
+		return pr, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read path routes: %w", err)
+	}
+	var routes []*PathRoute
+	if err := yaml.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("decode path routes: %w", err)
+	}
+	names := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("path route %q: %w", route.Name, err)
+		}
+		if names[route.Name] {
+			return nil, fmt.Errorf("duplicate path route %q", route.Name)
+		}
+		names[route.Name] = true
+	}
+	pr.routes = sortPathRoutes(routes)
+
+	logger.Info("Path routes loaded",
+		zap.String("file", file),
+		zap.Int("routes", len(routes)))
+	return pr, nil
+}
+
+// sortPathRoutes puts routes in match order
+func sortPathRoutes(routes []*PathRoute) []*PathRoute {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		switch {
+		case a.Priority != b.Priority:
+			return a.Priority > b.Priority
+		case len(a.Prefix) != len(b.Prefix):
+			return len(a.Prefix) > len(b.Prefix)
+		case (a.Host == "") != (b.Host == ""):
+			return a.Host != ""
+		default:
+			return a.Name < b.Name
+		}
+	})
+	return routes
+}
+
+// match returns the route of a request, nil when none matches
+func (pr *PathRoutes) match(r *http.Request) *PathRoute {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	for _, route := range pr.routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// list returns the routes in match order
+func (pr *PathRoutes) list() []*PathRoute {
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	return append([]*PathRoute{}, pr.routes...)
+}
+
+// set adds a route or replaces the one of the same name
+func (pr *PathRoutes) set(route *PathRoute) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	routes := make([]*PathRoute, 0, len(pr.routes)+1)
+	for _, existing := range pr.routes {
+		if existing.Name != route.Name {
+			routes = append(routes, existing)
+		}
+	}
+	pr.routes = sortPathRoutes(append(routes, route))
+}
+
+// remove deletes a route, reporting whether it existed
+func (pr *PathRoutes) remove(name string) bool {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for i, route := range pr.routes {
+		if route.Name == name {
+			pr.routes = append(pr.routes[:i:i], pr.routes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pathRouteHandler proxies requests matched by a path route
+func (gw *APIGateway) pathRouteHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	route := gw.pathRoutes.match(r)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	namespace, requested := route.target()
+	gw.metrics.requestsTotal.WithLabelValues(namespace).Inc()
+	serviceName := gw.aliases.Resolve(namespace, requested)
+	if gw.applyCORS(w, r, qualifiedName(namespace, serviceName)) {
+		return
+	}
+
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		gw.route(w, r, &proxyTarget{
+			namespace:        namespace,
+			serviceName:      serviceName,
+			poolName:         qualifiedName(namespace, serviceName),
+			path:             route.upstreamPath(r.URL.Path),
+			timeoutOverrides: route.Timeouts,
+		})
+	}
+	for i := len(route.Middleware) - 1; i >= 0; i-- {
+		switch next := handler; route.Middleware[i] {
+		case "admin":
+			handler = gw.requireAdmin(next)
+		case "authorize":
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				if gw.authorize(w, r, namespace, serviceName) {
+					next(w, r)
+				}
+			}
+		}
+	}
+	handler(w, r)
+
+	gw.metrics.requestDuration.WithLabelValues(namespace).Observe(time.Since(start).Seconds())
+}
+
+func (gw *APIGateway) listPathRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gw.pathRoutes.list())
+}
+
+func (gw *APIGateway) putPathRouteHandler(w http.ResponseWriter, r *http.Request) {
+	var route PathRoute
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	route.Name = mux.Vars(r)["name"]
+	if err := route.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gw.pathRoutes.set(&route)
+	gw.logger.Info("Path route updated",
+		zap.String("name", route.Name),
+		zap.String("prefix", route.Prefix),
+		zap.String("host", route.Host),
+		zap.String("service", route.Service))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(route)
+}
+
+func (gw *APIGateway) deletePathRouteHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !gw.pathRoutes.remove(name) {
+		http.Error(w, "Path route not found", http.StatusNotFound)
+		return
+	}
+	gw.logger.Info("Path route removed", zap.String("name", name))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Instance priorities. Instances registered without one are primaries.
+const (
+	priorityPrimary = "primary"
+	priorityBackup  = "backup"
+)
+
+// backupScope suffixes a pool key for the strategy state kept while the
+// pool has failed over to its backups
+const backupScope = "#backup"
+
+func validatePriority(priority string) error {
+	if priority != "" && priority != priorityPrimary && priority != priorityBackup {
+		return fmt.Errorf("invalid priority %q, expected %s or %s", priority, priorityPrimary, priorityBackup)
+	}
+	return nil
+}
+
+func isBackup(instance *ServiceInstance) bool {
+	return instance.Priority == priorityBackup
+}
+
+// preferPrimaries narrows a pool to its primary instances while any of them
+// can take traffic, so backups stay on warm standby. Once every primary is
+// unhealthy or ejected the pool fails over to the backups that can, and
+// when none can either the whole pool is returned for the strategies to
+// fall back on. Like preferLocalZone it also returns the key to keep
+// strategy state under. The caller must hold lb.mutex.
+func (lb *LoadBalancer) preferPrimaries(key string, instances []*ServiceInstance, now time.Time) ([]*ServiceInstance, string) {
+	primaries := make([]*ServiceInstance, 0, len(instances))
+	backups := make([]*ServiceInstance, 0)
+	primaryAvailable, backupAvailable := false, false
+	for _, instance := range instances {
+		available := routable(instance) && !lb.isEjected(instance.ID, now)
+		if isBackup(instance) {
+			backups = append(backups, instance)
+			backupAvailable = backupAvailable || available
+		} else {
+			primaries = append(primaries, instance)
+			primaryAvailable = primaryAvailable || available
+		}
+	}
+
+	switch {
+	case len(backups) == 0:
+		return instances, key
+	case primaryAvailable:
+		return primaries, key
+	case backupAvailable:
+		return backups, key + backupScope
+	default:
+		return instances, key
+	}
+}
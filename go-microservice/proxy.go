@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// proxyTransports holds the transports of proxied requests. Transports
+// carry the connect and response header timeouts, so services with the
+// same timeouts share one and reuse its connections. There is no overall
+// timeout at this level, so streamed responses (SSE, large downloads) can
+// run as long as the route allows.
+//
+// Idle connections are kept for reuse, PROXY_MAX_IDLE_CONNS_PER_HOST per
+// instance and PROXY_MAX_IDLE_CONNS in all, until PROXY_IDLE_CONN_TIMEOUT
+// passes without them being used. PROXY_MAX_CONNS_PER_HOST caps the
+// connections to an instance, requests beyond it waiting for one to free
+// up; zero is no cap.
+type proxyTransports struct {
+	transports      map[transportKey]http.RoundTripper
+	tlsSources      map[UpstreamTLS]*upstreamTLSSource
+	maxIdle         int
+	maxIdlePerHost  int
+	maxConnsPerHost int
+	idleTimeout     time.Duration
+	writeBuffer     int
+	tlsReload       time.Duration
+	mutex           sync.Mutex
+
+	connections     *prometheus.CounterVec
+	openConnections prometheus.Gauge
+	tlsReloads      *prometheus.CounterVec
+}
+
+type transportKey struct {
+	connect        Duration
+	responseHeader Duration
+	h2c            bool
+	tls            UpstreamTLS
+	https          bool
+}
+
+func newProxyTransports() *proxyTransports {
+	pt := &proxyTransports{
+		transports:      make(map[transportKey]http.RoundTripper),
+		tlsSources:      make(map[UpstreamTLS]*upstreamTLSSource),
+		maxIdle:         getEnvInt("PROXY_MAX_IDLE_CONNS", 1024),
+		maxIdlePerHost:  getEnvInt("PROXY_MAX_IDLE_CONNS_PER_HOST", 64),
+		maxConnsPerHost: getEnvInt("PROXY_MAX_CONNS_PER_HOST", 0),
+		idleTimeout:     getEnvDuration("PROXY_IDLE_CONN_TIMEOUT", 90*time.Second),
+		writeBuffer:     getEnvInt("PROXY_UPLOAD_BUFFER_BYTES", 64<<10),
+		tlsReload:       getEnvDuration("UPSTREAM_TLS_RELOAD_INTERVAL", 30*time.Second),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_upstream_connections_total",
+			Help: "Connections proxied requests were sent on, by whether they were reused",
+		}, []string{"reused"}),
+		openConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proxy_upstream_open_connections",
+			Help: "Connections open to upstream instances",
+		}),
+		tlsReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_upstream_tls_reloads_total",
+			Help: "Loads of upstream TLS certificates and keys, by result",
+		}, []string{"result"}),
+	}
+	prometheus.MustRegister(pt.connections, pt.openConnections, pt.tlsReloads)
+	return pt
+}
+
+// get returns the transport for a route's timeouts and upstream TLS, which
+// is nil for cleartext. h2c transports speak HTTP/2 only, as gRPC backends
+// expect: in cleartext, or negotiated over TLS.
+func (pt *proxyTransports) get(timeouts ProxyTimeouts, h2c bool, upstreamTLS *UpstreamTLS) http.RoundTripper {
+	key := transportKey{connect: timeouts.Connect, responseHeader: timeouts.ResponseHeader, h2c: h2c}
+	if upstreamTLS != nil {
+		key.tls, key.https = *upstreamTLS, true
+	}
+
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	if transport, exists := pt.transports[key]; exists {
+		return transport
+	}
+	dial := (&net.Dialer{
+		Timeout:   time.Duration(timeouts.Connect),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		pt.openConnections.Inc()
+		return &countedConn{Conn: conn, closed: pt.openConnections.Dec}, nil
+	}
+	transport.ResponseHeaderTimeout = time.Duration(timeouts.ResponseHeader)
+	transport.MaxIdleConns = pt.maxIdle
+	transport.MaxIdleConnsPerHost = pt.maxIdlePerHost
+	transport.MaxConnsPerHost = pt.maxConnsPerHost
+	transport.IdleConnTimeout = pt.idleTimeout
+	transport.WriteBufferSize = pt.writeBuffer
+	if key.https {
+		transport.TLSClientConfig = pt.tlsSource(key.tls).tlsConfig()
+	}
+	if h2c {
+		transport.Protocols = new(http.Protocols)
+		if key.https {
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+
+	traced := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				pt.connections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+			},
+		}
+		return transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	})
+	pt.transports[key] = traced
+	return traced
+}
+
+// tlsSource returns the material source of a TLS configuration, shared by
+// its transports. The caller holds pt.mutex.
+func (pt *proxyTransports) tlsSource(config UpstreamTLS) *upstreamTLSSource {
+	if source, exists := pt.tlsSources[config]; exists {
+		return source
+	}
+	source := &upstreamTLSSource{
+		config:   config,
+		interval: pt.tlsReload,
+		reloaded: func(err error) {
+			result := "success"
+			if err != nil {
+				result = "failed"
+			}
+			pt.tlsReloads.WithLabelValues(result).Inc()
+		},
+	}
+	pt.tlsSources[config] = source
+	return source
+}
+
+// countedConn is an upstream connection counted as open until it closes
+type countedConn struct {
+	net.Conn
+	closed func()
+	once   sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// isTimeout reports whether a proxy error is one of the route's timeouts
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// retryPicks bounds the load balancer picks made to find an instance a
+// request hasn't been tried on yet
+const retryPicks = 3
+
+// proxyTarget is what a proxied request was routed to
+type proxyTarget struct {
+	namespace         string
+	serviceName       string
+	poolName          string
+	version           string
+	instance          *ServiceInstance // for the first attempt
+	timeouts          ProxyTimeouts
+	timeoutOverrides  *ProxyTimeouts // of the path route, over the service's
+	path              string         // upstream path, see RouteTable.upstreamPath
+	headers           *HeaderRules
+	responseTransform *ResponseTransform
+	h2c               bool            // upstream over cleartext HTTP/2, as gRPC calls are
+	tls               *UpstreamTLS    // nil unless the upstream speaks HTTPS
+	maxResponseBody   int64           // zero when unlimited
+	cache             *cacheRequest   // nil unless the route is cached
+	canary            *CanaryConfig   // nil unless the pool has a canary
+	split             *TrafficSplit   // nil unless the pool's split picked the version
+	subset            *instanceSubset // of the pool picks are narrowed to
+	hedge             *HedgeConfig    // nil unless the request may be hedged
+
+	// idempotency holds the request's Idempotency-Key while it is proxied;
+	// nil when it has none
+	idempotency *idempotentRequest
+
+	// status is the response's status code, once there is one
+	status int
+
+	// breakerDone reports the request's result to the pool's breaker
+	breakerDone func(breakerResult)
+
+	// liftTimeout stops the route's total timeout; nil when there is none
+	liftTimeout func() bool
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// forward proxies a request, streaming the response back. Bodies are
+// flushed to the client every PROXY_FLUSH_INTERVAL, and immediately for
+// server-sent events and responses of unknown length. Event streams are
+// exempt from the route's total timeout and stay open until either side
+// closes them, as do upgraded connections such as WebSockets, which are
+// relayed both ways.
+func (gw *APIGateway) forward(w http.ResponseWriter, r *http.Request, target *proxyTarget) {
+	// The server's write timeout would cut long streams off, as would its
+	// read timeout for client-streaming gRPC calls; the route's total
+	// timeout bounds proxied requests instead
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+	if target.h2c {
+		controller.SetReadDeadline(time.Time{})
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = upstreamScheme(target.tls)
+			pr.Out.URL.Path = target.path
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = ""
+			gw.forwarded.apply(pr)
+			if target.headers != nil {
+				target.headers.Request.apply(pr.Out.Header)
+			}
+			// Responses to transform must come unencoded; the transport
+			// still compresses them in transit
+			if target.responseTransform != nil {
+				pr.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return gw.roundTrip(req, target)
+		}),
+		FlushInterval: gw.flushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			target.status = resp.StatusCode
+			if target.liftTimeout != nil && isEventStream(resp) {
+				target.liftTimeout()
+			}
+			if limit := target.maxResponseBody; limit > 0 && resp.StatusCode != http.StatusSwitchingProtocols {
+				if resp.ContentLength > limit {
+					return errResponseTooLarge
+				}
+				// Once streaming has begun all that is left is to cut the
+				// response off
+				resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: limit, exceeded: func() {
+					gw.logger.Warn("Proxied response body too large",
+						zap.String("service", target.serviceName),
+						zap.Int64("limit", limit))
+				}}
+			}
+			gw.forwarded.applyResponse(resp)
+			if target.headers != nil {
+				target.headers.Response.apply(resp.Header)
+			}
+			if transform := target.responseTransform; transform != nil && transform.applies(resp) {
+				if err := transform.apply(resp, gw.routes.maxTransformBody); err != nil {
+					return err
+				}
+			}
+			if target.cache != nil {
+				gw.cache.capture(r, resp, target.cache)
+			}
+			if target.idempotency != nil {
+				gw.idempotency.capture(resp, target.idempotency)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			gw.logger.Error("Proxy request failed",
+				zap.String("service", target.serviceName),
+				zap.Error(err))
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				target.status = http.StatusRequestEntityTooLarge
+				rejectTooLarge(w, tooLarge.Limit)
+			case errors.Is(err, errUploadStalled):
+				target.status = http.StatusRequestTimeout
+				http.Error(w, "Request body upload timed out", target.status)
+			case errors.Is(err, errResponseTooLarge):
+				target.status = http.StatusBadGateway
+				http.Error(w, "Service response exceeds the size limit", target.status)
+			case isTimeout(err) || errors.Is(context.Cause(r.Context()), context.DeadlineExceeded):
+				target.status = http.StatusGatewayTimeout
+				http.Error(w, "Service request timed out", target.status)
+			default:
+				target.status = http.StatusBadGateway
+				http.Error(w, "Service request failed", target.status)
+			}
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// roundTrip sends a proxied request upstream, retrying it on other
+// instances as the service's retry policy and the retry budget allow, and
+// failing over to another when connecting to one fails. Each
+// attempt counts as a request in flight to its instance until the response
+// body is closed.
+func (gw *APIGateway) roundTrip(req *http.Request, target *proxyTarget) (*http.Response, error) {
+	policy := gw.retries.policyFor(target.poolName)
+	attempts := 1
+	var body []byte
+	if policy != nil {
+		gw.retries.budget.request(target.poolName)
+		attempts = policy.MaxAttempts
+		// Retries replay the body, so only small ones with a known length
+		// are retried
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.ContentLength > 0 && req.ContentLength <= gw.retries.maxBody {
+				var err error
+				if body, err = io.ReadAll(req.Body); err != nil {
+					return nil, err
+				}
+				req.Body.Close()
+			} else {
+				attempts = 1
+			}
+		}
+	}
+
+	var unsent *unsentBody
+	if gw.failover != nil && body == nil && req.Body != nil && req.Body != http.NoBody {
+		unsent = &unsentBody{ReadCloser: req.Body}
+		req.Body = unsent
+	}
+
+	instance := target.instance
+	tried := make(map[string]bool)
+	failovers := 0
+	for attempt := 1; ; attempt++ {
+		tried[instance.ID] = true
+		var sent *proxyAttempt
+		if target.hedge != nil {
+			sent = gw.sendHedged(req, target, instance, tried)
+		} else {
+			sent = gw.send(req, target, instance, body)
+		}
+		instance = sent.instance
+		ctx, release, resp, err, cancelled := sent.ctx, sent.release, sent.resp, sent.err, sent.cancelled
+
+		// A request that couldn't connect goes straight to another
+		// instance, without using up an attempt
+		if req.Context().Err() == nil && gw.failover.allows(err, failovers, unsent) {
+			if next := gw.retryInstance(req, target, tried); next != nil && !tried[next.ID] {
+				release()
+				failovers++
+				gw.failover.failovers.WithLabelValues(target.namespace).Inc()
+				gw.logger.Debug("Failing proxied request over",
+					zap.String("service", target.serviceName),
+					zap.String("instance", instance.ID),
+					zap.String("next", next.ID),
+					zap.Error(err))
+				instance = next
+				attempt--
+				continue
+			}
+		}
+
+		retry := ctx.Err() == nil && attempt < attempts && policy.retryable(req.Method, resp, err)
+		if retry && !gw.retries.budget.allow(target.poolName) {
+			gw.retries.retriesTotal.WithLabelValues(target.namespace, "budget_exhausted").Inc()
+			retry = false
+		}
+		if !retry {
+			switch {
+			case cancelled:
+				target.breakerDone(breakerIgnored)
+			case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+				target.breakerDone(breakerFailure)
+			default:
+				target.breakerDone(breakerSuccess)
+			}
+			if err != nil {
+				release()
+				return nil, err
+			}
+			if upstream, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+				// ReverseProxy relays upgraded connections itself; close
+				// them when a drain or the client's request ends
+				stop := context.AfterFunc(ctx, func() { upstream.Close() })
+				resp.Body = &upgradedBody{
+					releasingBody: releasingBody{ReadCloser: upstream, release: func() { stop(); release() }},
+					writer:        upstream,
+				}
+				return resp, nil
+			}
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthCheckBody))
+			resp.Body.Close()
+		}
+		release()
+		gw.retries.retriesTotal.WithLabelValues(target.namespace, "retried").Inc()
+		gw.logger.Debug("Retrying proxied request",
+			zap.String("service", target.serviceName),
+			zap.String("instance", instance.ID),
+			zap.Int("attempt", attempt))
+
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if next := gw.retryInstance(req, target, tried); next != nil {
+			instance = next
+		}
+	}
+}
+
+// proxyAttempt is the outcome of sending a request to an instance. Its
+// release must be called once the attempt is done with.
+type proxyAttempt struct {
+	instance  *ServiceInstance
+	ctx       context.Context
+	release   func()
+	resp      *http.Response
+	err       error
+	cancelled bool // by the client, a drain, a body limit or a stalled upload
+}
+
+// send makes one attempt of a proxied request on an instance
+func (gw *APIGateway) send(req *http.Request, target *proxyTarget, instance *ServiceInstance, body []byte) *proxyAttempt {
+	ctx, release := gw.loadBalancer.Begin(req.Context(), instance.ID)
+	out := req.Clone(ctx)
+	out.URL.Host = serviceHostPort(instance)
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	start := time.Now()
+	resp, err := gw.proxyTransports.get(target.timeouts, target.h2c, target.tls).RoundTrip(out)
+	latency := time.Since(start)
+	// A client going away, sending too large a body or stalling an upload,
+	// or a drain timing out, says nothing about the instance's health,
+	// unlike the route's timeouts
+	var tooLarge *http.MaxBytesError
+	cancelled := errors.Is(context.Cause(ctx), context.Canceled) || errors.As(err, &tooLarge) || errors.Is(err, errUploadStalled)
+	if !cancelled {
+		gw.loadBalancer.ObserveLatency(instance.ID, latency, err != nil || resp.StatusCode >= http.StatusInternalServerError)
+		gw.outliers.Observe(instance, resp, err)
+		if target.hedge != nil {
+			gw.hedging.observe(target.poolName, latency)
+		}
+	}
+	return &proxyAttempt{instance: instance, ctx: ctx, release: release, resp: resp, err: err, cancelled: cancelled}
+}
+
+// retryInstance picks the instance for a retry, preferring one the request
+// hasn't been tried on. It returns nil when the pool has nothing left, in
+// which case the last instance is tried again.
+func (gw *APIGateway) retryInstance(req *http.Request, target *proxyTarget, tried map[string]bool) *ServiceInstance {
+	var fallback *ServiceInstance
+	for i := 0; i < retryPicks; i++ {
+		var instance *ServiceInstance
+		if target.subset != nil {
+			instance = gw.loadBalancer.GetNextServiceSubset(target.poolName, target.subset, req)
+		} else {
+			instance = gw.loadBalancer.GetNextServiceForRequest(target.poolName, target.version, req)
+		}
+		if instance == nil && gw.federation != nil {
+			instance = gw.federation.GetNextService(target.poolName, target.version)
+		}
+		if instance == nil || !tried[instance.ID] {
+			return instance
+		}
+		fallback = instance
+	}
+	return fallback
+}
+
+// releasingBody ends an attempt's time in flight once the proxy is done
+// with the response body
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// errResponseTooLarge fails responses over their route's body limit
+var errResponseTooLarge = errors.New("response body exceeds the size limit")
+
+// limitedBody fails reads past a response's body limit
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  func()
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	// Read one byte past the limit to tell a body that ends right at it
+	// from one that goes on
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n, b.remaining, b.err = int(b.remaining), 0, errResponseTooLarge
+	b.exceeded()
+	return n, b.err
+}
+
+// rejectTooLarge answers a request whose body is over its route's limit
+func rejectTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("Request body exceeds the limit of %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// upgradedBody is the connection of a 101 Switching Protocols response,
+// e.g. a WebSocket, which ReverseProxy needs to be writable
+type upgradedBody struct {
+	releasingBody
+	writer io.Writer
+}
+
+func (b *upgradedBody) Write(p []byte) (int, error) {
+	return b.writer.Write(p)
+}
+
+// isEventStream reports whether a response is a server-sent event stream
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// isUpgrade reports whether a request asks to switch protocols, e.g. to
+// a WebSocket
+func isUpgrade(r *http.Request) bool {
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return r.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.uber.org/zap"
+)
+
+// raftApplyTimeout bounds how long a write waits to be committed
+const raftApplyTimeout = 10 * time.Second
+
+// raftSecretHeader carries RAFT_CLUSTER_SECRET on writes forwarded to the
+// leader
+const raftSecretHeader = "X-Raft-Cluster-Secret"
+
+// raftCommand is a replicated registry mutation
+type raftCommand struct {
+	Op        string           `json:"op"` // register, deregister
+	Service   *ServiceInstance `json:"service,omitempty"`
+	ServiceID string           `json:"service_id,omitempty"`
+}
+
+// raftPeer is a cluster member from RAFT_PEERS ("id=raft_addr=http_url",
+// http_url being the member's RAFT_HTTP_ADDR listener)
+type raftPeer struct {
+	id      raft.ServerID
+	address raft.ServerAddress
+	httpURL string
+}
+
+// RaftBackend replicates the registry between gateway nodes with Raft.
+// Writes are committed through the leader and every node applies them to
+// its local FSM, so all gateways route from the same catalog and a new
+// leader takes over automatically. Followers forward writes to the leader's
+// peer listener on RAFT_HTTP_ADDR, which is separate from the public API
+// and only accepts requests carrying RAFT_CLUSTER_SECRET.
+type RaftBackend struct {
+	raft   *raft.Raft
+	fsm    *registryFSM
+	nodeID raft.ServerID
+	peers  map[raft.ServerID]raftPeer
+	secret []byte
+	client *http.Client
+	logger *zap.Logger
+}
+
+// NewRaftBackend starts the local Raft node and bootstraps the cluster from
+// RAFT_PEERS when there is no existing state on disk
+func NewRaftBackend(logger *zap.Logger) (*RaftBackend, error) {
+	nodeID := getEnv("RAFT_NODE_ID", "")
+	if nodeID == "" {
+		return nil, errors.New("RAFT_NODE_ID is required for the raft backend")
+	}
+
+	peers, err := parseRaftPeers(getEnvList("RAFT_PEERS", nil))
+	if err != nil {
+		return nil, err
+	}
+	secret := getEnv("RAFT_CLUSTER_SECRET", "")
+	if secret == "" && len(peers) > 1 {
+		return nil, errors.New("RAFT_CLUSTER_SECRET is required for a raft cluster")
+	}
+	peerListener, err := net.Listen("tcp", getEnv("RAFT_HTTP_ADDR", ":7001"))
+	if err != nil {
+		return nil, fmt.Errorf("raft peer listener: %w", err)
+	}
+
+	bindAddr := getEnv("RAFT_BIND_ADDR", ":7000")
+	advertise := bindAddr
+	if self, ok := peers[raft.ServerID(nodeID)]; ok {
+		advertise = string(self.address)
+	}
+	advertiseAddr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, fmt.Errorf("raft advertise address: %w", err)
+	}
+
+	dataDir := getEnv("RAFT_DATA_DIR", "raft-data")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("raft log store: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("raft snapshot store: %w", err)
+	}
+	transport, err := raft.NewTCPTransport(bindAddr, advertiseAddr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("raft transport: %w", err)
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(nodeID)
+
+	fsm := newRegistryFSM()
+	node, err := raft.NewRaft(config, fsm, store, store, snapshots, transport)
+	if err != nil {
+		return nil, fmt.Errorf("raft: %w", err)
+	}
+
+	existing, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if !existing && len(peers) > 0 {
+		servers := make([]raft.Server, 0, len(peers))
+		for _, peer := range peers {
+			servers = append(servers, raft.Server{ID: peer.id, Address: peer.address})
+		}
+		if err := node.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			return nil, fmt.Errorf("raft bootstrap: %w", err)
+		}
+	}
+
+	logger.Info("Using raft registry backend",
+		zap.String("node_id", nodeID),
+		zap.String("bind", bindAddr),
+		zap.String("peer_listener", peerListener.Addr().String()),
+		zap.Int("peers", len(peers)))
+
+	rb := &RaftBackend{
+		raft:   node,
+		fsm:    fsm,
+		nodeID: raft.ServerID(nodeID),
+		peers:  peers,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: raftApplyTimeout},
+		logger: logger,
+	}
+	go rb.servePeers(peerListener)
+	return rb, nil
+}
+
+// servePeers serves the writes forwarded by followers
+func (rb *RaftBackend) servePeers(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cluster/apply", rb.applyHandler)
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  raftApplyTimeout,
+		WriteTimeout: 2 * raftApplyTimeout,
+	}
+	if err := server.Serve(listener); err != nil {
+		rb.logger.Error("Raft peer listener stopped", zap.Error(err))
+	}
+}
+
+func parseRaftPeers(entries []string) (map[raft.ServerID]raftPeer, error) {
+	peers := make(map[raft.ServerID]raftPeer, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid RAFT_PEERS entry %q, expected id=raft_addr=http_url", entry)
+		}
+		peers[raft.ServerID(parts[0])] = raftPeer{
+			id:      raft.ServerID(parts[0]),
+			address: raft.ServerAddress(parts[1]),
+			httpURL: strings.TrimSuffix(parts[2], "/"),
+		}
+	}
+	return peers, nil
+}
+
+func (rb *RaftBackend) Register(ctx context.Context, service *ServiceInstance) error {
+	return rb.apply(ctx, &raftCommand{Op: "register", Service: service})
+}
+
+func (rb *RaftBackend) Deregister(ctx context.Context, serviceID string) error {
+	return rb.apply(ctx, &raftCommand{Op: "deregister", ServiceID: serviceID})
+}
+
+// PublishStatus replicates a health check result to the other nodes
+func (rb *RaftBackend) PublishStatus(ctx context.Context, service *ServiceInstance) error {
+	return rb.apply(ctx, &raftCommand{Op: "register", Service: service})
+}
+
+// IsLeader makes the raft leader the gateway that runs periodic jobs
+func (rb *RaftBackend) IsLeader() bool {
+	return rb.raft.State() == raft.Leader
+}
+
+func (rb *RaftBackend) List(ctx context.Context) ([]*ServiceInstance, error) {
+	return rb.fsm.list(), nil
+}
+
+func (rb *RaftBackend) Snapshot(ctx context.Context) (*RegistrySnapshot, error) {
+	return &RegistrySnapshot{Services: rb.fsm.list()}, nil
+}
+
+// Watch diffs the FSM contents every time a committed entry is applied,
+// starting with the entries applied since the snapshot
+func (rb *RaftBackend) Watch(ctx context.Context, from *RegistrySnapshot) (<-chan RegistryEvent, error) {
+	events := make(chan RegistryEvent)
+	go func() {
+		defer close(events)
+
+		known := indexServices(from.Services)
+		for {
+			notify := rb.fsm.changed()
+			var changes []RegistryEvent
+			known, changes = diffRegistry(known, rb.fsm.list())
+			for _, event := range changes {
+				if !sendRegistryEvent(ctx, events, event) {
+					return
+				}
+			}
+
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// apply commits a command locally when leader, otherwise forwards it
+func (rb *RaftBackend) apply(ctx context.Context, cmd *raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	if rb.raft.State() == raft.Leader {
+		future := rb.raft.Apply(data, raftApplyTimeout)
+		if err := future.Error(); err != nil {
+			return err
+		}
+		if err, ok := future.Response().(error); ok {
+			return err
+		}
+		return nil
+	}
+
+	_, leaderID := rb.raft.LeaderWithID()
+	leader, ok := rb.peers[leaderID]
+	if !ok {
+		return fmt.Errorf("no raft leader available (leader %q)", leaderID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leader.httpURL+"/cluster/apply", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(raftSecretHeader, string(rb.secret))
+
+	resp, err := rb.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("forward to raft leader %s: %w", leaderID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("raft leader %s rejected write: %s", leaderID, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// applyHandler accepts writes forwarded by followers. Only the leader
+// commits them; a follower answers 503 so the caller retries.
+func (rb *RaftBackend) applyHandler(w http.ResponseWriter, r *http.Request) {
+	secret := []byte(r.Header.Get(raftSecretHeader))
+	if len(rb.secret) == 0 || subtle.ConstantTimeCompare(secret, rb.secret) != 1 {
+		rb.logger.Warn("Refused raft write without the cluster secret",
+			zap.String("remote_addr", r.RemoteAddr))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if rb.raft.State() != raft.Leader {
+		http.Error(w, "Not the raft leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	var cmd raftCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := rb.apply(r.Context(), &cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// statusHandler reports this node's view of the cluster
+func (rb *RaftBackend) statusHandler(w http.ResponseWriter, r *http.Request) {
+	leaderAddr, leaderID := rb.raft.LeaderWithID()
+
+	servers := make([]map[string]interface{}, 0)
+	if future := rb.raft.GetConfiguration(); future.Error() == nil {
+		for _, server := range future.Configuration().Servers {
+			servers = append(servers, map[string]interface{}{
+				"id":       server.ID,
+				"address":  server.Address,
+				"suffrage": server.Suffrage.String(),
+				"leader":   server.ID == leaderID,
+			})
+		}
+	}
+
+	status := map[string]interface{}{
+		"node_id":        rb.nodeID,
+		"state":          rb.raft.State().String(),
+		"leader_id":      leaderID,
+		"leader_address": leaderAddr,
+		"servers":        servers,
+		"stats":          rb.raft.Stats(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// registryFSM is the replicated state machine holding the catalog
+type registryFSM struct {
+	services map[string]ServiceInstance
+	mutex    sync.RWMutex
+	notify   chan struct{}
+}
+
+func newRegistryFSM() *registryFSM {
+	return &registryFSM{
+		services: make(map[string]ServiceInstance),
+		notify:   make(chan struct{}),
+	}
+}
+
+func (f *registryFSM) Apply(log *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return fmt.Errorf("decode raft command: %w", err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch cmd.Op {
+	case "register":
+		if cmd.Service == nil {
+			return errors.New("register command without service")
+		}
+		f.services[cmd.Service.ID] = *cmd.Service
+	case "deregister":
+		delete(f.services, cmd.ServiceID)
+	default:
+		return fmt.Errorf("unknown raft command %q", cmd.Op)
+	}
+
+	f.broadcast()
+	return nil
+}
+
+// broadcast wakes up watchers; the caller must hold f.mutex
+func (f *registryFSM) broadcast() {
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+func (f *registryFSM) changed() <-chan struct{} {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.notify
+}
+
+func (f *registryFSM) list() []*ServiceInstance {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	services := make([]*ServiceInstance, 0, len(f.services))
+	for _, service := range f.services {
+		instance := service
+		services = append(services, &instance)
+	}
+	return services
+}
+
+func (f *registryFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	data, err := json.Marshal(f.services)
+	if err != nil {
+		return nil, err
+	}
+	return &registrySnapshot{data: data}, nil
+}
+
+func (f *registryFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	services := make(map[string]ServiceInstance)
+	if err := json.NewDecoder(snapshot).Decode(&services); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.services = services
+	f.broadcast()
+	return nil
+}
+
+type registrySnapshot struct {
+	data []byte
+}
+
+func (s *registrySnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *registrySnapshot) Release() {}
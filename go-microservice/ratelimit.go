@@ -0,0 +1,261 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Clients rate limits are keyed by, in RateLimit.Key
+const (
+	rateLimitByIP         = "ip"
+	rateLimitByAPIKey     = "api_key"
+	rateLimitByJWTSubject = "jwt_subject"
+)
+
+// RateLimit allows each client Requests requests per Period to a service,
+// in bursts of up to Burst, Requests by default. Clients are told apart by
+// Key: their IP address, "ip", the default; the API key they send, "api_key";
+// or the subject of their bearer JWT, "jwt_subject". Clients without an API
+// key or a valid JWT are limited by IP address. Zero fields take the
+// RATE_LIMIT_* defaults.
+type RateLimit struct {
+	Requests int      `json:"requests,omitempty"`
+	Period   Duration `json:"period,omitempty"`
+	Burst    int      `json:"burst,omitempty"`
+	Key      string   `json:"key,omitempty"`
+}
+
+func (rl *RateLimit) validate() error {
+	if rl.Requests < 0 || rl.Period < 0 || rl.Burst < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	switch rl.Key {
+	case "", rateLimitByIP, rateLimitByAPIKey:
+		return nil
+	case rateLimitByJWTSubject:
+		// Without an issuer no JWT verifies and every client would
+		// quietly be limited by IP address instead
+		if getEnv("RATE_LIMIT_JWT_ISSUER", "") == "" {
+			return errors.New("rate limit key jwt_subject needs RATE_LIMIT_JWT_ISSUER")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rate limit key %q", rl.Key)
+}
+
+// overlay returns the limit with the fields set in override replacing its
+// own
+func (rl RateLimit) overlay(override *RateLimit) RateLimit {
+	if override == nil {
+		return rl
+	}
+	if override.Requests > 0 {
+		rl.Requests = override.Requests
+		rl.Burst = 0 // the override's requests, unless it sets a burst
+	}
+	if override.Period > 0 {
+		rl.Period = override.Period
+	}
+	if override.Burst > 0 {
+		rl.Burst = override.Burst
+	}
+	if override.Key != "" {
+		rl.Key = override.Key
+	}
+	return rl
+}
+
+// RateLimiter throttles proxied requests with a token bucket per client and
+// service. RATE_LIMIT_REQUESTS, RATE_LIMIT_PERIOD, RATE_LIMIT_BURST and
+// RATE_LIMIT_KEY apply to services whose route doesn't set its own limit;
+// with RATE_LIMIT_REQUESTS at 0, the default, only those routes are
+// limited. Responses carry RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy, and throttled requests get 429
+// with a Retry-After.
+//
+// API keys are read from RATE_LIMIT_API_KEY_HEADER and not checked, so a
+// client making up keys gets a bucket for each; limit by them where the
+// services reject unknown keys. JWTs are verified against the keys of
+// RATE_LIMIT_JWT_ISSUER, and their audience against RATE_LIMIT_JWT_AUDIENCE
+// when set; limits by JWT subject, by default or on a route, are refused
+// without an issuer. Buckets of the RATE_LIMIT_MAX_CLIENTS clients seen
+// longest ago are dropped. Buckets are shared across replicas when Redis is
+// configured, see sharedBuckets.
+type RateLimiter struct {
+	defaults     RateLimit
+	apiKeyHeader string
+	verifier     *oidc.IDTokenVerifier
+	forwarded    *ForwardedHeaders
+	maxClients   int
+	shared       *sharedBuckets
+
+	buckets map[string]*list.Element // of *tokenBucket
+	order   *list.List               // least recently used first
+	mutex   sync.Mutex
+
+	throttled *prometheus.CounterVec
+	logger    *zap.Logger
+}
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(forwarded *ForwardedHeaders, logger *zap.Logger) (*RateLimiter, error) {
+	rl := &RateLimiter{
+		defaults: RateLimit{
+			Requests: getEnvInt("RATE_LIMIT_REQUESTS", 0),
+			Period:   Duration(getEnvDuration("RATE_LIMIT_PERIOD", time.Second)),
+			Burst:    getEnvInt("RATE_LIMIT_BURST", 0),
+			Key:      getEnv("RATE_LIMIT_KEY", rateLimitByIP),
+		},
+		apiKeyHeader: getEnv("RATE_LIMIT_API_KEY_HEADER", "X-API-Key"),
+		forwarded:    forwarded,
+		maxClients:   getEnvInt("RATE_LIMIT_MAX_CLIENTS", 100000),
+		buckets:      make(map[string]*list.Element),
+		order:        list.New(),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_rate_limited_requests_total",
+			Help: "Proxied requests throttled by their service's rate limit, by what clients are keyed by",
+		}, []string{"namespace", "service", "key"}),
+		logger: logger,
+	}
+	if err := rl.defaults.validate(); err != nil {
+		return nil, err
+	}
+	if rl.defaults.Period <= 0 {
+		return nil, errors.New("RATE_LIMIT_PERIOD must be positive")
+	}
+	shared, err := newSharedBuckets(logger)
+	if err != nil {
+		return nil, err
+	}
+	rl.shared = shared
+
+	if issuer := getEnv("RATE_LIMIT_JWT_ISSUER", ""); issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		provider, err := oidc.NewProvider(ctx, issuer)
+		if err != nil {
+			return nil, fmt.Errorf("discover JWT issuer: %w", err)
+		}
+		audience := getEnv("RATE_LIMIT_JWT_AUDIENCE", "")
+		rl.verifier = provider.Verifier(&oidc.Config{ClientID: audience, SkipClientIDCheck: audience == ""})
+	}
+
+	prometheus.MustRegister(rl.throttled)
+	return rl, nil
+}
+
+// allow takes a token from the bucket of a request's client, answering
+// with 429 and returning false when it is empty
+func (rl *RateLimiter) allow(w http.ResponseWriter, r *http.Request, target *proxyTarget, override *RateLimit) bool {
+	if rl == nil {
+		return true
+	}
+	limit := rl.defaults.overlay(override)
+	if limit.Requests <= 0 {
+		return true
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.Requests
+	}
+
+	keyType, client := rl.clientKey(r, limit.Key)
+	rate := float64(limit.Requests) / time.Duration(limit.Period).Seconds()
+	key := target.poolName + "|" + client
+	tokens, allowed, err := rl.shared.take(r.Context(), key, float64(limit.Burst), rate)
+	if err != nil {
+		tokens, allowed = rl.take(key, float64(limit.Burst), rate)
+	}
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(limit.Burst)-tokens)/rate))))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(math.Ceil(time.Duration(limit.Period).Seconds()))))
+	if allowed {
+		return true
+	}
+
+	rl.throttled.WithLabelValues(target.namespace, target.serviceName, keyType).Inc()
+	header.Set("Retry-After", strconv.Itoa(max(int(math.Ceil((1-tokens)/rate)), 1)))
+	http.Error(w, "Rate limit exceeded, retry later", http.StatusTooManyRequests)
+	return false
+}
+
+// clientKey tells a request's client apart as keyType says, returning what
+// it was keyed by in the end and its key
+func (rl *RateLimiter) clientKey(r *http.Request, keyType string) (string, string) {
+	switch keyType {
+	case rateLimitByAPIKey:
+		if key := r.Header.Get(rl.apiKeyHeader); key != "" {
+			digest := sha256.Sum256([]byte(key))
+			return rateLimitByAPIKey, "key:" + hex.EncodeToString(digest[:])
+		}
+	case rateLimitByJWTSubject:
+		if token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); bearer && rl.verifier != nil {
+			verified, err := rl.verifier.Verify(r.Context(), token)
+			if err == nil && verified.Subject != "" {
+				return rateLimitByJWTSubject, "sub:" + verified.Subject
+			}
+			rl.logger.Debug("Rate limiting by IP address for an unverified JWT", zap.Error(err))
+		}
+	}
+	return rateLimitByIP, "ip:" + rl.forwarded.ClientIP(r)
+}
+
+// take refills a bucket for the time since it was last used and takes a
+// token from it if there is one, returning the tokens left
+func (rl *RateLimiter) take(key string, burst, rate float64) (float64, bool) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	var bucket *tokenBucket
+	if element, exists := rl.buckets[key]; exists {
+		bucket = element.Value.(*tokenBucket)
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+		rl.order.MoveToBack(element)
+	} else {
+		bucket = &tokenBucket{key: key, tokens: burst}
+		rl.buckets[key] = rl.order.PushBack(bucket)
+		for rl.order.Len() > rl.maxClients {
+			delete(rl.buckets, rl.order.Remove(rl.order.Front()).(*tokenBucket).key)
+		}
+	}
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return bucket.tokens, false
+	}
+	bucket.tokens--
+	return bucket.tokens, true
+}
+
+// rateLimit returns a pool's rate limit, nil when it has none of its own
+func (rt *RouteTable) rateLimit(poolName string) *RateLimit {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.RateLimit
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// errSharedBucketsDown is returned without Redis, or while it is left alone
+// after failing
+var errSharedBucketsDown = errors.New("rate limit store unavailable")
+
+// takeTokenScript refills and takes from a bucket atomically on the Redis
+// clock, so replicas with skewed clocks agree. Buckets expire once they
+// would be full again.
+var takeTokenScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// sharedBuckets keeps rate limit buckets in the Redis at
+// RATE_LIMIT_REDIS_URL, under RATE_LIMIT_REDIS_PREFIX, so limits hold
+// across every gateway replica rather than for each. Requests that can't
+// reach Redis within RATE_LIMIT_REDIS_TIMEOUT are limited by the replica's
+// own buckets instead, and Redis is left alone for RATE_LIMIT_REDIS_RETRY
+// before being tried again; while it is down, each replica allows the
+// whole limit.
+type sharedBuckets struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+	retry   time.Duration
+	retryAt atomic.Int64 // unix nanoseconds
+	down    atomic.Bool
+	logger  *zap.Logger
+
+	fallbacks prometheus.Counter
+}
+
+// newSharedBuckets returns nil when RATE_LIMIT_REDIS_URL is not set
+func newSharedBuckets(logger *zap.Logger) (*sharedBuckets, error) {
+	url := getEnv("RATE_LIMIT_REDIS_URL", "")
+	if url == "" {
+		return nil, nil
+	}
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse RATE_LIMIT_REDIS_URL: %w", err)
+	}
+	// Falling back locally beats retrying on the request's time
+	options.MaxRetries = -1
+
+	sb := &sharedBuckets{
+		client:  redis.NewClient(options),
+		prefix:  getEnv("RATE_LIMIT_REDIS_PREFIX", "devtoolkit:ratelimit:"),
+		timeout: getEnvDuration("RATE_LIMIT_REDIS_TIMEOUT", 50*time.Millisecond),
+		retry:   getEnvDuration("RATE_LIMIT_REDIS_RETRY", 5*time.Second),
+		logger:  logger,
+		fallbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_rate_limit_fallbacks_total",
+			Help: "Rate limited requests limited by the gateway's own buckets as Redis was unavailable",
+		}),
+	}
+	prometheus.MustRegister(sb.fallbacks)
+
+	logger.Info("Sharing rate limits through Redis",
+		zap.String("addr", options.Addr),
+		zap.String("prefix", sb.prefix))
+	return sb, nil
+}
+
+// take takes a token from a shared bucket, returning the tokens left
+func (sb *sharedBuckets) take(ctx context.Context, key string, burst, rate float64) (float64, bool, error) {
+	if sb == nil {
+		return 0, false, errSharedBucketsDown
+	}
+	if time.Now().UnixNano() < sb.retryAt.Load() {
+		sb.fallbacks.Inc()
+		return 0, false, errSharedBucketsDown
+	}
+
+	// A client going away doesn't make Redis unavailable
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sb.timeout)
+	defer cancel()
+	reply, err := takeTokenScript.Run(ctx, sb.client, []string{sb.prefix + key}, burst, rate).Slice()
+	if err == nil && len(reply) != 2 {
+		err = fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	var tokens float64
+	if err == nil {
+		tokens, err = strconv.ParseFloat(fmt.Sprint(reply[1]), 64)
+	}
+	if err != nil {
+		sb.fallbacks.Inc()
+		sb.retryAt.Store(time.Now().Add(sb.retry).UnixNano())
+		if !sb.down.Swap(true) {
+			sb.logger.Warn("Rate limit store unavailable, limiting on this replica", zap.Error(err))
+		}
+		return 0, false, err
+	}
+
+	if sb.down.Swap(false) {
+		sb.logger.Info("Rate limit store available again")
+	}
+	return tokens, reply[0] == int64(1), nil
+}
+
+// check reports whether Redis answers, for the deep health check
+func (sb *sharedBuckets) check(ctx context.Context) error {
+	return sb.client.Ping(ctx).Err()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readinessTimeout bounds the backend check of a readiness probe
+const readinessTimeout = 2 * time.Second
+
+// Readiness tracks whether the gateway should receive traffic. /healthz
+// only says the process is alive; /readyz also requires the router to be
+// set up, the registry to be loaded from a reachable backend and at least
+// READY_MIN_UPSTREAMS instances in rotation. It turns not ready as soon as
+// shutdown begins so load balancers drain the gateway first.
+type Readiness struct {
+	routerReady    atomic.Bool
+	registryLoaded atomic.Bool
+	shuttingDown   atomic.Bool
+	minUpstreams   int
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{
+		minUpstreams: getEnvInt("READY_MIN_UPSTREAMS", 0),
+	}
+}
+
+// InstanceCount returns how many distinct healthy instances are in rotation
+func (lb *LoadBalancer) InstanceCount() int {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, instances := range lb.services {
+		for _, instance := range instances {
+			if routable(instance) {
+				seen[instance.ID] = true
+			}
+		}
+	}
+	return len(seen)
+}
+
+func (gw *APIGateway) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+}
+
+func (gw *APIGateway) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	ready := true
+	fail := func(check, reason string) {
+		checks[check] = reason
+		ready = false
+	}
+
+	if gw.readiness.shuttingDown.Load() {
+		fail("shutdown", "gateway is shutting down")
+	}
+	if gw.readiness.routerReady.Load() {
+		checks["router"] = "ok"
+	} else {
+		fail("router", "routes not initialized")
+	}
+	if gw.readiness.registryLoaded.Load() {
+		checks["registry"] = "ok"
+	} else {
+		fail("registry", "registry not loaded from backend yet")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if _, err := gw.registry.backend.List(ctx); err != nil {
+		fail("backend", err.Error())
+	} else {
+		checks["backend"] = "ok"
+	}
+
+	if upstreams := gw.loadBalancer.InstanceCount(); upstreams < gw.readiness.minUpstreams {
+		fail("upstreams", fmt.Sprintf("%d of %d required instances available", upstreams, gw.readiness.minUpstreams))
+	} else {
+		checks["upstreams"] = "ok"
+	}
+
+	response := map[string]interface{}{
+		"status": "ready",
+		"checks": checks,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		response["status"] = "not_ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// RegistryEventType identifies the kind of change reported by a backend watch
+type RegistryEventType string
+
+const (
+	RegistryEventPut    RegistryEventType = "put"
+	RegistryEventDelete RegistryEventType = "delete"
+)
+
+// RegistryEvent describes a single change in the backend catalog
+type RegistryEvent struct {
+	Type     RegistryEventType
+	Instance *ServiceInstance
+}
+
+// RegistryBackend is the source of truth for service registrations. The
+// ServiceRegistry keeps a local cache in front of it and applies the changes
+// reported by Watch, so registrations made elsewhere (other gateways, Consul
+// agents) become routable here too.
+type RegistryBackend interface {
+	Register(ctx context.Context, service *ServiceInstance) error
+	Deregister(ctx context.Context, serviceID string) error
+	List(ctx context.Context) ([]*ServiceInstance, error)
+
+	// Snapshot lists the instances along with where a watch carries on
+	// from, and Watch reports every change made after a snapshot
+	Snapshot(ctx context.Context) (*RegistrySnapshot, error)
+	Watch(ctx context.Context, from *RegistrySnapshot) (<-chan RegistryEvent, error)
+}
+
+// RegistrySnapshot is a backend listing together with the point in the
+// backend's history it was taken at, so that nothing changed between the
+// listing and the watch is missed
+type RegistrySnapshot struct {
+	Services []*ServiceInstance
+	Revision uint64 // Consul index or etcd revision; unused by the others
+}
+
+// indexServices indexes a listing by instance ID
+func indexServices(services []*ServiceInstance) map[string]*ServiceInstance {
+	indexed := make(map[string]*ServiceInstance, len(services))
+	for _, service := range services {
+		indexed[service.ID] = service
+	}
+	return indexed
+}
+
+// newRegistryBackend selects the backend named by REGISTRY_BACKEND
+func newRegistryBackend(logger *zap.Logger) (RegistryBackend, error) {
+	switch backend := os.Getenv("REGISTRY_BACKEND"); backend {
+	case "", "memory":
+		return NewMemoryBackend(), nil
+	case "consul":
+		return NewConsulBackend(logger)
+	case "etcd":
+		return NewEtcdBackend(logger)
+	case "raft":
+		return NewRaftBackend(logger)
+	case "bolt":
+		return NewBoltBackend(getEnv("REGISTRY_DB_PATH", "registry.db"))
+	default:
+		return nil, fmt.Errorf("unknown registry backend %q", backend)
+	}
+}
+
+func sendRegistryEvent(ctx context.Context, events chan<- RegistryEvent, event RegistryEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func sameRegistration(a, b *ServiceInstance) bool {
+	return a.Name == b.Name &&
+		a.Namespace == b.Namespace &&
+		a.Address == b.Address &&
+		a.Port == b.Port &&
+		a.Version == b.Version &&
+		a.Zone == b.Zone &&
+		a.Region == b.Region &&
+		a.Weight == b.Weight &&
+		a.Priority == b.Priority &&
+		a.TTL == b.TTL &&
+		a.Status == b.Status &&
+		reflect.DeepEqual(a.Metadata, b.Metadata) &&
+		reflect.DeepEqual(a.Tags, b.Tags) &&
+		reflect.DeepEqual(a.DependsOn, b.DependsOn) &&
+		reflect.DeepEqual(a.HealthCheck, b.HealthCheck)
+}
+
+// diffRegistry compares a new listing against the known instances and
+// returns the listing indexed by ID together with the events between them.
+// Backends without native change notifications build Watch on top of it.
+func diffRegistry(known map[string]*ServiceInstance, services []*ServiceInstance) (map[string]*ServiceInstance, []RegistryEvent) {
+	current := make(map[string]*ServiceInstance, len(services))
+	events := make([]RegistryEvent, 0)
+
+	for _, service := range services {
+		current[service.ID] = service
+		if previous, exists := known[service.ID]; !exists || !sameRegistration(previous, service) ||
+			!previous.LastHeartbeat.Equal(service.LastHeartbeat) {
+			events = append(events, RegistryEvent{Type: RegistryEventPut, Instance: service})
+		}
+	}
+	for id, service := range known {
+		if _, exists := current[id]; !exists {
+			events = append(events, RegistryEvent{Type: RegistryEventDelete, Instance: service})
+		}
+	}
+
+	return current, events
+}
+
+// MemoryBackend keeps registrations in process memory. Every write goes
+// through the local ServiceRegistry, so there is never anything to watch.
+type MemoryBackend struct {
+	services map[string]ServiceInstance
+	mutex    sync.RWMutex
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		services: make(map[string]ServiceInstance),
+	}
+}
+
+func (mb *MemoryBackend) Register(ctx context.Context, service *ServiceInstance) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	mb.services[service.ID] = *service
+	return nil
+}
+
+func (mb *MemoryBackend) Deregister(ctx context.Context, serviceID string) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	delete(mb.services, serviceID)
+	return nil
+}
+
+func (mb *MemoryBackend) List(ctx context.Context) ([]*ServiceInstance, error) {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+
+	services := make([]*ServiceInstance, 0, len(mb.services))
+	for _, service := range mb.services {
+		instance := service
+		services = append(services, &instance)
+	}
+	return services, nil
+}
+
+func (mb *MemoryBackend) Snapshot(ctx context.Context) (*RegistrySnapshot, error) {
+	services, err := mb.List(ctx)
+	return &RegistrySnapshot{Services: services}, err
+}
+
+func (mb *MemoryBackend) Watch(ctx context.Context, from *RegistrySnapshot) (<-chan RegistryEvent, error) {
+	events := make(chan RegistryEvent)
+	go func() {
+		<-ctx.Done()
+		close(events)
+	}()
+	return events, nil
+}
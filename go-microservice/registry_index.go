@@ -0,0 +1,115 @@
+package main
+
+import "fmt"
+
+// registryIndex maps tags, metadata key/value pairs and instance
+// attributes (namespace, zone, region) to instance IDs so filtered listings
+// don't have to scan every instance
+type registryIndex struct {
+	tags       map[string]map[string]struct{}
+	metadata   map[string]map[string]struct{} // "key=value" -> IDs
+	attributes map[string]map[string]struct{} // "zone=value" -> IDs
+}
+
+func newRegistryIndex() *registryIndex {
+	return &registryIndex{
+		tags:       make(map[string]map[string]struct{}),
+		metadata:   make(map[string]map[string]struct{}),
+		attributes: make(map[string]map[string]struct{}),
+	}
+}
+
+func serviceAttributes(service *ServiceInstance) map[string]string {
+	return map[string]string{
+		"namespace": service.Namespace,
+		"zone":      service.Zone,
+		"region":    service.Region,
+	}
+}
+
+func metadataIndexKey(key string, value interface{}) string {
+	return fmt.Sprintf("%s=%v", key, value)
+}
+
+func (ri *registryIndex) add(service *ServiceInstance) {
+	for _, tag := range service.Tags {
+		addToSet(ri.tags, tag, service.ID)
+	}
+	for key, value := range service.Metadata {
+		addToSet(ri.metadata, metadataIndexKey(key, value), service.ID)
+	}
+	for key, value := range serviceAttributes(service) {
+		if value != "" {
+			addToSet(ri.attributes, metadataIndexKey(key, value), service.ID)
+		}
+	}
+}
+
+func (ri *registryIndex) remove(service *ServiceInstance) {
+	for _, tag := range service.Tags {
+		removeFromSet(ri.tags, tag, service.ID)
+	}
+	for key, value := range service.Metadata {
+		removeFromSet(ri.metadata, metadataIndexKey(key, value), service.ID)
+	}
+	for key, value := range serviceAttributes(service) {
+		if value != "" {
+			removeFromSet(ri.attributes, metadataIndexKey(key, value), service.ID)
+		}
+	}
+}
+
+// lookup returns the IDs matching every tag, metadata and attribute filter
+func (ri *registryIndex) lookup(tags []string, metadata, attributes map[string]string) map[string]struct{} {
+	if len(tags) == 0 && len(metadata) == 0 && len(attributes) == 0 {
+		return nil
+	}
+
+	sets := make([]map[string]struct{}, 0, len(tags)+len(metadata)+len(attributes))
+	for _, tag := range tags {
+		sets = append(sets, ri.tags[tag])
+	}
+	for key, value := range metadata {
+		sets = append(sets, ri.metadata[metadataIndexKey(key, value)])
+	}
+	for key, value := range attributes {
+		sets = append(sets, ri.attributes[metadataIndexKey(key, value)])
+	}
+
+	// Intersect starting from the smallest set
+	smallest := 0
+	for i, set := range sets {
+		if len(set) < len(sets[smallest]) {
+			smallest = i
+		}
+	}
+
+	result := make(map[string]struct{})
+	for id := range sets[smallest] {
+		matches := true
+		for _, set := range sets {
+			if _, ok := set[id]; !ok {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			result[id] = struct{}{}
+		}
+	}
+	return result
+}
+
+func addToSet(sets map[string]map[string]struct{}, key, id string) {
+	if sets[key] == nil {
+		sets[key] = make(map[string]struct{})
+	}
+	sets[key][id] = struct{}{}
+}
+
+func removeFromSet(sets map[string]map[string]struct{}, key, id string) {
+	delete(sets[key], id)
+	if len(sets[key]) == 0 {
+		delete(sets, key)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registryMetrics exports metrics about the registry itself. Counters are
+// fed from the change log as changes are recorded; instance counts and
+// staleness are computed from the registry on every scrape.
+type registryMetrics struct {
+	registry *ServiceRegistry
+
+	registrations   *prometheus.CounterVec
+	deregistrations *prometheus.CounterVec
+	healthFlaps     *prometheus.CounterVec
+	evictions       *prometheus.CounterVec
+
+	instances   *prometheus.Desc
+	oldestStale *prometheus.Desc
+}
+
+func newRegistryMetrics(registry *ServiceRegistry) *registryMetrics {
+	labels := []string{"namespace", "service"}
+
+	return &registryMetrics{
+		registry: registry,
+		registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "registry_registrations_total",
+			Help: "Instances added to the registry",
+		}, labels),
+		deregistrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "registry_deregistrations_total",
+			Help: "Instances removed from the registry",
+		}, labels),
+		healthFlaps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "registry_health_flaps_total",
+			Help: "Instance status transitions",
+		}, labels),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "registry_gc_evictions_total",
+			Help: "Stale instances removed by garbage collection",
+		}, labels),
+		instances: prometheus.NewDesc(
+			"registry_instances",
+			"Registered instances per service and status",
+			[]string{"namespace", "service", "status"}, nil),
+		oldestStale: prometheus.NewDesc(
+			"registry_oldest_stale_instance_age_seconds",
+			"Time since the longest-failing instance was last seen healthy",
+			nil, nil),
+	}
+}
+
+// observe counts a change; it is called by recordChange
+func (rm *registryMetrics) observe(changeType string, service *ServiceInstance) {
+	switch changeType {
+	case "registered":
+		rm.registrations.WithLabelValues(service.Namespace, service.Name).Inc()
+	case "deregistered":
+		rm.deregistrations.WithLabelValues(service.Namespace, service.Name).Inc()
+	case "status_changed":
+		rm.healthFlaps.WithLabelValues(service.Namespace, service.Name).Inc()
+	}
+}
+
+func (rm *registryMetrics) Describe(ch chan<- *prometheus.Desc) {
+	rm.registrations.Describe(ch)
+	rm.deregistrations.Describe(ch)
+	rm.healthFlaps.Describe(ch)
+	rm.evictions.Describe(ch)
+	ch <- rm.instances
+	ch <- rm.oldestStale
+}
+
+func (rm *registryMetrics) Collect(ch chan<- prometheus.Metric) {
+	rm.registrations.Collect(ch)
+	rm.deregistrations.Collect(ch)
+	rm.healthFlaps.Collect(ch)
+	rm.evictions.Collect(ch)
+
+	type instanceKey struct{ namespace, service, status string }
+	counts := make(map[instanceKey]int)
+	oldest := time.Duration(0)
+
+	for _, service := range rm.registry.GetServices() {
+		counts[instanceKey{service.Namespace, service.Name, service.Status}]++
+
+		// Healthy instances and ones deliberately out of rotation aren't stale
+		if service.Status == "healthy" || service.Status == "maintenance" || service.LastSeen.IsZero() {
+			continue
+		}
+		if age := time.Since(service.LastSeen); age > oldest {
+			oldest = age
+		}
+	}
+
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(rm.instances, prometheus.GaugeValue, float64(count), key.namespace, key.service, key.status)
+	}
+	ch <- prometheus.MustNewConstMetric(rm.oldestStale, prometheus.GaugeValue, oldest.Seconds())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// maxRegistryChanges bounds the change log kept for watchers. Watchers that
+// fall further behind receive a full snapshot instead of a delta.
+const maxRegistryChanges = 1024
+
+// RegistryChange is a single entry of the registry change log
+type RegistryChange struct {
+	Index   uint64          `json:"index"`
+	Type    string          `json:"type"` // registered, updated, deregistered, status_changed
+	Service ServiceInstance `json:"service"`
+	Time    time.Time       `json:"time"`
+	Actor   *ChangeActor    `json:"actor,omitempty"` // nil for changes made by the gateway itself
+
+	// PreviousStatus is set when the change moved the instance to a new
+	// status; Reason explains it, e.g. the failed probe's error
+	PreviousStatus string `json:"previous_status,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// recordChange appends to the change log and wakes up watchers. The caller
+// must hold sr.mutex.
+func (sr *ServiceRegistry) recordChange(changeType string, service *ServiceInstance) {
+	sr.recordChangeFrom(context.Background(), changeType, service)
+}
+
+// recordChangeFrom records a change made on behalf of the actor in ctx
+func (sr *ServiceRegistry) recordChangeFrom(ctx context.Context, changeType string, service *ServiceInstance) {
+	sr.recordChangeWithReason(ctx, changeType, service, "")
+}
+
+// recordChangeWithReason records a change along with why it happened
+func (sr *ServiceRegistry) recordChangeWithReason(ctx context.Context, changeType string, service *ServiceInstance, reason string) {
+	change := RegistryChange{
+		Index:   sr.version + 1,
+		Type:    changeType,
+		Service: *service,
+		Time:    time.Now(),
+		Actor:   actorFrom(ctx),
+		Reason:  reason,
+	}
+	if history := sr.history[service.ID]; history != nil && history.status != service.Status {
+		change.PreviousStatus = history.status
+	}
+	if change.PreviousStatus != "" && service.Status == "healthy" {
+		service.recoveredAt = change.Time
+	}
+
+	sr.version++
+	sr.changes = append(sr.changes, change)
+	if len(sr.changes) > maxRegistryChanges {
+		sr.changes = sr.changes[len(sr.changes)-maxRegistryChanges:]
+	}
+	sr.metrics.observe(changeType, service)
+	sr.observeHistory(changeType, service)
+	if sr.audit != nil {
+		sr.audit.record(change)
+	}
+	sr.routing.refresh(service)
+
+	close(sr.changed)
+	sr.changed = make(chan struct{})
+}
+
+// ChangesSince returns the changes after index and the current index. reset
+// is true when index is too old (or zero) to be served as a delta.
+func (sr *ServiceRegistry) ChangesSince(index uint64) (changes []RegistryChange, current uint64, reset bool) {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+
+	if index == 0 || index > sr.version || (len(sr.changes) > 0 && index < sr.changes[0].Index-1) {
+		return nil, sr.version, true
+	}
+
+	changes = make([]RegistryChange, 0)
+	for _, change := range sr.changes {
+		if change.Index > index {
+			changes = append(changes, change)
+		}
+	}
+	return changes, sr.version, false
+}
+
+// WaitForChange blocks until the registry moves past index, the timeout
+// elapses or ctx is cancelled
+func (sr *ServiceRegistry) WaitForChange(ctx context.Context, index uint64, timeout time.Duration) {
+	sr.mutex.RLock()
+	if sr.version != index {
+		sr.mutex.RUnlock()
+		return
+	}
+	changed := sr.changed
+	sr.mutex.RUnlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
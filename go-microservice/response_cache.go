@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// ResponseCache keeps proxied GET responses in memory for the routes that
+// enable it, so repeated requests are answered without reaching a backend.
+// Entries are evicted least recently used first once they take up more
+// than PROXY_CACHE_MAX_BYTES; bodies over PROXY_CACHE_MAX_ENTRY_BYTES are
+// never cached. Responses stay fresh for their s-maxage or max-age, or the
+// route's TTL when they have neither, and are only stored when their
+// Cache-Control allows it. Responses carry X-Cache: HIT or MISS.
+type ResponseCache struct {
+	maxBytes      int64
+	maxEntryBytes int64
+	defaultTTL    time.Duration
+
+	lru      *list.List                 // of *cacheEntry, most recently used first
+	variants map[string][]*list.Element // by key, one per set of Vary values
+	size     int64
+	mutex    sync.Mutex
+
+	requests *prometheus.CounterVec
+}
+
+type cacheEntry struct {
+	key    string
+	pool   string
+	path   string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	expiry time.Time
+
+	// vary holds the request headers named by the response's Vary and
+	// varyValues their values in the request it was stored for
+	vary       []string
+	varyValues []string
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// matches reports whether an entry was stored for the same values of its
+// Vary headers as a request has
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for i, name := range e.vary {
+		if strings.Join(r.Header.Values(name), ",") != e.varyValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheRequest is a cache miss on a route with caching enabled, whose
+// response may be stored under key
+type cacheRequest struct {
+	key  string
+	ttl  time.Duration
+	pool string
+	path string
+}
+
+// NewResponseCache returns nil when PROXY_CACHE_MAX_BYTES is 0
+func NewResponseCache() *ResponseCache {
+	maxBytes := int64(getEnvInt("PROXY_CACHE_MAX_BYTES", 64<<20))
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	rc := &ResponseCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: min(int64(getEnvInt("PROXY_CACHE_MAX_ENTRY_BYTES", 1<<20)), maxBytes),
+		defaultTTL:    getEnvDuration("PROXY_CACHE_TTL", time.Minute),
+		lru:           list.New(),
+		variants:      make(map[string][]*list.Element),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_cache_requests_total",
+			Help: "Proxied requests on cached routes by result: hit or miss",
+		}, []string{"namespace", "result"}),
+	}
+	prometheus.MustRegister(rc.requests)
+	return rc
+}
+
+// cacheKey identifies the responses of a pool for a request, before Vary
+func cacheKey(poolName, version, path, query string) string {
+	return poolName + "\x00" + version + "\x00" + path + "?" + query
+}
+
+// serve answers a GET or HEAD request from the cache if it holds a fresh
+// response for it, and reports whether it did
+func (rc *ResponseCache) serve(w http.ResponseWriter, r *http.Request, namespace, key string) bool {
+	directives := parseCacheControl(r.Header.Values("Cache-Control"))
+	_, noStore := directives["no-store"]
+	_, noCache := directives["no-cache"]
+	if noStore || noCache || directives["max-age"] == "0" {
+		rc.requests.WithLabelValues(namespace, "miss").Inc()
+		return false
+	}
+
+	entry := rc.lookup(r, key)
+	if entry == nil {
+		rc.requests.WithLabelValues(namespace, "miss").Inc()
+		return false
+	}
+	rc.requests.WithLabelValues(namespace, "hit").Inc()
+
+	header := w.Header()
+	for name, values := range entry.header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.stored)/time.Second)))
+	header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+	header.Set("X-Cache", "HIT")
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+	return true
+}
+
+// lookup returns the fresh entry for a request, nil when there is none
+func (rc *ResponseCache) lookup(r *http.Request, key string) *cacheEntry {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	now := time.Now()
+	for _, element := range rc.variants[key] {
+		entry := element.Value.(*cacheEntry)
+		if !entry.matches(r) {
+			continue
+		}
+		if now.After(entry.expiry) {
+			rc.remove(element)
+			return nil
+		}
+		rc.lru.MoveToFront(element)
+		return entry
+	}
+	return nil
+}
+
+// capture marks a response to a cache miss and, if it may be stored,
+// stores it once its body has been read in full
+func (rc *ResponseCache) capture(r *http.Request, resp *http.Response, pending *cacheRequest) {
+	defer resp.Header.Set("X-Cache", "MISS")
+
+	if r.Method != http.MethodGet || resp.ContentLength > rc.maxEntryBytes {
+		return
+	}
+	ttl, ok := responseTTL(r, resp, pending.ttl)
+	if !ok {
+		return
+	}
+	if ttl == 0 {
+		ttl = rc.defaultTTL
+	}
+
+	entry := &cacheEntry{
+		key:    pending.key,
+		pool:   pending.pool,
+		path:   pending.path,
+		status: resp.StatusCode,
+		header: resp.Header.Clone(),
+	}
+	entry.header.Del("Age")
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				entry.vary = append(entry.vary, name)
+				entry.varyValues = append(entry.varyValues, strings.Join(r.Header.Values(name), ","))
+			}
+		}
+	}
+
+	resp.Body = &cachingBody{ReadCloser: resp.Body, limit: rc.maxEntryBytes, done: func(body []byte) {
+		entry.body = body
+		entry.stored = time.Now()
+		entry.expiry = entry.stored.Add(ttl)
+		rc.store(entry)
+	}}
+}
+
+// store adds an entry, replacing the one for the same request and evicting
+// the least recently used ones beyond the cache's size
+func (rc *ResponseCache) store(entry *cacheEntry) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	for _, element := range rc.variants[entry.key] {
+		if existing := element.Value.(*cacheEntry); slices.Equal(existing.vary, entry.vary) && slices.Equal(existing.varyValues, entry.varyValues) {
+			rc.remove(element)
+			break
+		}
+	}
+
+	rc.variants[entry.key] = append(rc.variants[entry.key], rc.lru.PushFront(entry))
+	rc.size += entry.size()
+	for rc.size > rc.maxBytes {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// remove drops an entry. The caller must hold rc.mutex.
+func (rc *ResponseCache) remove(element *list.Element) {
+	entry := rc.lru.Remove(element).(*cacheEntry)
+	rc.size -= entry.size()
+
+	variants := rc.variants[entry.key]
+	for i, variant := range variants {
+		if variant == element {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(rc.variants, entry.key)
+	} else {
+		rc.variants[entry.key] = variants
+	}
+}
+
+// Purge drops a pool's entries whose upstream path starts with pathPrefix,
+// returning how many there were
+func (rc *ResponseCache) Purge(poolName, pathPrefix string) int {
+	if rc == nil {
+		return 0
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	purged := 0
+	for element := rc.lru.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*cacheEntry); entry.pool == poolName && strings.HasPrefix(entry.path, pathPrefix) {
+			rc.remove(element)
+			purged++
+		}
+		element = next
+	}
+	return purged
+}
+
+// responseTTL reports whether a response to a GET may be cached and for
+// how long, zero meaning the route's default
+func responseTTL(r *http.Request, resp *http.Response, routeTTL time.Duration) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusOK || len(resp.Trailer) > 0 || isEventStream(resp) {
+		return 0, false
+	}
+	// Cookies are for one client only
+	if resp.Header.Get("Set-Cookie") != "" || strings.Contains(resp.Header.Get("Vary"), "*") {
+		return 0, false
+	}
+	if _, noStore := parseCacheControl(r.Header.Values("Cache-Control"))["no-store"]; noStore {
+		return 0, false
+	}
+
+	directives := parseCacheControl(resp.Header.Values("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0, false
+		}
+	}
+	sharedMaxAge, shared := directives["s-maxage"]
+	_, public := directives["public"]
+	if r.Header.Get("Authorization") != "" && !public && !shared {
+		return 0, false
+	}
+
+	ttl := routeTTL
+	maxAge, ok := directives["max-age"]
+	if shared {
+		maxAge, ok = sharedMaxAge, true
+	}
+	if ok {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			return 0, false
+		}
+		ttl = time.Duration(seconds) * time.Second
+		if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil {
+			ttl -= time.Duration(age) * time.Second
+		}
+		if ttl <= 0 {
+			return 0, false
+		}
+	}
+	return ttl, true
+}
+
+// parseCacheControl returns the directives of Cache-Control header values
+// by lowercase name, with their argument if they have one
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// cachingBody collects a response body as the proxy reads it and hands it
+// to done once it has been read in full, unless it grew past limit
+type cachingBody struct {
+	io.ReadCloser
+	limit int64
+	done  func([]byte)
+	buf   bytes.Buffer
+	over  bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over {
+		b.over = true
+		b.done(b.buf.Bytes())
+	}
+	return n, err
+}
+
+// purgeCacheHandler drops a service's cached responses, or with ?path= only
+// those whose path as forwarded to the service starts with it
+func (gw *APIGateway) purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	purged := gw.cache.Purge(qualifiedName(namespace, service), r.URL.Query().Get("path"))
+	gw.logger.Info("Response cache purged",
+		zap.String("namespace", namespace),
+		zap.String("service", service),
+		zap.Int("entries", purged))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"purged": purged,
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy says when a failed proxied request is retried against
+// another instance. Fields left out of RETRY_POLICIES_FILE entries take
+// the RETRY_* defaults.
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"max_attempts,omitempty"` // including the first
+	InitialBackoff Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     Duration `json:"max_backoff,omitempty"`
+	RetryOn        []int    `json:"retry_on,omitempty"` // response statuses
+	Methods        []string `json:"methods,omitempty"`
+}
+
+// RetryPolicies holds the default retry policy, the per-service overrides
+// and the retry budget that caps retries across all of them
+type RetryPolicies struct {
+	defaults RetryPolicy
+	services map[string]*RetryPolicy // by pool name
+	budget   *retryBudget
+	maxBody  int64
+
+	retriesTotal *prometheus.CounterVec
+}
+
+// NewRetryPolicies returns nil when retries are disabled: RETRY_MAX_ATTEMPTS
+// is 1 and there is no RETRY_POLICIES_FILE. The file maps service names,
+// qualified by namespace outside the default one, to policies:
+//
+//	{"payments": {"max_attempts": 1}, "team-a/search": {"retry_on": [502, 503, 504, 429]}}
+func NewRetryPolicies(logger *zap.Logger) (*RetryPolicies, error) {
+	defaults := RetryPolicy{
+		MaxAttempts:    getEnvInt("RETRY_MAX_ATTEMPTS", 2),
+		InitialBackoff: Duration(getEnvDuration("RETRY_INITIAL_BACKOFF", 25*time.Millisecond)),
+		MaxBackoff:     Duration(getEnvDuration("RETRY_MAX_BACKOFF", 250*time.Millisecond)),
+		Methods:        getEnvList("RETRY_METHODS", []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}),
+	}
+	for _, status := range getEnvList("RETRY_ON_STATUS", []string{"502", "503", "504"}) {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RETRY_ON_STATUS entry %q", status)
+		}
+		defaults.RetryOn = append(defaults.RetryOn, code)
+	}
+	if err := defaults.validate(); err != nil {
+		return nil, err
+	}
+
+	file := getEnv("RETRY_POLICIES_FILE", "")
+	if defaults.MaxAttempts <= 1 && file == "" {
+		return nil, nil
+	}
+
+	services := make(map[string]*RetryPolicy)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read retry policies: %w", err)
+		}
+		if err := json.Unmarshal(data, &services); err != nil {
+			return nil, fmt.Errorf("decode retry policies: %w", err)
+		}
+		for name, policy := range services {
+			policy.inherit(&defaults)
+			if err := policy.validate(); err != nil {
+				return nil, fmt.Errorf("retry policy %q: %w", name, err)
+			}
+		}
+		logger.Info("Retry policies loaded",
+			zap.String("file", file),
+			zap.Int("services", len(services)))
+	}
+
+	rp := &RetryPolicies{
+		defaults: defaults,
+		services: services,
+		budget: &retryBudget{
+			ratio:      float64(getEnvInt("RETRY_BUDGET_PERCENT", 20)) / 100,
+			minRetries: getEnvInt("RETRY_BUDGET_MIN_RETRIES", 10),
+			window:     getEnvDuration("RETRY_BUDGET_WINDOW", 10*time.Second),
+			pools:      make(map[string]*retryWindow),
+		},
+		maxBody: int64(getEnvInt("RETRY_MAX_BODY_BYTES", 1<<20)),
+		retriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_retries_total",
+			Help: "Proxied request retries, by whether the retry budget allowed them",
+		}, []string{"namespace", "outcome"}),
+	}
+	prometheus.MustRegister(rp.retriesTotal)
+	return rp, nil
+}
+
+// inherit fills in the fields a per-service policy leaves out
+func (p *RetryPolicy) inherit(defaults *RetryPolicy) {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = defaults.InitialBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if p.RetryOn == nil {
+		p.RetryOn = defaults.RetryOn
+	}
+	if p.Methods == nil {
+		p.Methods = defaults.Methods
+	}
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return errors.New("max_attempts must be at least 1")
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < p.InitialBackoff {
+		return errors.New("backoffs must not be negative and max_backoff must not be below initial_backoff")
+	}
+	for i, method := range p.Methods {
+		p.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+// policyFor returns the retry policy of a pool, nil when retries are off
+func (rp *RetryPolicies) policyFor(poolName string) *RetryPolicy {
+	if rp == nil {
+		return nil
+	}
+	policy, exists := rp.services[poolName]
+	if !exists {
+		policy = &rp.defaults
+	}
+	if policy.MaxAttempts <= 1 {
+		return nil
+	}
+	return policy
+}
+
+// retryable reports whether an attempt's outcome may be retried. Refused
+// connections never reached the instance, so they are retried whatever the
+// method; other failures only for the policy's methods.
+func (p *RetryPolicy) retryable(method string, resp *http.Response, err error) bool {
+	if err != nil && errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	allowed := false
+	for _, m := range p.Methods {
+		allowed = allowed || m == method
+	}
+	if !allowed {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	for _, status := range p.RetryOn {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before retry number n (from 1): exponential from
+// InitialBackoff up to MaxBackoff, with jitter so retries of concurrent
+// requests spread out
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	backoff := time.Duration(p.InitialBackoff)
+	for i := 1; i < n && backoff < time.Duration(p.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, time.Duration(p.MaxBackoff))
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// retryBudget keeps retries to RETRY_BUDGET_PERCENT of each pool's
+// requests per RETRY_BUDGET_WINDOW, plus RETRY_BUDGET_MIN_RETRIES so
+// low-traffic pools can still retry. When a pool is failing everywhere,
+// this stops retries from multiplying its load.
+type retryBudget struct {
+	ratio      float64
+	minRetries int
+	window     time.Duration
+	pools      map[string]*retryWindow
+	mutex      sync.Mutex
+}
+
+type retryWindow struct {
+	start    time.Time
+	requests int
+	retries  int
+}
+
+// current returns a pool's window, starting a new one when it ran out.
+// The caller must hold rb.mutex.
+func (rb *retryBudget) current(poolName string, now time.Time) *retryWindow {
+	window := rb.pools[poolName]
+	if window == nil || now.Sub(window.start) >= rb.window {
+		window = &retryWindow{start: now}
+		rb.pools[poolName] = window
+	}
+	return window
+}
+
+// request counts a proxied request towards a pool's budget
+func (rb *retryBudget) request(poolName string) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	rb.current(poolName, time.Now()).requests++
+}
+
+// allow takes a retry from a pool's budget if there is one left
+func (rb *retryBudget) allow(poolName string) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	window := rb.current(poolName, time.Now())
+	if float64(window.retries) >= float64(rb.minRetries)+rb.ratio*float64(window.requests) {
+		return false
+	}
+	window.retries++
+	return true
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RouteConfig is the proxy configuration of one service
+type RouteConfig struct {
+	Timeouts *ProxyTimeouts `json:"timeouts,omitempty"`
+
+	// StripPrefix forwards only the path after /api/proxy/{service}, so
+	// /api/proxy/orders/v1/items reaches orders as /v1/items
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+
+	// Rewrites are tried in order on the forwarded path, after StripPrefix;
+	// the first rule that matches rewrites it
+	Rewrites []*RewriteRule `json:"rewrites,omitempty"`
+
+	// Headers can also be changed at runtime through the routes API
+	Headers *HeaderRules `json:"headers,omitempty"`
+
+	// MaxRequestBody and MaxResponseBody cap proxied bodies in bytes; zero
+	// means the PROXY_MAX_*_BODY_BYTES default
+	MaxRequestBody  int64 `json:"max_request_body,omitempty"`
+	MaxResponseBody int64 `json:"max_response_body,omitempty"`
+
+	Cache  *RouteCache   `json:"cache,omitempty"`
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
+
+	// Canary can also be changed at runtime through the routes API
+	Canary *CanaryConfig `json:"canary,omitempty"`
+
+	// Rules are tried in order; the first that matches a request picks the
+	// version or instances it goes to
+	Rules []*RoutingRule `json:"rules,omitempty"`
+
+	Hedge *HedgeConfig `json:"hedge,omitempty"`
+
+	// Split can also be changed at runtime through the routes API
+	Split *TrafficSplit `json:"split,omitempty"`
+
+	RequestTransform  *RequestTransform  `json:"request_transform,omitempty"`
+	ResponseTransform *ResponseTransform `json:"response_transform,omitempty"`
+
+	// Protocol is what the service's instances are spoken to in: "http1"
+	// (the default) or "h2c", cleartext HTTP/2 with prior knowledge, which
+	// multiplexes requests over fewer connections. Upgrades such as
+	// WebSockets always go over HTTP/1.1.
+	Protocol string `json:"protocol,omitempty"`
+
+	// TLS switches the service's upstream to HTTPS, where HTTP/2 is
+	// negotiated rather than configured through Protocol
+	TLS *UpstreamTLS `json:"tls,omitempty"`
+
+	Concurrency *ConcurrencyLimit `json:"concurrency,omitempty"`
+	Upload      *UploadConfig     `json:"upload,omitempty"`
+	RateLimit   *RateLimit        `json:"rate_limit,omitempty"`
+
+	// IPAccess can also be changed at runtime through the routes API
+	IPAccess *IPAccessList `json:"ip_access,omitempty"`
+
+	Signature *SignatureConfig `json:"signature,omitempty"`
+	CORS      *CORSPolicy      `json:"cors,omitempty"`
+
+	Inspection *InspectionConfig `json:"inspection,omitempty"`
+}
+
+// Upstream protocols of RouteConfig.Protocol
+const (
+	protocolHTTP1 = "http1"
+	protocolH2C   = "h2c"
+)
+
+// RouteCache opts a service's GET responses into the response cache
+type RouteCache struct {
+	Enabled bool `json:"enabled"`
+
+	// TTL is how long responses without a max-age stay fresh; zero means
+	// PROXY_CACHE_TTL
+	TTL Duration `json:"ttl,omitempty"`
+}
+
+// RewriteRule replaces the matches of a regular expression in the
+// forwarded path. Replace may refer to capture groups as $1 or ${name},
+// e.g. {"match": "^/v1/(.*)$", "replace": "/api/$1"}.
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+
+	pattern *regexp.Regexp
+}
+
+func (route *RouteConfig) validate() error {
+	if route.Timeouts != nil {
+		if err := route.Timeouts.validate(); err != nil {
+			return err
+		}
+	}
+	if route.MaxRequestBody < 0 || route.MaxResponseBody < 0 {
+		return errors.New("body limits must not be negative")
+	}
+	if route.Cache != nil && route.Cache.TTL < 0 {
+		return errors.New("cache TTL must not be negative")
+	}
+	if route.Mirror != nil && (route.Mirror.Service == "" || route.Mirror.Percent < 0 || route.Mirror.Percent > 100) {
+		return errors.New("mirror needs a service and a percent between 0 and 100")
+	}
+	for _, rule := range route.Rewrites {
+		pattern, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("rewrite %q: %w", rule.Match, err)
+		}
+		rule.pattern = pattern
+	}
+	if route.Canary != nil {
+		if err := route.Canary.validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range route.Rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Hedge != nil {
+		if err := route.Hedge.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Split != nil {
+		if err := route.Split.validate(); err != nil {
+			return err
+		}
+	}
+	if route.RequestTransform != nil {
+		if err := route.RequestTransform.validate(); err != nil {
+			return err
+		}
+	}
+	if route.ResponseTransform != nil {
+		if err := route.ResponseTransform.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Protocol != "" && route.Protocol != protocolHTTP1 && route.Protocol != protocolH2C {
+		return fmt.Errorf("unsupported upstream protocol %q", route.Protocol)
+	}
+	if route.TLS != nil {
+		if route.Protocol == protocolH2C {
+			return errors.New("h2c is cleartext; TLS upstreams negotiate HTTP/2")
+		}
+		if err := route.TLS.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Concurrency != nil {
+		if err := route.Concurrency.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Upload != nil {
+		if err := route.Upload.validate(); err != nil {
+			return err
+		}
+	}
+	if route.RateLimit != nil {
+		if err := route.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if route.IPAccess != nil {
+		if err := route.IPAccess.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Signature != nil {
+		if err := route.Signature.validate(); err != nil {
+			return err
+		}
+	}
+	if route.CORS != nil {
+		if err := route.CORS.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Inspection != nil {
+		if err := route.Inspection.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Headers != nil {
+		return route.Headers.validate()
+	}
+	return nil
+}
+
+// ProxyTimeouts bound a proxied request: Connect the dial to an instance,
+// ResponseHeader the wait for its response headers and Total the whole
+// request including retries and the response body. Zero means no limit
+// for Total and the PROXY_* default for the others.
+type ProxyTimeouts struct {
+	Connect        Duration `json:"connect,omitempty"`
+	ResponseHeader Duration `json:"response_header,omitempty"`
+	Total          Duration `json:"total,omitempty"`
+
+	// MaxOverride caps the total timeout clients may ask for with the
+	// PROXY_TIMEOUT_HEADER; zero leaves it uncapped
+	MaxOverride Duration `json:"max_override,omitempty"`
+}
+
+// overlay replaces the timeouts other sets
+func (t *ProxyTimeouts) overlay(other *ProxyTimeouts) {
+	if other.Connect > 0 {
+		t.Connect = other.Connect
+	}
+	if other.ResponseHeader > 0 {
+		t.ResponseHeader = other.ResponseHeader
+	}
+	if other.Total > 0 {
+		t.Total = other.Total
+	}
+	if other.MaxOverride > 0 {
+		t.MaxOverride = other.MaxOverride
+	}
+}
+
+func (t *ProxyTimeouts) validate() error {
+	if t.Connect < 0 || t.ResponseHeader < 0 || t.Total < 0 || t.MaxOverride < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+// RouteTable holds the per-service proxy configuration from
+// PROXY_ROUTES_FILE, a JSON object keyed by service name (qualified by
+// namespace outside the default one):
+//
+//	{"reports": {"timeouts": {"response_header": "2m", "total": "10m"}, "strip_prefix": true}}
+type RouteTable struct {
+	routes   map[string]*RouteConfig // by pool name
+	mutex    sync.RWMutex
+	defaults ProxyTimeouts
+
+	// timeoutHeader lets clients pick a request's total timeout, e.g.
+	// "X-Request-Timeout: 5s"; empty disables it
+	timeoutHeader string
+
+	// Body limits of routes that don't set their own; zero is unlimited
+	maxRequestBody  int64
+	maxResponseBody int64
+
+	// maxTransformBody caps the bodies transforms buffer
+	maxTransformBody int64
+}
+
+func NewRouteTable(logger *zap.Logger) (*RouteTable, error) {
+	rt := &RouteTable{
+		routes: make(map[string]*RouteConfig),
+		defaults: ProxyTimeouts{
+			Connect:        Duration(getEnvDuration("PROXY_CONNECT_TIMEOUT", 30*time.Second)),
+			ResponseHeader: Duration(getEnvDuration("PROXY_RESPONSE_HEADER_TIMEOUT", 30*time.Second)),
+			Total:          Duration(getEnvDuration("PROXY_TIMEOUT", 0)),
+		},
+		timeoutHeader:    getEnv("PROXY_TIMEOUT_HEADER", ""),
+		maxRequestBody:   int64(getEnvInt("PROXY_MAX_REQUEST_BODY_BYTES", 0)),
+		maxResponseBody:  int64(getEnvInt("PROXY_MAX_RESPONSE_BODY_BYTES", 0)),
+		maxTransformBody: int64(getEnvInt("PROXY_TRANSFORM_MAX_BODY_BYTES", 1<<20)),
+	}
+	if err := rt.defaults.validate(); err != nil {
+		return nil, err
+	}
+	if rt.maxRequestBody < 0 || rt.maxResponseBody < 0 {
+		return nil, errors.New("body limits must not be negative")
+	}
+
+	file := getEnv("PROXY_ROUTES_FILE", "")
+	if file == "" {
+		return rt, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy routes: %w", err)
+	}
+	if err := json.Unmarshal(data, &rt.routes); err != nil {
+		return nil, fmt.Errorf("decode proxy routes: %w", err)
+	}
+	for name, route := range rt.routes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("route %q: %w", name, err)
+		}
+	}
+
+	logger.Info("Proxy routes loaded",
+		zap.String("file", file),
+		zap.Int("services", len(rt.routes)))
+	return rt, nil
+}
+
+// timeouts returns the timeouts of a request to a pool: the overrides of
+// the path route it came through, the service's own, the defaults for what
+// both leave out, and the total timeout the client asked for if the
+// timeout header is enabled
+func (rt *RouteTable) timeouts(poolName string, overrides *ProxyTimeouts, r *http.Request) ProxyTimeouts {
+	rt.mutex.RLock()
+	route := rt.routes[poolName]
+	rt.mutex.RUnlock()
+
+	timeouts := rt.defaults
+	if route != nil && route.Timeouts != nil {
+		timeouts.overlay(route.Timeouts)
+	}
+	if overrides != nil {
+		timeouts.overlay(overrides)
+	}
+
+	if rt.timeoutHeader == "" {
+		return timeouts
+	}
+	requested, err := time.ParseDuration(r.Header.Get(rt.timeoutHeader))
+	if err != nil || requested <= 0 {
+		return timeouts
+	}
+	if timeouts.MaxOverride > 0 {
+		requested = min(requested, time.Duration(timeouts.MaxOverride))
+	}
+	timeouts.Total = Duration(requested)
+	return timeouts
+}
+
+// bodyLimits returns the largest request and response bodies proxied to
+// a pool, zero when unlimited
+func (rt *RouteTable) bodyLimits(poolName string) (request, response int64) {
+	rt.mutex.RLock()
+	route := rt.routes[poolName]
+	rt.mutex.RUnlock()
+
+	request, response = rt.maxRequestBody, rt.maxResponseBody
+	if route != nil && route.MaxRequestBody > 0 {
+		request = route.MaxRequestBody
+	}
+	if route != nil && route.MaxResponseBody > 0 {
+		response = route.MaxResponseBody
+	}
+	return request, response
+}
+
+// h2c reports whether a pool's instances are spoken to in cleartext HTTP/2
+func (rt *RouteTable) h2c(poolName string) bool {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	route := rt.routes[poolName]
+	return route != nil && route.Protocol == protocolH2C
+}
+
+// cacheTTL reports whether a pool's responses are cached, and for how
+// long by default
+func (rt *RouteTable) cacheTTL(poolName string) (time.Duration, bool) {
+	rt.mutex.RLock()
+	route := rt.routes[poolName]
+	rt.mutex.RUnlock()
+
+	if route == nil || route.Cache == nil || !route.Cache.Enabled {
+		return 0, false
+	}
+	return time.Duration(route.Cache.TTL), true
+}
+
+// mirror returns the mirror of a pool's requests, nil when there is none
+func (rt *RouteTable) mirror(poolName string) *MirrorConfig {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Mirror
+	}
+	return nil
+}
+
+// upstreamPath returns the path a request to a pool is forwarded with.
+// fullPath is the path the gateway received and subPath the part after
+// /api/proxy/{service}.
+func (rt *RouteTable) upstreamPath(poolName, fullPath, subPath string) string {
+	rt.mutex.RLock()
+	route := rt.routes[poolName]
+	rt.mutex.RUnlock()
+
+	if route == nil {
+		return fullPath
+	}
+
+	path := fullPath
+	if route.StripPrefix {
+		path = subPath
+	}
+	for _, rule := range route.Rewrites {
+		if rule.pattern.MatchString(path) {
+			path = rule.pattern.ReplaceAllString(path, rule.Replace)
+			break
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
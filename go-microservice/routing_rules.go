@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// RoutingRule sends the requests with a header or cookie to a version of a
+// service or to its instances with a tag, e.g. {"header": "X-Beta",
+// "value": "true", "version": "v2"} lets internal users try a new build
+// on production URLs
+type RoutingRule struct {
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+
+	// Value the header or cookie must have; any value matches when empty
+	Value string `json:"value,omitempty"`
+
+	Version string `json:"version,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+}
+
+func (rule *RoutingRule) validate() error {
+	if (rule.Header == "") == (rule.Cookie == "") {
+		return errors.New("routing rule needs a header or a cookie")
+	}
+	if (rule.Version == "") == (rule.Tag == "") {
+		return errors.New("routing rule needs a version or a tag")
+	}
+	return nil
+}
+
+func (rule *RoutingRule) matches(r *http.Request) bool {
+	if rule.Cookie != "" {
+		cookie, err := r.Cookie(rule.Cookie)
+		return err == nil && (rule.Value == "" || cookie.Value == rule.Value)
+	}
+	for _, value := range r.Header.Values(rule.Header) {
+		if rule.Value == "" || value == rule.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// subset narrows picks to the instances with the rule's tag, or the whole
+// pool while there are none
+func (rule *RoutingRule) subset() *instanceSubset {
+	return &instanceSubset{
+		scope: "#tag:" + rule.Tag,
+		match: func(instance *ServiceInstance) bool { return hasTags(instance, []string{rule.Tag}) },
+	}
+}
+
+// matchRule returns the first of a pool's routing rules a request
+// matches, nil when none does
+func (rt *RouteTable) matchRule(poolName string, r *http.Request) *RoutingRule {
+	rt.mutex.RLock()
+	route := rt.routes[poolName]
+	rt.mutex.RUnlock()
+
+	if route == nil {
+		return nil
+	}
+	for _, rule := range route.Rules {
+		if rule.matches(r) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Headers of signed requests
+const (
+	signatureKeyHeader       = "X-Signature-Key-Id"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureHeader          = "X-Signature"
+)
+
+// SignatureConfig has a service's requests signed. Required refuses
+// unsigned requests; otherwise only the signed ones are checked. Keys
+// limits the keys the service accepts, all of them by default, and MaxSkew
+// how far the signing time may be from the gateway's, HMAC_MAX_SKEW by
+// default.
+type SignatureConfig struct {
+	Required bool     `json:"required,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	MaxSkew  Duration `json:"max_skew,omitempty"`
+}
+
+func (sc *SignatureConfig) validate() error {
+	if sc.MaxSkew < 0 {
+		return errors.New("signature max skew must not be negative")
+	}
+	return nil
+}
+
+// SignatureKey is a secret machine callers sign requests with
+type SignatureKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// Signatures authenticates machine callers by HMAC-SHA256 signatures over
+// their requests, with the keys in HMAC_KEYS_FILE:
+//
+//	{"keys": [{"id": "billing", "secret": "s3cret"}]}
+//
+// A caller sends the key's id as X-Signature-Key-Id, the Unix time in
+// seconds as X-Signature-Timestamp, and as X-Signature "sha256=" and the
+// hex signature of
+//
+//	timestamp "\n" method "\n" request URI "\n" hex SHA-256 of the body
+//
+// Requests signed too long ago, or whose signature was already seen while
+// it is valid, are refused as replays; replays are only caught by the
+// gateway replica that saw the request first. Signed bodies are buffered,
+// up to the route's MaxRequestBody or HMAC_MAX_BODY_BYTES.
+//
+// With VAULT_HMAC_KEYS_PATH set, the keys are the data of that KV secret
+// instead, in the same form, and rotated keys apply without a restart.
+type Signatures struct {
+	keys    atomic.Pointer[map[string][]byte]
+	maxSkew time.Duration
+	maxBody int64
+
+	seen      map[string]time.Time // signatures by when they expire
+	sweptAt   time.Time
+	seenMutex sync.Mutex
+
+	failures *prometheus.CounterVec
+	logger   *zap.Logger
+}
+
+// signatureKeys is the document HMAC keys are loaded from
+type signatureKeys struct {
+	Keys []*SignatureKey `json:"keys"`
+}
+
+// NewSignatures returns nil when neither HMAC_KEYS_FILE nor
+// VAULT_HMAC_KEYS_PATH is set
+func NewSignatures(vault *Vault, logger *zap.Logger) (*Signatures, error) {
+	file := getEnv("HMAC_KEYS_FILE", "")
+	vaultPath := getEnv("VAULT_HMAC_KEYS_PATH", "")
+	if file == "" && vaultPath == "" {
+		return nil, nil
+	}
+
+	s := &Signatures{
+		maxSkew: getEnvDuration("HMAC_MAX_SKEW", 5*time.Minute),
+		maxBody: int64(getEnvInt("HMAC_MAX_BODY_BYTES", 10<<20)),
+		seen:    make(map[string]time.Time),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "signature_failures_total",
+			Help: "Requests refused for their HMAC signature, by reason: missing, unknown_key, expired, replayed or invalid",
+		}, []string{"namespace", "service", "reason"}),
+		logger: logger,
+	}
+	if vaultPath != "" {
+		if vault == nil {
+			return nil, errors.New("VAULT_HMAC_KEYS_PATH needs VAULT_ADDR")
+		}
+		err := vault.watchKV(vaultPath, func(data map[string]interface{}) error {
+			var config signatureKeys
+			if err := decodeKVData(data, &config); err != nil {
+				return fmt.Errorf("decode HMAC keys: %w", err)
+			}
+			return s.load(&config)
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read HMAC keys: %w", err)
+		}
+		var config signatureKeys
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("decode HMAC keys: %w", err)
+		}
+		if err := s.load(&config); err != nil {
+			return nil, err
+		}
+	}
+	prometheus.MustRegister(s.failures)
+	return s, nil
+}
+
+// load checks signing keys and puts them in place of the current ones
+func (s *Signatures) load(config *signatureKeys) error {
+	keys := make(map[string][]byte, len(config.Keys))
+	for i, key := range config.Keys {
+		if key.ID == "" || len(key.Secret) < 16 {
+			return fmt.Errorf("HMAC key %d needs an id and a secret of 16 characters or more", i)
+		}
+		keys[key.ID] = []byte(key.Secret)
+	}
+	s.keys.Store(&keys)
+	s.logger.Info("HMAC request signing keys loaded", zap.Int("keys", len(keys)))
+	return nil
+}
+
+// verify checks the signature of a request to a service that has them,
+// answering with 401 and returning false when it doesn't hold up. The
+// body is left buffered in its place.
+func (s *Signatures) verify(w http.ResponseWriter, r *http.Request, target *proxyTarget, config *SignatureConfig, maxBody int64) bool {
+	if config == nil {
+		return true
+	}
+	if s == nil {
+		// Requiring signatures without keys fails closed
+		if config.Required {
+			http.Error(w, "Request signatures are not configured", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	keyID := r.Header.Get(signatureKeyHeader)
+	signature, signed := strings.CutPrefix(r.Header.Get(signatureHeader), "sha256=")
+	if keyID == "" && !signed {
+		if config.Required {
+			return s.reject(w, r, target, "missing", "")
+		}
+		return true
+	}
+	secret, known := (*s.keys.Load())[keyID]
+	if !known || (len(config.Keys) > 0 && !slices.Contains(config.Keys, keyID)) {
+		return s.reject(w, r, target, "unknown_key", keyID)
+	}
+
+	maxSkew := s.maxSkew
+	if config.MaxSkew > 0 {
+		maxSkew = time.Duration(config.MaxSkew)
+	}
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return s.reject(w, r, target, "expired", keyID)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > maxSkew || skew < -maxSkew {
+		return s.reject(w, r, target, "expired", keyID)
+	}
+
+	if maxBody <= 0 || maxBody > s.maxBody {
+		maxBody = s.maxBody
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	r.Body.Close()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			rejectTooLarge(w, tooLarge.Limit)
+			return false
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return false
+	}
+	if int64(len(data)) > maxBody {
+		rejectTooLarge(w, maxBody)
+		return false
+	}
+	r.Body, r.ContentLength = http.NoBody, 0
+	if len(data) > 0 {
+		r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(data)), int64(len(data))
+	}
+
+	digest := sha256.Sum256(data)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", timestamp, r.Method, r.RequestURI, hex.EncodeToString(digest[:]))
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac.Sum(nil), expected) {
+		return s.reject(w, r, target, "invalid", keyID)
+	}
+	if !s.firstSeen(keyID+":"+signature, signedAt.Add(maxSkew)) {
+		return s.reject(w, r, target, "replayed", keyID)
+	}
+	return true
+}
+
+// firstSeen records a signature until it expires, reporting whether it is
+// new
+func (s *Signatures) firstSeen(signature string, expiry time.Time) bool {
+	s.seenMutex.Lock()
+	defer s.seenMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.sweptAt) >= time.Minute {
+		for seen, seenExpiry := range s.seen {
+			if now.After(seenExpiry) {
+				delete(s.seen, seen)
+			}
+		}
+		s.sweptAt = now
+	}
+	if _, seen := s.seen[signature]; seen {
+		return false
+	}
+	s.seen[signature] = expiry
+	return true
+}
+
+func (s *Signatures) reject(w http.ResponseWriter, r *http.Request, target *proxyTarget, reason, keyID string) bool {
+	s.failures.WithLabelValues(target.namespace, target.serviceName, reason).Inc()
+	s.logger.Warn("Request signature rejected",
+		zap.String("service", target.serviceName),
+		zap.String("key_id", keyID),
+		zap.String("reason", reason),
+		zap.String("remote_addr", r.RemoteAddr))
+	http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+	return false
+}
+
+// signature returns a pool's signature configuration, nil when it has none
+func (rt *RouteTable) signature(poolName string) *SignatureConfig {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Signature
+	}
+	return nil
+}
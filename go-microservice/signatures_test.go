@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const testSignatureSecret = "0123456789abcdef"
+
+// newTestSignatures returns signatures with the keys "billing" and
+// "reports", a 5 minute skew and a 64 byte body limit, with metrics that
+// aren't registered
+func newTestSignatures(t *testing.T) *Signatures {
+	t.Helper()
+	s := &Signatures{
+		maxSkew:  5 * time.Minute,
+		maxBody:  64,
+		seen:     make(map[string]time.Time),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_failures"}, []string{"namespace", "service", "reason"}),
+		logger:   zap.NewNop(),
+	}
+	err := s.load(&signatureKeys{Keys: []*SignatureKey{
+		{ID: "billing", Secret: testSignatureSecret},
+		{ID: "reports", Secret: testSignatureSecret},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// signedRequest returns a POST of body signed with key at signedAt
+func signedRequest(key, body string, signedAt time.Time) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/orders/42?expand=items", strings.NewReader(body))
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	digest := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(testSignatureSecret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", timestamp, r.Method, r.RequestURI, hex.EncodeToString(digest[:]))
+
+	r.Header.Set(signatureKeyHeader, key)
+	r.Header.Set(signatureTimestampHeader, timestamp)
+	r.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestSignaturesVerify(t *testing.T) {
+	now := time.Now()
+	tampered := signedRequest("billing", `{"amount": 10}`, now)
+	tampered.Body = io.NopCloser(strings.NewReader(`{"amount": 99}`))
+	badTimestamp := signedRequest("billing", "", now)
+	badTimestamp.Header.Set(signatureTimestampHeader, "yesterday")
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		config  *SignatureConfig
+		maxBody int64
+		want    int
+	}{
+		{"valid", signedRequest("billing", `{"amount": 10}`, now), &SignatureConfig{Required: true}, 0, http.StatusOK},
+		{"valid without body", signedRequest("billing", "", now), &SignatureConfig{Required: true}, 0, http.StatusOK},
+		{"unsigned and optional", httptest.NewRequest(http.MethodPost, "/orders", nil), &SignatureConfig{}, 0, http.StatusOK},
+		{"unsigned and required", httptest.NewRequest(http.MethodPost, "/orders", nil), &SignatureConfig{Required: true}, 0, http.StatusUnauthorized},
+		{"unknown key", signedRequest("shipping", "", now), &SignatureConfig{}, 0, http.StatusUnauthorized},
+		{"key not accepted by the service", signedRequest("reports", "", now), &SignatureConfig{Keys: []string{"billing"}}, 0, http.StatusUnauthorized},
+		{"tampered body", tampered, &SignatureConfig{}, 0, http.StatusUnauthorized},
+		{"within skew", signedRequest("billing", "", now.Add(-4*time.Minute)), &SignatureConfig{}, 0, http.StatusOK},
+		{"too old", signedRequest("billing", "", now.Add(-6*time.Minute)), &SignatureConfig{}, 0, http.StatusUnauthorized},
+		{"too far ahead", signedRequest("billing", "", now.Add(6*time.Minute)), &SignatureConfig{}, 0, http.StatusUnauthorized},
+		{"too old for the service", signedRequest("billing", "", now.Add(-2*time.Minute)), &SignatureConfig{MaxSkew: Duration(time.Minute)}, 0, http.StatusUnauthorized},
+		{"unreadable timestamp", badTimestamp, &SignatureConfig{}, 0, http.StatusUnauthorized},
+		{"body at the limit", signedRequest("billing", strings.Repeat("x", 64), now), &SignatureConfig{}, 0, http.StatusOK},
+		{"body over the limit", signedRequest("billing", strings.Repeat("x", 65), now), &SignatureConfig{}, 0, http.StatusRequestEntityTooLarge},
+		{"body over the route's limit", signedRequest("billing", strings.Repeat("x", 20), now), &SignatureConfig{}, 16, http.StatusRequestEntityTooLarge},
+		{"route limit over the gateway's", signedRequest("billing", strings.Repeat("x", 65), now), &SignatureConfig{}, 1 << 20, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSignatures(t)
+			w := httptest.NewRecorder()
+			ok := s.verify(w, tt.request, &proxyTarget{serviceName: "orders"}, tt.config, tt.maxBody)
+			if got := w.Code; got != tt.want || ok != (tt.want == http.StatusOK) {
+				t.Errorf("verify() = %v with status %d, want status %d", ok, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignaturesVerifyKeepsBody(t *testing.T) {
+	s := newTestSignatures(t)
+	r := signedRequest("billing", `{"amount": 10}`, time.Now())
+	if !s.verify(httptest.NewRecorder(), r, &proxyTarget{serviceName: "orders"}, &SignatureConfig{}, 0) {
+		t.Fatal("verify() refused a valid signature")
+	}
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != `{"amount": 10}` || r.ContentLength != int64(len(body)) {
+		t.Errorf("body = %q with length %d after verify", body, r.ContentLength)
+	}
+}
+
+func TestSignaturesVerifyReplay(t *testing.T) {
+	s := newTestSignatures(t)
+	target := &proxyTarget{serviceName: "orders"}
+	signedAt := time.Now()
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    int
+	}{
+		{"first", signedRequest("billing", `{"amount": 10}`, signedAt), http.StatusOK},
+		{"replayed", signedRequest("billing", `{"amount": 10}`, signedAt), http.StatusUnauthorized},
+		{"same request with another key", signedRequest("reports", `{"amount": 10}`, signedAt), http.StatusOK},
+		{"signed again later", signedRequest("billing", `{"amount": 10}`, signedAt.Add(time.Second)), http.StatusOK},
+	}
+	// Cases run in order against the same signatures
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.verify(w, tt.request, target, &SignatureConfig{}, 0)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
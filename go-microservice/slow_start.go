@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// slowStartMinShare is the share of its turns a recovered instance gets
+// right after recovery
+const slowStartMinShare = 0.1
+
+// slowStartShare returns the share of its round-robin turns an instance
+// takes: instances that recovered within the SLOW_START_WINDOW ramp up
+// linearly from slowStartMinShare, everything else takes all of them
+func (lb *LoadBalancer) slowStartShare(instance *ServiceInstance, now time.Time) float64 {
+	if lb.slowStart <= 0 || instance.recoveredAt.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(instance.recoveredAt)
+	if elapsed >= lb.slowStart {
+		return 1
+	}
+	return max(slowStartMinShare, float64(elapsed)/float64(lb.slowStart))
+}
+
+// selectable reports whether an instance may take the current request: it
+// must be routable and not ejected, and instances in slow start pass on a
+// share of their turns. The caller must hold lb.mutex.
+func (lb *LoadBalancer) selectable(instance *ServiceInstance, now time.Time) bool {
+	if !routable(instance) || lb.isEjected(instance.ID, now) {
+		return false
+	}
+	share := lb.slowStartShare(instance, now)
+	return share >= 1 || rand.Float64() < share
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// LoadStaticUpstreams merges the fixed upstreams declared in
+// STATIC_UPSTREAMS_FILE into the registry, e.g.
+//
+//	{"postgres": ["10.0.0.5:5432"], "legacy-billing": ["billing.internal:8080"]}
+//
+// These are for databases and legacy services that can't register
+// themselves. Static instances are kept locally like other discovered
+// instances, are never health checked or expired, and can't be deregistered
+// through the API.
+func (gw *APIGateway) LoadStaticUpstreams(logger *zap.Logger) error {
+	file := getEnv("STATIC_UPSTREAMS_FILE", "")
+	if file == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read static upstreams: %w", err)
+	}
+
+	var upstreams map[string][]string
+	if err := json.Unmarshal(data, &upstreams); err != nil {
+		return fmt.Errorf("decode static upstreams: %w", err)
+	}
+
+	instances := make([]*ServiceInstance, 0)
+	for name, addresses := range upstreams {
+		for _, address := range addresses {
+			host, portValue, err := net.SplitHostPort(address)
+			if err != nil {
+				return fmt.Errorf("static upstream %s: %w", name, err)
+			}
+			port, err := strconv.Atoi(portValue)
+			if err != nil {
+				return fmt.Errorf("static upstream %s: invalid port in %q", name, address)
+			}
+
+			instances = append(instances, &ServiceInstance{
+				ID:       fmt.Sprintf("static-%s-%s-%d", name, host, port),
+				Name:     name,
+				Address:  host,
+				Port:     port,
+				Metadata: map[string]interface{}{"source": "static"},
+				Static:   true,
+			})
+		}
+	}
+
+	for _, instance := range instances {
+		if gw.registry.AddLocal(instance) {
+			gw.registry.addToRotation(instance.ID)
+		}
+	}
+
+	logger.Info("Static upstreams loaded",
+		zap.String("file", file),
+		zap.Int("services", len(upstreams)),
+		zap.Int("instances", len(instances)))
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StickySessions binds clients to an instance with a gateway-issued cookie.
+// The cookie holds the instance ID signed with HMAC-SHA256 over the pool
+// and ID, so clients can't pick arbitrary instances and gateways sharing
+// STICKY_COOKIE_SECRET honor each other's cookies. Each pool gets its own
+// cookie so one client can be bound in several services.
+type StickySessions struct {
+	cookieName string
+	secret     []byte
+	maxAge     time.Duration
+}
+
+// NewStickySessions returns nil unless STICKY_SESSIONS is true
+func NewStickySessions(logger *zap.Logger) (*StickySessions, error) {
+	if getEnv("STICKY_SESSIONS", "false") != "true" {
+		return nil, nil
+	}
+
+	secret := []byte(getEnv("STICKY_COOKIE_SECRET", ""))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generate sticky session secret: %w", err)
+		}
+		logger.Warn("STICKY_COOKIE_SECRET is not set, affinity cookies are only valid on this gateway")
+	}
+
+	return &StickySessions{
+		cookieName: getEnv("STICKY_COOKIE_NAME", "gw_affinity"),
+		secret:     secret,
+		maxAge:     getEnvDuration("STICKY_COOKIE_MAX_AGE", time.Hour),
+	}, nil
+}
+
+// poolCookie names the cookie of one pool
+func (ss *StickySessions) poolCookie(poolName string) string {
+	return fmt.Sprintf("%s_%016x", ss.cookieName, hashString(poolName))
+}
+
+func (ss *StickySessions) sign(poolName, instanceID string) string {
+	mac := hmac.New(sha256.New, ss.secret)
+	mac.Write([]byte(poolName + "|" + instanceID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// instanceFor returns the instance ID the request is bound to in a pool,
+// or "" when it has no valid cookie
+func (ss *StickySessions) instanceFor(r *http.Request, poolName string) string {
+	cookie, err := r.Cookie(ss.poolCookie(poolName))
+	if err != nil {
+		return ""
+	}
+	encoded, signature, found := strings.Cut(cookie.Value, ".")
+	if !found {
+		return ""
+	}
+	id, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	if !hmac.Equal([]byte(signature), []byte(ss.sign(poolName, string(id)))) {
+		return ""
+	}
+	return string(id)
+}
+
+// bind sets the cookie binding the client to an instance of a pool
+func (ss *StickySessions) bind(w http.ResponseWriter, poolName, instanceID string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ss.poolCookie(poolName),
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(instanceID)) + "." + ss.sign(poolName, instanceID),
+		Path:     "/",
+		MaxAge:   int(ss.maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// GetInstance returns an instance of a pool by ID if it can take traffic:
+// it must be healthy and not ejected
+func (lb *LoadBalancer) GetInstance(serviceName, version, instanceID string) *ServiceInstance {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	for _, instance := range lb.services[poolKey(serviceName, version)] {
+		if instance.ID != instanceID {
+			continue
+		}
+		if instance.Status != "healthy" || lb.isEjected(instance.ID, time.Now()) {
+			return nil
+		}
+		return instance
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// subset returns the part of a pool this gateway balances across. With
+// LB_SUBSET_SIZE set, large pools are split with deterministic subsetting:
+// gateways shuffle the pool the same way for each round of clients and
+// take consecutive slices, so every gateway replica (LB_SUBSET_CLIENT_ID,
+// e.g. a StatefulSet ordinal) holds connections to only LB_SUBSET_SIZE
+// instances while each instance is shared by an even number of gateways.
+// Without a shared registry backend each gateway's health checker only
+// probes the instances it balances across; see balances. The caller must
+// hold lb.mutex.
+func (lb *LoadBalancer) subset(key string, instances []*ServiceInstance) []*ServiceInstance {
+	if lb.subsetSize <= 0 || len(instances) <= lb.subsetSize {
+		return instances
+	}
+	if cached, exists := lb.subsets[key]; exists {
+		return cached
+	}
+
+	// Sort first so every gateway starts from the same order
+	shuffled := make([]*ServiceInstance, len(instances))
+	copy(shuffled, instances)
+	sort.Slice(shuffled, func(i, j int) bool { return shuffled[i].ID < shuffled[j].ID })
+
+	subsetCount := len(shuffled) / lb.subsetSize
+	round := lb.subsetClientID / subsetCount
+	rand.New(rand.NewSource(int64(round))).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	start := (lb.subsetClientID % subsetCount) * lb.subsetSize
+	subset := shuffled[start : start+lb.subsetSize]
+	lb.subsets[key] = subset
+	return subset
+}
+
+// balanced returns the instances of a pool this gateway balances across:
+// its subset, or the whole pool while the subset has no routable instance,
+// so that a subset that went down spills over to the rest. The caller must
+// hold lb.mutex.
+func (lb *LoadBalancer) balanced(key string) []*ServiceInstance {
+	pool := lb.services[key]
+	instances := lb.subset(key, pool)
+	for _, instance := range instances {
+		if routable(instance) {
+			return instances
+		}
+	}
+	return pool
+}
+
+// balances reports whether this gateway balances across an instance, in
+// its service's pool or its version's. Instances out of rotation are
+// reported as balanced so that they are still checked.
+func (lb *LoadBalancer) balances(service *ServiceInstance) bool {
+	if lb == nil || lb.subsetSize <= 0 {
+		return true
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	pooled := false
+	for _, key := range []string{service.poolName(), poolKey(service.poolName(), service.Version)} {
+		for _, instance := range lb.services[key] {
+			pooled = pooled || instance.ID == service.ID
+		}
+		for _, instance := range lb.balanced(key) {
+			if instance.ID == service.ID {
+				return true
+			}
+		}
+	}
+	return !pooled
+}
+
+// poolChanged drops the per-pool state derived from a pool's instances,
+// including that kept under the pool's scoped keys. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) poolChanged(key string) {
+	delete(lb.subsets, key)
+	for scoped := range lb.rings {
+		if scoped == key || strings.HasPrefix(scoped, key+"#") {
+			delete(lb.rings, scoped)
+		}
+	}
+	for scoped := range lb.currentWeights {
+		if scoped == key || strings.HasPrefix(scoped, key+"#") {
+			delete(lb.currentWeights, scoped)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const defaultSyntheticInterval = time.Minute
+
+// SyntheticProbe is a scripted transaction run against one service on a
+// schedule, e.g. add to cart then check out. All steps of a run go to the
+// same instance, picked by the load balancer like proxied traffic.
+type SyntheticProbe struct {
+	Name      string          `json:"name"`
+	Namespace string          `json:"namespace,omitempty"`
+	Service   string          `json:"service"`
+	Interval  Duration        `json:"interval,omitempty"`
+	Steps     []SyntheticStep `json:"steps"`
+}
+
+// SyntheticStep is one request of a probe and the assertions on its response
+type SyntheticStep struct {
+	Name         string            `json:"name,omitempty"`
+	Method       string            `json:"method,omitempty"` // default GET
+	Path         string            `json:"path"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Body         string            `json:"body,omitempty"`
+	ExpectStatus []int             `json:"expect_status,omitempty"` // default 200
+	ExpectBody   *HealthCheckBody  `json:"expect_body,omitempty"`
+	MaxLatency   Duration          `json:"max_latency,omitempty"`
+}
+
+// SyntheticResult is the outcome of a probe's latest run
+type SyntheticResult struct {
+	Probe      string    `json:"probe"`
+	Service    string    `json:"service"`
+	Success    bool      `json:"success"`
+	Time       time.Time `json:"time"`
+	DurationMs float64   `json:"duration_ms"`
+	Instance   string    `json:"instance,omitempty"`
+	FailedStep string    `json:"failed_step,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// SyntheticProber runs the probes declared in SYNTHETIC_PROBES_FILE, a
+// JSON array of SyntheticProbe. Results are exported as Prometheus metrics
+// and included in /api/health.
+type SyntheticProber struct {
+	gateway *APIGateway
+	probes  []SyntheticProbe
+	client  *http.Client
+	logger  *zap.Logger
+
+	results map[string]*SyntheticResult // by probe name
+	mutex   sync.RWMutex
+
+	success   *prometheus.GaugeVec
+	duration  *prometheus.GaugeVec
+	runsTotal *prometheus.CounterVec
+}
+
+// NewSyntheticProber returns nil when SYNTHETIC_PROBES_FILE is unset
+func NewSyntheticProber(gateway *APIGateway, logger *zap.Logger) (*SyntheticProber, error) {
+	file := getEnv("SYNTHETIC_PROBES_FILE", "")
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read synthetic probes: %w", err)
+	}
+
+	var probes []SyntheticProbe
+	if err := json.Unmarshal(data, &probes); err != nil {
+		return nil, fmt.Errorf("decode synthetic probes: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i := range probes {
+		if err := probes[i].validate(); err != nil {
+			return nil, fmt.Errorf("synthetic probe %q: %w", probes[i].Name, err)
+		}
+		if seen[probes[i].Name] {
+			return nil, fmt.Errorf("duplicate synthetic probe %q", probes[i].Name)
+		}
+		seen[probes[i].Name] = true
+	}
+
+	sp := &SyntheticProber{
+		gateway: gateway,
+		probes:  probes,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		logger:  logger,
+		results: make(map[string]*SyntheticResult),
+		success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "synthetic_probe_success",
+			Help: "Whether the latest run of a synthetic probe passed",
+		}, []string{"probe", "service"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "synthetic_probe_duration_seconds",
+			Help: "Duration of the latest run of a synthetic probe",
+		}, []string{"probe", "service"}),
+		runsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "synthetic_probe_runs_total",
+			Help: "Synthetic probe runs by result",
+		}, []string{"probe", "service", "result"}),
+	}
+	prometheus.MustRegister(sp.success, sp.duration, sp.runsTotal)
+
+	logger.Info("Synthetic probes loaded",
+		zap.String("file", file),
+		zap.Int("probes", len(probes)))
+	return sp, nil
+}
+
+func (p *SyntheticProbe) validate() error {
+	if p.Name == "" || p.Service == "" {
+		return errors.New("name and service are required")
+	}
+	if p.Namespace == "" {
+		p.Namespace = defaultNamespace
+	}
+	if !namespacePattern.MatchString(p.Namespace) {
+		return fmt.Errorf("invalid namespace %q", p.Namespace)
+	}
+	if len(p.Steps) == 0 {
+		return errors.New("at least one step is required")
+	}
+	if p.Interval != 0 && time.Duration(p.Interval) < minHealthCheckInterval {
+		return fmt.Errorf("interval must be at least %s", minHealthCheckInterval)
+	}
+	for _, step := range p.Steps {
+		if !strings.HasPrefix(step.Path, "/") {
+			return fmt.Errorf("step path %q must start with /", step.Path)
+		}
+		if step.ExpectBody != nil {
+			if err := step.ExpectBody.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run schedules every probe until ctx is done
+func (sp *SyntheticProber) Run(ctx context.Context) {
+	for i := range sp.probes {
+		go sp.schedule(ctx, &sp.probes[i])
+	}
+}
+
+func (sp *SyntheticProber) schedule(ctx context.Context, probe *SyntheticProbe) {
+	interval := time.Duration(probe.Interval)
+	if interval == 0 {
+		interval = defaultSyntheticInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sp.record(probe, sp.run(ctx, probe))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run performs one pass through a probe's steps, stopping at the first
+// failed assertion
+func (sp *SyntheticProber) run(ctx context.Context, probe *SyntheticProbe) *SyntheticResult {
+	start := time.Now()
+	result := &SyntheticResult{Probe: probe.Name, Service: probe.Service, Time: start}
+	defer func() {
+		result.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+	}()
+
+	instance := sp.gateway.loadBalancer.GetNextService(qualifiedName(probe.Namespace, probe.Service))
+	if instance == nil {
+		result.Error = "service not available"
+		return result
+	}
+	result.Instance = instance.ID
+
+	for i, step := range probe.Steps {
+		if err := sp.runStep(ctx, instance, &step); err != nil {
+			result.FailedStep = step.Name
+			if result.FailedStep == "" {
+				result.FailedStep = fmt.Sprintf("%d", i+1)
+			}
+			result.Error = err.Error()
+			return result
+		}
+	}
+	result.Success = true
+	return result
+}
+
+func (sp *SyntheticProber) runStep(ctx context.Context, instance *ServiceInstance, step *SyntheticStep) error {
+	method := step.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+serviceHostPort(instance)+step.Path, strings.NewReader(step.Body))
+	if err != nil {
+		return err
+	}
+	for name, value := range step.Headers {
+		req.Header.Set(name, value)
+	}
+
+	start := time.Now()
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	latency := time.Since(start)
+	if err != nil {
+		return err
+	}
+
+	expected := step.ExpectStatus
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+	matched := false
+	for _, status := range expected {
+		matched = matched || resp.StatusCode == status
+	}
+	if !matched {
+		return fmt.Errorf("%s %s returned status %d", method, step.Path, resp.StatusCode)
+	}
+
+	if step.MaxLatency > 0 && latency > time.Duration(step.MaxLatency) {
+		return fmt.Errorf("%s %s took %s, over %s", method, step.Path, latency, time.Duration(step.MaxLatency))
+	}
+	if step.ExpectBody != nil {
+		return step.ExpectBody.check(body)
+	}
+	return nil
+}
+
+func (sp *SyntheticProber) record(probe *SyntheticProbe, result *SyntheticResult) {
+	sp.mutex.Lock()
+	sp.results[probe.Name] = result
+	sp.mutex.Unlock()
+
+	service := qualifiedName(probe.Namespace, probe.Service)
+	outcome, success := "failure", 0.0
+	if result.Success {
+		outcome, success = "success", 1.0
+	} else {
+		sp.logger.Warn("Synthetic probe failed",
+			zap.String("probe", probe.Name),
+			zap.String("service", service),
+			zap.String("instance", result.Instance),
+			zap.String("step", result.FailedStep),
+			zap.String("error", result.Error))
+	}
+	sp.success.WithLabelValues(probe.Name, service).Set(success)
+	sp.duration.WithLabelValues(probe.Name, service).Set(result.DurationMs / 1000)
+	sp.runsTotal.WithLabelValues(probe.Name, service, outcome).Inc()
+}
+
+// Results returns the latest result of every probe that has run
+func (sp *SyntheticProber) Results() map[string]*SyntheticResult {
+	sp.mutex.RLock()
+	defer sp.mutex.RUnlock()
+
+	results := make(map[string]*SyntheticResult, len(sp.results))
+	for name, result := range sp.results {
+		copied := *result
+		results[name] = &copied
+	}
+	return results
+}
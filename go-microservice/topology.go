@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// TopologyNode is one service in the dependency graph
+type TopologyNode struct {
+	Name       string   `json:"name"`
+	Status     string   `json:"status"` // healthy, degraded, unhealthy, unknown
+	Instances  int      `json:"instances"`
+	Healthy    int      `json:"healthy"`
+	DependsOn  []string `json:"depends_on"`
+	ImpactedBy []string `json:"impacted_by"` // failing services reachable through dependencies
+}
+
+// TopologyEdge points from a service to one of its upstream dependencies
+type TopologyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type Topology struct {
+	Nodes []*TopologyNode `json:"nodes"`
+	Edges []TopologyEdge  `json:"edges"`
+}
+
+// BuildTopology aggregates instances per service name and resolves which
+// services are affected by a failing dependency
+func BuildTopology(services map[string]*ServiceInstance) *Topology {
+	nodes := make(map[string]*TopologyNode)
+	dependsOn := make(map[string]map[string]bool)
+
+	node := func(name string) *TopologyNode {
+		if nodes[name] == nil {
+			nodes[name] = &TopologyNode{Name: name, DependsOn: []string{}, ImpactedBy: []string{}}
+			dependsOn[name] = make(map[string]bool)
+		}
+		return nodes[name]
+	}
+
+	for _, service := range services {
+		n := node(service.Name)
+		n.Instances++
+		if service.Status == "healthy" {
+			n.Healthy++
+		}
+		for _, dependency := range service.DependsOn {
+			node(dependency)
+			dependsOn[service.Name][dependency] = true
+		}
+	}
+
+	for _, n := range nodes {
+		switch {
+		case n.Instances == 0:
+			n.Status = "unknown"
+		case n.Healthy == n.Instances:
+			n.Status = "healthy"
+		case n.Healthy == 0:
+			n.Status = "unhealthy"
+		default:
+			n.Status = "degraded"
+		}
+	}
+
+	topology := &Topology{
+		Nodes: make([]*TopologyNode, 0, len(nodes)),
+		Edges: make([]TopologyEdge, 0),
+	}
+	for name, n := range nodes {
+		for dependency := range dependsOn[name] {
+			n.DependsOn = append(n.DependsOn, dependency)
+			topology.Edges = append(topology.Edges, TopologyEdge{From: name, To: dependency})
+		}
+		sort.Strings(n.DependsOn)
+
+		// Walk the dependencies transitively, guarding against cycles
+		visited := map[string]bool{name: true}
+		queue := append([]string{}, n.DependsOn...)
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			if visited[current] {
+				continue
+			}
+			visited[current] = true
+
+			if status := nodes[current].Status; status == "unhealthy" || status == "unknown" {
+				n.ImpactedBy = append(n.ImpactedBy, current)
+			}
+			for next := range dependsOn[current] {
+				queue = append(queue, next)
+			}
+		}
+		sort.Strings(n.ImpactedBy)
+
+		topology.Nodes = append(topology.Nodes, n)
+	}
+
+	sort.Slice(topology.Nodes, func(i, j int) bool { return topology.Nodes[i].Name < topology.Nodes[j].Name })
+	sort.Slice(topology.Edges, func(i, j int) bool {
+		if topology.Edges[i].From != topology.Edges[j].From {
+			return topology.Edges[i].From < topology.Edges[j].From
+		}
+		return topology.Edges[i].To < topology.Edges[j].To
+	})
+
+	return topology
+}
+
+// topologyHandler builds the graph of one namespace; dependencies are
+// resolved by name within it
+func (gw *APIGateway) topologyHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	topology := BuildTopology(gw.registry.FindServices(nil, nil, map[string]string{"namespace": namespace}))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topology)
+}
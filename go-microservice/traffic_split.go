@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// TrafficSplit shares a service's proxied traffic between its versions by
+// weight, e.g. {"weights": {"v1": 90, "v2": 10}}. With a StickyKey, in the
+// format of LB_HASH_KEY, each client keeps its version as long as the
+// weights don't change; otherwise every request is drawn anew. Requests
+// asking for a version, or matching a routing rule, are routed as asked,
+// and a split takes precedence over a canary.
+type TrafficSplit struct {
+	Weights   map[string]int `json:"weights"`
+	StickyKey string         `json:"sticky_key,omitempty"`
+
+	versions []string // sorted, for a stable assignment
+	total    int
+}
+
+func (ts *TrafficSplit) validate() error {
+	ts.versions, ts.total = nil, 0
+	for version, weight := range ts.Weights {
+		if version == "" || weight < 0 {
+			return fmt.Errorf("invalid split weight %q: %d", version, weight)
+		}
+		if weight > 0 {
+			ts.versions = append(ts.versions, version)
+			ts.total += weight
+		}
+	}
+	if ts.total == 0 {
+		return errors.New("split needs a version with a positive weight")
+	}
+	if ts.StickyKey != "" && !validRequestKey(ts.StickyKey) {
+		return fmt.Errorf("invalid split sticky key %q, expected ip, header:<name> or cookie:<name>", ts.StickyKey)
+	}
+	sort.Strings(ts.versions)
+	return nil
+}
+
+// pickVersion draws the version of a request to a pool
+func (ts *TrafficSplit) pickVersion(r *http.Request, poolName string) string {
+	var point int
+	if ts.StickyKey != "" {
+		point = int(hashString(poolName+"|"+requestKey(r, ts.StickyKey)) % uint64(ts.total))
+	} else {
+		point = rand.Intn(ts.total)
+	}
+	for _, version := range ts.versions {
+		if point -= ts.Weights[version]; point < 0 {
+			return version
+		}
+	}
+	return ts.versions[len(ts.versions)-1]
+}
+
+// subset narrows picks to the instances of a version, or the whole pool
+// when the version has none
+func (ts *TrafficSplit) subset(version string) *instanceSubset {
+	return &instanceSubset{
+		scope: "#version:" + version,
+		match: func(instance *ServiceInstance) bool { return instance.Version == version },
+	}
+}
+
+// split returns the traffic split of a pool, nil when it has none
+func (rt *RouteTable) split(poolName string) *TrafficSplit {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Split
+	}
+	return nil
+}
+
+// setSplit replaces the traffic split of a pool; nil removes it
+func (rt *RouteTable) setSplit(poolName string, split *TrafficSplit) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	route := &RouteConfig{}
+	if existing := rt.routes[poolName]; existing != nil {
+		copied := *existing
+		route = &copied
+	}
+	route.Split = split
+	rt.routes[poolName] = route
+}
+
+func (gw *APIGateway) getSplitHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	split := gw.routes.split(qualifiedName(namespace, mux.Vars(r)["service"]))
+	if split == nil {
+		http.Error(w, "Service has no traffic split", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(split)
+}
+
+// putSplitHandler sets a service's split or shifts its weights
+func (gw *APIGateway) putSplitHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	var split TrafficSplit
+	if err := json.NewDecoder(r.Body).Decode(&split); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := split.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gw.routes.setSplit(qualifiedName(namespace, service), &split)
+	gw.logger.Info("Traffic split updated",
+		zap.String("namespace", namespace),
+		zap.String("service", service),
+		zap.Any("weights", split.Weights),
+		zap.String("sticky_key", split.StickyKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(split)
+}
+
+func (gw *APIGateway) deleteSplitHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, err := requestNamespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service := mux.Vars(r)["service"]
+	if !gw.authorize(w, r, namespace, service) {
+		return
+	}
+
+	gw.routes.setSplit(qualifiedName(namespace, service), nil)
+	gw.logger.Info("Traffic split removed",
+		zap.String("namespace", namespace),
+		zap.String("service", service))
+	w.WriteHeader(http.StatusNoContent)
+}
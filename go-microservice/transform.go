@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// getPath returns the value at a path of a JSON object. Transforms address
+// fields by dotted path, e.g. "customer.id".
+func getPath(object map[string]interface{}, path string) (interface{}, bool) {
+	parent, key := walkPath(object, path, false)
+	if parent == nil {
+		return nil, false
+	}
+	value, exists := parent[key]
+	return value, exists
+}
+
+// setPath sets the value at a path of a JSON object, creating the objects
+// on the way that are missing
+func setPath(object map[string]interface{}, path string, value interface{}) {
+	if parent, key := walkPath(object, path, true); parent != nil {
+		parent[key] = value
+	}
+}
+
+// deletePath removes the value at a path of a JSON object and returns it
+func deletePath(object map[string]interface{}, path string) (interface{}, bool) {
+	parent, key := walkPath(object, path, false)
+	if parent == nil {
+		return nil, false
+	}
+	value, exists := parent[key]
+	delete(parent, key)
+	return value, exists
+}
+
+// walkPath returns the object holding a path's last field and the field's
+// name. It returns nil when the path runs into something other than an
+// object, or into a missing field unless create is set.
+func walkPath(object map[string]interface{}, path string, create bool) (map[string]interface{}, string) {
+	fields := strings.Split(path, ".")
+	for _, field := range fields[:len(fields)-1] {
+		next, ok := object[field].(map[string]interface{})
+		if !ok {
+			if _, exists := object[field]; exists || !create {
+				return nil, ""
+			}
+			next = make(map[string]interface{})
+			object[field] = next
+		}
+		object = next
+	}
+	return object, fields[len(fields)-1]
+}
+
+// isJSON reports whether a Content-Type is JSON
+func isJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// decodeJSON decodes a JSON body, keeping numbers as they were written
+func decodeJSON(data []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// RequestTransform adapts the JSON bodies of a service's requests before
+// they are forwarded, so a backend can keep its own field names and
+// defaults. The steps run in the order of the fields: renames, removals,
+// query parameters moved into the body, then defaults, each addressing
+// fields by their name after the steps before.
+type RequestTransform struct {
+	// Rename maps old paths to new ones
+	Rename map[string]string `json:"rename,omitempty"`
+
+	Remove []string `json:"remove,omitempty"`
+
+	// Query maps query parameters to the body paths they are moved to, as
+	// strings
+	Query map[string]string `json:"query,omitempty"`
+
+	// Defaults are set at their paths when the body has no value there
+	Defaults map[string]interface{} `json:"defaults,omitempty"`
+}
+
+func (tr *RequestTransform) validate() error {
+	paths := append([]string{}, tr.Remove...)
+	for from, to := range tr.Rename {
+		paths = append(paths, from, to)
+	}
+	for _, path := range tr.Query {
+		paths = append(paths, path)
+	}
+	for path := range tr.Defaults {
+		paths = append(paths, path)
+	}
+	return validatePaths(paths)
+}
+
+// validatePaths checks that paths have no empty fields
+func validatePaths(paths []string) error {
+	for _, path := range paths {
+		for _, field := range strings.Split(path, ".") {
+			if field == "" {
+				return fmt.Errorf("invalid field path %q", path)
+			}
+		}
+	}
+	return nil
+}
+
+// errNotJSONObject fails transforms of bodies that aren't JSON objects
+var errNotJSONObject = errors.New("request body must be a JSON object")
+
+// apply transforms a request's body, which must be a JSON object; an empty
+// one counts as {}. Bodies over maxBody fail with an *http.MaxBytesError.
+func (tr *RequestTransform) apply(r *http.Request, maxBody int64) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxBody {
+		return &http.MaxBytesError{Limit: maxBody}
+	}
+
+	body := make(map[string]interface{})
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := decodeJSON(data, &body); err != nil || body == nil {
+			return errNotJSONObject
+		}
+	}
+
+	for from, to := range tr.Rename {
+		if value, exists := deletePath(body, from); exists {
+			setPath(body, to, value)
+		}
+	}
+	for _, path := range tr.Remove {
+		deletePath(body, path)
+	}
+	if len(tr.Query) > 0 {
+		query, moved := r.URL.Query(), false
+		for param, path := range tr.Query {
+			if query.Has(param) {
+				setPath(body, path, query.Get(param))
+				query.Del(param)
+				moved = true
+			}
+		}
+		if moved {
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+	for path, value := range tr.Defaults {
+		if _, exists := getPath(body, path); !exists {
+			setPath(body, path, value)
+		}
+	}
+
+	if data, err = json.Marshal(body); err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	return nil
+}
+
+// requestTransform returns the request transform of a pool, nil when it
+// has none
+func (rt *RouteTable) requestTransform(poolName string) *RequestTransform {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.RequestTransform
+	}
+	return nil
+}
+
+// ResponseTransform reshapes the JSON bodies of a service's successful
+// responses, to keep a stable public API over a changing backend. The
+// steps run in the order of the fields: Include, Exclude and Rename on
+// object bodies, then Envelope and Template on any.
+type ResponseTransform struct {
+	// Include keeps only the fields at these paths
+	Include []string `json:"include,omitempty"`
+
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Rename maps old paths to new ones
+	Rename map[string]string `json:"rename,omitempty"`
+
+	// Envelope wraps the body in an object under this field
+	Envelope string `json:"envelope,omitempty"`
+
+	// Template renders the body with text/template, the decoded JSON as
+	// its data; its json function encodes a value, e.g.
+	// {"items": {{json .results}}, "total": {{.count}}}
+	Template string `json:"template,omitempty"`
+
+	template *template.Template
+}
+
+var responseTemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+func (tr *ResponseTransform) validate() error {
+	paths := append(append([]string{}, tr.Include...), tr.Exclude...)
+	for from, to := range tr.Rename {
+		paths = append(paths, from, to)
+	}
+	if err := validatePaths(paths); err != nil {
+		return err
+	}
+	if tr.Template != "" {
+		parsed, err := template.New("response").Funcs(responseTemplateFuncs).Option("missingkey=zero").Parse(tr.Template)
+		if err != nil {
+			return fmt.Errorf("response template: %w", err)
+		}
+		tr.template = parsed
+	}
+	return nil
+}
+
+// applies reports whether a response is transformed: a successful JSON
+// one the gateway can read
+func (tr *ResponseTransform) applies(resp *http.Response) bool {
+	return resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices &&
+		resp.StatusCode != http.StatusNoContent && isJSON(resp.Header.Get("Content-Type")) &&
+		resp.Header.Get("Content-Encoding") == ""
+}
+
+// apply transforms a response's body. Bodies over maxBody fail with
+// errResponseTooLarge.
+func (tr *ResponseTransform) apply(resp *http.Response, maxBody int64) error {
+	if resp.ContentLength > maxBody {
+		return errResponseTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxBody {
+		return errResponseTooLarge
+	}
+
+	var body interface{}
+	if err := decodeJSON(data, &body); err != nil {
+		return fmt.Errorf("decode response to transform: %w", err)
+	}
+	if object, ok := body.(map[string]interface{}); ok {
+		if len(tr.Include) > 0 {
+			included := make(map[string]interface{})
+			for _, path := range tr.Include {
+				if value, exists := getPath(object, path); exists {
+					setPath(included, path, value)
+				}
+			}
+			object = included
+		}
+		for _, path := range tr.Exclude {
+			deletePath(object, path)
+		}
+		for from, to := range tr.Rename {
+			if value, exists := deletePath(object, from); exists {
+				setPath(object, to, value)
+			}
+		}
+		body = object
+	}
+	if tr.Envelope != "" {
+		body = map[string]interface{}{tr.Envelope: body}
+	}
+
+	if tr.template != nil {
+		var rendered bytes.Buffer
+		if err := tr.template.Execute(&rendered, body); err != nil {
+			return fmt.Errorf("render response template: %w", err)
+		}
+		data = rendered.Bytes()
+	} else if data, err = json.Marshal(body); err != nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	// The body is no longer the representation the ETag names
+	resp.Header.Del("ETag")
+	return nil
+}
+
+// responseTransform returns the response transform of a pool, nil when it
+// has none
+func (rt *RouteTable) responseTransform(poolName string) *ResponseTransform {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.ResponseTransform
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errUploadStalled fails uploads that ran past their timeouts, which is up
+// to the client rather than the service
+var errUploadStalled = errors.New("upload timed out")
+
+// UploadConfig bounds how long a service's uploads may take to arrive.
+// Timeout caps the whole body and IdleTimeout the wait for more of it;
+// zero takes PROXY_UPLOAD_TIMEOUT and PROXY_UPLOAD_IDLE_TIMEOUT. Their
+// size is capped by the route's MaxRequestBody, and the route's total
+// timeout still applies, so services taking large uploads need one to
+// match.
+type UploadConfig struct {
+	Timeout     Duration `json:"timeout,omitempty"`
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+}
+
+func (uc *UploadConfig) validate() error {
+	if uc.Timeout < 0 || uc.IdleTimeout < 0 {
+		return errors.New("upload timeouts must not be negative")
+	}
+	return nil
+}
+
+// Uploads streams large request bodies to their service as they arrive,
+// through the transport's PROXY_UPLOAD_BUFFER_BYTES write buffer, rather
+// than holding them in memory. Bodies of PROXY_UPLOAD_THRESHOLD_BYTES or
+// more, or of unknown length, count as uploads: the server's read timeout,
+// meant for ordinary requests, no longer applies to them, and they are
+// bounded by their route's upload timeouts instead. The bodies the gateway
+// does buffer, for retries, mirrors, transforms and idempotency keys, are
+// bounded on their own.
+type Uploads struct {
+	threshold   int64
+	timeout     time.Duration
+	idleTimeout time.Duration
+
+	inProgress *prometheus.GaugeVec
+	bytes      *prometheus.CounterVec
+	uploads    *prometheus.CounterVec
+}
+
+func NewUploads() *Uploads {
+	u := &Uploads{
+		threshold:   int64(getEnvInt("PROXY_UPLOAD_THRESHOLD_BYTES", 1<<20)),
+		timeout:     getEnvDuration("PROXY_UPLOAD_TIMEOUT", 0),
+		idleTimeout: getEnvDuration("PROXY_UPLOAD_IDLE_TIMEOUT", 30*time.Second),
+		inProgress: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_uploads_in_progress",
+			Help: "Uploads being streamed to services",
+		}, []string{"namespace", "service"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_upload_bytes_total",
+			Help: "Bytes of uploads read from clients",
+		}, []string{"namespace", "service"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_uploads_total",
+			Help: "Uploads by outcome: complete, or aborted before the end of the body",
+		}, []string{"namespace", "service", "outcome"}),
+	}
+	prometheus.MustRegister(u.inProgress, u.bytes, u.uploads)
+	return u
+}
+
+// track makes a request's body an upload if it is large enough, replacing
+// the server's read deadline with the route's upload timeouts. The
+// function returned records the outcome once the request is done.
+func (u *Uploads) track(w http.ResponseWriter, r *http.Request, target *proxyTarget, config *UploadConfig) func() {
+	if u == nil || r.Body == http.NoBody || isUpgrade(r) || isGRPC(r) || (r.ContentLength >= 0 && r.ContentLength < u.threshold) {
+		return func() {}
+	}
+
+	timeout, idleTimeout := u.timeout, u.idleTimeout
+	if config != nil && config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout)
+	}
+	if config != nil && config.IdleTimeout > 0 {
+		idleTimeout = time.Duration(config.IdleTimeout)
+	}
+
+	body := &uploadBody{
+		ReadCloser:  r.Body,
+		controller:  http.NewResponseController(w),
+		idleTimeout: idleTimeout,
+		read:        u.bytes.WithLabelValues(target.namespace, target.serviceName),
+	}
+	if timeout > 0 {
+		body.deadline = time.Now().Add(timeout)
+	}
+	body.extend()
+	r.Body = body
+
+	inProgress := u.inProgress.WithLabelValues(target.namespace, target.serviceName)
+	inProgress.Inc()
+	return func() {
+		inProgress.Dec()
+		outcome := "aborted"
+		if body.complete.Load() {
+			outcome = "complete"
+		}
+		u.uploads.WithLabelValues(target.namespace, target.serviceName, outcome).Inc()
+	}
+}
+
+// uploadBody counts an upload's bytes as they are read and keeps pushing
+// the connection's read deadline out while they keep coming
+type uploadBody struct {
+	io.ReadCloser
+	controller  *http.ResponseController
+	idleTimeout time.Duration
+	deadline    time.Time // zero when only idleness is bounded
+	read        prometheus.Counter
+	complete    atomic.Bool // read by the handler while the transport reads the body
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read.Add(float64(n))
+	if err == io.EOF {
+		// Waiting for the response is up to the route's timeouts
+		b.complete.Store(true)
+		b.controller.SetReadDeadline(time.Time{})
+	} else if isTimeout(err) {
+		err = fmt.Errorf("%w: %w", errUploadStalled, err)
+	} else if n > 0 {
+		b.extend()
+	}
+	return n, err
+}
+
+// extend sets the read deadline to the end of the idle timeout, or of the
+// whole upload if that comes first
+func (b *uploadBody) extend() {
+	deadline := b.deadline
+	if b.idleTimeout > 0 {
+		if idle := time.Now().Add(b.idleTimeout); deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	b.controller.SetReadDeadline(deadline)
+}
+
+// upload returns the upload configuration of a pool, nil when it has none
+func (rt *RouteTable) upload(poolName string) *UploadConfig {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Upload
+	}
+	return nil
+}
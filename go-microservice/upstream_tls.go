@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamTLSSecretPrefix restricts the environment variables upstream TLS
+// material can be read from, as for health check secrets
+const upstreamTLSSecretPrefix = "UPSTREAM_TLS_SECRET_"
+
+// UpstreamTLS makes the gateway speak HTTPS to a service's instances.
+// CA, Cert and Key are PEM sources: a file path, "env:NAME" for an
+// UPSTREAM_TLS_SECRET_* environment variable holding the PEM itself, or
+// "vault:path#field" for a field of a Vault KV secret. Files, such as
+// those a secrets manager mounts and rotates, and Vault secrets are read
+// again every UPSTREAM_TLS_RELOAD_INTERVAL when they have changed, so
+// rotated certificates are used for new connections without a restart.
+type UpstreamTLS struct {
+	CA string `json:"ca,omitempty"` // bundle to trust instead of the system roots
+
+	// Cert and Key are the client certificate presented for mutual TLS
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// ServerName is sent as SNI and verified against the instance's
+	// certificate; by default the instance address is, so certificates
+	// need it among their IP SANs
+	ServerName string `json:"server_name,omitempty"`
+
+	SkipVerify bool `json:"skip_verify,omitempty"` // for development only
+}
+
+func (ut *UpstreamTLS) validate() error {
+	if (ut.Cert == "") != (ut.Key == "") {
+		return errors.New("upstream TLS cert and key go together")
+	}
+	for _, source := range []string{ut.CA, ut.Cert, ut.Key} {
+		if name, ok := strings.CutPrefix(source, "env:"); ok && !strings.HasPrefix(name, upstreamTLSSecretPrefix) {
+			return fmt.Errorf("upstream TLS secret %s must start with %s", name, upstreamTLSSecretPrefix)
+		}
+	}
+	_, err := loadUpstreamTLS(*ut)
+	return err
+}
+
+// upstreamTLSMaterial is the loaded material of an upstream TLS
+// configuration
+type upstreamTLSMaterial struct {
+	certificate *tls.Certificate // nil without a client certificate
+	roots       *x509.CertPool   // nil for the system roots
+	revisions   map[string]string
+}
+
+// upstreamVault reads the vault: sources of upstream TLS configurations.
+// It is set at startup, before routes are loaded.
+var upstreamVault *Vault
+
+// readTLSSource returns the PEM of a source, and its revision: the
+// modification time of its file, or the version of its Vault secret
+func readTLSSource(source string) ([]byte, string, error) {
+	if name, ok := strings.CutPrefix(source, "env:"); ok {
+		value := os.Getenv(name)
+		if value == "" {
+			return nil, "", fmt.Errorf("upstream TLS secret %s is not set", name)
+		}
+		return []byte(value), "", nil
+	}
+	if reference, ok := strings.CutPrefix(source, "vault:"); ok {
+		if upstreamVault == nil {
+			return nil, "", fmt.Errorf("upstream TLS source %s needs VAULT_ADDR", source)
+		}
+		value, version, err := upstreamVault.readKVField(reference)
+		return []byte(value), strconv.Itoa(version), err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(source)
+	return data, info.ModTime().String(), err
+}
+
+// tlsSourceRevision returns the current revision of a source
+func tlsSourceRevision(source string) (string, error) {
+	if reference, ok := strings.CutPrefix(source, "vault:"); ok && upstreamVault != nil {
+		_, version, err := upstreamVault.readKVField(reference)
+		return strconv.Itoa(version), err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", err
+	}
+	return info.ModTime().String(), nil
+}
+
+func loadUpstreamTLS(config UpstreamTLS) (*upstreamTLSMaterial, error) {
+	material := &upstreamTLSMaterial{revisions: make(map[string]string)}
+
+	if config.CA != "" {
+		data, revision, err := readTLSSource(config.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream CA: %w", err)
+		}
+		material.roots = x509.NewCertPool()
+		if !material.roots.AppendCertsFromPEM(data) {
+			return nil, errors.New("upstream CA contains no PEM certificates")
+		}
+		material.revisions[config.CA] = revision
+	}
+
+	if config.Cert != "" {
+		cert, certRevision, err := readTLSSource(config.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream client certificate: %w", err)
+		}
+		key, keyRevision, err := readTLSSource(config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream client key: %w", err)
+		}
+		certificate, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("upstream client certificate: %w", err)
+		}
+		material.certificate = &certificate
+		material.revisions[config.Cert] = certRevision
+		material.revisions[config.Key] = keyRevision
+	}
+	return material, nil
+}
+
+// changed reports whether any file or Vault secret the material was read
+// from has been modified, or is gone
+func (m *upstreamTLSMaterial) changed() bool {
+	for source, revision := range m.revisions {
+		if strings.HasPrefix(source, "env:") {
+			continue
+		}
+		current, err := tlsSourceRevision(source)
+		if err != nil || current != revision {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamTLSSource hands out the current material of a configuration,
+// reloading it at most every interval. A reload that fails keeps the
+// material already loaded, so a rotation caught half-written doesn't break
+// new connections.
+type upstreamTLSSource struct {
+	config   UpstreamTLS
+	interval time.Duration
+	reloaded func(err error)
+
+	material *upstreamTLSMaterial
+	err      error // of the first load, while there is no material
+	checked  time.Time
+	mutex    sync.Mutex
+}
+
+func (s *upstreamTLSSource) current() (*upstreamTLSMaterial, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.checked.IsZero() && time.Since(s.checked) < s.interval {
+		return s.material, s.err
+	}
+	s.checked = time.Now()
+	if s.material != nil && !s.material.changed() {
+		return s.material, nil
+	}
+
+	material, err := loadUpstreamTLS(s.config)
+	s.reloaded(err)
+	if err != nil {
+		if s.material == nil {
+			s.err = err
+		}
+		return s.material, s.err
+	}
+	s.material, s.err = material, nil
+	return material, nil
+}
+
+// tlsConfig returns the client configuration of the source's connections.
+// Verification happens in VerifyConnection rather than through RootCAs so
+// a reloaded CA applies to the next handshake.
+func (s *upstreamTLSSource) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		ServerName:         s.config.ServerName,
+		InsecureSkipVerify: true,
+	}
+	if !s.config.SkipVerify {
+		config.VerifyConnection = s.verify
+	}
+	if s.config.Cert != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			material, err := s.current()
+			if err != nil {
+				return nil, err
+			}
+			return material.certificate, nil
+		}
+	}
+	return config
+}
+
+// verify checks an instance's certificate chain and name against the
+// current roots
+func (s *upstreamTLSSource) verify(state tls.ConnectionState) error {
+	material, err := s.current()
+	if err != nil {
+		return err
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("upstream presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         material.roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// upstreamTLS returns the TLS configuration of a pool's instances, nil when
+// they are spoken to in cleartext
+func (rt *RouteTable) upstreamTLS(poolName string) *UpstreamTLS {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.TLS
+	}
+	return nil
+}
+
+// upstreamScheme returns the URL scheme of requests to instances with a
+// TLS configuration
+func upstreamScheme(config *UpstreamTLS) string {
+	if config != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// vaultTimeout bounds a single call to Vault
+	vaultTimeout = 10 * time.Second
+
+	// vaultRetryInterval is how soon a failed login or certificate renewal
+	// is tried again
+	vaultRetryInterval = 30 * time.Second
+)
+
+// Vault reads the gateway's secrets from HashiCorp Vault rather than from
+// files or the environment. The client takes VAULT_ADDR, VAULT_CACERT and
+// VAULT_NAMESPACE as the Vault CLI does, and logs in with VAULT_TOKEN, or
+// with AppRole when VAULT_ROLE_ID and VAULT_SECRET_ID are set
+// (VAULT_APPROLE_MOUNT, "approle" by default). The token is renewed for as
+// long as Vault allows, and AppRole logs in again when it can't be.
+//
+// Secrets are read from the KV version 2 engine at VAULT_KV_MOUNT,
+// "secret" by default, and checked for new versions every
+// VAULT_REFRESH_INTERVAL so rotated secrets take effect without a restart.
+// Certificates may instead be issued by the PKI engine at VAULT_PKI_MOUNT,
+// and are issued again when two thirds of their lifetime has passed.
+type Vault struct {
+	client    *vault.Client
+	kvMount   string
+	pkiMount  string
+	refresh   time.Duration
+	appRoleID string
+	appSecret string
+	appMount  string
+
+	failures *prometheus.CounterVec
+	logger   *zap.Logger
+}
+
+// NewVault returns nil when VAULT_ADDR is not set
+func NewVault(logger *zap.Logger) (*Vault, error) {
+	if getEnv("VAULT_ADDR", "") == "" {
+		return nil, nil
+	}
+	config := vault.DefaultConfig()
+	if config.Error != nil {
+		return nil, fmt.Errorf("configure Vault client: %w", config.Error)
+	}
+	config.Timeout = vaultTimeout
+	client, err := vault.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("create Vault client: %w", err)
+	}
+
+	v := &Vault{
+		client:    client,
+		kvMount:   getEnv("VAULT_KV_MOUNT", "secret"),
+		pkiMount:  getEnv("VAULT_PKI_MOUNT", "pki"),
+		refresh:   getEnvDuration("VAULT_REFRESH_INTERVAL", time.Minute),
+		appRoleID: getEnv("VAULT_ROLE_ID", ""),
+		appSecret: getEnv("VAULT_SECRET_ID", ""),
+		appMount:  getEnv("VAULT_APPROLE_MOUNT", "approle"),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vault_failures_total",
+			Help: "Failed calls to Vault, by operation: login, renew, read or issue",
+		}, []string{"operation"}),
+		logger: logger,
+	}
+	if v.refresh <= 0 {
+		return nil, errors.New("VAULT_REFRESH_INTERVAL must be positive")
+	}
+
+	var auth *vault.Secret
+	if v.appRoleID != "" {
+		if auth, err = v.login(); err != nil {
+			return nil, err
+		}
+	} else {
+		if client.Token() == "" {
+			return nil, errors.New("Vault needs VAULT_TOKEN, or VAULT_ROLE_ID and VAULT_SECRET_ID")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+		defer cancel()
+		auth, err = client.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err != nil {
+			// Root and other periodic-less tokens can't be renewed, and
+			// don't need to be
+			logger.Info("Vault token is not renewable", zap.Error(err))
+			auth = nil
+		}
+	}
+	prometheus.MustRegister(v.failures)
+	go v.keepLoggedIn(auth)
+
+	logger.Info("Vault secrets enabled",
+		zap.String("address", client.Address()),
+		zap.String("kv_mount", v.kvMount),
+		zap.Bool("approle", v.appRoleID != ""))
+	return v, nil
+}
+
+// login logs in with AppRole, switching the client to the new token
+func (v *Vault) login() (*vault.Secret, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	secret, err := v.client.Logical().WriteWithContext(ctx, "auth/"+v.appMount+"/login", map[string]interface{}{
+		"role_id":   v.appRoleID,
+		"secret_id": v.appSecret,
+	})
+	if err != nil {
+		v.failures.WithLabelValues("login").Inc()
+		return nil, fmt.Errorf("Vault AppRole login: %w", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		v.failures.WithLabelValues("login").Inc()
+		return nil, errors.New("Vault AppRole login returned no token")
+	}
+	v.client.SetToken(secret.Auth.ClientToken)
+	return secret, nil
+}
+
+// keepLoggedIn renews the client's token until Vault won't any longer,
+// then logs in again with AppRole. AppRole tokens that can't be renewed,
+// such as batch tokens, are replaced two thirds into their TTL. Static
+// tokens that run out are logged, as only an operator can replace them.
+func (v *Vault) keepLoggedIn(auth *vault.Secret) {
+	for {
+		if auth != nil && auth.Auth != nil && auth.Auth.Renewable {
+			watcher, err := v.client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: auth})
+			if err != nil {
+				v.logger.Error("Failed to watch Vault token", zap.Error(err))
+				return
+			}
+			go watcher.Start()
+		renewals:
+			for {
+				select {
+				case err := <-watcher.DoneCh():
+					if err != nil {
+						v.failures.WithLabelValues("renew").Inc()
+						v.logger.Warn("Vault token renewal stopped", zap.Error(err))
+					}
+					break renewals
+				case <-watcher.RenewCh():
+					v.logger.Debug("Vault token renewed")
+				}
+			}
+			watcher.Stop()
+		} else if auth != nil && auth.Auth != nil && v.appRoleID != "" {
+			ttl := time.Duration(auth.Auth.LeaseDuration) * time.Second
+			if ttl <= 0 {
+				return
+			}
+			time.Sleep(ttl * 2 / 3)
+		}
+		if v.appRoleID == "" {
+			if auth != nil {
+				v.logger.Error("Vault token can no longer be renewed, replace VAULT_TOKEN before it expires")
+			}
+			return
+		}
+
+		var err error
+		if auth, err = v.login(); err != nil {
+			v.logger.Error("Failed to log in to Vault, retrying", zap.Error(err))
+			auth = nil
+			time.Sleep(vaultRetryInterval)
+		}
+	}
+}
+
+// check reports whether Vault is reachable and unsealed
+func (v *Vault) check(ctx context.Context) error {
+	health, err := v.client.Sys().HealthWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Sealed {
+		return errors.New("Vault is sealed")
+	}
+	return nil
+}
+
+// readKV returns the latest version of a KV secret
+func (v *Vault) readKV(path string) (*vault.KVSecret, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	secret, err := v.client.KVv2(v.kvMount).Get(ctx, path)
+	if err != nil {
+		v.failures.WithLabelValues("read").Inc()
+		return nil, fmt.Errorf("read Vault secret %s: %w", path, err)
+	}
+	return secret, nil
+}
+
+// readKVField returns a string field of a KV secret, named as
+// "path#field"
+func (v *Vault) readKVField(reference string) (string, int, error) {
+	path, field, found := strings.Cut(reference, "#")
+	if !found || path == "" || field == "" {
+		return "", 0, fmt.Errorf("Vault reference %q needs the form path#field", reference)
+	}
+	secret, err := v.readKV(path)
+	if err != nil {
+		return "", 0, err
+	}
+	value, ok := secret.Data[field].(string)
+	if !ok {
+		return "", 0, fmt.Errorf("Vault secret %s has no string field %s", path, field)
+	}
+	return value, kvVersion(secret), nil
+}
+
+// kvVersion returns the version of a KV secret, 0 when Vault didn't say
+func kvVersion(secret *vault.KVSecret) int {
+	if secret.VersionMetadata == nil {
+		return 0
+	}
+	return secret.VersionMetadata.Version
+}
+
+// watchKV hands the data of a KV secret to apply, now and whenever a new
+// version is written. Only the first apply failing is an error; later
+// versions that don't apply are logged and the one in use is kept.
+func (v *Vault) watchKV(path string, apply func(data map[string]interface{}) error) error {
+	secret, err := v.readKV(path)
+	if err != nil {
+		return err
+	}
+	if err := apply(secret.Data); err != nil {
+		return fmt.Errorf("Vault secret %s: %w", path, err)
+	}
+	version := kvVersion(secret)
+
+	go func() {
+		for range time.Tick(v.refresh) {
+			secret, err := v.readKV(path)
+			if err != nil {
+				v.logger.Warn("Failed to refresh Vault secret", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			if kvVersion(secret) == version {
+				continue
+			}
+			if err := apply(secret.Data); err != nil {
+				v.logger.Error("Rotated Vault secret doesn't apply, keeping the previous version",
+					zap.String("path", path),
+					zap.Int("version", kvVersion(secret)),
+					zap.Error(err))
+			} else {
+				v.logger.Info("Vault secret rotated",
+					zap.String("path", path),
+					zap.Int("version", kvVersion(secret)))
+			}
+			version = kvVersion(secret)
+		}
+	}()
+	return nil
+}
+
+// decodeKVData decodes the data of a KV secret into a configuration
+// struct, as if it had been read from a JSON file
+func decodeKVData(data map[string]interface{}, into interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, into)
+}
+
+// kvCertificate parses a certificate kept in a KV secret, as the PEM
+// fields "certificate" and "private_key"
+func kvCertificate(data map[string]interface{}) (*tls.Certificate, error) {
+	cert, _ := data["certificate"].(string)
+	key, _ := data["private_key"].(string)
+	if cert == "" || key == "" {
+		return nil, errors.New("certificate secrets need certificate and private_key fields")
+	}
+	certificate, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// issueCertificate has the PKI engine issue a certificate for a role
+func (v *Vault) issueCertificate(role, commonName string, altNames []string, ttl time.Duration) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	request := map[string]interface{}{"common_name": commonName}
+	if len(altNames) > 0 {
+		request["alt_names"] = strings.Join(altNames, ",")
+	}
+	if ttl > 0 {
+		request["ttl"] = ttl.String()
+	}
+	secret, err := v.client.Logical().WriteWithContext(ctx, v.pkiMount+"/issue/"+role, request)
+	if err != nil {
+		v.failures.WithLabelValues("issue").Inc()
+		return nil, fmt.Errorf("issue certificate from Vault: %w", err)
+	}
+	if secret == nil {
+		v.failures.WithLabelValues("issue").Inc()
+		return nil, errors.New("Vault issued no certificate")
+	}
+
+	cert, _ := secret.Data["certificate"].(string)
+	key, _ := secret.Data["private_key"].(string)
+	if chain, ok := secret.Data["ca_chain"].([]interface{}); ok {
+		for _, ca := range chain {
+			if pem, ok := ca.(string); ok {
+				cert += "\n" + pem
+			}
+		}
+	} else if ca, ok := secret.Data["issuing_ca"].(string); ok {
+		cert += "\n" + ca
+	}
+	certificate, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("certificate issued by Vault: %w", err)
+	}
+	if certificate.Leaf == nil {
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &certificate, nil
+}
+
+// rotateCertificate issues a certificate and hands it to store, then
+// issues the next one when two thirds of its lifetime has passed. Failed
+// renewals are retried, the current certificate staying in use meanwhile.
+func (v *Vault) rotateCertificate(role, commonName string, altNames []string, ttl time.Duration, store func(*tls.Certificate)) error {
+	certificate, err := v.issueCertificate(role, commonName, altNames, ttl)
+	if err != nil {
+		return err
+	}
+	store(certificate)
+
+	go func() {
+		for {
+			leaf := certificate.Leaf
+			time.Sleep(time.Until(leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)))
+			next, err := v.issueCertificate(role, commonName, altNames, ttl)
+			for err != nil {
+				v.logger.Error("Failed to renew Vault certificate, retrying",
+					zap.String("common_name", commonName),
+					zap.Time("expires", leaf.NotAfter),
+					zap.Error(err))
+				time.Sleep(vaultRetryInterval)
+				next, err = v.issueCertificate(role, commonName, altNames, ttl)
+			}
+			certificate = next
+			store(certificate)
+			v.logger.Info("Vault certificate renewed",
+				zap.String("common_name", commonName),
+				zap.Time("expires", certificate.Leaf.NotAfter))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Inspection modes, of WAF_MODE and InspectionConfig.Mode
+const (
+	inspectionOff   = "off"
+	inspectionLog   = "log"
+	inspectionBlock = "block"
+)
+
+// Parts of a request inspection rules look at
+const (
+	inspectPath    = "path"
+	inspectQuery   = "query"
+	inspectHeaders = "headers"
+	inspectBody    = "body"
+)
+
+// InspectionConfig sets how a service's requests are inspected. Mode is
+// "off", "log", which only logs and counts matches for tuning rules, or
+// "block"; empty takes WAF_MODE. SkipRules lists the ids of rules that
+// don't apply to the service, such as "xss-tag" for a service taking HTML.
+type InspectionConfig struct {
+	Mode      string   `json:"mode,omitempty"`
+	SkipRules []string `json:"skip_rules,omitempty"`
+}
+
+func (ic *InspectionConfig) validate() error {
+	switch ic.Mode {
+	case "", inspectionOff, inspectionLog, inspectionBlock:
+		return nil
+	}
+	return fmt.Errorf("unknown inspection mode %q", ic.Mode)
+}
+
+// InspectionRule refuses requests whose Targets match Pattern. Targets are
+// "path", "query", "headers" and "body", all of them by default.
+type InspectionRule struct {
+	ID          string   `json:"id"`
+	Description string   `json:"description,omitempty"`
+	Targets     []string `json:"targets,omitempty"`
+	Pattern     string   `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+func (ir *InspectionRule) validate() error {
+	if ir.ID == "" {
+		return errors.New("inspection rules need an id")
+	}
+	for _, target := range ir.Targets {
+		switch target {
+		case inspectPath, inspectQuery, inspectHeaders, inspectBody:
+		default:
+			return fmt.Errorf("inspection rule %q: unknown target %q", ir.ID, target)
+		}
+	}
+	pattern, err := regexp.Compile(ir.Pattern)
+	if err != nil {
+		return fmt.Errorf("inspection rule %q: %w", ir.ID, err)
+	}
+	ir.pattern = pattern
+	return nil
+}
+
+func (ir *InspectionRule) inspects(target string) bool {
+	return len(ir.Targets) == 0 || slices.Contains(ir.Targets, target)
+}
+
+// builtinInspectionRules catch the obvious SQL injection, cross-site
+// scripting and path traversal attempts. They are patterns rather than
+// parsers, so they miss what's well obfuscated and are a first line only.
+var builtinInspectionRules = []*InspectionRule{
+	{ID: "sqli-union", Description: "UNION SELECT", Pattern: `(?i)\bunion\b(\s|/\*.*?\*/)+(all\s+|distinct\s+)?select\b`},
+	{ID: "sqli-tautology", Description: "Quoted always-true condition", Pattern: `(?i)['"]\s*\)?\s*(or|and)\s+['"]?[\w.]+['"]?\s*(=|like)\s*['"]?[\w.]+`},
+	{ID: "sqli-stacked", Description: "Stacked or commented-out statement", Pattern: `(?i)['";]\s*(drop|delete|insert|update|alter|truncate|exec|shutdown)\s|'\s*(--|#|/\*)`},
+	{ID: "sqli-functions", Description: "Timing and file functions", Pattern: `(?i)\b(sleep|benchmark|pg_sleep|load_file)\s*\(|\bwaitfor\s+delay\b|\binto\s+(out|dump)file\b`},
+	{ID: "xss-tag", Description: "Script-capable HTML tag", Pattern: `(?i)<\s*/?\s*(script|iframe|object|embed|svg|applet|meta|base)\b`},
+	{ID: "xss-handler", Description: "Inline event handler", Pattern: `(?i)<[^>]*\bon[a-z]+\s*=`},
+	{ID: "xss-uri", Description: "Script URI", Pattern: `(?i)\b(javascript|vbscript)\s*:|\bdata\s*:\s*text/html`},
+	{ID: "path-traversal", Description: "Parent directory or NUL byte", Targets: []string{inspectPath, inspectQuery, inspectBody}, Pattern: `(^|[/\\])\.\.([/\\]|$)|\x00`},
+	{ID: "path-sensitive", Description: "Well-known system file", Targets: []string{inspectPath, inspectQuery, inspectBody}, Pattern: `(?i)(/etc/(passwd|shadow)|\bboot\.ini\b|\bwin\.ini\b|/proc/self/)`},
+}
+
+// uninspectedHeaders carry credentials and opaque values that are no use
+// to match and would only be written to the logs
+var uninspectedHeaders = []string{"Authorization", "Cookie", "X-Registry-Token", signatureHeader}
+
+// Inspector refuses proxied requests that look like attacks before they
+// reach a backend. WAF_MODE sets the mode of services whose route doesn't
+// set one, "off" by default. Rules are the built-in ones, less those
+// listed in WAF_DISABLED_RULES, and those of WAF_RULES_FILE:
+//
+//	{"rules": [{"id": "no-admin", "targets": ["path"], "pattern": "^/admin"}]}
+//
+// Values are URL-decoded, twice to catch double encoding, before they are
+// matched. JSON and form bodies are inspected value by value and other
+// bodies as a whole, except binary ones (uploads, media) which pass
+// uninspected. Bodies over WAF_MAX_BODY_BYTES are refused with 413 in block
+// mode and pass uninspected otherwise.
+type Inspector struct {
+	mode    string
+	rules   []*InspectionRule
+	maxBody int64
+
+	forwarded *ForwardedHeaders
+	matches   *prometheus.CounterVec
+	logger    *zap.Logger
+}
+
+func NewInspector(forwarded *ForwardedHeaders, logger *zap.Logger) (*Inspector, error) {
+	in := &Inspector{
+		mode:      getEnv("WAF_MODE", inspectionOff),
+		maxBody:   int64(getEnvInt("WAF_MAX_BODY_BYTES", 1<<20)),
+		forwarded: forwarded,
+		matches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "waf_rule_matches_total",
+			Help: "Proxied requests matching an inspection rule, by action: logged or blocked",
+		}, []string{"namespace", "service", "rule", "action"}),
+		logger: logger,
+	}
+	if err := (&InspectionConfig{Mode: in.mode}).validate(); err != nil {
+		return nil, fmt.Errorf("WAF_MODE: %w", err)
+	}
+
+	disabled := getEnvList("WAF_DISABLED_RULES", nil)
+	for _, rule := range builtinInspectionRules {
+		if slices.Contains(disabled, rule.ID) {
+			continue
+		}
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		in.rules = append(in.rules, rule)
+	}
+
+	if file := getEnv("WAF_RULES_FILE", ""); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read WAF rules: %w", err)
+		}
+		var config struct {
+			Rules []*InspectionRule `json:"rules"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("decode WAF rules: %w", err)
+		}
+		for _, rule := range config.Rules {
+			if err := rule.validate(); err != nil {
+				return nil, err
+			}
+			in.rules = append(in.rules, rule)
+		}
+		logger.Info("WAF rules loaded",
+			zap.String("file", file),
+			zap.Int("rules", len(config.Rules)))
+	}
+
+	prometheus.MustRegister(in.matches)
+	return in, nil
+}
+
+// inspect matches a request to a service against the rules, answering
+// with 403 and returning false when a rule matches in block mode. An
+// inspected body is left buffered in its place.
+func (in *Inspector) inspect(w http.ResponseWriter, r *http.Request, target *proxyTarget, config *InspectionConfig) bool {
+	mode := in.mode
+	var skip []string
+	if config != nil {
+		if config.Mode != "" {
+			mode = config.Mode
+		}
+		skip = config.SkipRules
+	}
+	if mode == inspectionOff {
+		return true
+	}
+
+	values := map[string][]string{
+		inspectPath:  {decodeInspected(r.URL.EscapedPath(), url.PathUnescape)},
+		inspectQuery: {decodeInspected(r.URL.RawQuery, url.QueryUnescape)},
+	}
+	for name, headerValues := range r.Header {
+		if !slices.Contains(uninspectedHeaders, name) {
+			values[inspectHeaders] = append(values[inspectHeaders], headerValues...)
+		}
+	}
+	body, err := in.bodyValues(r)
+	if errors.Is(err, errBodyTooLargeToInspect) {
+		if mode == inspectionBlock {
+			rejectTooLarge(w, in.maxBody)
+			return false
+		}
+		err = nil
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			rejectTooLarge(w, tooLarge.Limit)
+			return false
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return false
+	}
+	values[inspectBody] = body
+
+	for _, rule := range in.rules {
+		if slices.Contains(skip, rule.ID) {
+			continue
+		}
+		part, matched := rule.match(values)
+		if !matched {
+			continue
+		}
+		action := "logged"
+		if mode == inspectionBlock {
+			action = "blocked"
+		}
+		in.matches.WithLabelValues(target.namespace, target.serviceName, rule.ID, action).Inc()
+		in.logger.Warn("Request matched an inspection rule",
+			zap.String("service", target.serviceName),
+			zap.String("rule", rule.ID),
+			zap.String("target", part),
+			zap.String("action", action),
+			zap.String("client_ip", in.forwarded.ClientIP(r)),
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path))
+		if mode == inspectionBlock {
+			http.Error(w, "Request blocked", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the first part of a request whose values the rule matches
+func (ir *InspectionRule) match(values map[string][]string) (string, bool) {
+	for _, part := range []string{inspectPath, inspectQuery, inspectHeaders, inspectBody} {
+		if !ir.inspects(part) {
+			continue
+		}
+		for _, value := range values[part] {
+			if ir.pattern.MatchString(value) {
+				return part, true
+			}
+		}
+	}
+	return "", false
+}
+
+// errBodyTooLargeToInspect reports a body over the inspection limit, which
+// bodyValues leaves unread for the backend
+var errBodyTooLargeToInspect = errors.New("request body exceeds the inspection limit")
+
+// uninspectedBody reports whether a content type is binary, so there is no
+// text to match in it
+func uninspectedBody(contentType string) bool {
+	if contentType == "application/octet-stream" {
+		return true
+	}
+	for _, prefix := range []string{"multipart/", "image/", "audio/", "video/", "font/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyValues returns the values and keys of a JSON or form body, or other
+// bodies whole, putting the body back for the backend. Binary bodies have
+// none.
+func (in *Inspector) bodyValues(r *http.Request) ([]string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if uninspectedBody(contentType) {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, in.maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > in.maxBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return nil, errBodyTooLargeToInspect
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	// Forms and other text are matched whole, URL-decoded like the query
+	if !isJSON(contentType) {
+		return []string{decodeInspected(string(data), url.QueryUnescape)}, nil
+	}
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		// Left for the backend to refuse
+		return []string{string(data)}, nil
+	}
+	var values []string
+	collectJSONStrings(document, &values)
+	for i, value := range values {
+		values[i] = decodeInspected(value, url.QueryUnescape)
+	}
+	return values, nil
+}
+
+// collectJSONStrings gathers the strings and object keys of a JSON document
+func collectJSONStrings(value interface{}, values *[]string) {
+	switch value := value.(type) {
+	case string:
+		*values = append(*values, value)
+	case []interface{}:
+		for _, element := range value {
+			collectJSONStrings(element, values)
+		}
+	case map[string]interface{}:
+		for key, element := range value {
+			*values = append(*values, key)
+			collectJSONStrings(element, values)
+		}
+	}
+}
+
+// decodeInspected URL-decodes a value up to twice, keeping the last form
+// that decoded
+func decodeInspected(value string, unescape func(string) (string, error)) string {
+	for i := 0; i < 2 && strings.Contains(value, "%"); i++ {
+		decoded, err := unescape(value)
+		if err != nil {
+			break
+		}
+		value = decoded
+	}
+	return value
+}
+
+// inspection returns a pool's inspection settings, nil when it has none of
+// its own
+func (rt *RouteTable) inspection(poolName string) *InspectionConfig {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	if route := rt.routes[poolName]; route != nil {
+		return route.Inspection
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookWorkers    = 4
+	webhookQueueSize  = 1000
+	webhookMaxBackoff = time.Minute
+)
+
+// Registry events a webhook can subscribe to, mapped from change log types
+var webhookEvents = map[string]string{
+	"registered":     "service_registered",
+	"deregistered":   "service_deregistered",
+	"status_changed": "health_changed",
+}
+
+// Webhook is an operator-registered HTTP callback for registry events.
+// Every webhook has a secret; one is generated when the operator doesn't
+// supply it and returned once, in the create response.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookPayload is the signed JSON body POSTed to webhooks
+type WebhookPayload struct {
+	Event     string          `json:"event"`
+	Timestamp time.Time       `json:"timestamp"`
+	Service   ServiceInstance `json:"service"`
+
+	// Set for health_changed events
+	PreviousStatus string `json:"previous_status,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+type webhookDelivery struct {
+	webhook Webhook
+	payload WebhookPayload
+}
+
+// WebhookManager follows the registry change log and delivers matching
+// events to webhooks. Payloads are signed with HMAC-SHA256 over
+// "<timestamp>.<body>" using the webhook secret and retried with
+// exponential backoff.
+type WebhookManager struct {
+	registry    *ServiceRegistry
+	hooks       map[string]*Webhook
+	mutex       sync.RWMutex
+	client      *http.Client
+	queue       chan webhookDelivery
+	maxAttempts int
+	logger      *zap.Logger
+}
+
+func NewWebhookManager(registry *ServiceRegistry, logger *zap.Logger) *WebhookManager {
+	return &WebhookManager{
+		registry:    registry,
+		hooks:       make(map[string]*Webhook),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan webhookDelivery, webhookQueueSize),
+		maxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		logger:      logger,
+	}
+}
+
+// Run starts the delivery workers and dispatches registry changes
+func (wm *WebhookManager) Run(ctx context.Context) {
+	for i := 0; i < webhookWorkers; i++ {
+		go wm.worker(ctx)
+	}
+
+	_, index, _ := wm.registry.ChangesSince(0)
+	for ctx.Err() == nil {
+		wm.registry.WaitForChange(ctx, index, time.Minute)
+
+		changes, current, reset := wm.registry.ChangesSince(index)
+		if reset {
+			wm.logger.Warn("Webhook dispatcher fell behind the registry change log")
+		}
+		index = current
+
+		for _, change := range changes {
+			if event, ok := webhookEvents[change.Type]; ok {
+				wm.dispatch(WebhookPayload{
+					Event:     event,
+					Timestamp: time.Now(),
+					Service:   change.Service,
+
+					PreviousStatus: change.PreviousStatus,
+					Reason:         change.Reason,
+				})
+			}
+		}
+	}
+}
+
+func (wm *WebhookManager) dispatch(payload WebhookPayload) {
+	wm.mutex.RLock()
+	defer wm.mutex.RUnlock()
+
+	for _, hook := range wm.hooks {
+		if !hook.subscribed(payload.Event) {
+			continue
+		}
+		select {
+		case wm.queue <- webhookDelivery{webhook: *hook, payload: payload}:
+		default:
+			wm.logger.Warn("Webhook queue full, dropping delivery",
+				zap.String("webhook", hook.ID),
+				zap.String("event", payload.Event))
+		}
+	}
+}
+
+func (h *Webhook) subscribed(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (wm *WebhookManager) worker(ctx context.Context) {
+	for {
+		select {
+		case delivery := <-wm.queue:
+			wm.deliver(ctx, delivery)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver POSTs a payload, retrying with exponential backoff
+func (wm *WebhookManager) deliver(ctx context.Context, delivery webhookDelivery) {
+	body, err := json.Marshal(delivery.payload)
+	if err != nil {
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; attempt <= wm.maxAttempts; attempt++ {
+		err = wm.post(ctx, &delivery.webhook, delivery.payload.Event, body)
+		if err == nil {
+			return
+		}
+
+		wm.logger.Warn("Webhook delivery failed",
+			zap.String("webhook", delivery.webhook.ID),
+			zap.String("event", delivery.payload.Event),
+			zap.Int("attempt", attempt),
+			zap.Error(err))
+
+		if attempt == wm.maxAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+
+	wm.logger.Error("Webhook delivery abandoned",
+		zap.String("webhook", delivery.webhook.ID),
+		zap.String("event", delivery.payload.Event))
+}
+
+func (wm *WebhookManager) post(ctx context.Context, hook *Webhook, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-DevToolkit-Event", event)
+	req.Header.Set("X-DevToolkit-Timestamp", timestamp)
+	req.Header.Set("X-DevToolkit-Signature", "sha256="+signWebhook(hook.Secret, timestamp, body))
+
+	resp, err := wm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return "wh-" + hex.EncodeToString(buf)
+}
+
+func (wm *WebhookManager) createHandler(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if target, err := url.Parse(hook.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "A valid http(s) url is required", http.StatusBadRequest)
+		return
+	}
+	for _, event := range hook.Events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("Unknown event %q", event), http.StatusBadRequest)
+			return
+		}
+	}
+
+	generated := hook.Secret == ""
+	if generated {
+		secret, err := randomString()
+		if err != nil {
+			http.Error(w, "Failed to generate webhook secret", http.StatusInternalServerError)
+			return
+		}
+		hook.Secret = secret
+	}
+
+	hook.ID = newWebhookID()
+	hook.CreatedAt = time.Now()
+
+	wm.mutex.Lock()
+	wm.hooks[hook.ID] = &hook
+	wm.mutex.Unlock()
+
+	wm.logger.Info("Webhook registered",
+		zap.String("id", hook.ID),
+		zap.String("url", hook.URL),
+		zap.Strings("events", hook.Events))
+
+	// Only a generated secret is shown, as the operator has no other way
+	// to learn it
+	response := hook
+	if !generated {
+		response.Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (wm *WebhookManager) listHandler(w http.ResponseWriter, r *http.Request) {
+	wm.mutex.RLock()
+	hooks := make([]Webhook, 0, len(wm.hooks))
+	for _, hook := range wm.hooks {
+		redacted := *hook
+		redacted.Secret = ""
+		hooks = append(hooks, redacted)
+	}
+	wm.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+func (wm *WebhookManager) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	wm.mutex.Lock()
+	_, exists := wm.hooks[id]
+	delete(wm.hooks, id)
+	wm.mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// websocketSendBuffer is how many messages may queue for a client
+	// before it is considered too slow and disconnected
+	websocketSendBuffer = 32
+	// websocketWriteTimeout bounds a single write to a client
+	websocketWriteTimeout = 10 * time.Second
+)
+
+// websocketClient is a connected WebSocket client. Only its writer
+// goroutine writes to the connection; everyone else queues messages, so a
+// slow client never holds up the others or the registry.
+type websocketClient struct {
+	id     string
+	conn   *websocket.Conn
+	send   chan interface{}
+	logger *zap.Logger
+}
+
+func newWebsocketClient(id string, conn *websocket.Conn, logger *zap.Logger) *websocketClient {
+	client := &websocketClient{
+		id:     id,
+		conn:   conn,
+		send:   make(chan interface{}, websocketSendBuffer),
+		logger: logger,
+	}
+	go client.writeMessages()
+	return client
+}
+
+// queue hands a message to the writer. A client whose queue is full is
+// disconnected rather than waited for.
+func (c *websocketClient) queue(message interface{}) {
+	select {
+	case c.send <- message:
+	default:
+		c.logger.Warn("WebSocket client too slow, disconnecting", zap.String("client_id", c.id))
+		c.conn.Close()
+	}
+}
+
+// writeMessages writes queued messages until the queue is closed. A failed
+// write closes the connection, which ends the client's read loop.
+func (c *websocketClient) writeMessages() {
+	for message := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		if err := c.conn.WriteJSON(message); err != nil {
+			c.logger.Warn("Failed to send message to client",
+				zap.String("client_id", c.id),
+				zap.Error(err))
+			c.conn.Close()
+			return
+		}
+	}
+}
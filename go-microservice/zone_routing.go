@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// localZoneScope suffixes a pool key for the strategy state kept while
+// only local-zone instances are candidates
+const localZoneScope = "#local-zone"
+
+// preferLocalZone narrows a pool to the instances in the gateway's own
+// zone (GATEWAY_ZONE) that can take traffic: healthy, not ejected and,
+// with LB_ZONE_MAX_INFLIGHT set, below that many requests in flight per
+// unit of weight. Traffic spills over to every zone when no local instance
+// qualifies. It also returns the key to keep strategy state under, since
+// the candidate set differs from the full pool. The caller must hold
+// lb.mutex.
+func (lb *LoadBalancer) preferLocalZone(key string, instances []*ServiceInstance, now time.Time) ([]*ServiceInstance, string) {
+	if lb.zone == "" {
+		return instances, key
+	}
+
+	local := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if instance.Zone != lb.zone || instance.Status != "healthy" || lb.isEjected(instance.ID, now) {
+			continue
+		}
+		if lb.zoneMaxInflight > 0 && lb.inflight[instance.ID] >= lb.zoneMaxInflight*max(instance.Weight, 1) {
+			continue
+		}
+		local = append(local, instance)
+	}
+
+	if len(local) == 0 {
+		return instances, key
+	}
+	return local, key + localZoneScope
+}